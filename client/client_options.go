@@ -1,7 +1,10 @@
 package registry
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 
 	bosherr "github.com/cloudfoundry/bosh-utils/errors"
 )
@@ -48,6 +51,7 @@ func (o ClientOptions) Endpoint() string {
 }
 
 // EndpointWithCredentials returns the BOSH Registry endpoint including credentials.
+// It must not be logged, see Endpoint.
 func (o ClientOptions) EndpointWithCredentials() string {
 	return fmt.Sprintf("%s://%s:%s@%s:%d", o.Protocol, o.Username, o.Password, o.Host, o.Port)
 }
@@ -96,3 +100,31 @@ func (o ClientTLSOptions) Validate() error {
 
 	return nil
 }
+
+// TLSConfig returns the TLS configuration used to connect to the BOSH Registry.
+func (o ClientTLSOptions) TLSConfig() (*tls.Config, error) {
+	certificates, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Loading X509 Key Pair")
+	}
+
+	certPool := x509.NewCertPool()
+	if o.CACertFile != "" {
+		caCert, err := ioutil.ReadFile(o.CACertFile)
+		if err != nil {
+			return nil, bosherr.WrapError(err, "Loading CA certificate")
+		}
+
+		if !certPool.AppendCertsFromPEM(caCert) {
+			return nil, bosherr.WrapError(err, "Invalid CA Certificate")
+		}
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates:       []tls.Certificate{certificates},
+		InsecureSkipVerify: o.InsecureSkipVerify,
+		RootCAs:            certPool,
+	}
+
+	return tlsConfig, nil
+}
@@ -2,8 +2,8 @@ package registry
 
 import (
 	"bytes"
-	"crypto/tls"
-	"crypto/x509"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -12,12 +12,18 @@ import (
 
 	bosherr "github.com/cloudfoundry/bosh-utils/errors"
 	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+
+	"github.com/frodenas/bosh-registry/redact"
 )
 
 const httpClientLogTag = "RegistryHTTPClient"
 const httpClientMaxAttemps = 5
 const httpClientRetryDelay = 5
 
+// RequestIDHeader is the header identifying the requests, so the logs of the
+// client and of the BOSH Registry can be correlated.
+const RequestIDHeader = "X-Request-Id"
+
 // HTTPClient represents a BOSH Registry Client.
 type HTTPClient struct {
 	options ClientOptions
@@ -37,15 +43,17 @@ func NewHTTPClient(
 
 // Delete deletes the instance settings for a given instance ID.
 func (c HTTPClient) Delete(instanceID string) error {
-	endpoint := fmt.Sprintf("%s/instances/%s/settings", c.options.EndpointWithCredentials(), instanceID)
-	c.logger.Debug(httpClientLogTag, "Deleting agent settings from registry endpoint '%s'", endpoint)
+	endpoint := fmt.Sprintf("%s/instances/%s/settings", c.options.Endpoint(), instanceID)
+	requestID := newRequestID()
+	logTag := requestLogTag(requestID)
+	c.logger.Debug(logTag, "Deleting agent settings from registry endpoint '%s'", endpoint)
 
 	request, err := http.NewRequest("DELETE", endpoint, nil)
 	if err != nil {
 		return bosherr.WrapErrorf(err, "Creating DELETE request for registry endpoint '%s'", endpoint)
 	}
 
-	httpResponse, err := c.doRequest(request)
+	httpResponse, err := c.doRequest(request, requestID)
 	if err != nil {
 		return bosherr.WrapErrorf(err, "Deleting agent settings from registry endpoint '%s'", endpoint)
 	}
@@ -53,24 +61,26 @@ func (c HTTPClient) Delete(instanceID string) error {
 	defer httpResponse.Body.Close()
 
 	if httpResponse.StatusCode != http.StatusOK {
-		return bosherr.Errorf("Received status code '%d' when deleting agent settings from registry endpoint '%s'", httpResponse.StatusCode, endpoint)
+		return bosherr.Errorf("Received status code '%d' when deleting agent settings from registry endpoint '%s' (request ID '%s')", httpResponse.StatusCode, endpoint, requestID)
 	}
 
-	c.logger.Debug(httpClientLogTag, "Deleted agent settings from registry endpoint '%s'", endpoint)
+	c.logger.Debug(logTag, "Deleted agent settings from registry endpoint '%s'", endpoint)
 	return nil
 }
 
 // Fetch gets the agent settings for a given instance ID.
 func (c HTTPClient) Fetch(instanceID string) (AgentSettings, error) {
-	endpoint := fmt.Sprintf("%s/instances/%s/settings", c.options.EndpointWithCredentials(), instanceID)
-	c.logger.Debug(httpClientLogTag, "Fetching agent settings from registry endpoint '%s'", endpoint)
+	endpoint := fmt.Sprintf("%s/instances/%s/settings", c.options.Endpoint(), instanceID)
+	requestID := newRequestID()
+	logTag := requestLogTag(requestID)
+	c.logger.Debug(logTag, "Fetching agent settings from registry endpoint '%s'", endpoint)
 
 	request, err := http.NewRequest("GET", endpoint, nil)
 	if err != nil {
 		return AgentSettings{}, bosherr.WrapErrorf(err, "Creating GET request for registry endpoint '%s'", endpoint)
 	}
 
-	httpResponse, err := c.doRequest(request)
+	httpResponse, err := c.doRequest(request, requestID)
 	if err != nil {
 		return AgentSettings{}, bosherr.WrapErrorf(err, "Fetching agent settings from registry endpoint '%s'", endpoint)
 	}
@@ -78,7 +88,7 @@ func (c HTTPClient) Fetch(instanceID string) (AgentSettings, error) {
 	defer httpResponse.Body.Close()
 
 	if httpResponse.StatusCode != http.StatusOK {
-		return AgentSettings{}, bosherr.Errorf("Received status code '%d' when fetching agent settings from registry endpoint '%s'", httpResponse.StatusCode, endpoint)
+		return AgentSettings{}, bosherr.Errorf("Received status code '%d' when fetching agent settings from registry endpoint '%s' (request ID '%s')", httpResponse.StatusCode, endpoint, requestID)
 	}
 
 	httpBody, err := ioutil.ReadAll(httpResponse.Body)
@@ -88,15 +98,15 @@ func (c HTTPClient) Fetch(instanceID string) (AgentSettings, error) {
 
 	var settingsResponse agentSettingsResponse
 	if err = json.Unmarshal(httpBody, &settingsResponse); err != nil {
-		return AgentSettings{}, bosherr.WrapErrorf(err, "Unmarshalling agent settings response from registry endpoint '%s', contents: '%s'", endpoint, httpBody)
+		return AgentSettings{}, bosherr.WrapErrorf(err, "Unmarshalling agent settings response from registry endpoint '%s', contents: '%s'", endpoint, redact.SettingsJSON(string(httpBody)))
 	}
 
 	var agentSettings AgentSettings
 	if err = json.Unmarshal([]byte(settingsResponse.Settings), &agentSettings); err != nil {
-		return AgentSettings{}, bosherr.WrapErrorf(err, "Unmarshalling agent settings response from registry endpoint '%s', contents: '%s'", endpoint, httpBody)
+		return AgentSettings{}, bosherr.WrapErrorf(err, "Unmarshalling agent settings response from registry endpoint '%s', contents: '%s'", endpoint, redact.SettingsJSON(string(httpBody)))
 	}
 
-	c.logger.Debug(httpClientLogTag, "Received agent settings from registry endpoint '%s', contents: '%s'", endpoint, httpBody)
+	c.logger.Debug(logTag, "Received agent settings from registry endpoint '%s', contents: '%s'", endpoint, redact.SettingsJSON(string(httpBody)))
 	return agentSettings, nil
 }
 
@@ -104,46 +114,55 @@ func (c HTTPClient) Fetch(instanceID string) (AgentSettings, error) {
 func (c HTTPClient) Update(instanceID string, agentSettings AgentSettings) error {
 	settingsJSON, err := json.Marshal(agentSettings)
 	if err != nil {
-		return bosherr.WrapErrorf(err, "Marshalling agent settings, contents: '%#v", agentSettings)
+		return bosherr.WrapError(err, "Marshalling agent settings")
 	}
+	redactedSettingsJSON := redact.SettingsJSON(string(settingsJSON))
 
-	endpoint := fmt.Sprintf("%s/instances/%s/settings", c.options.EndpointWithCredentials(), instanceID)
-	c.logger.Debug(httpClientLogTag, "Updating registry endpoint '%s' with agent settings '%s'", endpoint, settingsJSON)
+	endpoint := fmt.Sprintf("%s/instances/%s/settings", c.options.Endpoint(), instanceID)
+	requestID := newRequestID()
+	logTag := requestLogTag(requestID)
+	c.logger.Debug(logTag, "Updating registry endpoint '%s' with agent settings '%s'", endpoint, redactedSettingsJSON)
 
 	putPayload := bytes.NewReader(settingsJSON)
 	request, err := http.NewRequest("PUT", endpoint, putPayload)
 	if err != nil {
-		return bosherr.WrapErrorf(err, "Creating PUT request for registry endpoint '%s' with agent settings '%s'", endpoint, settingsJSON)
+		return bosherr.WrapErrorf(err, "Creating PUT request for registry endpoint '%s' with agent settings '%s'", endpoint, redactedSettingsJSON)
 	}
 
-	httpResponse, err := c.doRequest(request)
+	httpResponse, err := c.doRequest(request, requestID)
 	if err != nil {
-		return bosherr.WrapErrorf(err, "Updating registry endpoint '%s' with agent settings: '%s'", endpoint, settingsJSON)
+		return bosherr.WrapErrorf(err, "Updating registry endpoint '%s' with agent settings: '%s'", endpoint, redactedSettingsJSON)
 	}
 
 	defer httpResponse.Body.Close()
 
 	if httpResponse.StatusCode != http.StatusOK && httpResponse.StatusCode != http.StatusCreated {
-		return bosherr.Errorf("Received status code '%d' when updating registry endpoint '%s' with agent settings: '%s'", httpResponse.StatusCode, endpoint, settingsJSON)
+		return bosherr.Errorf("Received status code '%d' when updating registry endpoint '%s' with agent settings: '%s' (request ID '%s')", httpResponse.StatusCode, endpoint, redactedSettingsJSON, requestID)
 	}
 
-	c.logger.Debug(httpClientLogTag, "Updated registry endpoint '%s' with agent settings '%s'", endpoint, settingsJSON)
+	c.logger.Debug(logTag, "Updated registry endpoint '%s' with agent settings '%s'", endpoint, redactedSettingsJSON)
 	return nil
 }
 
-func (c HTTPClient) doRequest(request *http.Request) (httpResponse *http.Response, err error) {
+// doRequest sends the credentials in the Authorization header rather than in
+// the endpoint, so they are not logged with it, and the same request ID on
+// every attempt.
+func (c HTTPClient) doRequest(request *http.Request, requestID string) (httpResponse *http.Response, err error) {
 	httpClient, err := c.httpClient()
 	if err != nil {
 		return nil, bosherr.WrapErrorf(err, "Creating HTTP Client")
 	}
 
+	request.SetBasicAuth(c.options.Username, c.options.Password)
+	request.Header.Set(RequestIDHeader, requestID)
+
 	retryDelay := time.Duration(httpClientRetryDelay) * time.Second
 	for attempt := 0; attempt < httpClientMaxAttemps; attempt++ {
 		httpResponse, err = httpClient.Do(request)
 		if err == nil {
 			return httpResponse, nil
 		}
-		c.logger.Debug(httpClientLogTag, "Performing registry HTTP call #%d got error '%v'", attempt, err)
+		c.logger.Debug(requestLogTag(requestID), "Performing registry HTTP call #%d got error '%v'", attempt, err)
 		time.Sleep(retryDelay)
 	}
 
@@ -154,27 +173,9 @@ func (c HTTPClient) httpClient() (http.Client, error) {
 	httpClient := http.Client{}
 
 	if c.options.Protocol == "https" {
-		certificates, err := tls.LoadX509KeyPair(c.options.TLS.CertFile, c.options.TLS.KeyFile)
+		tlsConfig, err := c.options.TLS.TLSConfig()
 		if err != nil {
-			return httpClient, bosherr.WrapError(err, "Loading X509 Key Pair")
-		}
-
-		certPool := x509.NewCertPool()
-		if c.options.TLS.CACertFile != "" {
-			caCert, err := ioutil.ReadFile(c.options.TLS.CACertFile)
-			if err != nil {
-				return httpClient, bosherr.WrapError(err, "Loading CA certificate")
-			}
-
-			if !certPool.AppendCertsFromPEM(caCert) {
-				return httpClient, bosherr.WrapError(err, "Invalid CA Certificate")
-			}
-		}
-
-		tlsConfig := &tls.Config{
-			Certificates:       []tls.Certificate{certificates},
-			InsecureSkipVerify: c.options.TLS.InsecureSkipVerify,
-			RootCAs:            certPool,
+			return httpClient, err
 		}
 
 		httpClient.Transport = &http.Transport{TLSClientConfig: tlsConfig}
@@ -182,3 +183,16 @@ func (c HTTPClient) httpClient() (http.Client, error) {
 
 	return httpClient, nil
 }
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// requestLogTag appends the ID of the request to the log tag, as the BOSH
+// Registry does.
+func requestLogTag(requestID string) string {
+	return httpClientLogTag + " request_id=" + requestID
+}
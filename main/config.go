@@ -2,17 +2,38 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
 
 	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
 	boshsys "github.com/cloudfoundry/bosh-utils/system"
 
 	"github.com/frodenas/bosh-registry/server"
+	"github.com/frodenas/bosh-registry/server/cluster"
+	"github.com/frodenas/bosh-registry/server/notifications"
 	"github.com/frodenas/bosh-registry/server/store"
 )
 
+// reloadableFields, reloadableLoggingFields, reloadableServerFields and
+// reloadableListenerFields are the settings, by their JSON names, that can
+// change when reloading the configuration.
+var (
+	reloadableFields         = []string{"log_level", "logging", "server", "notifications"}
+	reloadableLoggingFields  = []string{"level"}
+	reloadableServerFields   = []string{"username", "password", "users", "client_certs", "signed_urls", "tls", "auth_limiter", "shutdown_grace_period", "listeners"}
+	reloadableListenerFields = []string{"tls"}
+)
+
 type Config struct {
-	Server server.Config `json:"server,omitempty"`
-	Store  store.Config  `json:"store,omitempty"`
+	LogLevel      string               `json:"log_level,omitempty"`
+	Logging       LoggingConfig        `json:"logging,omitempty"`
+	Server        server.Config        `json:"server,omitempty"`
+	Store         store.Config         `json:"store,omitempty"`
+	Notifications notifications.Config `json:"notifications,omitempty"`
+	Cluster       cluster.Config       `json:"cluster,omitempty"`
+	Replica       server.ReplicaConfig `json:"replica,omitempty"`
 }
 
 func NewConfigFromPath(configFile string, fs boshsys.FileSystem) (Config, error) {
@@ -39,6 +60,20 @@ func NewConfigFromPath(configFile string, fs boshsys.FileSystem) (Config, error)
 }
 
 func (c Config) Validate() error {
+	if c.LogLevel != "" {
+		if _, err := boshlog.Levelify(c.LogLevel); err != nil {
+			return bosherr.WrapError(err, "Validating LogLevel")
+		}
+
+		if c.Logging.Level != "" {
+			return bosherr.Error("Must not provide both LogLevel and Logging Level")
+		}
+	}
+
+	if err := c.Logging.Validate(); err != nil {
+		return bosherr.WrapError(err, "Validating Logging configuration")
+	}
+
 	if err := c.Server.Validate(); err != nil {
 		return bosherr.WrapError(err, "Validating Server configuration")
 	}
@@ -47,5 +82,140 @@ func (c Config) Validate() error {
 		return bosherr.WrapError(err, "Validating Store configuration")
 	}
 
+	if err := c.Notifications.Validate(); err != nil {
+		return bosherr.WrapError(err, "Validating Notifications configuration")
+	}
+
+	if err := c.Cluster.Validate(); err != nil {
+		return bosherr.WrapError(err, "Validating Cluster configuration")
+	}
+
+	if err := c.Replica.Validate(); err != nil {
+		return bosherr.WrapError(err, "Validating Replica configuration")
+	}
+
+	if c.Cluster.Enabled() && c.Replica.Enabled() {
+		return bosherr.Error("Must not enable both Cluster and Replica modes")
+	}
+
+	if c.Cluster.Enabled() && !c.Cluster.RedirectFollowerWrites() && len(c.Server.TrustedProxies) == 0 {
+		return bosherr.Errorf("Must provide non-empty Server TrustedProxies, including the cluster nodes, unless the Cluster FollowerWrites is '%s'", cluster.FollowerWritesRedirect)
+	}
+
+	if c.Replica.Enabled() && c.Server.InstanceTokens.OneTimeUse && !c.Replica.ProxyWrites() {
+		return bosherr.Errorf("Must proxy Replica writes ('%s') to revoke one-time Instance Tokens on the primary", server.ReplicaWritesProxy)
+	}
+
+	return nil
+}
+
+// Level returns the Logging Level, or the LogLevel it replaces, which
+// defaults to debug.
+func (c Config) Level() boshlog.LogLevel {
+	levelString := c.Logging.Level
+	if levelString == "" {
+		levelString = c.LogLevel
+	}
+
+	if levelString == "" {
+		return boshlog.LevelDebug
+	}
+
+	level, _ := boshlog.Levelify(levelString)
+	return level
+}
+
+// Features returns the names of the optional features enabled.
+func (c Config) Features() []string {
+	features := []string{"read_auth_" + c.Server.ReadAuthMode()}
+
+	var tls, unixSocket, proxyProtocol bool
+	for _, listenerConfig := range c.Server.ListenerConfigs() {
+		tls = tls || listenerConfig.Protocol == "https"
+		unixSocket = unixSocket || listenerConfig.UnixSocket.Enabled()
+		proxyProtocol = proxyProtocol || listenerConfig.ProxyProtocol
+	}
+
+	if tls {
+		features = append(features, "tls")
+	}
+	if unixSocket {
+		features = append(features, "unix_socket")
+	}
+	if proxyProtocol {
+		features = append(features, "proxy_protocol")
+	}
+	if len(c.Server.ClientCerts) > 0 {
+		features = append(features, "client_certs")
+	}
+	if c.Server.SignedURLs.Enabled() {
+		features = append(features, "signed_urls")
+	}
+	if len(c.Notifications.Webhooks) > 0 || c.Notifications.NATS.Enabled() {
+		features = append(features, "notifications")
+	}
+	if c.Server.AccessLog.Enabled() {
+		features = append(features, "access_log")
+	}
+	if c.Cluster.Enabled() {
+		features = append(features, "cluster")
+	}
+	if c.Replica.Enabled() {
+		features = append(features, "replica")
+	}
+
+	return features
+}
+
+// CheckReload returns an error listing the settings of a new configuration
+// that cannot change without restarting.
+func (c Config) CheckReload(newConfig Config) error {
+	changed := changedFields(c, newConfig, "", reloadableFields)
+	changed = append(changed, changedFields(c.Logging, newConfig.Logging, "logging.", reloadableLoggingFields)...)
+	changed = append(changed, changedFields(c.Server, newConfig.Server, "server.", reloadableServerFields)...)
+
+	if len(c.Server.Listeners) != len(newConfig.Server.Listeners) {
+		changed = append(changed, "server.listeners")
+	} else {
+		for i := range c.Server.Listeners {
+			prefix := fmt.Sprintf("server.listeners[%d].", i)
+			changed = append(changed, changedFields(c.Server.Listeners[i], newConfig.Server.Listeners[i], prefix, reloadableListenerFields)...)
+		}
+	}
+
+	if len(changed) > 0 {
+		return bosherr.Errorf("Must restart to change %s", strings.Join(changed, ", "))
+	}
+
 	return nil
 }
+
+// changedFields returns the JSON names of the fields of two structs of the
+// same type that differ, skipping the reloadable ones.
+func changedFields(oldConfig, newConfig interface{}, prefix string, reloadable []string) []string {
+	var changed []string
+
+	oldValue, newValue := reflect.ValueOf(oldConfig), reflect.ValueOf(newConfig)
+	for i := 0; i < oldValue.NumField(); i++ {
+		name := strings.Split(oldValue.Type().Field(i).Tag.Get("json"), ",")[0]
+		if containsString(reloadable, name) {
+			continue
+		}
+
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			changed = append(changed, prefix+name)
+		}
+	}
+
+	return changed
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -6,11 +6,15 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
 	fakesys "github.com/cloudfoundry/bosh-utils/system/fakes"
 
 	. "github.com/frodenas/bosh-registry/main"
 
+	registry "github.com/frodenas/bosh-registry/client"
 	"github.com/frodenas/bosh-registry/server"
+	"github.com/frodenas/bosh-registry/server/cluster"
+	"github.com/frodenas/bosh-registry/server/notifications"
 	"github.com/frodenas/bosh-registry/server/store"
 )
 
@@ -106,5 +110,227 @@ var _ = Describe("Config", func() {
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("Validating Store configuration"))
 		})
+
+		It("returns error if notifications section is not valid", func() {
+			config.Notifications = notifications.Config{
+				Webhooks: []notifications.WebhookConfig{{URL: ""}},
+			}
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating Notifications configuration"))
+		})
+
+		It("returns error if cluster section is not valid", func() {
+			config.Cluster = cluster.Config{NodeID: "fake-node-id"}
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating Cluster configuration"))
+		})
+
+		It("returns error if replica section is not valid", func() {
+			config.Replica = server.ReplicaConfig{Primary: registry.ClientOptions{Host: "fake-primary-host"}}
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating Replica configuration"))
+		})
+
+		It("returns error if log level is not valid", func() {
+			config.LogLevel = "fake-level"
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating LogLevel"))
+		})
+
+		It("returns error if both LogLevel and Logging Level are provided", func() {
+			config.LogLevel = "info"
+			config.Logging.Level = "info"
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must not provide both LogLevel and Logging Level"))
+		})
+
+		It("returns error if Logging is not valid", func() {
+			config.Logging.Format = "fake-format"
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating Logging configuration"))
+		})
+
+		It("returns error if a replica refusing writes uses one-time instance tokens", func() {
+			config.Server.InstanceTokens.OneTimeUse = true
+			config.Replica = server.ReplicaConfig{
+				Primary: registry.ClientOptions{
+					Protocol: "http",
+					Host:     "fake-primary-host",
+					Port:     5555,
+					Username: "fake-username",
+					Password: "fake-password",
+				},
+			}
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must proxy Replica writes ('proxy') to revoke one-time Instance Tokens on the primary"))
+
+			config.Replica.Writes = server.ReplicaWritesProxy
+			Expect(config.Validate()).To(Succeed())
+		})
+
+		It("returns error if cluster followers forward writes without trusted proxies", func() {
+			config.Cluster = cluster.Config{
+				NodeID:         "fake-node-id",
+				BindAddress:    "127.0.0.1:7000",
+				APIURL:         "http://fake-host:5555",
+				DataDir:        "/fake-data-dir",
+				FollowerWrites: cluster.FollowerWritesForward,
+			}
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide non-empty Server TrustedProxies, including the cluster nodes, unless the Cluster FollowerWrites is 'redirect'"))
+
+			config.Server.TrustedProxies = []string{"10.0.0.0/24"}
+			Expect(config.Validate()).To(Succeed())
+
+			config.Server.TrustedProxies = nil
+			config.Cluster.FollowerWrites = cluster.FollowerWritesRedirect
+			Expect(config.Validate()).To(Succeed())
+		})
+
+		It("returns error if both cluster and replica modes are enabled", func() {
+			config.Cluster = cluster.Config{
+				NodeID:      "fake-node-id",
+				BindAddress: "127.0.0.1:7000",
+				APIURL:      "http://fake-host:5555",
+				DataDir:     "/fake-data-dir",
+			}
+			config.Replica = server.ReplicaConfig{
+				Primary: registry.ClientOptions{
+					Protocol: "http",
+					Host:     "fake-primary-host",
+					Port:     5555,
+					Username: "fake-username",
+					Password: "fake-password",
+				},
+			}
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must not enable both Cluster and Replica modes"))
+		})
+	})
+
+	Describe("Level", func() {
+		It("defaults to debug", func() {
+			Expect(validConfig.Level()).To(Equal(boshlog.LevelDebug))
+		})
+
+		It("returns the log level", func() {
+			config = validConfig
+			config.LogLevel = "warn"
+			Expect(config.Level()).To(Equal(boshlog.LevelWarn))
+		})
+
+		It("returns the Logging level", func() {
+			config = validConfig
+			config.Logging.Level = "error"
+			Expect(config.Level()).To(Equal(boshlog.LevelError))
+		})
+	})
+
+	Describe("Features", func() {
+		It("returns the read policy", func() {
+			Expect(validConfig.Features()).To(Equal([]string{"read_auth_none"}))
+		})
+
+		It("returns the enabled features", func() {
+			config = validConfig
+			config.Server.ReadAuth = server.ReadAuthBasic
+			config.Server.Protocol = ""
+			config.Server.Address = ""
+			config.Server.Port = 0
+			config.Server.Listeners = []server.ListenerConfig{
+				{Protocol: "http", Address: "fake-host", Port: 5555},
+				{Protocol: "https", Address: "fake-host", Port: 5556},
+			}
+			config.Server.AccessLog = server.AccessLogConfig{Format: server.AccessLogFormatJSON}
+			config.Notifications = notifications.Config{
+				NATS: notifications.NATSConfig{URL: "nats://fake-host:4222"},
+			}
+
+			Expect(config.Features()).To(Equal([]string{"read_auth_basic", "tls", "notifications", "access_log"}))
+		})
+	})
+
+	Describe("CheckReload", func() {
+		var (
+			newConfig Config
+		)
+
+		BeforeEach(func() {
+			config = validConfig
+			newConfig = validConfig
+		})
+
+		It("does not return error if only reloadable settings changed", func() {
+			newConfig.LogLevel = "info"
+			newConfig.Notifications = notifications.Config{
+				Webhooks: []notifications.WebhookConfig{{URL: "http://fake-webhook"}},
+			}
+			newConfig.Server.Username = "fake-new-username"
+			newConfig.Server.Password = "fake-new-password"
+			newConfig.Server.AuthLimiter = server.AuthLimiterConfig{MaxFailures: 10}
+			newConfig.Server.ClientCerts = []server.ClientCertConfig{{CN: "fake-cn", Role: server.RoleReader}}
+			newConfig.Server.SignedURLs = server.SignedURLsConfig{Keys: []server.SigningKeyConfig{{ID: "fake-key-id", Secret: "fake-secret-fake-secret-fake-secret"}}}
+
+			err := config.CheckReload(newConfig)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns error listing the settings that cannot be reloaded", func() {
+			newConfig.Server.Port = 6666
+			newConfig.Server.TrustedProxies = []string{"10.0.0.1"}
+			newConfig.Store.Adapter = "fake-new-adapter"
+
+			err := config.CheckReload(newConfig)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Must restart to change store, server.port, server.trusted_proxies"))
+		})
+
+		It("allows to reload only the TLS settings of the listeners", func() {
+			config.Server.Listeners = []server.ListenerConfig{
+				{Protocol: "https", Address: "127.0.0.1", Port: 25777, TLS: server.TLSConfig{CertFile: "fake-cert-file"}},
+			}
+			newConfig.Server.Listeners = []server.ListenerConfig{
+				{Protocol: "https", Address: "127.0.0.1", Port: 25777, TLS: server.TLSConfig{CertFile: "fake-new-cert-file"}},
+			}
+			Expect(config.CheckReload(newConfig)).To(Succeed())
+
+			newConfig.Server.Listeners[0].Operations = []string{server.OperationRead}
+			err := config.CheckReload(newConfig)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Must restart to change server.listeners[0].operations"))
+
+			newConfig.Server.Listeners = append(newConfig.Server.Listeners, server.ListenerConfig{Protocol: "http", Address: "127.0.0.1", Port: 25778})
+			err = config.CheckReload(newConfig)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Must restart to change server.listeners"))
+		})
+
+		It("allows to reload only the Logging level", func() {
+			newConfig.Logging.Level = "warn"
+			Expect(config.CheckReload(newConfig)).To(Succeed())
+
+			newConfig.Logging.Format = "json"
+			err := config.CheckReload(newConfig)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Must restart to change logging.format"))
+		})
 	})
 })
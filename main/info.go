@@ -0,0 +1,30 @@
+package main
+
+import (
+	"runtime"
+
+	"github.com/frodenas/bosh-registry/server"
+)
+
+// version, commit and buildDate are stamped at link time, e.g.
+// -ldflags "-X main.version=1.2.3 -X main.commit=$(git rev-parse HEAD)".
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// newInfo returns the build information and the features enabled by the
+// configuration, reported by the /info endpoint.
+func newInfo(config Config) server.Info {
+	return server.Info{
+		Version: version,
+		Build: server.BuildInfo{
+			Commit:    commit,
+			Date:      buildDate,
+			GoVersion: runtime.Version(),
+		},
+		Features:     config.Features(),
+		StoreAdapter: config.Store.Adapter,
+	}
+}
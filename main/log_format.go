@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+// logDateLayout is the layout of the date and time of the log lines.
+const logDateLayout = "2006/01/02 15:04:05"
+
+// logRequestIDSeparator separates the tag of the log lines written while
+// serving a request from its request ID.
+const logRequestIDSeparator = " request_id="
+
+type jsonLogLine struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Tag       string `json:"tag,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Message   string `json:"message"`
+}
+
+// JSONWriter writes each log line as a JSON object with its time, level,
+// tag, request ID if any, and message.
+type JSONWriter struct {
+	out io.Writer
+}
+
+func NewJSONWriter(out io.Writer) JSONWriter {
+	return JSONWriter{out: out}
+}
+
+func (w JSONWriter) Write(p []byte) (int, error) {
+	line := parseLogLine(p)
+
+	logTime := time.Now()
+	if line.parsed {
+		if parsedTime, err := time.ParseInLocation(logDateLayout, line.date, time.Local); err == nil {
+			logTime = parsedTime
+		}
+	}
+
+	tag, requestID := line.tag, ""
+	if separator := strings.Index(tag, logRequestIDSeparator); separator != -1 {
+		tag, requestID = tag[:separator], tag[separator+len(logRequestIDSeparator):]
+	}
+
+	lineJSON, err := json.Marshal(jsonLogLine{
+		Time:      logTime.Format(time.RFC3339),
+		Level:     levelNames[line.level],
+		Tag:       tag,
+		RequestID: requestID,
+		Message:   line.message,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := writeLevel(w.out, line.level, append(lineJSON, '\n')); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+var levelNames = map[boshlog.LogLevel]string{
+	boshlog.LevelDebug: "debug",
+	boshlog.LevelInfo:  "info",
+	boshlog.LevelWarn:  "warn",
+	boshlog.LevelError: "error",
+}
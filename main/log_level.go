@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+// logDateLength is the length of the date and time written by the standard
+// logger after the tag, e.g. "2006/01/02 15:04:05 ".
+const logDateLength = 20
+
+// LevelWriter drops the log lines below its level, which can be changed
+// while the loggers writing to it are in use, as well as its output.
+type LevelWriter struct {
+	level int32
+
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+// leveledWriter is an output writing the log lines depending on their level,
+// like syslog.
+type leveledWriter interface {
+	WriteLevel(level boshlog.LogLevel, p []byte) (int, error)
+}
+
+func NewLevelWriter(out io.Writer, level boshlog.LogLevel) *LevelWriter {
+	return &LevelWriter{
+		out:   out,
+		level: int32(level),
+	}
+}
+
+func (w *LevelWriter) SetLevel(level boshlog.LogLevel) {
+	atomic.StoreInt32(&w.level, int32(level))
+}
+
+func (w *LevelWriter) SetOutput(out io.Writer) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.out = out
+}
+
+func (w *LevelWriter) Write(p []byte) (int, error) {
+	level := parseLogLine(p).level
+	if level < boshlog.LogLevel(atomic.LoadInt32(&w.level)) {
+		return len(p), nil
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return writeLevel(w.out, level, p)
+}
+
+func writeLevel(out io.Writer, level boshlog.LogLevel, p []byte) (int, error) {
+	if leveledOut, ok := out.(leveledWriter); ok {
+		return leveledOut.WriteLevel(level, p)
+	}
+
+	return out.Write(p)
+}
+
+// logLine is a "[tag] 2006/01/02 15:04:05 LEVEL - msg" line.
+type logLine struct {
+	tag     string
+	date    string
+	level   boshlog.LogLevel
+	message string
+	parsed  bool
+}
+
+// parseLogLine parses a log line. Lines that cannot be parsed are treated as
+// errors, so they are kept.
+func parseLogLine(line []byte) logLine {
+	unparsed := logLine{level: boshlog.LevelError, message: string(bytes.TrimRight(line, "\n"))}
+
+	tagEnd := bytes.Index(line, []byte("] "))
+	if !bytes.HasPrefix(line, []byte("[")) || tagEnd == -1 || len(line) < tagEnd+2+logDateLength {
+		return unparsed
+	}
+
+	rest := line[tagEnd+2+logDateLength:]
+	levelEnd := bytes.Index(rest, []byte(" - "))
+	if levelEnd == -1 {
+		return unparsed
+	}
+
+	level, err := boshlog.Levelify(string(rest[:levelEnd]))
+	if err != nil {
+		return unparsed
+	}
+
+	return logLine{
+		tag:     string(line[1:tagEnd]),
+		date:    string(line[tagEnd+2 : tagEnd+2+logDateLength-1]),
+		level:   level,
+		message: string(bytes.TrimRight(rest[levelEnd+3:], "\n")),
+		parsed:  true,
+	}
+}
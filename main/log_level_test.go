@@ -0,0 +1,62 @@
+package main_test
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+
+	. "github.com/frodenas/bosh-registry/main"
+)
+
+var _ = Describe("LevelWriter", func() {
+	var (
+		out       *bytes.Buffer
+		logWriter *LevelWriter
+		logger    boshlog.Logger
+	)
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		logWriter = NewLevelWriter(out, boshlog.LevelInfo)
+		logger = boshlog.NewWriterLogger(boshlog.LevelDebug, logWriter, logWriter)
+	})
+
+	It("drops the log lines below its level", func() {
+		logger.Debug("fake-tag", "fake-debug-message")
+		logger.Info("fake-tag", "fake-info-message")
+		logger.Error("fake-tag", "fake-error-message")
+
+		Expect(out.String()).ToNot(ContainSubstring("fake-debug-message"))
+		Expect(out.String()).To(ContainSubstring("INFO - fake-info-message"))
+		Expect(out.String()).To(ContainSubstring("ERROR - fake-error-message"))
+	})
+
+	It("applies a changed level", func() {
+		logWriter.SetLevel(boshlog.LevelError)
+		logger.Warn("fake-tag", "fake-warn-message")
+		Expect(out.String()).To(BeEmpty())
+
+		logWriter.SetLevel(boshlog.LevelDebug)
+		logger.Debug("fake-tag", "fake-debug-message")
+		Expect(out.String()).To(ContainSubstring("DEBUG - fake-debug-message"))
+	})
+
+	It("keeps the lines it cannot parse", func() {
+		logWriter.SetLevel(boshlog.LevelError)
+
+		_, err := logWriter.Write([]byte("fake-line\n"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out.String()).To(Equal("fake-line\n"))
+	})
+	It("writes to a changed output", func() {
+		otherOut := &bytes.Buffer{}
+		logWriter.SetOutput(otherOut)
+
+		logger.Info("fake-tag", "fake-info-message")
+		Expect(out.String()).To(BeEmpty())
+		Expect(otherOut.String()).To(ContainSubstring("INFO - fake-info-message"))
+	})
+})
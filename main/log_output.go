@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io"
+	"log/syslog"
+	"os"
+	"sync"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+const logFileMode = 0640
+
+// LogOutput writes the log lines to stderr, a file or syslog. The file can be
+// reopened after being rotated.
+type LogOutput struct {
+	config LoggingConfig
+
+	mutex  sync.Mutex
+	file   *os.File
+	syslog *syslog.Writer
+}
+
+func NewLogOutput(config LoggingConfig) (*LogOutput, error) {
+	o := &LogOutput{config: config}
+
+	switch config.OutputMode() {
+	case LogOutputFile:
+		file, err := openLogFile(config.File)
+		if err != nil {
+			return nil, err
+		}
+		o.file = file
+	case LogOutputSyslog:
+		facility := syslogFacilities[config.Syslog.facility()]
+		writer, err := syslog.Dial(config.Syslog.Network, config.Syslog.Address, facility|syslog.LOG_INFO, config.Syslog.tag())
+		if err != nil {
+			return nil, bosherr.WrapError(err, "Connecting to syslog")
+		}
+		o.syslog = writer
+	}
+
+	return o, nil
+}
+
+// Writer returns the writer formatting the log lines and writing them to the
+// output.
+func (o *LogOutput) Writer() io.Writer {
+	if o.config.FormatMode() == LogFormatJSON {
+		return NewJSONWriter(o)
+	}
+
+	return o
+}
+
+func (o *LogOutput) Write(p []byte) (int, error) {
+	return o.WriteLevel(boshlog.LevelError, p)
+}
+
+// WriteLevel writes a log line, with the syslog severity of its level.
+func (o *LogOutput) WriteLevel(level boshlog.LogLevel, p []byte) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	switch {
+	case o.file != nil:
+		return o.file.Write(p)
+	case o.syslog != nil:
+		return len(p), writeSyslog(o.syslog, level, string(p))
+	}
+
+	return os.Stderr.Write(p)
+}
+
+// Reopen opens the log file again, so the lines are written to a new file
+// once the current one has been moved away by a log rotation.
+func (o *LogOutput) Reopen() error {
+	if o.config.OutputMode() != LogOutputFile {
+		return nil
+	}
+
+	file, err := openLogFile(o.config.File)
+	if err != nil {
+		return err
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.file.Close()
+	o.file = file
+
+	return nil
+}
+
+func (o *LogOutput) Close() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	switch {
+	case o.file != nil:
+		return o.file.Close()
+	case o.syslog != nil:
+		return o.syslog.Close()
+	}
+
+	return nil
+}
+
+func openLogFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, logFileMode)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Opening log file '%s'", path)
+	}
+
+	return file, nil
+}
+
+func writeSyslog(writer *syslog.Writer, level boshlog.LogLevel, message string) error {
+	switch level {
+	case boshlog.LevelDebug:
+		return writer.Debug(message)
+	case boshlog.LevelInfo:
+		return writer.Info(message)
+	case boshlog.LevelWarn:
+		return writer.Warning(message)
+	}
+
+	return writer.Err(message)
+}
@@ -0,0 +1,123 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+
+	. "github.com/frodenas/bosh-registry/main"
+)
+
+var _ = Describe("JSONWriter", func() {
+	var (
+		out    *bytes.Buffer
+		logger boshlog.Logger
+	)
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		jsonWriter := NewJSONWriter(out)
+		logger = boshlog.NewWriterLogger(boshlog.LevelDebug, jsonWriter, jsonWriter)
+	})
+
+	It("writes each log line as a JSON object", func() {
+		logger.Warn("fake-tag", "fake-message with '%s'", "fake-argument")
+
+		var line map[string]string
+		Expect(json.Unmarshal(out.Bytes(), &line)).To(Succeed())
+		Expect(line["level"]).To(Equal("warn"))
+		Expect(line["tag"]).To(Equal("fake-tag"))
+		Expect(line["message"]).To(Equal("fake-message with 'fake-argument'"))
+		Expect(line["time"]).ToNot(BeEmpty())
+		Expect(out.String()).To(HaveSuffix("}\n"))
+	})
+
+	It("writes the request ID of the log lines written while serving a request", func() {
+		logger.Debug("fake-tag request_id=fake-request-id", "fake-message")
+
+		var line map[string]string
+		Expect(json.Unmarshal(out.Bytes(), &line)).To(Succeed())
+		Expect(line["tag"]).To(Equal("fake-tag"))
+		Expect(line["request_id"]).To(Equal("fake-request-id"))
+		Expect(line["message"]).To(Equal("fake-message"))
+	})
+
+	It("writes the lines it cannot parse as errors", func() {
+		_, err := NewJSONWriter(out).Write([]byte("fake-line\n"))
+		Expect(err).ToNot(HaveOccurred())
+
+		var line map[string]string
+		Expect(json.Unmarshal(out.Bytes(), &line)).To(Succeed())
+		Expect(line["level"]).To(Equal("error"))
+		Expect(line["message"]).To(Equal("fake-line"))
+	})
+})
+
+var _ = Describe("LogOutput", func() {
+	var (
+		tempDir string
+		logFile string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "log-output")
+		Expect(err).ToNot(HaveOccurred())
+		logFile = filepath.Join(tempDir, "registry.log")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	It("writes to a file reopened after being rotated", func() {
+		logOutput, err := NewLogOutput(LoggingConfig{Output: LogOutputFile, File: logFile})
+		Expect(err).ToNot(HaveOccurred())
+		defer logOutput.Close()
+
+		_, err = logOutput.Write([]byte("fake-line-1\n"))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(os.Rename(logFile, logFile+".1")).To(Succeed())
+		_, err = logOutput.Write([]byte("fake-line-2\n"))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(logOutput.Reopen()).To(Succeed())
+		_, err = logOutput.Write([]byte("fake-line-3\n"))
+		Expect(err).ToNot(HaveOccurred())
+
+		rotated, err := ioutil.ReadFile(logFile + ".1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(rotated)).To(Equal("fake-line-1\nfake-line-2\n"))
+
+		current, err := ioutil.ReadFile(logFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(current)).To(Equal("fake-line-3\n"))
+	})
+
+	It("returns error if the file cannot be opened", func() {
+		_, err := NewLogOutput(LoggingConfig{Output: LogOutputFile, File: filepath.Join(tempDir, "missing", "registry.log")})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Opening log file"))
+	})
+
+	It("formats the log lines as JSON", func() {
+		logOutput, err := NewLogOutput(LoggingConfig{Format: LogFormatJSON, Output: LogOutputFile, File: logFile})
+		Expect(err).ToNot(HaveOccurred())
+		defer logOutput.Close()
+
+		logger := boshlog.NewWriterLogger(boshlog.LevelDebug, logOutput.Writer(), logOutput.Writer())
+		logger.Info("fake-tag", "fake-message")
+
+		contents, err := ioutil.ReadFile(logFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(contents)).To(ContainSubstring(`"message":"fake-message"`))
+	})
+})
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"log/syslog"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+const (
+	LogOutputStderr = "stderr"
+	LogOutputFile   = "file"
+	LogOutputSyslog = "syslog"
+)
+
+const defaultSyslogTag = "bosh-registry"
+const defaultSyslogFacility = "daemon"
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// LoggingConfig sets which messages are logged, their format, text by
+// default, and where they are written, stderr by default.
+type LoggingConfig struct {
+	Level  string       `json:"level,omitempty"`
+	Format string       `json:"format,omitempty"`
+	Output string       `json:"output,omitempty"`
+	File   string       `json:"file,omitempty"`
+	Syslog SyslogConfig `json:"syslog,omitempty"`
+}
+
+// SyslogConfig sets the syslog server, the local one when Network and
+// Address are empty.
+type SyslogConfig struct {
+	Network  string `json:"network,omitempty"`
+	Address  string `json:"address,omitempty"`
+	Tag      string `json:"tag,omitempty"`
+	Facility string `json:"facility,omitempty"`
+}
+
+func (c LoggingConfig) Validate() error {
+	if c.Level != "" {
+		if _, err := boshlog.Levelify(c.Level); err != nil {
+			return bosherr.WrapError(err, "Validating Level")
+		}
+	}
+
+	switch c.Format {
+	case "", LogFormatText, LogFormatJSON:
+	default:
+		return bosherr.Errorf("Must provide a valid Format ('%s' or '%s'), got '%s'", LogFormatText, LogFormatJSON, c.Format)
+	}
+
+	switch c.OutputMode() {
+	case LogOutputStderr:
+	case LogOutputFile:
+		if c.File == "" {
+			return bosherr.Errorf("Must provide a non-empty File with the '%s' Output", LogOutputFile)
+		}
+	case LogOutputSyslog:
+		if err := c.Syslog.Validate(); err != nil {
+			return bosherr.WrapError(err, "Validating Syslog configuration")
+		}
+	default:
+		return bosherr.Errorf("Must provide a valid Output ('%s', '%s' or '%s'), got '%s'", LogOutputStderr, LogOutputFile, LogOutputSyslog, c.Output)
+	}
+
+	return nil
+}
+
+func (c LoggingConfig) FormatMode() string {
+	if c.Format == "" {
+		return LogFormatText
+	}
+
+	return c.Format
+}
+
+func (c LoggingConfig) OutputMode() string {
+	if c.Output == "" {
+		return LogOutputStderr
+	}
+
+	return c.Output
+}
+
+func (c SyslogConfig) Validate() error {
+	switch c.Network {
+	case "":
+		if c.Address != "" {
+			return bosherr.Error("Must provide a non-empty Network with an Address")
+		}
+	case "udp", "tcp", "unix", "unixgram":
+		if c.Address == "" {
+			return bosherr.Error("Must provide a non-empty Address with a Network")
+		}
+	default:
+		return bosherr.Errorf("Must provide a valid Network ('udp', 'tcp', 'unix' or 'unixgram'), got '%s'", c.Network)
+	}
+
+	if _, found := syslogFacilities[c.facility()]; !found {
+		return bosherr.Errorf("Must provide a valid Facility, got '%s'", c.Facility)
+	}
+
+	return nil
+}
+
+func (c SyslogConfig) tag() string {
+	if c.Tag == "" {
+		return defaultSyslogTag
+	}
+
+	return c.Tag
+}
+
+func (c SyslogConfig) facility() string {
+	if c.Facility == "" {
+		return defaultSyslogFacility
+	}
+
+	return c.Facility
+}
@@ -0,0 +1,96 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/main"
+)
+
+var _ = Describe("LoggingConfig", func() {
+	var (
+		config LoggingConfig
+	)
+
+	BeforeEach(func() {
+		config = LoggingConfig{}
+	})
+
+	Describe("Validate", func() {
+		It("does not return error if all fields are empty", func() {
+			err := config.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("does not return error if all fields are valid", func() {
+			config = LoggingConfig{
+				Level:  "info",
+				Format: LogFormatJSON,
+				Output: LogOutputSyslog,
+				Syslog: SyslogConfig{Network: "udp", Address: "fake-host:514", Tag: "fake-tag", Facility: "local0"},
+			}
+
+			err := config.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns error if Level is not valid", func() {
+			config.Level = "fake-level"
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating Level"))
+		})
+
+		It("returns error if Format is not valid", func() {
+			config.Format = "fake-format"
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a valid Format ('text' or 'json'), got 'fake-format'"))
+		})
+
+		It("returns error if Output is not valid", func() {
+			config.Output = "fake-output"
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a valid Output ('stderr', 'file' or 'syslog'), got 'fake-output'"))
+		})
+
+		It("returns error if File is empty with the file Output", func() {
+			config.Output = LogOutputFile
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a non-empty File with the 'file' Output"))
+		})
+
+		It("returns error if the Syslog Network is not valid", func() {
+			config.Output = LogOutputSyslog
+			config.Syslog.Network = "fake-network"
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a valid Network"))
+		})
+
+		It("returns error if the Syslog Address is empty with a Network", func() {
+			config.Output = LogOutputSyslog
+			config.Syslog.Network = "tcp"
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a non-empty Address with a Network"))
+		})
+
+		It("returns error if the Syslog Facility is not valid", func() {
+			config.Output = LogOutputSyslog
+			config.Syslog.Facility = "fake-facility"
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a valid Facility, got 'fake-facility'"))
+		})
+	})
+})
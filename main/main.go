@@ -1,71 +1,347 @@
 package main
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	bosherr "github.com/cloudfoundry/bosh-utils/errors"
 	boshlog "github.com/cloudfoundry/bosh-utils/logger"
 	boshsys "github.com/cloudfoundry/bosh-utils/system"
+	"golang.org/x/crypto/bcrypt"
 
 	"github.com/frodenas/bosh-registry/server"
+	"github.com/frodenas/bosh-registry/server/cluster"
+	"github.com/frodenas/bosh-registry/server/instanceip"
+	"github.com/frodenas/bosh-registry/server/metrics"
+	"github.com/frodenas/bosh-registry/server/notifications"
 	"github.com/frodenas/bosh-registry/server/store"
 )
 
 const mainLogTag = "main"
+const eventBrokerBufferSize = 1000
+const upgradeTimeout = 60 * time.Second
 
 var (
-	configFileOpt = flag.String("configFile", "", "Path to configuration file")
+	configFileOpt   = flag.String("configFile", "", "Path to configuration file")
+	hashPasswordOpt = flag.Bool("hashPassword", false, "Print the bcrypt hash of a password read from stdin")
 )
 
 func main() {
-	logger := boshlog.NewWriterLogger(boshlog.LevelDebug, os.Stderr, os.Stderr)
-	fs := boshsys.NewOsFileSystem(logger)
+	logWriter := NewLevelWriter(os.Stderr, boshlog.LevelDebug)
+	logger := boshlog.NewWriterLogger(boshlog.LevelDebug, logWriter, logWriter)
+
+	// The file system logs the contents of the files it reads, including the
+	// credentials of the config file.
+	fs := boshsys.NewOsFileSystem(boshlog.NewLogger(boshlog.LevelNone))
 
 	defer logger.HandlePanic("Main")
 
 	flag.Parse()
 
+	if *hashPasswordOpt {
+		if err := hashPassword(os.Stdin, os.Stdout); err != nil {
+			logger.Error(mainLogTag, "Hashing password: %s", err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	config, err := NewConfigFromPath(*configFileOpt, fs)
 	if err != nil {
 		logger.Error(mainLogTag, "Loading config: %s", err.Error())
 		os.Exit(1)
 	}
+	logWriter.SetLevel(config.Level())
 
-	instanceHandler, err := createInstanceHandler(config, logger)
+	logOutput, err := NewLogOutput(config.Logging)
 	if err != nil {
-		logger.Error(mainLogTag, "Creating Registry Instance Handler: %s", err.Error())
+		logger.Error(mainLogTag, "Creating log output: %s", err.Error())
 		os.Exit(1)
 	}
+	logWriter.SetOutput(logOutput.Writer())
 
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	eventBroker := server.NewEventBroker(eventBrokerBufferSize, logger)
+	notifier, err := notifications.NewNotifier(config.Notifications, logger)
+	if err != nil {
+		logger.Error(mainLogTag, "Creating Registry Notifier: %s", err.Error())
+		os.Exit(1)
+	}
+	eventPublishers := server.EventPublishers{eventBroker, notifier}
+	var tokenEventPublisher server.EventPublisher = eventBroker
+
+	metricsRegistry := metrics.NewRegistry()
+	registryStore, clusterNode, err := createRegistryStore(config, server.NewClusterEvents(eventBroker), metricsRegistry, logger)
+	if err != nil {
+		logger.Error(mainLogTag, "Creating Registry Store: %s", err.Error())
+		os.Exit(1)
+	}
+
+	// The events stream of every cluster node is fed by the changes applied
+	// to its local store, so the handlers of the leader only notify them.
+	if clusterNode != nil {
+		eventPublishers = server.EventPublishers{notifier}
+		tokenEventPublisher = server.EventPublishers{}
+	}
+
+	users, err := server.NewUsers(config.Server)
+	if err != nil {
+		logger.Error(mainLogTag, "Creating Registry Users: %s", err.Error())
+		os.Exit(1)
+	}
+
+	signedURLs, err := server.NewSignedURLs(config.Server.SignedURLs)
+	if err != nil {
+		logger.Error(mainLogTag, "Creating Registry Signed URLs: %s", err.Error())
+		os.Exit(1)
+	}
+
+	instanceTokens := server.NewInstanceTokens(config.Server.InstanceTokens, registryStore, tokenEventPublisher)
+	readAuthenticator, err := createReadAuthenticator(config, users, instanceTokens, signedURLs, logger)
+	if err != nil {
+		logger.Error(mainLogTag, "Creating Registry Read Authenticator: %s", err.Error())
+		os.Exit(1)
+	}
+	writeAuthenticator := server.NewBasicAuthenticator(users, server.RoleWriter)
+
+	// Cluster followers check their local store, as linearizable reads fail
+	// on them, and leave the instances gauge to the leader.
+	readinessStore := registryStore
+	var metricsClusterNode server.ClusterNode
+	if clusterNode != nil {
+		readinessStore = clusterNode.LocalStore()
+		metricsClusterNode = clusterNode
+	}
+
+	handlers := server.Handlers{
+		Instances: server.NewInstanceHandler(readAuthenticator, writeAuthenticator, registryStore, instanceTokens, eventPublishers, logger),
+		Events:    server.NewEventsHandler(users, eventBroker, logger),
+		Backup:    server.NewBackupHandler(users, registryStore, eventBroker, logger),
+		Health:    server.NewHealthHandler(),
+		Readiness: server.NewReadinessHandler(readinessStore, logger),
+		Info:      server.NewInfoHandler(newInfo(config)),
+		Metrics:   server.NewMetricsHandler(config.Server.Metrics, users, metricsRegistry, registryStore, metricsClusterNode, logger),
+	}
+
+	var accessLog *server.AccessLog
+	if config.Server.AccessLog.Enabled() {
+		accessLog, err = server.NewAccessLog(config.Server.AccessLog, logger)
+		if err != nil {
+			logger.Error(mainLogTag, "Creating Registry Access Log: %s", err.Error())
+			os.Exit(1)
+		}
+		handlers.AccessLog = accessLog
+	}
 
-	listener := server.NewListener(config.Server, instanceHandler, logger)
-	errChan := listener.ListenAndServe()
-	select {
-	case err := <-errChan:
+	handlers.SignedURLs = server.NewSignedURLsHandler(users, signedURLs, logger)
+
+	if clusterNode != nil {
+		handlers.Cluster, err = server.NewClusterHandler(users, clusterNode, config.Server, logger)
+		if err != nil {
+			logger.Error(mainLogTag, "Creating Registry Cluster Handler: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	var replicaFollower *server.ReplicaFollower
+	if config.Replica.Enabled() {
+		// The primary already notified the changes a replica applies, so they
+		// are only published to its events stream.
+		replicaFollower, err = server.NewReplicaFollower(config.Replica, registryStore, eventBroker, logger)
 		if err != nil {
-			logger.Error(mainLogTag, "Error occurred: %s", err.Error())
+			logger.Error(mainLogTag, "Creating Registry Replica Follower: %s", err.Error())
 			os.Exit(1)
 		}
-	case sig := <-signals:
-		logger.Debug(mainLogTag, "Exiting, received signal: %#v", sig)
+
+		handlers.Replica, err = server.NewReplicaHandler(config.Replica, config.Server.InstanceTokens, replicaFollower, logger)
+		if err != nil {
+			logger.Error(mainLogTag, "Creating Registry Replica Handler: %s", err.Error())
+			os.Exit(1)
+		}
+
+		replicaFollower.Start()
+	}
+
+	listener := server.NewListener(config.Server, handlers, logger)
+	if err := listener.Listen(); err != nil {
+		logger.Error(mainLogTag, "Error occurred: %s", err.Error())
+		os.Exit(1)
+	}
+	errChan := listener.Serve()
+
+	if err := server.NotifyUpgradeReady(); err != nil {
+		logger.Error(mainLogTag, "Notifying upgraded process: %s", err.Error())
+	}
+
+	shutdown := func() {
+		// The queued notifications get what is left of the grace period
+		// once the requests have been drained.
+		deadline := time.Now().Add(config.Server.GracePeriod())
 		listener.Stop()
+		if replicaFollower != nil {
+			replicaFollower.Stop()
+		}
+		notifier.Stop(time.Until(deadline))
+		if accessLog != nil {
+			accessLog.Close()
+		}
+		if err := registryStore.Close(); err != nil {
+			logger.Error(mainLogTag, "Closing Registry Store: %s", err.Error())
+			os.Exit(1)
+		}
+		logger.Debug(mainLogTag, "Exited cleanly")
+		os.Exit(0)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	for {
+		select {
+		case err := <-errChan:
+			if err != nil {
+				logger.Error(mainLogTag, "Error occurred: %s", err.Error())
+				os.Exit(1)
+			}
+			os.Exit(0)
+		case sig := <-signals:
+			switch sig {
+			case syscall.SIGHUP:
+				logger.Info(mainLogTag, "Reloading configuration, received signal: %#v", sig)
+				newConfig, err := reloadConfig(config, fs, users, signedURLs, &listener, notifier)
+				if err != nil {
+					logger.Error(mainLogTag, "Keeping the previous configuration: %s", err.Error())
+					continue
+				}
+				config = newConfig
+				logWriter.SetLevel(config.Level())
+				logger.Info(mainLogTag, "Reloaded configuration")
+			case syscall.SIGUSR1:
+				if err := logOutput.Reopen(); err != nil {
+					logger.Error(mainLogTag, "Reopening log file: %s", err.Error())
+					continue
+				}
+				if accessLog != nil {
+					if err := accessLog.Reopen(); err != nil {
+						logger.Error(mainLogTag, "Reopening access log file: %s", err.Error())
+						continue
+					}
+				}
+				logger.Info(mainLogTag, "Reopened log files, received signal: %#v", sig)
+			case syscall.SIGUSR2:
+				logger.Info(mainLogTag, "Upgrading, received signal: %#v", sig)
+				if clusterNode != nil {
+					logger.Error(mainLogTag, "Keeping the current process: upgrades are not supported in cluster mode")
+					continue
+				}
+				if err := server.NewUpgrader(upgradeTimeout, logger).Upgrade(&listener); err != nil {
+					logger.Error(mainLogTag, "Keeping the current process: %s", err.Error())
+					continue
+				}
+				logger.Info(mainLogTag, "Exiting, upgraded")
+				shutdown()
+			default:
+				logger.Debug(mainLogTag, "Exiting, received signal: %#v", sig)
+				shutdown()
+			}
+		}
+	}
+}
+
+// reloadConfig applies the reloadable settings of the config file, rejecting
+// it when other settings changed. The TLS settings are applied first, as they
+// are the most likely to fail, and restored if a later step fails.
+func reloadConfig(config Config, fs boshsys.FileSystem, users *server.Users, signedURLs *server.SignedURLs, listener *server.Listener, notifier *notifications.Notifier) (Config, error) {
+	newConfig, err := NewConfigFromPath(*configFileOpt, fs)
+	if err != nil {
+		return config, bosherr.WrapError(err, "Loading config")
+	}
+
+	if err := config.CheckReload(newConfig); err != nil {
+		return config, err
+	}
+
+	if err := listener.Reload(newConfig.Server); err != nil {
+		return config, bosherr.WrapError(err, "Reloading Registry Listener")
+	}
+
+	if err := notifier.Reload(newConfig.Notifications); err != nil {
+		listener.Reload(config.Server)
+		return config, bosherr.WrapError(err, "Reloading Registry Notifier")
+	}
+
+	if err := users.Update(newConfig.Server); err != nil {
+		listener.Reload(config.Server)
+		notifier.Reload(config.Notifications)
+		return config, bosherr.WrapError(err, "Reloading Registry Users")
 	}
 
-	os.Exit(0)
+	if err := signedURLs.Update(newConfig.Server.SignedURLs); err != nil {
+		listener.Reload(config.Server)
+		notifier.Reload(config.Notifications)
+		users.Update(config.Server)
+		return config, bosherr.WrapError(err, "Reloading Registry Signed URLs")
+	}
+
+	return newConfig, nil
 }
 
-func createInstanceHandler(config Config, logger boshlog.Logger) (*server.InstanceHandler, error) {
-	store, err := store.NewStore(config.Store, logger)
+// createRegistryStore returns the store recording its operations metrics. In
+// cluster mode, the metrics are those of the replicated operations, and the
+// changes applied to the local store are told to the change observer.
+func createRegistryStore(config Config, changeObserver cluster.ChangeObserver, metricsRegistry *metrics.Registry, logger boshlog.Logger) (store.Store, *cluster.Node, error) {
+	registryStore, err := store.NewStore(config.Store, logger)
+	if err != nil {
+		return nil, nil, bosherr.WrapError(err, "Creating a Registry Store")
+	}
+
+	if !config.Cluster.Enabled() {
+		return store.NewMetricsStore(registryStore, config.Store.Adapter, metricsRegistry), nil, nil
+	}
+
+	clusterNode, err := cluster.NewNode(config.Cluster, registryStore, changeObserver, logger)
 	if err != nil {
-		return nil, bosherr.WrapError(err, "Creating a Registry Store")
+		return nil, nil, bosherr.WrapError(err, "Creating a Registry Cluster Node")
+	}
+
+	return store.NewMetricsStore(clusterNode.Store(), config.Store.Adapter, metricsRegistry), clusterNode, nil
+}
+
+func createReadAuthenticator(config Config, users *server.Users, instanceTokens *server.InstanceTokens, signedURLs *server.SignedURLs, logger boshlog.Logger) (server.Authenticator, error) {
+	var instanceIPResolver instanceip.Resolver
+	if config.Server.ReadAuthMode() == server.ReadAuthIP {
+		var err error
+		instanceIPResolver, err = instanceip.NewResolver(config.Server.InstanceIPCheckConfig(), logger)
+		if err != nil {
+			return nil, bosherr.WrapError(err, "Creating Instance IP Resolver")
+		}
+	}
+
+	return server.NewReadAuthenticator(config.Server, users, instanceIPResolver, instanceTokens, signedURLs)
+}
+
+func hashPassword(in io.Reader, out io.Writer) error {
+	password, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return bosherr.WrapError(err, "Reading password")
+	}
+
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return bosherr.Error("Must provide a non-empty password")
 	}
 
-	instanceHandler := server.NewInstanceHandler(config.Server, store, logger)
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return bosherr.WrapError(err, "Generating bcrypt hash")
+	}
 
-	return instanceHandler, nil
+	_, err = fmt.Fprintln(out, string(passwordHash))
+	return err
 }
@@ -0,0 +1,123 @@
+// Package redact masks the secrets in the settings JSON and URLs before they
+// are logged.
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+// Mask replaces the secret values.
+const Mask = "REDACTED"
+
+// secretFields are the names of the fields holding secrets in the agent
+// settings, e.g. the blobstore options or the env.bosh password.
+var secretFields = map[string]bool{
+	"password":          true,
+	"secret":            true,
+	"secret_access_key": true,
+	"private_key":       true,
+	"json_key":          true,
+	"credentials_json":  true,
+	"token":             true,
+	"api_key":           true,
+	"encryption_key":    true,
+}
+
+// secretFieldSuffixes match the other fields holding secrets, e.g.
+// "user_password" or "client_secret".
+var secretFieldSuffixes = []string{"_password", "_secret", "_private_key", "_token"}
+
+// SettingsJSON returns the JSON with the values of the secret fields masked,
+// as well as the passwords of the URLs, like the mbus one. Strings holding a
+// JSON object, like the settings of a registry response, are redacted too.
+// Contents that are not JSON are masked entirely, as they cannot be parsed.
+func SettingsJSON(settingsJSON string) string {
+	var settings interface{}
+	decoder := json.NewDecoder(strings.NewReader(settingsJSON))
+	decoder.UseNumber()
+	if err := decoder.Decode(&settings); err != nil || decoder.More() {
+		return Mask
+	}
+
+	redactedJSON, err := marshal(redactValue(settings))
+	if err != nil {
+		return Mask
+	}
+
+	return redactedJSON
+}
+
+// URL returns the URL with its password masked.
+func URL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+
+	if _, found := u.User.Password(); !found {
+		return rawURL
+	}
+	u.User = url.UserPassword(u.User.Username(), Mask)
+
+	return u.String()
+}
+
+func redactValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for name, fieldValue := range value {
+			if isSecretField(name) {
+				value[name] = Mask
+				continue
+			}
+			value[name] = redactValue(fieldValue)
+		}
+		return value
+	case []interface{}:
+		for i, item := range value {
+			value[i] = redactValue(item)
+		}
+		return value
+	case string:
+		if strings.HasPrefix(strings.TrimSpace(value), "{") {
+			return SettingsJSON(value)
+		}
+		if strings.Contains(value, "://") {
+			return URL(value)
+		}
+		return value
+	}
+
+	return value
+}
+
+func isSecretField(name string) bool {
+	name = strings.ToLower(name)
+	if secretFields[name] {
+		return true
+	}
+
+	for _, suffix := range secretFieldSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// marshal encodes the value without escaping HTML characters, so the logged
+// JSON reads like the original.
+func marshal(value interface{}) (string, error) {
+	buffer := &bytes.Buffer{}
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(buffer.String(), "\n"), nil
+}
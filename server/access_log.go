@@ -0,0 +1,220 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+const accessLogLogTag = "RegistryServerAccessLog"
+const accessLogFileMode = 0640
+
+const (
+	AccessLogFormatCLF  = "clf"
+	AccessLogFormatJSON = "json"
+)
+
+// clfDateLayout is the layout of the dates of the Common Log Format.
+const clfDateLayout = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLogConfig sets the format of the access log, which is disabled when
+// empty, and the file it is written to, stdout by default.
+type AccessLogConfig struct {
+	Format string `json:"format,omitempty"`
+	File   string `json:"file,omitempty"`
+}
+
+func (c AccessLogConfig) Enabled() bool {
+	return c.Format != ""
+}
+
+func (c AccessLogConfig) Validate() error {
+	switch c.Format {
+	case "":
+		if c.File != "" {
+			return bosherr.Error("Must provide a Format with File")
+		}
+	case AccessLogFormatCLF, AccessLogFormatJSON:
+	default:
+		return bosherr.Errorf("Format '%s' not supported", c.Format)
+	}
+
+	return nil
+}
+
+// AccessLogEntry is a request served, as written by the JSON format.
+type AccessLogEntry struct {
+	Time       string  `json:"time"`
+	RequestID  string  `json:"request_id"`
+	ClientIP   string  `json:"client_ip"`
+	Principal  string  `json:"principal,omitempty"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	InstanceID string  `json:"instance_id,omitempty"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	Latency    float64 `json:"latency_seconds"`
+}
+
+// AccessLog writes a line for every request served, in the Common Log Format
+// followed by the request ID, instance ID and latency, or in JSON. The query
+// of the requests is not logged, as it may contain tokens. The file can be
+// reopened after being rotated.
+type AccessLog struct {
+	config AccessLogConfig
+	logger boshlog.Logger
+
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func NewAccessLog(config AccessLogConfig, logger boshlog.Logger) (*AccessLog, error) {
+	a := &AccessLog{config: config, logger: logger}
+
+	if config.File != "" {
+		file, err := openAccessLogFile(config.File)
+		if err != nil {
+			return nil, err
+		}
+		a.file = file
+	}
+
+	return a, nil
+}
+
+// Wrap logs the requests once served.
+func (a *AccessLog) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, req)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		clientIP := req.RemoteAddr
+		if ip := requestIP(req); ip != nil {
+			clientIP = ip.String()
+		}
+
+		a.write(AccessLogEntry{
+			Time:       start.Format(time.RFC3339),
+			RequestID:  requestID(req),
+			ClientIP:   clientIP,
+			Principal:  requestPrincipal(req),
+			Method:     req.Method,
+			Path:       req.URL.Path,
+			InstanceID: accessLogInstanceID(req),
+			Status:     status,
+			Bytes:      recorder.bytes,
+			Latency:    time.Since(start).Seconds(),
+		}, start, req.Proto)
+	})
+}
+
+// Reopen opens the access log file again, so the lines are written to a new
+// file once the current one has been moved away by a log rotation.
+func (a *AccessLog) Reopen() error {
+	if a.config.File == "" {
+		return nil
+	}
+
+	file, err := openAccessLogFile(a.config.File)
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.file.Close()
+	a.file = file
+
+	return nil
+}
+
+func (a *AccessLog) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.file != nil {
+		return a.file.Close()
+	}
+
+	return nil
+}
+
+func (a *AccessLog) write(entry AccessLogEntry, start time.Time, proto string) {
+	var line []byte
+	if a.config.Format == AccessLogFormatJSON {
+		entryJSON, err := json.Marshal(entry)
+		if err != nil {
+			a.logger.Warn(accessLogLogTag, "Marshalling access log entry: %s", err.Error())
+			return
+		}
+		line = append(entryJSON, '\n')
+	} else {
+		line = []byte(fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d request_id=%s instance_id=%s latency=%.6f\n",
+			entry.ClientIP,
+			clfField(entry.Principal),
+			start.Format(clfDateLayout),
+			entry.Method,
+			clfField(entry.Path),
+			proto,
+			entry.Status,
+			entry.Bytes,
+			clfField(entry.RequestID),
+			clfField(entry.InstanceID),
+			entry.Latency,
+		))
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var out io.Writer = os.Stdout
+	if a.file != nil {
+		out = a.file
+	}
+
+	if _, err := out.Write(line); err != nil {
+		a.logger.Warn(accessLogLogTag, "Writing access log entry: %s", err.Error())
+	}
+}
+
+// clfField returns the value of a field, or "-" when it is empty, escaping
+// the spaces and quotes that would break the line apart.
+func clfField(value string) string {
+	if value == "" {
+		return "-"
+	}
+
+	return strings.NewReplacer(" ", "%20", `"`, "%22").Replace(value)
+}
+
+func accessLogInstanceID(req *http.Request) string {
+	if !strings.HasPrefix(req.URL.Path, "/instances/") {
+		return ""
+	}
+
+	return strings.SplitN(strings.TrimPrefix(req.URL.Path, "/instances/"), "/", 2)[0]
+}
+
+func openAccessLogFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, accessLogFileMode)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Opening access log file '%s'", path)
+	}
+
+	return file, nil
+}
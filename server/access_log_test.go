@@ -0,0 +1,128 @@
+package server_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+var _ = Describe("AccessLogConfig", func() {
+	Describe("Validate", func() {
+		It("does not return error if disabled", func() {
+			Expect(AccessLogConfig{}.Validate()).To(Succeed())
+		})
+
+		It("does not return error for the supported formats", func() {
+			Expect(AccessLogConfig{Format: AccessLogFormatCLF}.Validate()).To(Succeed())
+			Expect(AccessLogConfig{Format: AccessLogFormatJSON, File: "/fake-file"}.Validate()).To(Succeed())
+		})
+
+		It("returns error if the format is not supported", func() {
+			err := AccessLogConfig{Format: "fake-format"}.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Format 'fake-format' not supported"))
+		})
+
+		It("returns error if a file is provided without a format", func() {
+			err := AccessLogConfig{File: "/fake-file"}.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a Format with File"))
+		})
+	})
+})
+
+var _ = Describe("AccessLog", func() {
+	var (
+		tempDir       string
+		accessLogFile string
+		accessLog     *AccessLog
+
+		logger = boshlog.NewLogger(boshlog.LevelNone)
+	)
+
+	serve := func(method string, target string) {
+		handler := accessLog.Wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("fake-body"))
+		}))
+
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = "10.0.0.5:1234"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	readAccessLog := func(path string) string {
+		contents, err := ioutil.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		return string(contents)
+	}
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "access-log")
+		Expect(err).ToNot(HaveOccurred())
+		accessLogFile = filepath.Join(tempDir, "access.log")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	It("writes the requests in the Common Log Format, without their query", func() {
+		var err error
+		accessLog, err = NewAccessLog(AccessLogConfig{Format: AccessLogFormatCLF, File: accessLogFile}, logger)
+		Expect(err).ToNot(HaveOccurred())
+		defer accessLog.Close()
+
+		serve("GET", "/instances/fake-instance-id/settings?token=fake-token")
+
+		Expect(readAccessLog(accessLogFile)).To(MatchRegexp(
+			`^10\.0\.0\.5 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /instances/fake-instance-id/settings HTTP/1\.1" 404 9 request_id=- instance_id=fake-instance-id latency=\d+\.\d{6}\n$`,
+		))
+	})
+
+	It("writes the requests in JSON", func() {
+		var err error
+		accessLog, err = NewAccessLog(AccessLogConfig{Format: AccessLogFormatJSON, File: accessLogFile}, logger)
+		Expect(err).ToNot(HaveOccurred())
+		defer accessLog.Close()
+
+		serve("GET", "/backup")
+
+		accessLogLine := readAccessLog(accessLogFile)
+		Expect(accessLogLine).To(ContainSubstring(`"client_ip":"10.0.0.5"`))
+		Expect(accessLogLine).To(ContainSubstring(`"method":"GET","path":"/backup","status":404,"bytes":9,`))
+		Expect(accessLogLine).ToNot(ContainSubstring("instance_id"))
+		Expect(accessLogLine).ToNot(ContainSubstring("principal"))
+	})
+
+	It("writes to a file reopened after being rotated", func() {
+		var err error
+		accessLog, err = NewAccessLog(AccessLogConfig{Format: AccessLogFormatCLF, File: accessLogFile}, logger)
+		Expect(err).ToNot(HaveOccurred())
+		defer accessLog.Close()
+
+		serve("GET", "/backup")
+		Expect(os.Rename(accessLogFile, accessLogFile+".1")).To(Succeed())
+		Expect(accessLog.Reopen()).To(Succeed())
+		serve("DELETE", "/backup")
+
+		Expect(readAccessLog(accessLogFile + ".1")).To(ContainSubstring(`"GET /backup`))
+		Expect(readAccessLog(accessLogFile)).To(ContainSubstring(`"DELETE /backup`))
+	})
+
+	It("returns error if the file cannot be opened", func() {
+		_, err := NewAccessLog(AccessLogConfig{Format: AccessLogFormatCLF, File: filepath.Join(tempDir, "missing", "access.log")}, logger)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Opening access log file"))
+	})
+})
@@ -0,0 +1,348 @@
+package server
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+const authLimiterLogTag = "RegistryServerAuthLimiter"
+const authLimiterSweepInterval = time.Minute
+
+const (
+	defaultAuthLimiterMaxFailures = 5
+	defaultAuthLimiterBaseBackoff = 1
+	defaultAuthLimiterMaxBackoff  = 300
+	defaultAuthLimiterResetAfter  = 900
+)
+
+// AuthLimiterConfig sets how failed authentication attempts are throttled.
+// Times are in seconds.
+type AuthLimiterConfig struct {
+	Disabled    bool `json:"disabled,omitempty"`
+	MaxFailures int  `json:"max_failures,omitempty"`
+	BaseBackoff int  `json:"base_backoff,omitempty"`
+	MaxBackoff  int  `json:"max_backoff,omitempty"`
+	ResetAfter  int  `json:"reset_after,omitempty"`
+}
+
+func (c AuthLimiterConfig) Validate() error {
+	if c.MaxFailures < 0 || c.BaseBackoff < 0 || c.MaxBackoff < 0 || c.ResetAfter < 0 {
+		return bosherr.Error("Must provide non-negative MaxFailures, BaseBackoff, MaxBackoff and ResetAfter")
+	}
+
+	if c.MaxBackoff != 0 && c.MaxBackoff < c.baseBackoff() {
+		return bosherr.Error("Must provide a MaxBackoff not lower than BaseBackoff")
+	}
+
+	return nil
+}
+
+func (c AuthLimiterConfig) maxFailures() int {
+	if c.MaxFailures == 0 {
+		return defaultAuthLimiterMaxFailures
+	}
+
+	return c.MaxFailures
+}
+
+func (c AuthLimiterConfig) baseBackoff() int {
+	if c.BaseBackoff == 0 {
+		return defaultAuthLimiterBaseBackoff
+	}
+
+	return c.BaseBackoff
+}
+
+func (c AuthLimiterConfig) maxBackoff() int {
+	if c.MaxBackoff == 0 {
+		return defaultAuthLimiterMaxBackoff
+	}
+
+	return c.MaxBackoff
+}
+
+func (c AuthLimiterConfig) resetAfter() int {
+	if c.ResetAfter == 0 {
+		return defaultAuthLimiterResetAfter
+	}
+
+	return c.ResetAfter
+}
+
+type authFailures struct {
+	count        int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// AuthLimiter counts the failed authentication attempts (the requests
+// answered with a 401 Unauthorized) of every client IP and username. Once
+// there are more than MaxFailures, each new failure blocks the IP or username
+// for twice as long as the previous one, from BaseBackoff up to MaxBackoff.
+// Counters are forgotten ResetAfter seconds after their last failure.
+type AuthLimiter struct {
+	logger boshlog.Logger
+
+	mutex     sync.Mutex
+	config    AuthLimiterConfig
+	failures  map[string]*authFailures
+	lastSweep time.Time
+}
+
+func NewAuthLimiter(config AuthLimiterConfig, logger boshlog.Logger) *AuthLimiter {
+	return &AuthLimiter{
+		config:   config,
+		logger:   logger,
+		failures: map[string]*authFailures{},
+	}
+}
+
+// Wrap answers the requests from blocked IPs with a 429 Too Many Requests,
+// and counts the failed credential checks of the rest. The usernames are
+// only blocked for failed credential checks, so the requests with valid
+// credentials are still served while a username is blocked.
+func (l *AuthLimiter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if l.disabled() {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		ipKey := authLimiterIPKey(req)
+		if retryAfter, blocked := l.RetryAfter(ipKey); blocked {
+			l.logger.Warn(requestLogTag(authLimiterLogTag, req), "Throttling %s %s from '%s' after failed authentication attempts", req.Method, req.URL.Path, req.RemoteAddr)
+			writeTooManyRequests(w, retryAfter)
+			return
+		}
+
+		attempt := &authAttempt{}
+		req = req.WithContext(context.WithValue(req.Context(), authAttemptKey{}, attempt))
+		limiterWriter := &authLimiterWriter{statusRecorder: statusRecorder{ResponseWriter: w}, limiter: l, attempt: attempt}
+		next.ServeHTTP(limiterWriter, req)
+
+		username, failed := attempt.failedUsername()
+		if !failed || (limiterWriter.status != http.StatusUnauthorized && !limiterWriter.throttled) {
+			return
+		}
+
+		if limiterWriter.throttled {
+			l.logger.Warn(requestLogTag(authLimiterLogTag, req), "Throttling %s %s for blocked user '%s' from '%s' after failed authentication attempts", req.Method, req.URL.Path, username, req.RemoteAddr)
+		} else {
+			l.logger.Warn(requestLogTag(authLimiterLogTag, req), "Failed authentication of %s %s for user '%s' from '%s'", req.Method, req.URL.Path, username, req.RemoteAddr)
+		}
+		l.Fail(ipKey, authLimiterUserKey(username))
+	})
+}
+
+// Update replaces the configuration. Counted failures are kept, and they are
+// forgotten when the limiter is disabled.
+func (l *AuthLimiter) Update(config AuthLimiterConfig) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.config = config
+	if config.Disabled {
+		l.failures = map[string]*authFailures{}
+	}
+}
+
+func (l *AuthLimiter) disabled() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.config.Disabled
+}
+
+// RetryAfter returns how long the longest blocked of the keys is blocked for.
+func (l *AuthLimiter) RetryAfter(keys ...string) (time.Duration, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	var retryAfter time.Duration
+	for _, key := range keys {
+		if failures, found := l.failures[key]; found && failures.blockedUntil.After(now) {
+			if blockedFor := failures.blockedUntil.Sub(now); blockedFor > retryAfter {
+				retryAfter = blockedFor
+			}
+		}
+	}
+
+	return retryAfter, retryAfter > 0
+}
+
+// Fail counts a failed authentication attempt for every key.
+func (l *AuthLimiter) Fail(keys ...string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	resetAfter := time.Duration(l.config.resetAfter()) * time.Second
+	for _, key := range keys {
+		failures, found := l.failures[key]
+		if !found || now.Sub(failures.lastFailure) > resetAfter {
+			failures = &authFailures{}
+			l.failures[key] = failures
+		}
+
+		failures.count++
+		failures.lastFailure = now
+
+		if excess := failures.count - l.config.maxFailures(); excess > 0 {
+			failures.blockedUntil = now.Add(l.backoff(excess))
+		}
+	}
+
+	if now.Sub(l.lastSweep) > authLimiterSweepInterval {
+		l.sweep(now, resetAfter)
+	}
+}
+
+func (l *AuthLimiter) backoff(excess int) time.Duration {
+	maxBackoff := time.Duration(l.config.maxBackoff()) * time.Second
+	backoff := time.Duration(l.config.baseBackoff()) * time.Second
+	for i := 1; i < excess && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > maxBackoff {
+		return maxBackoff
+	}
+
+	return backoff
+}
+
+func (l *AuthLimiter) sweep(now time.Time, resetAfter time.Duration) {
+	for key, failures := range l.failures {
+		if now.Sub(failures.lastFailure) > resetAfter && !failures.blockedUntil.After(now) {
+			delete(l.failures, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+func authLimiterIPKey(req *http.Request) string {
+	if ip := requestIP(req); ip != nil {
+		return "ip:" + ip.String()
+	}
+
+	return "ip:" + req.RemoteAddr
+}
+
+func authLimiterUserKey(username string) string {
+	return "user:" + username
+}
+
+func writeTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+}
+
+type authAttemptKey struct{}
+
+// authAttempt records the username of the credentials of a request that
+// failed to be verified.
+type authAttempt struct {
+	mutex    sync.Mutex
+	username string
+	failed   bool
+}
+
+func (a *authAttempt) failedUsername() (string, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.username, a.failed
+}
+
+// failAuthAttempt records that the credentials of the request for the
+// username failed to be verified.
+func failAuthAttempt(req *http.Request, username string) {
+	attempt, found := req.Context().Value(authAttemptKey{}).(*authAttempt)
+	if !found {
+		return
+	}
+
+	attempt.mutex.Lock()
+	defer attempt.mutex.Unlock()
+
+	attempt.username = username
+	attempt.failed = true
+}
+
+// authLimiterWriter answers with a 429 Too Many Requests, rather than a 401
+// Unauthorized, the requests whose credentials failed to be verified for a
+// blocked username.
+type authLimiterWriter struct {
+	statusRecorder
+	limiter   *AuthLimiter
+	attempt   *authAttempt
+	throttled bool
+}
+
+func (w *authLimiterWriter) WriteHeader(status int) {
+	if w.status == 0 && status == http.StatusUnauthorized {
+		if username, failed := w.attempt.failedUsername(); failed {
+			if retryAfter, blocked := w.limiter.RetryAfter(authLimiterUserKey(username)); blocked {
+				w.throttled = true
+				w.Header().Del("WWW-Authenticate")
+				writeTooManyRequests(&w.statusRecorder, retryAfter)
+				return
+			}
+		}
+	}
+
+	w.statusRecorder.WriteHeader(status)
+}
+
+func (w *authLimiterWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.throttled {
+		return len(b), nil
+	}
+
+	return w.statusRecorder.Write(b)
+}
+
+// statusRecorder records the status code and the size of the body of a
+// response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
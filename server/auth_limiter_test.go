@@ -0,0 +1,186 @@
+package server_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+var _ = Describe("AuthLimiterConfig", func() {
+	It("does not return error if all fields are valid", func() {
+		Expect(AuthLimiterConfig{}.Validate()).To(Succeed())
+		Expect(AuthLimiterConfig{MaxFailures: 3, BaseBackoff: 2, MaxBackoff: 60, ResetAfter: 600}.Validate()).To(Succeed())
+	})
+
+	It("returns error if a field is negative", func() {
+		err := AuthLimiterConfig{ResetAfter: -1}.Validate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Must provide non-negative MaxFailures, BaseBackoff, MaxBackoff and ResetAfter"))
+	})
+
+	It("returns error if MaxBackoff is lower than BaseBackoff", func() {
+		err := AuthLimiterConfig{BaseBackoff: 10, MaxBackoff: 5}.Validate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Must provide a MaxBackoff not lower than BaseBackoff"))
+	})
+})
+
+var _ = Describe("AuthLimiter", func() {
+	var (
+		config      AuthLimiterConfig
+		authLimiter *AuthLimiter
+		handler     http.Handler
+		statusCode  int
+
+		users  *Users
+		logger = boshlog.NewLogger(boshlog.LevelNone)
+	)
+
+	BeforeEach(func() {
+		users = newUsers(Config{Username: "fake-username", Password: "fake-password"})
+		config = AuthLimiterConfig{MaxFailures: 2, BaseBackoff: 10, MaxBackoff: 35}
+		statusCode = http.StatusOK
+	})
+
+	JustBeforeEach(func() {
+		authLimiter = NewAuthLimiter(config, logger)
+		handler = authLimiter.Wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !users.IsAuthorized(req, RoleReader) {
+				w.Header().Add("WWW-Authenticate", `Basic realm="Bosh Registry"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(statusCode)
+		}))
+	})
+
+	serveWithPassword := func(remoteAddr string, username string, password string) *httptest.ResponseRecorder {
+		request, err := http.NewRequest("GET", "/instances/fake-instance-id/settings", nil)
+		Expect(err).ToNot(HaveOccurred())
+		request.RemoteAddr = remoteAddr
+		if username != "" {
+			request.SetBasicAuth(username, password)
+		}
+
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, request)
+		return responseRecorder
+	}
+
+	serve := func(remoteAddr string, username string) *httptest.ResponseRecorder {
+		return serveWithPassword(remoteAddr, username, "fake-wrong-password")
+	}
+
+	It("blocks IPs after too many failed credential checks", func() {
+		Expect(serve("10.0.0.5:34567", "fake-username").Code).To(Equal(http.StatusUnauthorized))
+		Expect(serve("10.0.0.5:34568", "fake-other-username").Code).To(Equal(http.StatusUnauthorized))
+		Expect(serve("10.0.0.5:34569", "fake-other-username").Code).To(Equal(http.StatusUnauthorized))
+
+		responseRecorder := serveWithPassword("10.0.0.5:34570", "fake-username", "fake-password")
+		Expect(responseRecorder.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(responseRecorder.Header().Get("Retry-After")).To(Equal("10"))
+
+		Expect(serveWithPassword("10.0.0.6:34567", "fake-username", "fake-password").Code).To(Equal(http.StatusOK))
+	})
+
+	It("does not count the refusals without failed credential checks", func() {
+		for i := 0; i < 5; i++ {
+			Expect(serve("10.0.0.5:34567", "").Code).To(Equal(http.StatusUnauthorized))
+		}
+	})
+
+	It("blocks the failed credential checks of usernames from any IP, still serving valid credentials", func() {
+		serve("10.0.0.5:34567", "fake-username")
+		serve("10.0.0.6:34567", "fake-username")
+		serve("10.0.0.7:34567", "fake-username")
+
+		responseRecorder := serve("10.0.0.8:34567", "fake-username")
+		Expect(responseRecorder.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(responseRecorder.Header().Get("WWW-Authenticate")).To(BeEmpty())
+		Expect(serve("10.0.0.8:34567", "fake-other-username").Code).To(Equal(http.StatusUnauthorized))
+
+		Expect(serveWithPassword("10.0.0.9:34567", "fake-username", "fake-password").Code).To(Equal(http.StatusOK))
+	})
+
+	It("does not count other responses as failed authentication attempts", func() {
+		statusCode = http.StatusNotFound
+
+		for i := 0; i < 5; i++ {
+			Expect(serveWithPassword("10.0.0.5:34567", "fake-username", "fake-password").Code).To(Equal(http.StatusNotFound))
+		}
+	})
+
+	It("backs off exponentially up to the maximum backoff", func() {
+		authLimiter.Fail("fake-key", "fake-key")
+		_, blocked := authLimiter.RetryAfter("fake-key")
+		Expect(blocked).To(BeFalse())
+
+		authLimiter.Fail("fake-key")
+		retryAfter, blocked := authLimiter.RetryAfter("fake-key")
+		Expect(blocked).To(BeTrue())
+		Expect(retryAfter).To(BeNumerically("~", 10*time.Second, time.Second))
+
+		authLimiter.Fail("fake-key")
+		retryAfter, _ = authLimiter.RetryAfter("fake-key")
+		Expect(retryAfter).To(BeNumerically("~", 20*time.Second, time.Second))
+
+		authLimiter.Fail("fake-key")
+		retryAfter, _ = authLimiter.RetryAfter("fake-key")
+		Expect(retryAfter).To(BeNumerically("~", 35*time.Second, time.Second))
+
+		retryAfter, _ = authLimiter.RetryAfter("fake-other-key", "fake-key")
+		Expect(retryAfter).To(BeNumerically("~", 35*time.Second, time.Second))
+	})
+
+	It("keeps flushing responses", func() {
+		handler = authLimiter.Wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, ok := w.(http.Flusher)
+			Expect(ok).To(BeTrue())
+		}))
+
+		serve("10.0.0.5:34567", "")
+	})
+
+	It("applies an updated configuration", func() {
+		serve("10.0.0.5:34567", "fake-username")
+		serve("10.0.0.5:34567", "fake-username")
+
+		authLimiter.Update(AuthLimiterConfig{MaxFailures: 1, BaseBackoff: 20, MaxBackoff: 60})
+		Expect(serve("10.0.0.5:34567", "fake-other-username").Code).To(Equal(http.StatusUnauthorized))
+
+		responseRecorder := serve("10.0.0.5:34567", "fake-other-username")
+		Expect(responseRecorder.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(responseRecorder.Header().Get("Retry-After")).To(Equal("40"))
+	})
+
+	It("forgets the failed authentication attempts when updated to disabled", func() {
+		for i := 0; i < 3; i++ {
+			serve("10.0.0.5:34567", "fake-username")
+		}
+
+		authLimiter.Update(AuthLimiterConfig{Disabled: true})
+		Expect(serve("10.0.0.5:34567", "fake-username").Code).To(Equal(http.StatusUnauthorized))
+
+		authLimiter.Update(config)
+		Expect(serve("10.0.0.5:34567", "fake-username").Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	Context("when disabled", func() {
+		BeforeEach(func() {
+			config.Disabled = true
+		})
+
+		It("does not block failed authentication attempts", func() {
+			for i := 0; i < 5; i++ {
+				Expect(serve("10.0.0.5:34567", "fake-username").Code).To(Equal(http.StatusUnauthorized))
+			}
+		})
+	})
+})
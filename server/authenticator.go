@@ -0,0 +1,271 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+
+	"github.com/frodenas/bosh-registry/server/instanceip"
+)
+
+const (
+	ReadAuthNone          = "none"
+	ReadAuthBasic         = "basic"
+	ReadAuthClientCert    = "client_cert"
+	ReadAuthInstanceToken = "instance_token"
+	ReadAuthIP            = "ip"
+)
+
+// signedURLPrincipal is the principal of the requests authenticated by a
+// signed URL.
+const signedURLPrincipal = "signed_url"
+
+// Authenticator decides whether a request may access the settings of an
+// instance, returning the reason when it may not.
+type Authenticator interface {
+	Authenticate(req *http.Request, instanceID string, settingsJSON string) error
+}
+
+// SettingsAuthenticator is an Authenticator that may need the settings of
+// the instance, which are otherwise not looked up before authenticating.
+type SettingsAuthenticator interface {
+	RequiresSettings() bool
+}
+
+func requiresSettings(authenticator Authenticator) bool {
+	settingsAuthenticator, ok := authenticator.(SettingsAuthenticator)
+	return ok && settingsAuthenticator.RequiresSettings()
+}
+
+// NewReadAuthenticator returns the Authenticator for the configured read
+// policy. Users with, at least, the reader role can always read settings, as
+// can signed URLs when signedURLs is not nil and client certificates allowed
+// to read the settings of the instance. The client certificate rules and the
+// signing keys are the current ones, so they can be reloaded.
+func NewReadAuthenticator(
+	config Config,
+	users *Users,
+	instanceIPResolver instanceip.Resolver,
+	instanceTokens InstanceTokenVerifier,
+	signedURLs *SignedURLs,
+) (Authenticator, error) {
+	authenticators := AnyAuthenticator{NewBasicAuthenticator(users, RoleReader)}
+	if signedURLs != nil {
+		authenticators = append(authenticators, NewSignedURLAuthenticator(signedURLs))
+	}
+	if config.ReadAuthMode() != ReadAuthClientCert {
+		authenticators = append(authenticators, NewClientCertAuthenticator(users, false))
+	}
+
+	switch config.ReadAuthMode() {
+	case ReadAuthNone:
+		return NoneAuthenticator{}, nil
+	case ReadAuthBasic:
+		return authenticators, nil
+	case ReadAuthClientCert:
+		return append(authenticators, NewClientCertAuthenticator(users, true)), nil
+	case ReadAuthInstanceToken:
+		if instanceTokens == nil {
+			return nil, bosherr.Error("Must provide instance tokens for read policy 'instance_token'")
+		}
+		return append(authenticators, NewInstanceTokenAuthenticator(instanceTokens)), nil
+	case ReadAuthIP:
+		if instanceIPResolver == nil {
+			return nil, bosherr.Error("Must provide an instance IP resolver for read policy 'ip'")
+		}
+		return append(authenticators, NewIPAuthenticator(instanceIPResolver)), nil
+	}
+
+	return nil, bosherr.Errorf("Read policy '%s' not supported", config.ReadAuthMode())
+}
+
+type NoneAuthenticator struct{}
+
+func (a NoneAuthenticator) Authenticate(req *http.Request, instanceID string, settingsJSON string) error {
+	return nil
+}
+
+// AnyAuthenticator authorizes the requests authorized by any of its
+// authenticators.
+type AnyAuthenticator []Authenticator
+
+func (a AnyAuthenticator) Authenticate(req *http.Request, instanceID string, settingsJSON string) error {
+	var reasons []string
+	for _, authenticator := range a {
+		err := authenticator.Authenticate(req, instanceID, settingsJSON)
+		if err == nil {
+			return nil
+		}
+		reasons = append(reasons, err.Error())
+	}
+
+	return bosherr.Error(strings.Join(reasons, "; "))
+}
+
+func (a AnyAuthenticator) RequiresSettings() bool {
+	for _, authenticator := range a {
+		if requiresSettings(authenticator) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type BasicAuthenticator struct {
+	users *Users
+	role  string
+}
+
+func NewBasicAuthenticator(users *Users, role string) BasicAuthenticator {
+	return BasicAuthenticator{users: users, role: role}
+}
+
+func (a BasicAuthenticator) Authenticate(req *http.Request, instanceID string, settingsJSON string) error {
+	name, role, found := a.users.Authenticate(req)
+	if !found {
+		return bosherr.Error("missing or invalid credentials")
+	}
+
+	if roleLevels[role] < roleLevels[a.role] {
+		return bosherr.Errorf("user '%s' with role '%s' requires role '%s'", name, role, a.role)
+	}
+
+	return nil
+}
+
+// ClientCertAuthenticator authorizes verified client certificates allowed to
+// read the settings of the instance by the client certificate rules of the
+// users or, when there are none and anyVerifiedCert is set, every verified
+// client certificate.
+type ClientCertAuthenticator struct {
+	users           *Users
+	anyVerifiedCert bool
+}
+
+func NewClientCertAuthenticator(users *Users, anyVerifiedCert bool) ClientCertAuthenticator {
+	return ClientCertAuthenticator{users: users, anyVerifiedCert: anyVerifiedCert}
+}
+
+func (a ClientCertAuthenticator) Authenticate(req *http.Request, instanceID string, settingsJSON string) error {
+	clientCerts := a.users.ClientCerts()
+	if len(clientCerts) > 0 || !a.anyVerifiedCert {
+		if err := clientCerts.AuthorizeInstance(req, instanceID); err != nil {
+			return err
+		}
+	}
+
+	cert, found := verifiedClientCert(req)
+	if !found {
+		return bosherr.Error("missing verified client certificate")
+	}
+
+	setRequestPrincipal(req, clientCertName(cert))
+	return nil
+}
+
+type InstanceTokenAuthenticator struct {
+	instanceTokens InstanceTokenVerifier
+}
+
+func NewInstanceTokenAuthenticator(instanceTokens InstanceTokenVerifier) InstanceTokenAuthenticator {
+	return InstanceTokenAuthenticator{instanceTokens: instanceTokens}
+}
+
+func (a InstanceTokenAuthenticator) Authenticate(req *http.Request, instanceID string, settingsJSON string) error {
+	token := instanceTokenFromRequest(req)
+	if token == "" {
+		return bosherr.Error("missing instance token")
+	}
+
+	if err := a.instanceTokens.VerifyInstanceToken(instanceID, token); err != nil {
+		return err
+	}
+
+	setRequestPrincipal(req, instancePrincipal(instanceID))
+	return nil
+}
+
+type SignedURLAuthenticator struct {
+	signedURLs *SignedURLs
+}
+
+func NewSignedURLAuthenticator(signedURLs *SignedURLs) SignedURLAuthenticator {
+	return SignedURLAuthenticator{signedURLs: signedURLs}
+}
+
+func (a SignedURLAuthenticator) Authenticate(req *http.Request, instanceID string, settingsJSON string) error {
+	if err := a.signedURLs.Verify(req); err != nil {
+		return err
+	}
+
+	setRequestPrincipal(req, signedURLPrincipal)
+	return nil
+}
+
+type IPAuthenticator struct {
+	instanceIPResolver instanceip.Resolver
+}
+
+func NewIPAuthenticator(instanceIPResolver instanceip.Resolver) IPAuthenticator {
+	return IPAuthenticator{instanceIPResolver: instanceIPResolver}
+}
+
+// RequiresSettings returns true, as the instance IPs may be those of the
+// network settings.
+func (a IPAuthenticator) RequiresSettings() bool {
+	return true
+}
+
+// Authenticate mirrors the Ruby BOSH Registry: the request must come from
+// one of the instance IPs.
+func (a IPAuthenticator) Authenticate(req *http.Request, instanceID string, settingsJSON string) error {
+	ip := requestIP(req)
+	if ip == nil {
+		return bosherr.Errorf("invalid remote address '%s'", req.RemoteAddr)
+	}
+
+	instanceIPs, err := a.instanceIPResolver.InstanceIPs(instanceID, settingsJSON)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "failed to resolve instance IPs for '%s'", ip)
+	}
+
+	if len(instanceIPs) == 0 {
+		return bosherr.Errorf("no instance IPs known for '%s'", ip)
+	}
+
+	for _, instanceIP := range instanceIPs {
+		if instanceIP.Equal(ip) {
+			setRequestPrincipal(req, instancePrincipal(instanceID))
+			return nil
+		}
+	}
+
+	return bosherr.Errorf("IP '%s' does not belong to instance (instance IPs: %v)", ip, instanceIPs)
+}
+
+// instancePrincipal is the principal of the requests authenticated as an
+// instance, by its token or IP.
+func instancePrincipal(instanceID string) string {
+	return "instance:" + instanceID
+}
+
+// instanceTokenFromRequest returns the instance token sent in the
+// Authorization header or in the token query parameter.
+func instanceTokenFromRequest(req *http.Request) string {
+	if token := bearerToken(req); token != "" {
+		return token
+	}
+
+	return req.URL.Query().Get("token")
+}
+
+func bearerToken(req *http.Request) string {
+	authorization := req.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+
+	return ""
+}
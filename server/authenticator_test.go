@@ -0,0 +1,248 @@
+package server_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+
+	"github.com/frodenas/bosh-registry/server/fakes"
+	instanceipfakes "github.com/frodenas/bosh-registry/server/instanceip/fakes"
+	storefakes "github.com/frodenas/bosh-registry/server/store/fakes"
+)
+
+var _ = Describe("Authenticator", func() {
+	var (
+		err                error
+		request            *http.Request
+		users              *Users
+		instanceIPResolver *instanceipfakes.FakeResolver
+		registryStore      *storefakes.FakeStore
+		instanceTokens     *InstanceTokens
+
+		config = Config{
+			Protocol: "https",
+			Username: "fake-username",
+			Password: "fake-password",
+			Users: []UserConfig{
+				{Name: "fake-reader", PasswordHash: "$2a$04$7r81GRQeDgn8ssDbGBv.hu9S5SCsylmffgm4Hkr0fL37Tf.NbZEH.", Role: RoleReader},
+			},
+		}
+	)
+
+	BeforeEach(func() {
+		users = newUsers(config)
+		instanceIPResolver = &instanceipfakes.FakeResolver{InstanceIPsIPs: []net.IP{net.ParseIP("10.0.0.5")}}
+		registryStore = &storefakes.FakeStore{}
+		instanceTokens = NewInstanceTokens(InstanceTokensConfig{}, registryStore, &fakes.FakeEventPublisher{})
+
+		request, err = http.NewRequest("GET", "/instances/fake-instance-id/settings", nil)
+		Expect(err).ToNot(HaveOccurred())
+		request.RemoteAddr = "10.0.0.6:34567"
+	})
+
+	newReadAuthenticator := func(readAuth string) Authenticator {
+		readAuthConfig := config
+		readAuthConfig.ReadAuth = readAuth
+
+		authenticator, err := NewReadAuthenticator(readAuthConfig, users, instanceIPResolver, instanceTokens, nil)
+		Expect(err).ToNot(HaveOccurred())
+		return authenticator
+	}
+
+	Describe("NewReadAuthenticator", func() {
+		It("authorizes every request with read policy 'none'", func() {
+			Expect(newReadAuthenticator(ReadAuthNone).Authenticate(request, "fake-instance-id", "fake-settings")).To(Succeed())
+		})
+
+		It("authorizes readers with read policy 'basic'", func() {
+			authenticator := newReadAuthenticator(ReadAuthBasic)
+			Expect(authenticator.Authenticate(request, "fake-instance-id", "fake-settings")).ToNot(Succeed())
+
+			request.SetBasicAuth("fake-reader", "fake-password")
+			Expect(authenticator.Authenticate(request, "fake-instance-id", "fake-settings")).To(Succeed())
+		})
+
+		It("authorizes verified client certificates or readers with read policy 'client_cert'", func() {
+			authenticator := newReadAuthenticator(ReadAuthClientCert)
+			Expect(authenticator.Authenticate(request, "fake-instance-id", "fake-settings")).ToNot(Succeed())
+
+			request.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{&x509.Certificate{}}}}
+			Expect(authenticator.Authenticate(request, "fake-instance-id", "fake-settings")).To(Succeed())
+
+			request.TLS = nil
+			request.SetBasicAuth("fake-reader", "fake-password")
+			Expect(authenticator.Authenticate(request, "fake-instance-id", "fake-settings")).To(Succeed())
+		})
+
+		It("authorizes client certificates allowed to read the instance settings with read policy 'client_cert'", func() {
+			clientCertsConfig := config
+			clientCertsConfig.ReadAuth = ReadAuthClientCert
+			clientCertsConfig.ClientCerts = []ClientCertConfig{{OU: "fake-agents", InstanceID: "{cn}"}}
+			users = newUsers(clientCertsConfig)
+
+			authenticator, err := NewReadAuthenticator(clientCertsConfig, users, instanceIPResolver, instanceTokens, nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			withClientCert(request, &x509.Certificate{Subject: pkix.Name{CommonName: "fake-other-instance-id", OrganizationalUnit: []string{"fake-agents"}}})
+			Expect(authenticator.Authenticate(request, "fake-instance-id", "fake-settings")).ToNot(Succeed())
+
+			withClientCert(request, &x509.Certificate{Subject: pkix.Name{CommonName: "fake-instance-id", OrganizationalUnit: []string{"fake-agents"}}})
+			Expect(authenticator.Authenticate(request, "fake-instance-id", "fake-settings")).To(Succeed())
+		})
+
+		It("authorizes client certificates allowed to read the instance settings with other read policies", func() {
+			clientCertsConfig := config
+			clientCertsConfig.ReadAuth = ReadAuthBasic
+			clientCertsConfig.ClientCerts = []ClientCertConfig{{CN: "fake-instance-id", InstanceID: "{cn}"}}
+			users = newUsers(clientCertsConfig)
+
+			authenticator, err := NewReadAuthenticator(clientCertsConfig, users, instanceIPResolver, instanceTokens, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(authenticator.Authenticate(request, "fake-instance-id", "fake-settings")).ToNot(Succeed())
+
+			withClientCert(request, &x509.Certificate{Subject: pkix.Name{CommonName: "fake-instance-id"}})
+			Expect(authenticator.Authenticate(request, "fake-instance-id", "fake-settings")).To(Succeed())
+		})
+
+		It("uses the client certificate rules updated in the users", func() {
+			authenticator := newReadAuthenticator(ReadAuthBasic)
+
+			withClientCert(request, &x509.Certificate{Subject: pkix.Name{CommonName: "fake-instance-id"}})
+			Expect(authenticator.Authenticate(request, "fake-instance-id", "fake-settings")).ToNot(Succeed())
+
+			clientCertsConfig := config
+			clientCertsConfig.ClientCerts = []ClientCertConfig{{CN: "fake-instance-id", InstanceID: "{cn}"}}
+			Expect(users.Update(clientCertsConfig)).To(Succeed())
+			Expect(authenticator.Authenticate(request, "fake-instance-id", "fake-settings")).To(Succeed())
+		})
+
+		It("authorizes instance tokens or readers with read policy 'instance_token'", func() {
+			registryStore.GetFound = true
+			registryStore.GetValue = `{"hash":"e1466187c844c921b622aff2197444cfdc2c87489f7a6e71cef47b31a1602ced"}`
+
+			authenticator := newReadAuthenticator(ReadAuthInstanceToken)
+			err = authenticator.Authenticate(request, "fake-instance-id", "fake-settings")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("missing instance token"))
+
+			request.Header.Set("Authorization", "Bearer fake-other-token")
+			err = authenticator.Authenticate(request, "fake-instance-id", "fake-settings")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("invalid instance token"))
+
+			request.Header.Set("Authorization", "Bearer fake-token")
+			Expect(authenticator.Authenticate(request, "fake-instance-id", "fake-settings")).To(Succeed())
+
+			request.SetBasicAuth("fake-reader", "fake-password")
+			Expect(authenticator.Authenticate(request, "fake-instance-id", "fake-settings")).To(Succeed())
+		})
+
+		It("authorizes instance IPs or readers with read policy 'ip'", func() {
+			authenticator := newReadAuthenticator(ReadAuthIP)
+			Expect(authenticator.Authenticate(request, "fake-instance-id", "fake-settings")).ToNot(Succeed())
+
+			request.RemoteAddr = "10.0.0.5:34567"
+			Expect(authenticator.Authenticate(request, "fake-instance-id", "fake-settings")).To(Succeed())
+		})
+
+		It("requires the instance settings only with read policy 'ip'", func() {
+			Expect(newReadAuthenticator(ReadAuthIP).(SettingsAuthenticator).RequiresSettings()).To(BeTrue())
+			Expect(newReadAuthenticator(ReadAuthBasic).(SettingsAuthenticator).RequiresSettings()).To(BeFalse())
+			Expect(newReadAuthenticator(ReadAuthInstanceToken).(SettingsAuthenticator).RequiresSettings()).To(BeFalse())
+		})
+
+		It("authorizes signed URLs if signed URLs are enabled", func() {
+			signedURLs, err := NewSignedURLs(SignedURLsConfig{Keys: []SigningKeyConfig{{ID: "fake-key-id", Secret: "fake-secret-fake-secret-fake-secret"}}})
+			Expect(err).ToNot(HaveOccurred())
+
+			signedPath, err := signedURLs.Sign("/instances/fake-instance-id/settings", time.Now().Add(time.Minute))
+			Expect(err).ToNot(HaveOccurred())
+			request, err = http.NewRequest("GET", signedPath, nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			readAuthConfig := config
+			readAuthConfig.ReadAuth = ReadAuthBasic
+			Expect(newReadAuthenticator(ReadAuthBasic).Authenticate(request, "fake-instance-id", "fake-settings")).ToNot(Succeed())
+
+			authenticator, err := NewReadAuthenticator(readAuthConfig, users, instanceIPResolver, instanceTokens, signedURLs)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(authenticator.Authenticate(request, "fake-instance-id", "fake-settings")).To(Succeed())
+		})
+
+		It("uses read policy 'ip' if the instance IP check is enabled", func() {
+			ipCheckConfig := config
+			ipCheckConfig.InstanceIPCheck.Enabled = true
+
+			authenticator, err := NewReadAuthenticator(ipCheckConfig, users, instanceIPResolver, instanceTokens, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(authenticator.Authenticate(request, "fake-instance-id", "fake-settings")).ToNot(Succeed())
+		})
+
+		It("returns error if read policy is not supported", func() {
+			readAuthConfig := config
+			readAuthConfig.ReadAuth = "fake-read-auth"
+
+			_, err = NewReadAuthenticator(readAuthConfig, users, instanceIPResolver, instanceTokens, nil)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Read policy 'fake-read-auth' not supported"))
+		})
+	})
+
+	Describe("BasicAuthenticator", func() {
+		It("refuses users without the required role", func() {
+			request.SetBasicAuth("fake-reader", "fake-password")
+
+			err = NewBasicAuthenticator(users, RoleWriter).Authenticate(request, "fake-instance-id", "")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("user 'fake-reader' with role 'reader' requires role 'writer'"))
+		})
+	})
+
+	Describe("IPAuthenticator", func() {
+		var authenticator IPAuthenticator
+
+		BeforeEach(func() {
+			authenticator = NewIPAuthenticator(instanceIPResolver)
+		})
+
+		It("authorizes requests coming from an instance IP", func() {
+			request.RemoteAddr = "10.0.0.5:34567"
+
+			Expect(authenticator.Authenticate(request, "fake-instance-id", "fake-settings")).To(Succeed())
+			Expect(instanceIPResolver.InstanceIPsInstanceID).To(Equal("fake-instance-id"))
+			Expect(instanceIPResolver.InstanceIPsSettingsJSON).To(Equal("fake-settings"))
+		})
+
+		It("refuses requests not coming from an instance IP", func() {
+			err = authenticator.Authenticate(request, "fake-instance-id", "fake-settings")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("IP '10.0.0.6' does not belong to instance"))
+		})
+
+		It("refuses requests if instance IPs cannot be resolved", func() {
+			request.RemoteAddr = "10.0.0.5:34567"
+			instanceIPResolver.InstanceIPsErr = errors.New("fake-resolver-error")
+
+			err = authenticator.Authenticate(request, "fake-instance-id", "fake-settings")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-resolver-error"))
+		})
+
+		It("refuses requests if instance IPs are not known", func() {
+			instanceIPResolver.InstanceIPsIPs = nil
+
+			err = authenticator.Authenticate(request, "fake-instance-id", "fake-settings")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("no instance IPs known"))
+		})
+	})
+})
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+
+	"github.com/frodenas/bosh-registry/server/store"
+)
+
+const backupHandlerLogTag = "RegistryServerBackupHandler"
+const backupPath = "/backup"
+
+type BackupHandler struct {
+	users         *Users
+	registryStore store.Store
+	eventBroker   *EventBroker
+	logger        boshlog.Logger
+}
+
+func NewBackupHandler(
+	users *Users,
+	registryStore store.Store,
+	eventBroker *EventBroker,
+	logger boshlog.Logger,
+) *BackupHandler {
+	return &BackupHandler{
+		users:         users,
+		registryStore: registryStore,
+		eventBroker:   eventBroker,
+		logger:        logger,
+	}
+}
+
+// BackupResponse contains the settings of every instance, and the hash of
+// their tokens. Replaying the events stream after LastEventID of Epoch brings
+// a copy of the backup up to date.
+type BackupResponse struct {
+	Epoch          string            `json:"epoch"`
+	LastEventID    uint64            `json:"last_event_id"`
+	Instances      map[string]string `json:"instances,omitempty"`
+	InstanceTokens map[string]string `json:"instance_tokens,omitempty"`
+	Status         string            `json:"status"`
+}
+
+func (bh *BackupHandler) HandleFunc(w http.ResponseWriter, req *http.Request) {
+	bh.logger.Debug(requestLogTag(backupHandlerLogTag, req), "Received %s %s from %s", req.Method, req.URL.Path, req.RemoteAddr)
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !bh.users.IsReplicationAuthorized(req) {
+		bh.logger.Debug(requestLogTag(backupHandlerLogTag, req), "Received unauthorized request")
+		w.Header().Add("WWW-Authenticate", `Basic realm="Bosh Registry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// Read the last event ID first: events published while reading the store
+	// are replayed by the events stream and applying them again is harmless.
+	lastEventID := bh.eventBroker.LastEventID()
+	instances, err := bh.registryStore.GetAll()
+	if err != nil {
+		bh.logger.Debug(requestLogTag(backupHandlerLogTag, req), "Failed to read settings: '%v'", err)
+		bh.writeJSON(w, http.StatusInternalServerError, BackupResponse{Status: "error"}, req)
+		return
+	}
+
+	instances, instanceTokens := splitInstanceTokens(instances)
+
+	bh.writeJSON(w, http.StatusOK, BackupResponse{
+		Epoch:          bh.eventBroker.Epoch(),
+		LastEventID:    lastEventID,
+		Instances:      instances,
+		InstanceTokens: instanceTokens,
+		Status:         "ok",
+	}, req)
+}
+
+func (bh *BackupHandler) writeJSON(w http.ResponseWriter, statusCode int, response BackupResponse, req *http.Request) {
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		bh.logger.Warn(requestLogTag(backupHandlerLogTag, req), "Failed to marshal backup response: '%s'", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(statusCode)
+	w.Write(responseJSON)
+}
@@ -0,0 +1,102 @@
+package server_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+	"golang.org/x/crypto/bcrypt"
+
+	storefakes "github.com/frodenas/bosh-registry/server/store/fakes"
+)
+
+var _ = Describe("BackupHandler", func() {
+	var (
+		err              error
+		responseRecorder *httptest.ResponseRecorder
+		request          *http.Request
+		registryStore    *storefakes.FakeStore
+		eventBroker      *EventBroker
+		backupHandler    *BackupHandler
+
+		logger = boshlog.NewLogger(boshlog.LevelNone)
+		config = Config{
+			Protocol: "http",
+			Address:  "fake-host",
+			Port:     5555,
+			Username: "fake-username",
+			Password: "fake-password",
+		}
+	)
+
+	BeforeEach(func() {
+		responseRecorder = httptest.NewRecorder()
+		registryStore = &storefakes.FakeStore{
+			GetAllValues: map[string]string{"fake-instance-id": "fake-settings"},
+		}
+		eventBroker = NewEventBroker(10, logger)
+		backupHandler = NewBackupHandler(newUsers(config), registryStore, eventBroker, logger)
+
+		eventBroker.Publish(NewEvent(EventTypeCreated, "fake-instance-id"))
+
+		request, err = http.NewRequest("GET", "/backup", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.SetBasicAuth("fake-username", "fake-password")
+	})
+
+	It("returns the settings of every instance and the last event ID", func() {
+		backupHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+		Expect(responseRecorder.Body.String()).To(Equal(`{"epoch":"` + eventBroker.Epoch() + `","last_event_id":1,"instances":{"fake-instance-id":"fake-settings"},"status":"ok"}`))
+	})
+
+	It("returns the instance tokens apart from the settings", func() {
+		registryStore.GetAllValues["tokens/fake-instance-id"] = `{"hash":"fake-hash"}`
+
+		backupHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+		Expect(responseRecorder.Body.String()).To(ContainSubstring(`"instances":{"fake-instance-id":"fake-settings"},"instance_tokens":{"fake-instance-id":"{\"hash\":\"fake-hash\"}"},`))
+	})
+
+	It("returns an Unauthorized error if request does not contain credentials", func() {
+		request.Header.Del("Authorization")
+
+		backupHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusUnauthorized))
+		Expect(registryStore.GetAllCalled).To(BeFalse())
+	})
+
+	It("returns an Unauthorized error to users without the replicator or admin role", func() {
+		readerPasswordHash, err := bcrypt.GenerateFromPassword([]byte("fake-reader-password"), bcrypt.MinCost)
+		Expect(err).ToNot(HaveOccurred())
+		readerConfig := config
+		readerConfig.Users = []UserConfig{{Name: "fake-reader", PasswordHash: string(readerPasswordHash), Role: RoleReader}}
+		backupHandler = NewBackupHandler(newUsers(readerConfig), registryStore, eventBroker, logger)
+		request.SetBasicAuth("fake-reader", "fake-reader-password")
+
+		backupHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusUnauthorized))
+		Expect(registryStore.GetAllCalled).To(BeFalse())
+	})
+
+	It("returns a Method Not Allowed error if method is not GET", func() {
+		request.Method = "PUT"
+
+		backupHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusMethodNotAllowed))
+	})
+
+	It("returns an Internal Server Error if store fails", func() {
+		registryStore.GetAllErr = errors.New("fake-get-all-error")
+
+		backupHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusInternalServerError))
+		Expect(responseRecorder.Body.String()).To(ContainSubstring("error"))
+	})
+})
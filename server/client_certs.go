@@ -0,0 +1,169 @@
+package server
+
+import (
+	"crypto/x509"
+	"net/http"
+	"path"
+	"strings"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+)
+
+// clientCertCNPlaceholder is replaced in instance ID patterns by the common
+// name of the certificate, so agents can be limited to their own settings.
+const clientCertCNPlaceholder = "{cn}"
+
+// ClientCertConfig maps the client certificates whose subject common name,
+// organizational unit and subject alternative name match the given patterns
+// (as in path.Match, empty patterns match everything) either to a role or to
+// read access to the settings of the instances whose ID matches InstanceID.
+type ClientCertConfig struct {
+	CN         string `json:"cn,omitempty"`
+	OU         string `json:"ou,omitempty"`
+	SAN        string `json:"san,omitempty"`
+	Role       string `json:"role,omitempty"`
+	InstanceID string `json:"instance_id,omitempty"`
+}
+
+func (c ClientCertConfig) Validate() error {
+	if c.CN == "" && c.OU == "" && c.SAN == "" {
+		return bosherr.Error("Must provide a CN, OU or SAN pattern")
+	}
+
+	for _, pattern := range []string{c.CN, c.OU, c.SAN, strings.Replace(c.InstanceID, clientCertCNPlaceholder, "", -1)} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return bosherr.WrapErrorf(err, "Must provide valid patterns, got '%s'", pattern)
+		}
+	}
+
+	if (c.Role == "") == (c.InstanceID == "") {
+		return bosherr.Error("Must provide either a Role or an InstanceID pattern")
+	}
+
+	if _, found := roleLevels[c.Role]; c.Role != "" && !found {
+		return bosherr.Errorf("Must provide a valid Role ('%s', '%s', '%s' or '%s'), got '%s'", RoleReader, RoleReplicator, RoleWriter, RoleAdmin, c.Role)
+	}
+
+	return nil
+}
+
+func (c ClientCertConfig) matches(cert *x509.Certificate) bool {
+	if c.CN != "" && !matchesPattern(c.CN, cert.Subject.CommonName) {
+		return false
+	}
+
+	if c.OU != "" && !matchesAnyPattern(c.OU, cert.Subject.OrganizationalUnit) {
+		return false
+	}
+
+	if c.SAN != "" && !matchesAnyPattern(c.SAN, certificateSANs(cert)) {
+		return false
+	}
+
+	return true
+}
+
+func (c ClientCertConfig) matchesInstance(cert *x509.Certificate, instanceID string) bool {
+	pattern := strings.Replace(c.InstanceID, clientCertCNPlaceholder, escapePattern(cert.Subject.CommonName), -1)
+	return matchesPattern(pattern, instanceID)
+}
+
+// ClientCerts authorizes verified client certificates by the first matching
+// rule.
+type ClientCerts []ClientCertConfig
+
+func NewClientCerts(configs []ClientCertConfig) (ClientCerts, error) {
+	for _, config := range configs {
+		if err := config.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return ClientCerts(configs), nil
+}
+
+// Role returns the identity and role of the verified client certificate in
+// the request.
+func (c ClientCerts) Role(req *http.Request) (string, string, bool) {
+	cert, found := verifiedClientCert(req)
+	if !found {
+		return "", "", false
+	}
+
+	for _, rule := range c {
+		if rule.Role != "" && rule.matches(cert) {
+			return clientCertName(cert), rule.Role, true
+		}
+	}
+
+	return "", "", false
+}
+
+// AuthorizeInstance returns if the verified client certificate in the request
+// can read the settings of the instance.
+func (c ClientCerts) AuthorizeInstance(req *http.Request, instanceID string) error {
+	cert, found := verifiedClientCert(req)
+	if !found {
+		return bosherr.Error("missing verified client certificate")
+	}
+
+	for _, rule := range c {
+		if rule.InstanceID != "" && rule.matches(cert) && rule.matchesInstance(cert, instanceID) {
+			return nil
+		}
+	}
+
+	return bosherr.Errorf("client certificate '%s' not authorized for instance", clientCertName(cert))
+}
+
+// verifiedClientCert ignores the certificate of requests forwarded by a
+// cluster follower, as it is the one of the follower and not of the client.
+func verifiedClientCert(req *http.Request) (*x509.Certificate, bool) {
+	if req.Header.Get(clusterForwardedHeader) != "" {
+		return nil, false
+	}
+
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+
+	return req.TLS.VerifiedChains[0][0], true
+}
+
+func clientCertName(cert *x509.Certificate) string {
+	return "CN=" + cert.Subject.CommonName
+}
+
+func certificateSANs(cert *x509.Certificate) []string {
+	var sans []string
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+
+	return sans
+}
+
+func matchesPattern(pattern string, value string) bool {
+	matched, err := path.Match(pattern, value)
+	return err == nil && matched
+}
+
+func matchesAnyPattern(pattern string, values []string) bool {
+	for _, value := range values {
+		if matchesPattern(pattern, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func escapePattern(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`)
+	return replacer.Replace(value)
+}
@@ -0,0 +1,157 @@
+package server_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+)
+
+func withClientCert(request *http.Request, cert *x509.Certificate) *http.Request {
+	request.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	return request
+}
+
+var _ = Describe("ClientCertConfig", func() {
+	var config ClientCertConfig
+
+	BeforeEach(func() {
+		config = ClientCertConfig{CN: "fake-cpi", Role: RoleWriter}
+	})
+
+	Describe("Validate", func() {
+		It("does not return error if all fields are valid", func() {
+			Expect(config.Validate()).To(Succeed())
+		})
+
+		It("returns error if there are no patterns", func() {
+			config.CN = ""
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a CN, OU or SAN pattern"))
+		})
+
+		It("returns error if a pattern is not valid", func() {
+			config.OU = "fake-ou["
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide valid patterns, got 'fake-ou['"))
+		})
+
+		It("returns error if both Role and InstanceID are provided", func() {
+			config.InstanceID = "{cn}"
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide either a Role or an InstanceID pattern"))
+		})
+
+		It("returns error if neither Role nor InstanceID are provided", func() {
+			config.Role = ""
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide either a Role or an InstanceID pattern"))
+		})
+
+		It("returns error if Role is not valid", func() {
+			config.Role = "fake-role"
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a valid Role"))
+		})
+	})
+})
+
+var _ = Describe("ClientCerts", func() {
+	var (
+		err         error
+		request     *http.Request
+		clientCerts ClientCerts
+
+		cpiCert = &x509.Certificate{
+			Subject:  pkix.Name{CommonName: "fake-cpi", OrganizationalUnit: []string{"fake-director"}},
+			DNSNames: []string{"cpi.fake-domain"},
+		}
+		agentCert = &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "fake-instance-id", OrganizationalUnit: []string{"fake-agents"}},
+			IPAddresses: []net.IP{net.ParseIP("10.0.0.5")},
+		}
+	)
+
+	BeforeEach(func() {
+		clientCerts, err = NewClientCerts([]ClientCertConfig{
+			{OU: "fake-director", SAN: "*.fake-domain", Role: RoleWriter},
+			{OU: "fake-agents", InstanceID: "{cn}"},
+			{SAN: "10.0.1.*", InstanceID: "fake-shared-*"},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		request, err = http.NewRequest("GET", "/instances/fake-instance-id/settings", nil)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("returns error if a rule is not valid", func() {
+		_, err = NewClientCerts([]ClientCertConfig{{CN: "fake-cpi"}})
+		Expect(err).To(HaveOccurred())
+	})
+
+	Describe("Role", func() {
+		It("returns the role of the first matching rule", func() {
+			name, role, found := clientCerts.Role(withClientCert(request, cpiCert))
+			Expect(found).To(BeTrue())
+			Expect(name).To(Equal("CN=fake-cpi"))
+			Expect(role).To(Equal(RoleWriter))
+		})
+
+		It("does not return a role if no rule with role matches", func() {
+			_, _, found := clientCerts.Role(withClientCert(request, agentCert))
+			Expect(found).To(BeFalse())
+		})
+
+		It("does not return a role without a verified client certificate", func() {
+			_, _, found := clientCerts.Role(request)
+			Expect(found).To(BeFalse())
+		})
+	})
+
+	Describe("AuthorizeInstance", func() {
+		It("authorizes certificates whose common name is the instance ID", func() {
+			Expect(clientCerts.AuthorizeInstance(withClientCert(request, agentCert), "fake-instance-id")).To(Succeed())
+
+			err = clientCerts.AuthorizeInstance(withClientCert(request, agentCert), "fake-other-instance-id")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("client certificate 'CN=fake-instance-id' not authorized for instance"))
+		})
+
+		It("authorizes certificates matching the instance ID pattern", func() {
+			sharedCert := &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("10.0.1.5")}}
+			Expect(clientCerts.AuthorizeInstance(withClientCert(request, sharedCert), "fake-shared-instance-id")).To(Succeed())
+			Expect(clientCerts.AuthorizeInstance(withClientCert(request, sharedCert), "fake-instance-id")).ToNot(Succeed())
+		})
+
+		It("does not treat the common name as a pattern", func() {
+			wildcardCert := &x509.Certificate{Subject: pkix.Name{CommonName: "*", OrganizationalUnit: []string{"fake-agents"}}}
+			Expect(clientCerts.AuthorizeInstance(withClientCert(request, wildcardCert), "fake-instance-id")).ToNot(Succeed())
+		})
+
+		It("does not authorize certificates with a role", func() {
+			Expect(clientCerts.AuthorizeInstance(withClientCert(request, cpiCert), "fake-instance-id")).ToNot(Succeed())
+		})
+
+		It("returns error without a verified client certificate", func() {
+			err = clientCerts.AuthorizeInstance(request, "fake-instance-id")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("missing verified client certificate"))
+		})
+	})
+})
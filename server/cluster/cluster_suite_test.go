@@ -0,0 +1,13 @@
+package cluster_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestRegistryCluster(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Registry Cluster Suite")
+}
@@ -0,0 +1,88 @@
+package cluster
+
+import (
+	"net"
+	"net/url"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+)
+
+const (
+	ReadConsistencyLocal        = "local"
+	ReadConsistencyLinearizable = "linearizable"
+
+	FollowerWritesForward  = "forward"
+	FollowerWritesRedirect = "redirect"
+)
+
+type Config struct {
+	NodeID           string `json:"node_id,omitempty"`
+	BindAddress      string `json:"bind_address,omitempty"`
+	AdvertiseAddress string `json:"advertise_address,omitempty"`
+	APIURL           string `json:"api_url,omitempty"`
+	DataDir          string `json:"data_dir,omitempty"`
+	Bootstrap        bool   `json:"bootstrap,omitempty"`
+	ReadConsistency  string `json:"read_consistency,omitempty"`
+	FollowerWrites   string `json:"follower_writes,omitempty"`
+}
+
+func (c Config) Enabled() bool {
+	return c.NodeID != ""
+}
+
+func (c Config) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+
+	if c.BindAddress == "" {
+		return bosherr.Error("Must provide a non-empty BindAddress")
+	}
+
+	if _, _, err := net.SplitHostPort(c.BindAddress); err != nil {
+		return bosherr.WrapErrorf(err, "Must provide a valid BindAddress, got '%s'", c.BindAddress)
+	}
+
+	if c.AdvertiseAddress != "" {
+		if _, _, err := net.SplitHostPort(c.AdvertiseAddress); err != nil {
+			return bosherr.WrapErrorf(err, "Must provide a valid AdvertiseAddress, got '%s'", c.AdvertiseAddress)
+		}
+	}
+
+	if c.APIURL == "" {
+		return bosherr.Error("Must provide a non-empty APIURL")
+	}
+
+	apiURL, err := url.Parse(c.APIURL)
+	if err != nil || (apiURL.Scheme != "http" && apiURL.Scheme != "https") || apiURL.Host == "" {
+		return bosherr.Errorf("Must provide a valid http or https APIURL, got '%s'", c.APIURL)
+	}
+
+	if c.DataDir == "" {
+		return bosherr.Error("Must provide a non-empty DataDir")
+	}
+
+	switch c.ReadConsistency {
+	case "", ReadConsistencyLocal, ReadConsistencyLinearizable:
+	default:
+		return bosherr.Errorf("Must provide a valid ReadConsistency ('%s' or '%s'), got '%s'", ReadConsistencyLocal, ReadConsistencyLinearizable, c.ReadConsistency)
+	}
+
+	switch c.FollowerWrites {
+	case "", FollowerWritesForward, FollowerWritesRedirect:
+	default:
+		return bosherr.Errorf("Must provide a valid FollowerWrites ('%s' or '%s'), got '%s'", FollowerWritesForward, FollowerWritesRedirect, c.FollowerWrites)
+	}
+
+	return nil
+}
+
+func (c Config) LinearizableReads() bool {
+	return c.ReadConsistency == ReadConsistencyLinearizable
+}
+
+// RedirectFollowerWrites returns if followers redirect writes to the leader,
+// the default, rather than forwarding them.
+func (c Config) RedirectFollowerWrites() bool {
+	return c.FollowerWrites != FollowerWritesForward
+}
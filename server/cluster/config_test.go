@@ -0,0 +1,112 @@
+package cluster_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server/cluster"
+)
+
+var _ = Describe("Config", func() {
+	var (
+		options Config
+
+		validOptions = Config{
+			NodeID:           "fake-node-id",
+			BindAddress:      "0.0.0.0:25778",
+			AdvertiseAddress: "10.0.0.1:25778",
+			APIURL:           "https://10.0.0.1:25777",
+			DataDir:          "/var/vcap/store/registry",
+			ReadConsistency:  ReadConsistencyLinearizable,
+			FollowerWrites:   FollowerWritesRedirect,
+		}
+	)
+
+	Describe("Validate", func() {
+		BeforeEach(func() {
+			options = validOptions
+		})
+
+		It("does not return error if all fields are valid", func() {
+			err := options.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("does not return error if cluster is not enabled", func() {
+			err := Config{}.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns error if BindAddress is empty", func() {
+			options.BindAddress = ""
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a non-empty BindAddress"))
+		})
+
+		It("returns error if BindAddress is not valid", func() {
+			options.BindAddress = "fake-address"
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a valid BindAddress"))
+		})
+
+		It("returns error if AdvertiseAddress is not valid", func() {
+			options.AdvertiseAddress = "fake-address"
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a valid AdvertiseAddress"))
+		})
+
+		It("returns error if APIURL is empty", func() {
+			options.APIURL = ""
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a non-empty APIURL"))
+		})
+
+		It("returns error if APIURL is not valid", func() {
+			options.APIURL = "10.0.0.1:25777"
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a valid http or https APIURL"))
+		})
+
+		It("returns error if DataDir is empty", func() {
+			options.DataDir = ""
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a non-empty DataDir"))
+		})
+
+		It("returns error if ReadConsistency is not valid", func() {
+			options.ReadConsistency = "fake-consistency"
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a valid ReadConsistency"))
+		})
+
+		It("returns error if FollowerWrites is not valid", func() {
+			options.FollowerWrites = "fake-mode"
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a valid FollowerWrites"))
+		})
+	})
+
+	Describe("RedirectFollowerWrites", func() {
+		It("redirects follower writes by default", func() {
+			Expect(Config{}.RedirectFollowerWrites()).To(BeTrue())
+			Expect(Config{FollowerWrites: FollowerWritesRedirect}.RedirectFollowerWrites()).To(BeTrue())
+			Expect(Config{FollowerWrites: FollowerWritesForward}.RedirectFollowerWrites()).To(BeFalse())
+		})
+	})
+})
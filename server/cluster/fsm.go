@@ -0,0 +1,206 @@
+package cluster
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+	"github.com/hashicorp/raft"
+
+	"github.com/frodenas/bosh-registry/server/store"
+)
+
+const fsmLogTag = "RegistryClusterFSM"
+
+const (
+	commandSave         = "save"
+	commandDelete       = "delete"
+	commandRegisterNode = "register_node"
+)
+
+type command struct {
+	Op     string `json:"op"`
+	Key    string `json:"key,omitempty"`
+	Value  string `json:"value,omitempty"`
+	NodeID string `json:"node_id,omitempty"`
+	APIURL string `json:"api_url,omitempty"`
+}
+
+type fsmState struct {
+	Settings map[string]string `json:"settings"`
+	APIURLs  map[string]string `json:"api_urls"`
+}
+
+// Change is a save or a delete of a key applied to the local store of a node.
+type Change struct {
+	Key     string
+	Value   string
+	Created bool
+	Deleted bool
+}
+
+// ChangeObserver is told about the changes applied to the local store of the
+// node, on every node of the cluster. It must not block.
+type ChangeObserver interface {
+	ObserveChange(Change)
+}
+
+// fsm applies the replicated commands to the node's local store. Besides the
+// settings, it keeps the API URL of every node, so followers know where to
+// forward writes to.
+type fsm struct {
+	localStore     store.Store
+	changeObserver ChangeObserver
+	logger         boshlog.Logger
+
+	mutex   sync.RWMutex
+	apiURLs map[string]string
+}
+
+func newFSM(localStore store.Store, changeObserver ChangeObserver, logger boshlog.Logger) *fsm {
+	return &fsm{
+		localStore:     localStore,
+		changeObserver: changeObserver,
+		logger:         logger,
+		apiURLs:        map[string]string{},
+	}
+}
+
+func (f *fsm) Apply(log *raft.Log) interface{} {
+	var cmd command
+	if err := json.Unmarshal(log.Data, &cmd); err != nil {
+		return bosherr.WrapErrorf(err, "Unmarshalling command at index %d", log.Index)
+	}
+
+	switch cmd.Op {
+	case commandSave:
+		_, exists, err := f.localStore.Get(cmd.Key)
+		if err != nil {
+			return bosherr.WrapErrorf(err, "Reading key '%s' at index %d", cmd.Key, log.Index)
+		}
+		if err = f.localStore.Save(cmd.Key, cmd.Value); err != nil {
+			return err
+		}
+		f.observeChange(Change{Key: cmd.Key, Value: cmd.Value, Created: !exists})
+		return nil
+	case commandDelete:
+		if err := f.localStore.Delete(cmd.Key); err != nil {
+			return err
+		}
+		f.observeChange(Change{Key: cmd.Key, Deleted: true})
+		return nil
+	case commandRegisterNode:
+		f.logger.Debug(fsmLogTag, "Registering node '%s' API URL '%s' at index %d", cmd.NodeID, cmd.APIURL, log.Index)
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		if cmd.APIURL == "" {
+			delete(f.apiURLs, cmd.NodeID)
+		} else {
+			f.apiURLs[cmd.NodeID] = cmd.APIURL
+		}
+		return nil
+	}
+
+	return bosherr.Errorf("Unknown command '%s' at index %d", cmd.Op, log.Index)
+}
+
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	settings, err := f.localStore.GetAll()
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Reading settings for snapshot")
+	}
+
+	return &fsmSnapshot{
+		state: fsmState{
+			Settings: settings,
+			APIURLs:  f.copyAPIURLs(),
+		},
+	}, nil
+}
+
+func (f *fsm) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+
+	var state fsmState
+	if err := json.NewDecoder(snapshot).Decode(&state); err != nil {
+		return bosherr.WrapError(err, "Decoding snapshot")
+	}
+
+	existingSettings, err := f.localStore.GetAll()
+	if err != nil {
+		return bosherr.WrapError(err, "Reading settings before restoring snapshot")
+	}
+
+	for key := range existingSettings {
+		if _, found := state.Settings[key]; !found {
+			if err = f.localStore.Delete(key); err != nil {
+				return bosherr.WrapErrorf(err, "Deleting key '%s' while restoring snapshot", key)
+			}
+			f.observeChange(Change{Key: key, Deleted: true})
+		}
+	}
+
+	for key, value := range state.Settings {
+		existingValue, exists := existingSettings[key]
+		if exists && existingValue == value {
+			continue
+		}
+
+		if err = f.localStore.Save(key, value); err != nil {
+			return bosherr.WrapErrorf(err, "Saving key '%s' while restoring snapshot", key)
+		}
+		f.observeChange(Change{Key: key, Value: value, Created: !exists})
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.apiURLs = state.APIURLs
+	if f.apiURLs == nil {
+		f.apiURLs = map[string]string{}
+	}
+
+	f.logger.Debug(fsmLogTag, "Restored snapshot with %d keys", len(state.Settings))
+	return nil
+}
+
+func (f *fsm) observeChange(change Change) {
+	if f.changeObserver != nil {
+		f.changeObserver.ObserveChange(change)
+	}
+}
+
+func (f *fsm) apiURL(nodeID string) string {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.apiURLs[nodeID]
+}
+
+func (f *fsm) copyAPIURLs() map[string]string {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	apiURLs := map[string]string{}
+	for nodeID, apiURL := range f.apiURLs {
+		apiURLs[nodeID] = apiURL
+	}
+
+	return apiURLs
+}
+
+type fsmSnapshot struct {
+	state fsmState
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s.state); err != nil {
+		sink.Cancel()
+		return bosherr.WrapError(err, "Encoding snapshot")
+	}
+
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {}
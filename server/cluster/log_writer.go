@@ -0,0 +1,35 @@
+package cluster
+
+import (
+	"strings"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+const raftLogTag = "RegistryClusterRaft"
+
+// logWriter sends the Raft library log lines to the registry logger.
+type logWriter struct {
+	logger boshlog.Logger
+}
+
+func newLogWriter(logger boshlog.Logger) logWriter {
+	return logWriter{logger: logger}
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+
+	switch {
+	case strings.Contains(line, "[ERR]"):
+		w.logger.Error(raftLogTag, "%s", line)
+	case strings.Contains(line, "[WARN]"):
+		w.logger.Warn(raftLogTag, "%s", line)
+	case strings.Contains(line, "[INFO]"):
+		w.logger.Info(raftLogTag, "%s", line)
+	default:
+		w.logger.Debug(raftLogTag, "%s", line)
+	}
+
+	return len(p), nil
+}
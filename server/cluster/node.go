@@ -0,0 +1,342 @@
+package cluster
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/raft-boltdb"
+
+	"github.com/frodenas/bosh-registry/server/store"
+)
+
+const nodeLogTag = "RegistryClusterNode"
+const nodeRaftDBFile = "raft.db"
+const nodeRaftLogCacheSize = 512
+const nodeSnapshotsRetained = 2
+const nodeTransportMaxPool = 3
+const nodeTransportTimeout = 10 * time.Second
+const nodeApplyTimeout = 10 * time.Second
+const nodeMembershipTimeout = 30 * time.Second
+
+var ErrNotLeader = bosherr.Error("Node is not the cluster leader")
+
+type Member struct {
+	ID          string `json:"id"`
+	RaftAddress string `json:"raft_address"`
+	APIURL      string `json:"api_url,omitempty"`
+	Leader      bool   `json:"leader"`
+}
+
+type Node struct {
+	config    Config
+	logger    boshlog.Logger
+	fsm       *fsm
+	raft      *raft.Raft
+	transport *raft.NetworkTransport
+	raftStore *raftboltdb.BoltStore
+	leaderCh  chan bool
+	stopCh    chan struct{}
+}
+
+// NewNode starts a cluster node replicating the settings into the local
+// store. The change observer, when not nil, is told about every change
+// applied to it, including those replayed when the node starts.
+func NewNode(
+	config Config,
+	localStore store.Store,
+	changeObserver ChangeObserver,
+	logger boshlog.Logger,
+) (*Node, error) {
+	if err := os.MkdirAll(config.DataDir, 0700); err != nil {
+		return nil, bosherr.WrapErrorf(err, "Creating cluster data directory '%s'", config.DataDir)
+	}
+
+	raftLogger := log.New(newLogWriter(logger), "", 0)
+
+	var advertiseAddress net.Addr
+	if config.AdvertiseAddress != "" {
+		tcpAddress, err := net.ResolveTCPAddr("tcp", config.AdvertiseAddress)
+		if err != nil {
+			return nil, bosherr.WrapErrorf(err, "Resolving cluster advertise address '%s'", config.AdvertiseAddress)
+		}
+		advertiseAddress = tcpAddress
+	}
+
+	transport, err := raft.NewTCPTransportWithLogger(config.BindAddress, advertiseAddress, nodeTransportMaxPool, nodeTransportTimeout, raftLogger)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Starting cluster transport at '%s'", config.BindAddress)
+	}
+
+	raftStore, err := raftboltdb.NewBoltStore(filepath.Join(config.DataDir, nodeRaftDBFile))
+	if err != nil {
+		transport.Close()
+		return nil, bosherr.WrapError(err, "Opening cluster log store")
+	}
+
+	node := &Node{
+		config:    config,
+		logger:    logger,
+		fsm:       newFSM(localStore, changeObserver, logger),
+		transport: transport,
+		raftStore: raftStore,
+		leaderCh:  make(chan bool, 1),
+		stopCh:    make(chan struct{}),
+	}
+
+	if err = node.start(raftLogger); err != nil {
+		raftStore.Close()
+		transport.Close()
+		return nil, err
+	}
+
+	return node, nil
+}
+
+func (n *Node) start(raftLogger *log.Logger) error {
+	logStore, err := raft.NewLogCache(nodeRaftLogCacheSize, n.raftStore)
+	if err != nil {
+		return bosherr.WrapError(err, "Creating cluster log cache")
+	}
+
+	snapshotStore, err := raft.NewFileSnapshotStoreWithLogger(n.config.DataDir, nodeSnapshotsRetained, raftLogger)
+	if err != nil {
+		return bosherr.WrapError(err, "Creating cluster snapshot store")
+	}
+
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = raft.ServerID(n.config.NodeID)
+	raftConfig.Logger = raftLogger
+	raftConfig.NotifyCh = n.leaderCh
+
+	if n.config.Bootstrap {
+		hasState, err := raft.HasExistingState(logStore, n.raftStore, snapshotStore)
+		if err != nil {
+			return bosherr.WrapError(err, "Checking existing cluster state")
+		}
+
+		if !hasState {
+			n.logger.Info(nodeLogTag, "Bootstrapping cluster with node '%s'", n.config.NodeID)
+			configuration := raft.Configuration{
+				Servers: []raft.Server{
+					{ID: raftConfig.LocalID, Address: n.transport.LocalAddr()},
+				},
+			}
+			if err = raft.BootstrapCluster(raftConfig, logStore, n.raftStore, snapshotStore, n.transport, configuration); err != nil {
+				return bosherr.WrapError(err, "Bootstrapping cluster")
+			}
+		}
+	}
+
+	n.raft, err = raft.NewRaft(raftConfig, n.fsm, logStore, n.raftStore, snapshotStore, n.transport)
+	if err != nil {
+		return bosherr.WrapError(err, "Starting cluster node")
+	}
+
+	go n.watchLeadership()
+
+	n.logger.Debug(nodeLogTag, "Started cluster node '%s' at '%s'", n.config.NodeID, n.transport.LocalAddr())
+	return nil
+}
+
+func (n *Node) Config() Config {
+	return n.config
+}
+
+func (n *Node) Store() store.Store {
+	return &Store{node: n}
+}
+
+// LocalStore returns the store the replicated changes are applied to, which
+// answers without reaching the leader.
+func (n *Node) LocalStore() store.Store {
+	return n.fsm.localStore
+}
+
+func (n *Node) RaftAddress() string {
+	return string(n.transport.LocalAddr())
+}
+
+func (n *Node) IsLeader() bool {
+	return n.raft.State() == raft.Leader
+}
+
+func (n *Node) Leader() (Member, bool) {
+	leaderAddress := n.raft.Leader()
+	if leaderAddress == "" {
+		return Member{}, false
+	}
+
+	members, err := n.Members()
+	if err != nil {
+		return Member{}, false
+	}
+
+	for _, member := range members {
+		if member.RaftAddress == string(leaderAddress) {
+			return member, true
+		}
+	}
+
+	return Member{}, false
+}
+
+func (n *Node) Members() ([]Member, error) {
+	future := n.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, bosherr.WrapError(err, "Reading cluster configuration")
+	}
+
+	leaderAddress := n.raft.Leader()
+
+	var members []Member
+	for _, server := range future.Configuration().Servers {
+		members = append(members, Member{
+			ID:          string(server.ID),
+			RaftAddress: string(server.Address),
+			APIURL:      n.fsm.apiURL(string(server.ID)),
+			Leader:      server.Address == leaderAddress,
+		})
+	}
+
+	return members, nil
+}
+
+// Join adds a voting member to the cluster. It must be called on the leader.
+func (n *Node) Join(member Member) error {
+	if member.ID == "" || member.RaftAddress == "" || member.APIURL == "" {
+		return bosherr.Error("Must provide a non-empty member ID, Raft address and API URL")
+	}
+
+	if !n.IsLeader() {
+		return ErrNotLeader
+	}
+
+	n.logger.Info(nodeLogTag, "Adding node '%s' at '%s' to the cluster", member.ID, member.RaftAddress)
+	future := n.raft.AddVoter(raft.ServerID(member.ID), raft.ServerAddress(member.RaftAddress), 0, nodeMembershipTimeout)
+	if err := future.Error(); err != nil {
+		return n.wrapRaftError(err, "Adding node '%s' to the cluster", member.ID)
+	}
+
+	return n.apply(command{Op: commandRegisterNode, NodeID: member.ID, APIURL: member.APIURL})
+}
+
+// Remove removes a member from the cluster. It must be called on the leader.
+func (n *Node) Remove(id string) error {
+	if !n.IsLeader() {
+		return ErrNotLeader
+	}
+
+	n.logger.Info(nodeLogTag, "Removing node '%s' from the cluster", id)
+	future := n.raft.RemoveServer(raft.ServerID(id), 0, nodeMembershipTimeout)
+	if err := future.Error(); err != nil {
+		return n.wrapRaftError(err, "Removing node '%s' from the cluster", id)
+	}
+
+	if id == n.config.NodeID {
+		return nil
+	}
+
+	return n.apply(command{Op: commandRegisterNode, NodeID: id})
+}
+
+// VerifyLeader confirms with a quorum of the cluster that this node is still
+// the leader.
+func (n *Node) VerifyLeader() error {
+	if err := n.raft.VerifyLeader().Error(); err != nil {
+		return n.wrapRaftError(err, "Verifying cluster leadership")
+	}
+
+	return nil
+}
+
+func (n *Node) Shutdown() error {
+	n.logger.Debug(nodeLogTag, "Shutting down cluster node '%s'", n.config.NodeID)
+	close(n.stopCh)
+	if err := n.raft.Shutdown().Error(); err != nil {
+		return bosherr.WrapError(err, "Shutting down cluster node")
+	}
+
+	if err := n.transport.Close(); err != nil {
+		return bosherr.WrapError(err, "Closing cluster transport")
+	}
+
+	if err := n.raftStore.Close(); err != nil {
+		return bosherr.WrapError(err, "Closing cluster log store")
+	}
+
+	if err := n.fsm.localStore.Close(); err != nil {
+		return bosherr.WrapError(err, "Closing cluster local store")
+	}
+
+	return nil
+}
+
+func (n *Node) apply(cmd command) error {
+	if !n.IsLeader() {
+		return ErrNotLeader
+	}
+
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Marshalling '%s' command", cmd.Op)
+	}
+
+	future := n.raft.Apply(data, nodeApplyTimeout)
+	if err = future.Error(); err != nil {
+		return n.wrapRaftError(err, "Applying '%s' command", cmd.Op)
+	}
+
+	if err, ok := future.Response().(error); ok && err != nil {
+		return bosherr.WrapErrorf(err, "Applying '%s' command", cmd.Op)
+	}
+
+	return nil
+}
+
+// watchLeadership registers the node API URL every time the node becomes the
+// leader, so it is known by the rest of the cluster.
+func (n *Node) watchLeadership() {
+	for {
+		select {
+		case isLeader := <-n.leaderCh:
+			if isLeader {
+				n.logger.Info(nodeLogTag, "Node '%s' is the cluster leader", n.config.NodeID)
+				go n.registerAPIURL()
+			} else {
+				n.logger.Info(nodeLogTag, "Node '%s' is no longer the cluster leader", n.config.NodeID)
+			}
+		case <-n.stopCh:
+			return
+		}
+	}
+}
+
+func (n *Node) registerAPIURL() {
+	if err := n.raft.Barrier(nodeApplyTimeout).Error(); err != nil {
+		n.logger.Error(nodeLogTag, "Waiting for pending cluster commands: %s", err.Error())
+		return
+	}
+
+	if n.fsm.apiURL(n.config.NodeID) == n.config.APIURL {
+		return
+	}
+
+	if err := n.apply(command{Op: commandRegisterNode, NodeID: n.config.NodeID, APIURL: n.config.APIURL}); err != nil {
+		n.logger.Error(nodeLogTag, "Registering node API URL: %s", err.Error())
+	}
+}
+
+func (n *Node) wrapRaftError(err error, msg string, args ...interface{}) error {
+	if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+		return ErrNotLeader
+	}
+
+	return bosherr.WrapErrorf(err, msg, args...)
+}
@@ -0,0 +1,309 @@
+package cluster_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server/cluster"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+
+	"github.com/frodenas/bosh-registry/server/store"
+)
+
+type changeRecorder struct {
+	mutex   sync.Mutex
+	changes []Change
+}
+
+func (r *changeRecorder) ObserveChange(change Change) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.changes = append(r.changes, change)
+}
+
+func (r *changeRecorder) Changes() []Change {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]Change{}, r.changes...)
+}
+
+var _ = Describe("Node", func() {
+	var (
+		err       error
+		tempDir   string
+		nodes     map[string]*Node
+		stores    map[string]store.Store
+		recorders map[string]*changeRecorder
+		stopped   map[string]bool
+
+		logger = boshlog.NewLogger(boshlog.LevelNone)
+	)
+
+	startNode := func(id string, config Config) *Node {
+		config.NodeID = id
+		config.BindAddress = "127.0.0.1:0"
+		config.APIURL = fmt.Sprintf("http://%s.fake-host:25777", id)
+		config.DataDir = filepath.Join(tempDir, id)
+
+		err = os.MkdirAll(config.DataDir, 0700)
+		Expect(err).ToNot(HaveOccurred())
+
+		localStore := store.NewBoltStore(store.BoltConfig{DBFile: filepath.Join(config.DataDir, "registry.db")}, logger)
+
+		recorder := &changeRecorder{}
+		node, err := NewNode(config, localStore, recorder, logger)
+		Expect(err).ToNot(HaveOccurred())
+
+		nodes[id] = node
+		stores[id] = localStore
+		recorders[id] = recorder
+		return node
+	}
+
+	leaderOf := func(ids ...string) func() string {
+		return func() string {
+			for _, id := range ids {
+				if !stopped[id] && nodes[id].IsLeader() {
+					return id
+				}
+			}
+			return ""
+		}
+	}
+
+	localValue := func(id string, key string) func() string {
+		return func() string {
+			value, _, _ := stores[id].Get(key)
+			return value
+		}
+	}
+
+	BeforeEach(func() {
+		tempDir, err = ioutil.TempDir("", "registry-cluster")
+		Expect(err).ToNot(HaveOccurred())
+
+		nodes = map[string]*Node{}
+		stores = map[string]store.Store{}
+		recorders = map[string]*changeRecorder{}
+		stopped = map[string]bool{}
+	})
+
+	AfterEach(func() {
+		for id, node := range nodes {
+			if !stopped[id] {
+				node.Shutdown()
+			}
+		}
+		os.RemoveAll(tempDir)
+	})
+
+	Context("with a single bootstrapped node", func() {
+		var node *Node
+
+		BeforeEach(func() {
+			node = startNode("node-1", Config{Bootstrap: true})
+			Eventually(node.IsLeader, 10*time.Second).Should(BeTrue())
+		})
+
+		It("saves, reads and deletes settings", func() {
+			err = node.Store().Save("fake-instance-id", "fake-settings")
+			Expect(err).ToNot(HaveOccurred())
+
+			value, found, err := node.Store().Get("fake-instance-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found).To(BeTrue())
+			Expect(value).To(Equal("fake-settings"))
+
+			err = node.Store().Delete("fake-instance-id")
+			Expect(err).ToNot(HaveOccurred())
+
+			_, found, err = node.Store().Get("fake-instance-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found).To(BeFalse())
+		})
+
+		It("registers its API URL", func() {
+			Eventually(func() string {
+				leader, _ := node.Leader()
+				return leader.APIURL
+			}).Should(Equal("http://node-1.fake-host:25777"))
+		})
+
+		It("recovers its state after a restart", func() {
+			err = node.Store().Save("fake-instance-id", "fake-settings")
+			Expect(err).ToNot(HaveOccurred())
+
+			err = node.Shutdown()
+			Expect(err).ToNot(HaveOccurred())
+
+			node = startNode("node-1", Config{Bootstrap: true})
+			Eventually(node.IsLeader, 10*time.Second).Should(BeTrue())
+
+			value, found, err := node.Store().Get("fake-instance-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found).To(BeTrue())
+			Expect(value).To(Equal("fake-settings"))
+		})
+	})
+
+	Context("with three nodes", func() {
+		BeforeEach(func() {
+			leader := startNode("node-1", Config{Bootstrap: true})
+			Eventually(leader.IsLeader, 10*time.Second).Should(BeTrue())
+
+			for _, id := range []string{"node-2", "node-3"} {
+				node := startNode(id, Config{})
+				err = leader.Join(Member{
+					ID:          id,
+					RaftAddress: node.RaftAddress(),
+					APIURL:      fmt.Sprintf("http://%s.fake-host:25777", id),
+				})
+				Expect(err).ToNot(HaveOccurred())
+			}
+		})
+
+		It("lists the cluster members", func() {
+			Eventually(func() []Member {
+				members, _ := nodes["node-3"].Members()
+				return members
+			}, 5*time.Second).Should(ConsistOf(
+				Member{ID: "node-1", RaftAddress: nodes["node-1"].RaftAddress(), APIURL: "http://node-1.fake-host:25777", Leader: true},
+				Member{ID: "node-2", RaftAddress: nodes["node-2"].RaftAddress(), APIURL: "http://node-2.fake-host:25777", Leader: false},
+				Member{ID: "node-3", RaftAddress: nodes["node-3"].RaftAddress(), APIURL: "http://node-3.fake-host:25777", Leader: false},
+			))
+		})
+
+		It("replicates writes into every node local store", func() {
+			err = nodes["node-1"].Store().Save("fake-instance-id", "fake-settings")
+			Expect(err).ToNot(HaveOccurred())
+
+			Eventually(localValue("node-2", "fake-instance-id"), 5*time.Second).Should(Equal("fake-settings"))
+			Eventually(localValue("node-3", "fake-instance-id"), 5*time.Second).Should(Equal("fake-settings"))
+
+			err = nodes["node-1"].Store().Delete("fake-instance-id")
+			Expect(err).ToNot(HaveOccurred())
+
+			Eventually(localValue("node-2", "fake-instance-id"), 5*time.Second).Should(BeEmpty())
+			Eventually(localValue("node-3", "fake-instance-id"), 5*time.Second).Should(BeEmpty())
+		})
+
+		It("tells every node about the changes applied to its local store", func() {
+			err = nodes["node-1"].Store().Save("fake-instance-id", "fake-settings")
+			Expect(err).ToNot(HaveOccurred())
+			err = nodes["node-1"].Store().Save("fake-instance-id", "fake-new-settings")
+			Expect(err).ToNot(HaveOccurred())
+			err = nodes["node-1"].Store().Delete("fake-instance-id")
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, id := range []string{"node-1", "node-2", "node-3"} {
+				Eventually(recorders[id].Changes, 5*time.Second).Should(Equal([]Change{
+					{Key: "fake-instance-id", Value: "fake-settings", Created: true},
+					{Key: "fake-instance-id", Value: "fake-new-settings"},
+					{Key: "fake-instance-id", Deleted: true},
+				}))
+			}
+		})
+
+		It("refuses writes on followers", func() {
+			err = nodes["node-2"].Store().Save("fake-instance-id", "fake-settings")
+			Expect(err).To(Equal(ErrNotLeader))
+
+			err = nodes["node-2"].Join(Member{ID: "node-4", RaftAddress: "127.0.0.1:1", APIURL: "http://node-4.fake-host:25777"})
+			Expect(err).To(Equal(ErrNotLeader))
+		})
+
+		It("serves local reads on followers", func() {
+			err = nodes["node-1"].Store().Save("fake-instance-id", "fake-settings")
+			Expect(err).ToNot(HaveOccurred())
+
+			Eventually(func() string {
+				value, _, _ := nodes["node-2"].Store().Get("fake-instance-id")
+				return value
+			}, 5*time.Second).Should(Equal("fake-settings"))
+		})
+
+		It("removes members", func() {
+			err = nodes["node-1"].Remove("node-3")
+			Expect(err).ToNot(HaveOccurred())
+			stopped["node-3"] = true
+			nodes["node-3"].Shutdown()
+
+			members, err := nodes["node-1"].Members()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(members).To(HaveLen(2))
+		})
+
+		It("elects a new leader when the leader fails", func() {
+			err = nodes["node-1"].Store().Save("fake-instance-id", "fake-settings")
+			Expect(err).ToNot(HaveOccurred())
+
+			stopped["node-1"] = true
+			err = nodes["node-1"].Shutdown()
+			Expect(err).ToNot(HaveOccurred())
+
+			Eventually(leaderOf("node-2", "node-3"), 15*time.Second).ShouldNot(BeEmpty())
+			newLeader := nodes[leaderOf("node-2", "node-3")()]
+
+			value, found, err := newLeader.Store().Get("fake-instance-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found).To(BeTrue())
+			Expect(value).To(Equal("fake-settings"))
+
+			err = newLeader.Store().Save("fake-instance-id", "fake-new-settings")
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Context("with linearizable reads", func() {
+		It("refuses reads on followers", func() {
+			leader := startNode("node-1", Config{Bootstrap: true, ReadConsistency: ReadConsistencyLinearizable})
+			Eventually(leader.IsLeader, 10*time.Second).Should(BeTrue())
+
+			follower := startNode("node-2", Config{ReadConsistency: ReadConsistencyLinearizable})
+			err = leader.Join(Member{ID: "node-2", RaftAddress: follower.RaftAddress(), APIURL: "http://node-2.fake-host:25777"})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = leader.Store().Save("fake-instance-id", "fake-settings")
+			Expect(err).ToNot(HaveOccurred())
+
+			value, found, err := leader.Store().Get("fake-instance-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found).To(BeTrue())
+			Expect(value).To(Equal("fake-settings"))
+
+			_, _, err = follower.Store().Get("fake-instance-id")
+			Expect(err).To(Equal(ErrNotLeader))
+		})
+
+		It("serves the local store and the keys on followers", func() {
+			leader := startNode("node-1", Config{Bootstrap: true, ReadConsistency: ReadConsistencyLinearizable})
+			Eventually(leader.IsLeader, 10*time.Second).Should(BeTrue())
+
+			follower := startNode("node-2", Config{ReadConsistency: ReadConsistencyLinearizable})
+			err = leader.Join(Member{ID: "node-2", RaftAddress: follower.RaftAddress(), APIURL: "http://node-2.fake-host:25777"})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = leader.Store().Save("fake-instance-id", "fake-settings")
+			Expect(err).ToNot(HaveOccurred())
+
+			Eventually(func() bool {
+				_, found, _ := follower.LocalStore().Get("fake-instance-id")
+				return found
+			}, 10*time.Second).Should(BeTrue())
+
+			keys, err := follower.Store().Keys()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(keys).To(ContainElement("fake-instance-id"))
+		})
+	})
+})
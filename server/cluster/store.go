@@ -0,0 +1,47 @@
+package cluster
+
+// Store is a registry store replicated through the cluster. Writes must be
+// performed on the leader, reads are served by the local store, verifying
+// first the leadership when linearizable reads are configured.
+type Store struct {
+	node *Node
+}
+
+func (s *Store) Delete(key string) error {
+	return s.node.apply(command{Op: commandDelete, Key: key})
+}
+
+func (s *Store) Get(key string) (string, bool, error) {
+	if s.node.config.LinearizableReads() {
+		if err := s.node.VerifyLeader(); err != nil {
+			return "", false, err
+		}
+	}
+
+	return s.node.fsm.localStore.Get(key)
+}
+
+func (s *Store) GetAll() (map[string]string, error) {
+	if s.node.config.LinearizableReads() {
+		if err := s.node.VerifyLeader(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s.node.fsm.localStore.GetAll()
+}
+
+// Keys returns the keys of the local store, without verifying the leadership,
+// as they are only counted.
+func (s *Store) Keys() ([]string, error) {
+	return s.node.fsm.localStore.Keys()
+}
+
+func (s *Store) Save(key string, value string) error {
+	return s.node.apply(command{Op: commandSave, Key: key, Value: value})
+}
+
+// Close shuts down the cluster node, closing its local store.
+func (s *Store) Close() error {
+	return s.node.Shutdown()
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/frodenas/bosh-registry/server/cluster"
+)
+
+// ClusterEvents publishes the changes applied to the local store of a
+// cluster node as events, so the events stream of every node, and not only
+// the one of the leader serving the writes, has them.
+type ClusterEvents struct {
+	eventPublisher EventPublisher
+}
+
+func NewClusterEvents(eventPublisher EventPublisher) ClusterEvents {
+	return ClusterEvents{eventPublisher: eventPublisher}
+}
+
+func (e ClusterEvents) ObserveChange(change cluster.Change) {
+	if isInstanceTokenKey(change.Key) {
+		instanceID := strings.TrimPrefix(change.Key, instanceTokenKeyPrefix)
+		if change.Deleted {
+			e.eventPublisher.Publish(NewEvent(EventTypeTokenRevoked, instanceID))
+			return
+		}
+
+		event := NewEvent(EventTypeTokenIssued, instanceID)
+		event.Settings = change.Value
+		e.eventPublisher.Publish(event)
+		return
+	}
+
+	event := NewEvent(EventTypeUpdated, change.Key)
+	switch {
+	case change.Deleted:
+		event.Type = EventTypeDeleted
+	case change.Created:
+		event.Type = EventTypeCreated
+	}
+	event.Settings = change.Value
+	e.eventPublisher.Publish(event)
+}
@@ -0,0 +1,49 @@
+package server_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+
+	"github.com/frodenas/bosh-registry/server/cluster"
+	"github.com/frodenas/bosh-registry/server/fakes"
+)
+
+var _ = Describe("ClusterEvents", func() {
+	var (
+		eventPublisher *fakes.FakeEventPublisher
+		clusterEvents  ClusterEvents
+	)
+
+	BeforeEach(func() {
+		eventPublisher = &fakes.FakeEventPublisher{}
+		clusterEvents = NewClusterEvents(eventPublisher)
+	})
+
+	It("publishes settings changes", func() {
+		clusterEvents.ObserveChange(cluster.Change{Key: "fake-instance-id", Value: "fake-settings", Created: true})
+		clusterEvents.ObserveChange(cluster.Change{Key: "fake-instance-id", Value: "fake-new-settings"})
+		clusterEvents.ObserveChange(cluster.Change{Key: "fake-instance-id", Deleted: true})
+
+		Expect(eventPublisher.PublishedEvents).To(HaveLen(3))
+		Expect(eventPublisher.PublishedEvents[0].Type).To(Equal(EventTypeCreated))
+		Expect(eventPublisher.PublishedEvents[0].InstanceID).To(Equal("fake-instance-id"))
+		Expect(eventPublisher.PublishedEvents[0].Settings).To(Equal("fake-settings"))
+		Expect(eventPublisher.PublishedEvents[1].Type).To(Equal(EventTypeUpdated))
+		Expect(eventPublisher.PublishedEvents[1].Settings).To(Equal("fake-new-settings"))
+		Expect(eventPublisher.PublishedEvents[2].Type).To(Equal(EventTypeDeleted))
+	})
+
+	It("publishes instance token changes as token events", func() {
+		clusterEvents.ObserveChange(cluster.Change{Key: "tokens/fake-instance-id", Value: "fake-token-hash", Created: true})
+		clusterEvents.ObserveChange(cluster.Change{Key: "tokens/fake-instance-id", Deleted: true})
+
+		Expect(eventPublisher.PublishedEvents).To(HaveLen(2))
+		Expect(eventPublisher.PublishedEvents[0].Type).To(Equal(EventTypeTokenIssued))
+		Expect(eventPublisher.PublishedEvents[0].InstanceID).To(Equal("fake-instance-id"))
+		Expect(eventPublisher.PublishedEvents[0].Settings).To(Equal("fake-token-hash"))
+		Expect(eventPublisher.PublishedEvents[1].Type).To(Equal(EventTypeTokenRevoked))
+		Expect(eventPublisher.PublishedEvents[1].InstanceID).To(Equal("fake-instance-id"))
+	})
+})
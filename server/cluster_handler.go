@@ -0,0 +1,231 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+
+	"github.com/frodenas/bosh-registry/server/cluster"
+)
+
+const clusterHandlerLogTag = "RegistryServerClusterHandler"
+const clusterForwardedHeader = "X-Registry-Forwarded-By"
+const clusterMembersPath = "/cluster/members"
+
+type ClusterNode interface {
+	Config() cluster.Config
+	IsLeader() bool
+	Leader() (cluster.Member, bool)
+	Members() ([]cluster.Member, error)
+	Join(cluster.Member) error
+	Remove(string) error
+}
+
+type ClusterHandler struct {
+	users                *Users
+	node                 ClusterNode
+	instanceTokensConfig InstanceTokensConfig
+	transport            *http.Transport
+	logger               boshlog.Logger
+}
+
+// NewClusterHandler forwards requests to the leader over https with the TLS
+// configuration of the first https listener, the nodes of a cluster sharing
+// their certificates.
+func NewClusterHandler(
+	users *Users,
+	node ClusterNode,
+	config Config,
+	logger boshlog.Logger,
+) (*ClusterHandler, error) {
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	for _, listenerConfig := range config.ListenerConfigs() {
+		if listenerConfig.Protocol == "https" {
+			tlsConfig, err := listenerConfig.TLS.ClientConfig()
+			if err != nil {
+				return nil, bosherr.WrapError(err, "Creating Cluster TLS configuration")
+			}
+			transport.TLSClientConfig = tlsConfig
+			break
+		}
+	}
+
+	return &ClusterHandler{
+		users:                users,
+		node:                 node,
+		instanceTokensConfig: config.InstanceTokens,
+		transport:            transport,
+		logger:               logger,
+	}, nil
+}
+
+type MembersResponse struct {
+	Members []cluster.Member `json:"members,omitempty"`
+	Status  string           `json:"status"`
+}
+
+// Wrap sends the requests that must be served by the leader (writes, reads
+// revoking a one-time instance token and, when configured, all reads) to the
+// leader when this node is a follower.
+func (ch *ClusterHandler) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if ch.mustBeServedByLeader(req) && !ch.node.IsLeader() {
+			ch.sendToLeader(w, req)
+			return
+		}
+
+		next(w, req)
+	}
+}
+
+func (ch *ClusterHandler) HandleFunc(w http.ResponseWriter, req *http.Request) {
+	ch.logger.Debug(requestLogTag(clusterHandlerLogTag, req), "Received %s %s from %s", req.Method, req.URL.Path, req.RemoteAddr)
+	if !ch.users.IsAuthorized(req, RoleAdmin) {
+		ch.handleUnauthorized(w, req)
+		return
+	}
+
+	memberID := strings.Trim(strings.TrimPrefix(req.URL.Path, clusterMembersPath), "/")
+
+	switch {
+	case req.Method == "GET" && memberID == "":
+		ch.HandleGetMembers(w, req)
+	case req.Method == "POST" && memberID == "":
+		ch.Wrap(ch.HandleJoin)(w, req)
+	case req.Method == "DELETE" && memberID != "":
+		ch.Wrap(func(w http.ResponseWriter, req *http.Request) {
+			ch.HandleRemove(memberID, w, req)
+		})(w, req)
+	default:
+		ch.writeStatus(w, http.StatusNotFound, "not_found", req)
+	}
+}
+
+func (ch *ClusterHandler) HandleGetMembers(w http.ResponseWriter, req *http.Request) {
+	members, err := ch.node.Members()
+	if err != nil {
+		ch.logger.Debug(requestLogTag(clusterHandlerLogTag, req), "Failed to read cluster members: '%v'", err)
+		ch.writeStatus(w, http.StatusServiceUnavailable, "error", req)
+		return
+	}
+
+	ch.writeJSON(w, http.StatusOK, MembersResponse{Members: members, Status: "ok"}, req)
+}
+
+func (ch *ClusterHandler) HandleJoin(w http.ResponseWriter, req *http.Request) {
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		ch.writeStatus(w, http.StatusBadRequest, "error", req)
+		return
+	}
+
+	var member cluster.Member
+	if err = json.Unmarshal(reqBody, &member); err != nil {
+		ch.logger.Debug(requestLogTag(clusterHandlerLogTag, req), "Failed to unmarshal cluster member: '%v'", err)
+		ch.writeStatus(w, http.StatusBadRequest, "error", req)
+		return
+	}
+
+	if err = ch.node.Join(member); err != nil {
+		ch.logger.Debug(requestLogTag(clusterHandlerLogTag, req), "Failed to add cluster member '%s': '%v'", member.ID, err)
+		ch.writeNodeError(w, err, req)
+		return
+	}
+
+	ch.HandleGetMembers(w, req)
+}
+
+func (ch *ClusterHandler) HandleRemove(memberID string, w http.ResponseWriter, req *http.Request) {
+	if err := ch.node.Remove(memberID); err != nil {
+		ch.logger.Debug(requestLogTag(clusterHandlerLogTag, req), "Failed to remove cluster member '%s': '%v'", memberID, err)
+		ch.writeNodeError(w, err, req)
+		return
+	}
+
+	ch.writeStatus(w, http.StatusOK, "ok", req)
+}
+
+func (ch *ClusterHandler) mustBeServedByLeader(req *http.Request) bool {
+	switch req.Method {
+	case "GET":
+		return ch.node.Config().LinearizableReads() || ch.instanceTokensConfig.revokesOnUse(req)
+	case "PUT", "POST", "DELETE":
+		return true
+	}
+
+	return false
+}
+
+func (ch *ClusterHandler) sendToLeader(w http.ResponseWriter, req *http.Request) {
+	leader, found := ch.node.Leader()
+	if !found || leader.APIURL == "" {
+		ch.logger.Debug(requestLogTag(clusterHandlerLogTag, req), "No cluster leader available for %s %s", req.Method, req.URL.Path)
+		ch.writeStatus(w, http.StatusServiceUnavailable, "no_leader", req)
+		return
+	}
+
+	leaderURL, err := url.Parse(leader.APIURL)
+	if err != nil {
+		ch.logger.Debug(requestLogTag(clusterHandlerLogTag, req), "Invalid cluster leader API URL '%s': '%v'", leader.APIURL, err)
+		ch.writeStatus(w, http.StatusServiceUnavailable, "no_leader", req)
+		return
+	}
+
+	if ch.node.Config().RedirectFollowerWrites() {
+		location := strings.TrimSuffix(leaderURL.String(), "/") + req.URL.RequestURI()
+		ch.logger.Debug(requestLogTag(clusterHandlerLogTag, req), "Redirecting %s %s to cluster leader '%s'", req.Method, req.URL.Path, leader.ID)
+		http.Redirect(w, req, location, http.StatusTemporaryRedirect)
+		return
+	}
+
+	if req.Header.Get(clusterForwardedHeader) != "" {
+		ch.logger.Debug(requestLogTag(clusterHandlerLogTag, req), "Refusing to forward again a request forwarded by '%s'", req.Header.Get(clusterForwardedHeader))
+		ch.writeStatus(w, http.StatusServiceUnavailable, "no_leader", req)
+		return
+	}
+
+	// The proxy appends the client IP to X-Forwarded-For, which the leader
+	// honors as the followers are trusted proxies.
+	ch.logger.Debug(requestLogTag(clusterHandlerLogTag, req), "Forwarding %s %s to cluster leader '%s'", req.Method, req.URL.Path, leader.ID)
+	req.Header.Set(clusterForwardedHeader, ch.node.Config().NodeID)
+	proxy := httputil.NewSingleHostReverseProxy(leaderURL)
+	proxy.Transport = ch.transport
+	proxy.ServeHTTP(w, req)
+}
+
+func (ch *ClusterHandler) writeNodeError(w http.ResponseWriter, err error, req *http.Request) {
+	if err == cluster.ErrNotLeader {
+		ch.writeStatus(w, http.StatusServiceUnavailable, "no_leader", req)
+		return
+	}
+
+	ch.writeStatus(w, http.StatusBadRequest, "error", req)
+}
+
+func (ch *ClusterHandler) handleUnauthorized(w http.ResponseWriter, req *http.Request) {
+	ch.logger.Debug(requestLogTag(clusterHandlerLogTag, req), "Received unauthorized request")
+	w.Header().Add("WWW-Authenticate", `Basic realm="Bosh Registry"`)
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func (ch *ClusterHandler) writeStatus(w http.ResponseWriter, statusCode int, status string, req *http.Request) {
+	ch.writeJSON(w, statusCode, MembersResponse{Status: status}, req)
+}
+
+func (ch *ClusterHandler) writeJSON(w http.ResponseWriter, statusCode int, response MembersResponse, req *http.Request) {
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		ch.logger.Warn(requestLogTag(clusterHandlerLogTag, req), "Failed to marshal cluster response: '%s'", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(statusCode)
+	w.Write(responseJSON)
+}
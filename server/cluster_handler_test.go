@@ -0,0 +1,319 @@
+package server_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+
+	"github.com/frodenas/bosh-registry/server/cluster"
+	"github.com/frodenas/bosh-registry/server/fakes"
+)
+
+var _ = Describe("ClusterHandler", func() {
+	var (
+		err              error
+		responseRecorder *httptest.ResponseRecorder
+		request          *http.Request
+		clusterNode      *fakes.FakeClusterNode
+		clusterHandler   *ClusterHandler
+		nextCalled       bool
+		next             http.HandlerFunc
+
+		logger = boshlog.NewLogger(boshlog.LevelNone)
+		config = Config{
+			Protocol: "http",
+			Address:  "fake-host",
+			Port:     5555,
+			Username: "fake-username",
+			Password: "fake-password",
+		}
+	)
+
+	BeforeEach(func() {
+		responseRecorder = httptest.NewRecorder()
+		clusterNode = &fakes.FakeClusterNode{
+			ClusterConfig: cluster.Config{NodeID: "node-2", FollowerWrites: cluster.FollowerWritesForward},
+		}
+		clusterHandler, err = NewClusterHandler(newUsers(config), clusterNode, config, logger)
+		Expect(err).ToNot(HaveOccurred())
+		nextCalled = false
+		next = func(w http.ResponseWriter, req *http.Request) {
+			nextCalled = true
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+
+	Describe("Wrap", func() {
+		Context("when the node is the leader", func() {
+			BeforeEach(func() {
+				clusterNode.Leading = true
+			})
+
+			It("serves writes locally", func() {
+				request, err = http.NewRequest("PUT", "/instances/fake-instance-id/settings", nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				clusterHandler.Wrap(next)(responseRecorder, request)
+				Expect(nextCalled).To(BeTrue())
+			})
+		})
+
+		Context("when the node is a follower", func() {
+			var leaderServer *httptest.Server
+			var leaderRequests []*http.Request
+
+			BeforeEach(func() {
+				leaderRequests = nil
+				leaderServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+					leaderRequests = append(leaderRequests, req)
+					w.WriteHeader(http.StatusCreated)
+				}))
+
+				clusterNode.Leading = false
+				clusterNode.LeaderFound = true
+				clusterNode.LeaderMember = cluster.Member{ID: "node-1", APIURL: leaderServer.URL}
+			})
+
+			AfterEach(func() {
+				leaderServer.Close()
+			})
+
+			It("serves local reads", func() {
+				request, err = http.NewRequest("GET", "/instances/fake-instance-id/settings", nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				clusterHandler.Wrap(next)(responseRecorder, request)
+				Expect(nextCalled).To(BeTrue())
+			})
+
+			It("forwards linearizable reads to the leader", func() {
+				clusterNode.ClusterConfig.ReadConsistency = cluster.ReadConsistencyLinearizable
+
+				request, err = http.NewRequest("GET", "/instances/fake-instance-id/settings", nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				clusterHandler.Wrap(next)(responseRecorder, request)
+				Expect(nextCalled).To(BeFalse())
+				Expect(leaderRequests).To(HaveLen(1))
+			})
+
+			It("serves local reads with reusable instance tokens", func() {
+				request, err = http.NewRequest("GET", "/instances/fake-instance-id/settings?token=fake-token", nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				clusterHandler.Wrap(next)(responseRecorder, request)
+				Expect(nextCalled).To(BeTrue())
+			})
+
+			It("forwards reads revoking a one-time instance token to the leader", func() {
+				oneTimeTokensConfig := config
+				oneTimeTokensConfig.InstanceTokens.OneTimeUse = true
+				clusterHandler, err = NewClusterHandler(newUsers(config), clusterNode, oneTimeTokensConfig, logger)
+				Expect(err).ToNot(HaveOccurred())
+
+				request, err = http.NewRequest("GET", "/instances/fake-instance-id/settings", nil)
+				Expect(err).NotTo(HaveOccurred())
+				request.Header.Set("Authorization", "Bearer fake-token")
+
+				clusterHandler.Wrap(next)(responseRecorder, request)
+				Expect(nextCalled).To(BeFalse())
+				Expect(leaderRequests).To(HaveLen(1))
+				Expect(leaderRequests[0].Header.Get("Authorization")).To(Equal("Bearer fake-token"))
+			})
+
+			It("forwards writes to the leader", func() {
+				request, err = http.NewRequest("PUT", "/instances/fake-instance-id/settings", bytes.NewReader([]byte("fake-instance-settings")))
+				Expect(err).NotTo(HaveOccurred())
+				request.SetBasicAuth("fake-username", "fake-password")
+				request.RemoteAddr = "10.0.0.5:34567"
+
+				clusterHandler.Wrap(next)(responseRecorder, request)
+				Expect(nextCalled).To(BeFalse())
+				Expect(responseRecorder.Code).To(Equal(http.StatusCreated))
+				Expect(leaderRequests).To(HaveLen(1))
+				Expect(leaderRequests[0].Method).To(Equal("PUT"))
+				Expect(leaderRequests[0].URL.Path).To(Equal("/instances/fake-instance-id/settings"))
+				Expect(leaderRequests[0].Header.Get("Authorization")).To(Equal(request.Header.Get("Authorization")))
+				Expect(leaderRequests[0].Header.Get("X-Registry-Forwarded-By")).To(Equal("node-2"))
+				Expect(leaderRequests[0].Header.Get("X-Forwarded-For")).To(Equal("10.0.0.5"))
+			})
+
+			Context("when the leader requires client certificates", func() {
+				var tempDir string
+
+				BeforeEach(func() {
+					tempDir, err = ioutil.TempDir("", "cluster-handler")
+					Expect(err).ToNot(HaveOccurred())
+
+					ca := newTestCertificate("fake-ca", nil, nil)
+					caFile, _ := ca.writeFiles(tempDir, "ca")
+					certFile, keyFile := newTestCertificate("fake-registry", []string{"localhost"}, ca).writeFiles(tempDir, "registry")
+					config.Protocol = "https"
+					config.TLS = TLSConfig{CertFile: certFile, KeyFile: keyFile, CACertFile: caFile}
+
+					serverConfig, err := config.TLS.ServerConfig(logger)
+					Expect(err).ToNot(HaveOccurred())
+					leaderServer.Close()
+					leaderServer = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+						leaderRequests = append(leaderRequests, req)
+						w.WriteHeader(http.StatusCreated)
+					}))
+					leaderServer.TLS = serverConfig
+					leaderServer.StartTLS()
+
+					leaderURL, err := url.Parse(leaderServer.URL)
+					Expect(err).ToNot(HaveOccurred())
+					clusterNode.LeaderMember.APIURL = "https://localhost:" + leaderURL.Port()
+				})
+
+				AfterEach(func() {
+					config.Protocol = "http"
+					config.TLS = TLSConfig{}
+					os.RemoveAll(tempDir)
+				})
+
+				It("forwards writes with the listener certificate", func() {
+					clusterHandler, err = NewClusterHandler(newUsers(config), clusterNode, config, logger)
+					Expect(err).ToNot(HaveOccurred())
+
+					request, err = http.NewRequest("PUT", "/instances/fake-instance-id/settings", bytes.NewReader([]byte("fake-instance-settings")))
+					Expect(err).NotTo(HaveOccurred())
+
+					clusterHandler.Wrap(next)(responseRecorder, request)
+					Expect(responseRecorder.Code).To(Equal(http.StatusCreated))
+					Expect(leaderRequests).To(HaveLen(1))
+					Expect(leaderRequests[0].TLS.PeerCertificates[0].Subject.CommonName).To(Equal("fake-registry"))
+				})
+			})
+
+			It("does not forward again requests already forwarded", func() {
+				request, err = http.NewRequest("DELETE", "/instances/fake-instance-id/settings", nil)
+				Expect(err).NotTo(HaveOccurred())
+				request.Header.Set("X-Registry-Forwarded-By", "node-3")
+
+				clusterHandler.Wrap(next)(responseRecorder, request)
+				Expect(responseRecorder.Code).To(Equal(http.StatusServiceUnavailable))
+				Expect(leaderRequests).To(BeEmpty())
+			})
+
+			It("redirects writes to the leader if configured", func() {
+				clusterNode.ClusterConfig.FollowerWrites = cluster.FollowerWritesRedirect
+
+				request, err = http.NewRequest("DELETE", "/instances/fake-instance-id/settings", nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				clusterHandler.Wrap(next)(responseRecorder, request)
+				Expect(nextCalled).To(BeFalse())
+				Expect(responseRecorder.Code).To(Equal(http.StatusTemporaryRedirect))
+				Expect(responseRecorder.Header().Get("Location")).To(Equal(leaderServer.URL + "/instances/fake-instance-id/settings"))
+				Expect(leaderRequests).To(BeEmpty())
+			})
+
+			It("returns a Service Unavailable error if there is no leader", func() {
+				clusterNode.LeaderFound = false
+
+				request, err = http.NewRequest("PUT", "/instances/fake-instance-id/settings", nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				clusterHandler.Wrap(next)(responseRecorder, request)
+				Expect(responseRecorder.Code).To(Equal(http.StatusServiceUnavailable))
+				Expect(responseRecorder.Body.String()).To(ContainSubstring("no_leader"))
+			})
+		})
+	})
+
+	Describe("HandleFunc", func() {
+		BeforeEach(func() {
+			clusterNode.Leading = true
+		})
+
+		It("returns an Unauthorized error if request does not contain credentials", func() {
+			request, err = http.NewRequest("GET", "/cluster/members", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			clusterHandler.HandleFunc(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusUnauthorized))
+			Expect(responseRecorder.HeaderMap).To(HaveKey("Www-Authenticate"))
+		})
+
+		It("lists the cluster members", func() {
+			clusterNode.MembersList = []cluster.Member{
+				{ID: "node-1", RaftAddress: "10.0.0.1:25778", APIURL: "http://10.0.0.1:25777", Leader: true},
+			}
+
+			request, err = http.NewRequest("GET", "/cluster/members", nil)
+			Expect(err).NotTo(HaveOccurred())
+			request.SetBasicAuth("fake-username", "fake-password")
+
+			clusterHandler.HandleFunc(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(responseRecorder.Body.String()).To(MatchJSON(`{"members":[{"id":"node-1","raft_address":"10.0.0.1:25778","api_url":"http://10.0.0.1:25777","leader":true}],"status":"ok"}`))
+		})
+
+		It("adds a member to the cluster", func() {
+			request, err = http.NewRequest("POST", "/cluster/members", bytes.NewReader([]byte(`{"id":"node-3","raft_address":"10.0.0.3:25778","api_url":"http://10.0.0.3:25777"}`)))
+			Expect(err).NotTo(HaveOccurred())
+			request.SetBasicAuth("fake-username", "fake-password")
+
+			clusterHandler.HandleFunc(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(clusterNode.JoinCalled).To(BeTrue())
+			Expect(clusterNode.JoinMember).To(Equal(cluster.Member{ID: "node-3", RaftAddress: "10.0.0.3:25778", APIURL: "http://10.0.0.3:25777"}))
+		})
+
+		It("returns a Bad Request error if the member cannot be added", func() {
+			clusterNode.JoinErr = errors.New("fake-join-error")
+
+			request, err = http.NewRequest("POST", "/cluster/members", bytes.NewReader([]byte(`{"id":"node-3"}`)))
+			Expect(err).NotTo(HaveOccurred())
+			request.SetBasicAuth("fake-username", "fake-password")
+
+			clusterHandler.HandleFunc(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("removes a member from the cluster", func() {
+			request, err = http.NewRequest("DELETE", "/cluster/members/node-3", nil)
+			Expect(err).NotTo(HaveOccurred())
+			request.SetBasicAuth("fake-username", "fake-password")
+
+			clusterHandler.HandleFunc(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(clusterNode.RemoveCalled).To(BeTrue())
+			Expect(clusterNode.RemoveID).To(Equal("node-3"))
+		})
+
+		It("returns a Service Unavailable error if the node lost the leadership", func() {
+			clusterNode.RemoveErr = cluster.ErrNotLeader
+
+			request, err = http.NewRequest("DELETE", "/cluster/members/node-3", nil)
+			Expect(err).NotTo(HaveOccurred())
+			request.SetBasicAuth("fake-username", "fake-password")
+
+			clusterHandler.HandleFunc(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusServiceUnavailable))
+		})
+
+		It("returns a Not Found error for unknown requests", func() {
+			request, err = http.NewRequest("PUT", "/cluster/members", nil)
+			Expect(err).NotTo(HaveOccurred())
+			request.SetBasicAuth("fake-username", "fake-password")
+
+			clusterHandler.HandleFunc(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusNotFound))
+			body, _ := ioutil.ReadAll(responseRecorder.Body)
+			Expect(string(body)).To(ContainSubstring("not_found"))
+		})
+	})
+})
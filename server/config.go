@@ -1,62 +1,179 @@
 package server
 
 import (
+	"reflect"
+	"time"
+
 	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+
+	"github.com/frodenas/bosh-registry/server/instanceip"
 )
 
+const defaultShutdownGracePeriod = 30
+
 type Config struct {
-	Protocol string    `json:"protocol,omitempty"`
-	Address  string    `json:"address,omitempty"`
-	Port     int       `json:"port,omitempty"`
-	Username string    `json:"username,omitempty"`
-	Password string    `json:"password,omitempty"`
-	TLS      TLSConfig `json:"tls,omitempty"`
-}
+	Protocol string `json:"protocol,omitempty"`
+	Address  string `json:"address,omitempty"`
+	Port     int    `json:"port,omitempty"`
+
+	UnixSocket UnixSocketConfig `json:"unix_socket,omitempty"`
+	Listeners  []ListenerConfig `json:"listeners,omitempty"`
+
+	Username string       `json:"username,omitempty"`
+	Password string       `json:"password,omitempty"`
+	Users    []UserConfig `json:"users,omitempty"`
+	TLS      TLSConfig    `json:"tls,omitempty"`
+
+	ClientCerts []ClientCertConfig `json:"client_certs,omitempty"`
+	AuthLimiter AuthLimiterConfig  `json:"auth_limiter,omitempty"`
 
-type TLSConfig struct {
-	CertFile   string `json:"certfile,omitempty"`
-	KeyFile    string `json:"keyfile,omitempty"`
-	CACertFile string `json:"cacertfile,omitempty"`
+	// ShutdownGracePeriod is a pointer so that 0, closing the connections
+	// right away, is not taken for the default.
+	ShutdownGracePeriod *int `json:"shutdown_grace_period,omitempty"`
+
+	Metrics   MetricsConfig   `json:"metrics,omitempty"`
+	AccessLog AccessLogConfig `json:"access_log,omitempty"`
+
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+	ProxyProtocol  bool     `json:"proxy_protocol,omitempty"`
+
+	ReadAuth        string               `json:"read_auth,omitempty"`
+	InstanceIPCheck instanceip.Config    `json:"instance_ip_check,omitempty"`
+	InstanceTokens  InstanceTokensConfig `json:"instance_tokens,omitempty"`
+	SignedURLs      SignedURLsConfig     `json:"signed_urls,omitempty"`
 }
 
 func (c Config) Validate() error {
-	if c.Protocol != "http" && c.Protocol != "https" {
-		return bosherr.Error("Must provide a valid Protocol")
+	if len(c.Listeners) > 0 {
+		if c.Protocol != "" || c.Address != "" || c.Port != 0 || c.UnixSocket.Enabled() || c.ProxyProtocol || !reflect.DeepEqual(c.TLS, TLSConfig{}) {
+			return bosherr.Error("Must not provide Protocol, Address, Port, UnixSocket, TLS or ProxyProtocol with Listeners")
+		}
+
+		for i, listenerConfig := range c.Listeners {
+			if err := listenerConfig.Validate(); err != nil {
+				return bosherr.WrapErrorf(err, "Validating Listener %d", i)
+			}
+		}
+	} else if err := c.ListenerConfigs()[0].Validate(); err != nil {
+		return err
 	}
 
-	if c.Address == "" {
-		return bosherr.Error("Must provide a non-empty Address")
+	if len(c.Users) == 0 && len(c.ClientCerts) == 0 && c.Username == "" {
+		return bosherr.Error("Must provide a non-empty Username")
 	}
 
-	if c.Port == 0 {
-		return bosherr.Error("Must provide a non-empty Port")
+	if c.Username != "" && c.Password == "" {
+		return bosherr.Error("Must provide a non-empty Password")
 	}
 
-	if c.Username == "" {
-		return bosherr.Error("Must provide a non-empty Username")
+	if _, err := NewUsers(c); err != nil {
+		return bosherr.WrapError(err, "Validating Users")
 	}
 
-	if c.Password == "" {
-		return bosherr.Error("Must provide a non-empty Password")
+	if err := c.AuthLimiter.Validate(); err != nil {
+		return bosherr.WrapError(err, "Validating Auth Limiter configuration")
 	}
 
-	if c.Protocol == "https" {
-		if err := c.TLS.Validate(); err != nil {
-			return bosherr.WrapError(err, "Validating TLS configuration")
-		}
+	if len(c.ClientCerts) > 0 && !c.anyListener(ListenerConfig.VerifiesClientCerts) {
+		return bosherr.Errorf("Must use the https Protocol, the '%s' or '%s' TLS ClientAuth and a TLS CACertFile with ClientCerts", TLSClientAuthVerifyIfGiven, TLSClientAuthRequire)
+	}
+
+	if c.ShutdownGracePeriod != nil && *c.ShutdownGracePeriod < 0 {
+		return bosherr.Error("Must provide a non-negative ShutdownGracePeriod")
+	}
+
+	if _, err := NewTrustedProxies(c.TrustedProxies); err != nil {
+		return bosherr.WrapError(err, "Validating TrustedProxies")
+	}
+
+	proxyProtocol := func(listenerConfig ListenerConfig) bool { return listenerConfig.ProxyProtocol }
+	if c.anyListener(proxyProtocol) && len(c.TrustedProxies) == 0 {
+		return bosherr.Error("Must provide non-empty TrustedProxies when enabling ProxyProtocol")
+	}
+
+	switch c.ReadAuthMode() {
+	case ReadAuthNone, ReadAuthBasic, ReadAuthClientCert, ReadAuthInstanceToken, ReadAuthIP:
+	default:
+		return bosherr.Errorf("Must provide a valid ReadAuth ('%s', '%s', '%s', '%s' or '%s'), got '%s'", ReadAuthNone, ReadAuthBasic, ReadAuthClientCert, ReadAuthInstanceToken, ReadAuthIP, c.ReadAuth)
+	}
+
+	readsWithoutClientCerts := func(listenerConfig ListenerConfig) bool {
+		return listenerConfig.Allows(OperationRead) && !listenerConfig.VerifiesClientCerts()
+	}
+	if c.ReadAuthMode() == ReadAuthClientCert && c.anyListener(readsWithoutClientCerts) {
+		return bosherr.Errorf("Must use the https Protocol, the '%s' or '%s' TLS ClientAuth and a TLS CACertFile with ReadAuth '%s'", TLSClientAuthVerifyIfGiven, TLSClientAuthRequire, ReadAuthClientCert)
+	}
+
+	if err := c.InstanceIPCheckConfig().Validate(); err != nil {
+		return bosherr.WrapError(err, "Validating Instance IP Check configuration")
+	}
+
+	if err := c.SignedURLs.Validate(); err != nil {
+		return bosherr.WrapError(err, "Validating Signed URLs configuration")
+	}
+
+	if err := c.AccessLog.Validate(); err != nil {
+		return bosherr.WrapError(err, "Validating Access Log configuration")
 	}
 
 	return nil
 }
 
-func (c TLSConfig) Validate() error {
-	if c.CertFile == "" {
-		return bosherr.Error("Must provide a non-empty CertFile")
+// ListenerConfigs returns the Listeners, or a single one with the Protocol,
+// Address, Port, UnixSocket, TLS and ProxyProtocol when none is provided.
+func (c Config) ListenerConfigs() []ListenerConfig {
+	if len(c.Listeners) > 0 {
+		return c.Listeners
 	}
 
-	if c.KeyFile == "" {
-		return bosherr.Error("Must provide a non-empty KeyFile")
+	return []ListenerConfig{
+		{
+			Protocol:      c.Protocol,
+			Address:       c.Address,
+			Port:          c.Port,
+			UnixSocket:    c.UnixSocket,
+			TLS:           c.TLS,
+			ProxyProtocol: c.ProxyProtocol,
+		},
 	}
+}
 
-	return nil
+func (c Config) anyListener(matches func(ListenerConfig) bool) bool {
+	for _, listenerConfig := range c.ListenerConfigs() {
+		if matches(listenerConfig) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GracePeriod returns how long to wait for the requests in progress when
+// shutting down, 30 seconds by default.
+func (c Config) GracePeriod() time.Duration {
+	if c.ShutdownGracePeriod == nil {
+		return defaultShutdownGracePeriod * time.Second
+	}
+
+	return time.Duration(*c.ShutdownGracePeriod) * time.Second
+}
+
+// ReadAuthMode returns the read policy. The instance IP check enables the ip
+// read policy when no read policy is set.
+func (c Config) ReadAuthMode() string {
+	if c.ReadAuth == "" {
+		if c.InstanceIPCheck.Enabled {
+			return ReadAuthIP
+		}
+		return ReadAuthNone
+	}
+
+	return c.ReadAuth
+}
+
+func (c Config) InstanceIPCheckConfig() instanceip.Config {
+	config := c.InstanceIPCheck
+	config.Enabled = c.ReadAuthMode() == ReadAuthIP
+
+	return config
 }
@@ -1,10 +1,15 @@
 package server_test
 
 import (
+	"encoding/json"
+	"time"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
 	. "github.com/frodenas/bosh-registry/server"
+
+	"github.com/frodenas/bosh-registry/server/instanceip"
 )
 
 var _ = Describe("Config", func() {
@@ -77,6 +82,246 @@ var _ = Describe("Config", func() {
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("Must provide a non-empty Password"))
 		})
+
+		It("does not return error if Users are provided instead of Username and Password", func() {
+			options.Username = ""
+			options.Password = ""
+			options.Users = []UserConfig{{Name: "fake-user", PasswordHash: "$2a$04$7r81GRQeDgn8ssDbGBv.hu9S5SCsylmffgm4Hkr0fL37Tf.NbZEH.", Role: RoleWriter}}
+
+			err := options.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns error if Users are not valid", func() {
+			options.Users = []UserConfig{{Name: "fake-user", PasswordHash: "fake-password", Role: RoleWriter}}
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating Users"))
+		})
+
+		It("does not return error if ClientCerts are provided instead of Username and Password", func() {
+			options.Protocol = "https"
+			options.TLS = TLSConfig{CertFile: "fake-certfile", KeyFile: "fake-keyfile", CACertFile: "fake-cacertfile"}
+			options.Username = ""
+			options.Password = ""
+			options.ClientCerts = []ClientCertConfig{{CN: "fake-cpi", Role: RoleAdmin}}
+
+			err := options.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns error if ClientCerts are not valid", func() {
+			options.Protocol = "https"
+			options.TLS = TLSConfig{CertFile: "fake-certfile", KeyFile: "fake-keyfile", CACertFile: "fake-cacertfile"}
+			options.ClientCerts = []ClientCertConfig{{CN: "fake-cpi"}}
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating ClientCerts"))
+		})
+
+		It("returns error if ClientCerts are provided and Protocol is not https", func() {
+			options.ClientCerts = []ClientCertConfig{{CN: "fake-cpi", Role: RoleAdmin}}
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must use the https Protocol, the 'verify_if_given' or 'require' TLS ClientAuth and a TLS CACertFile with ClientCerts"))
+		})
+
+		It("returns error if AuthLimiter is not valid", func() {
+			options.AuthLimiter = AuthLimiterConfig{MaxFailures: -1}
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating Auth Limiter configuration"))
+		})
+
+		It("returns error if TrustedProxies are not valid", func() {
+			options.TrustedProxies = []string{"fake-proxy"}
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating TrustedProxies"))
+		})
+
+		It("returns error if ProxyProtocol is enabled without TrustedProxies", func() {
+			options.ProxyProtocol = true
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide non-empty TrustedProxies when enabling ProxyProtocol"))
+		})
+
+		It("returns error if ShutdownGracePeriod is negative", func() {
+			shutdownGracePeriod := -1
+			options.ShutdownGracePeriod = &shutdownGracePeriod
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a non-negative ShutdownGracePeriod"))
+		})
+
+		It("does not require Address and Port when listening on a Unix socket", func() {
+			options.Address = ""
+			options.Port = 0
+			options.UnixSocket = UnixSocketConfig{Path: "/fake-path/registry.sock"}
+
+			err := options.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns error if Unix socket is not valid", func() {
+			options.UnixSocket = UnixSocketConfig{Path: "/fake-path/registry.sock", Mode: "fake-mode"}
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating Unix Socket configuration"))
+		})
+
+		It("returns error if ProxyProtocol is enabled with a Unix socket", func() {
+			options.UnixSocket = UnixSocketConfig{Path: "/fake-path/registry.sock"}
+			options.TrustedProxies = []string{"127.0.0.1"}
+			options.ProxyProtocol = true
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must not enable ProxyProtocol with a Unix Socket"))
+		})
+
+		It("returns error if ReadAuth is not valid", func() {
+			options.ReadAuth = "fake-read-auth"
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a valid ReadAuth"))
+		})
+
+		It("returns error if ReadAuth is 'client_cert' and Protocol is not https", func() {
+			options.ReadAuth = ReadAuthClientCert
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must use the https Protocol, the 'verify_if_given' or 'require' TLS ClientAuth and a TLS CACertFile with ReadAuth 'client_cert'"))
+		})
+
+		It("returns error if ReadAuth is 'ip' and the InstanceIPCheck resolver is not valid", func() {
+			options.ReadAuth = ReadAuthIP
+			options.InstanceIPCheck = instanceip.Config{Resolver: "fake-resolver"}
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating Instance IP Check configuration"))
+		})
+
+		It("returns error if InstanceIPCheck is not valid", func() {
+			options.InstanceIPCheck = instanceip.Config{Enabled: true, Resolver: "fake-resolver"}
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating Instance IP Check configuration"))
+		})
+
+		It("returns error if SignedURLs are not valid", func() {
+			options.SignedURLs = SignedURLsConfig{Keys: []SigningKeyConfig{{ID: "fake-key-id", Secret: "fake-secret"}}}
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating Signed URLs configuration"))
+		})
+
+		It("returns error if AccessLog is not valid", func() {
+			options.AccessLog = AccessLogConfig{Format: "fake-format"}
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating Access Log configuration"))
+		})
+
+		Context("when Listeners are provided", func() {
+			BeforeEach(func() {
+				options.Protocol = ""
+				options.Address = ""
+				options.Port = 0
+				options.Listeners = []ListenerConfig{
+					{Protocol: "http", Address: "fake-host", Port: 25777, Operations: []string{OperationRead}},
+					{Protocol: "http", Address: "::1", Port: 25778},
+				}
+			})
+
+			It("does not return error if all fields are valid", func() {
+				err := options.Validate()
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("returns error if a Listener is not valid", func() {
+				options.Listeners[1].Port = 0
+
+				err := options.Validate()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Validating Listener 1"))
+			})
+
+			It("returns error if the top-level listening settings are also provided", func() {
+				options.Port = 25777
+
+				err := options.Validate()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Must not provide Protocol, Address, Port, UnixSocket, TLS or ProxyProtocol with Listeners"))
+			})
+
+			It("returns error if ProxyProtocol is enabled on a Listener without TrustedProxies", func() {
+				options.Listeners[1].ProxyProtocol = true
+
+				err := options.Validate()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Must provide non-empty TrustedProxies when enabling ProxyProtocol"))
+			})
+
+			It("returns error if ReadAuth is 'client_cert' and a Listener allowing reads does not verify client certificates", func() {
+				options.ReadAuth = ReadAuthClientCert
+
+				err := options.Validate()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("with ReadAuth 'client_cert'"))
+			})
+		})
+	})
+
+	Describe("GracePeriod", func() {
+		It("defaults to 30 seconds", func() {
+			Expect(Config{}.GracePeriod()).To(Equal(30 * time.Second))
+		})
+
+		It("returns the ShutdownGracePeriod, even if it is 0", func() {
+			shutdownGracePeriod := 0
+			Expect(Config{ShutdownGracePeriod: &shutdownGracePeriod}.GracePeriod()).To(BeZero())
+
+			shutdownGracePeriod = 60
+			Expect(Config{ShutdownGracePeriod: &shutdownGracePeriod}.GracePeriod()).To(Equal(time.Minute))
+		})
+
+		It("reads 0 from the JSON configuration", func() {
+			var config Config
+			Expect(json.Unmarshal([]byte(`{"shutdown_grace_period":0}`), &config)).To(Succeed())
+			Expect(config.GracePeriod()).To(BeZero())
+		})
+	})
+
+	Describe("ListenerConfigs", func() {
+		It("returns the Listeners", func() {
+			listeners := []ListenerConfig{{Protocol: "http", Address: "fake-host", Port: 25777}}
+
+			Expect(Config{Listeners: listeners}.ListenerConfigs()).To(Equal(listeners))
+		})
+
+		It("returns a single Listener with the top-level settings when no Listeners are provided", func() {
+			config := Config{Protocol: "http", Address: "fake-host", Port: 25777, ProxyProtocol: true}
+
+			Expect(config.ListenerConfigs()).To(Equal([]ListenerConfig{
+				{Protocol: "http", Address: "fake-host", Port: 25777, ProxyProtocol: true},
+			}))
+		})
 	})
 })
 
@@ -122,5 +367,124 @@ var _ = Describe("TLSConfig", func() {
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("Must provide a non-empty KeyFile"))
 		})
+
+		It("returns error if an additional certificate is not complete", func() {
+			options.TLS.Certificates = []TLSCertificateConfig{{CertFile: "fake-other-certificate"}}
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a non-empty CertFile and KeyFile for every certificate"))
+		})
+
+		It("returns error if ClientAuth is not valid", func() {
+			options.TLS.ClientAuth = "fake-client-auth"
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a valid ClientAuth"))
+		})
+
+		It("does not require a CACertFile when ClientAuth is not provided", func() {
+			Expect(options.TLS.VerifiesClientCerts()).To(BeFalse())
+
+			options.TLS.CACertFile = "fake-ca-certificate"
+			Expect(options.Validate()).To(Succeed())
+			Expect(options.TLS.VerifiesClientCerts()).To(BeTrue())
+		})
+
+		It("returns error if client certificates are verified and CACertFile is empty", func() {
+			options.TLS.ClientAuth = TLSClientAuthRequire
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a non-empty CACertFile with ClientAuth 'require'"))
+
+			options.TLS.ClientAuth = TLSClientAuthNone
+			Expect(options.Validate()).To(Succeed())
+		})
+
+		It("returns error if ReadAuth is 'client_cert' and client certificates are not verified", func() {
+			options.TLS.ClientAuth = TLSClientAuthRequest
+			options.ReadAuth = ReadAuthClientCert
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must use the https Protocol, the 'verify_if_given' or 'require' TLS ClientAuth and a TLS CACertFile with ReadAuth 'client_cert'"))
+		})
+
+		It("returns error if MinVersion is not valid", func() {
+			options.TLS.MinVersion = "fake-version"
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a valid MinVersion ('1.0', '1.1', '1.2', '1.3'), got 'fake-version'"))
+		})
+
+		It("returns error if MaxVersion is not valid", func() {
+			options.TLS.MaxVersion = "fake-version"
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a valid MaxVersion"))
+		})
+
+		It("returns error if MinVersion is greater than MaxVersion", func() {
+			options.TLS.MinVersion = "1.3"
+			options.TLS.MaxVersion = "1.2"
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a MinVersion not greater than MaxVersion"))
+		})
+
+		It("returns error if a cipher suite is not valid", func() {
+			options.TLS.CipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "fake-cipher-suite"}
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide valid CipherSuites, got 'fake-cipher-suite'"))
+		})
+
+		It("returns error if a cipher suite is insecure", func() {
+			options.TLS.CipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_RC4_128_SHA"}
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must not provide insecure CipherSuites, got 'TLS_ECDHE_RSA_WITH_RC4_128_SHA'"))
+		})
+
+		It("returns error if cipher suites are provided with MinVersion 1.3", func() {
+			options.TLS.MinVersion = "1.3"
+			options.TLS.CipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must not provide CipherSuites with MinVersion '1.3'"))
+		})
+
+		It("returns error if a curve is not valid", func() {
+			options.TLS.Curves = []string{"X25519", "fake-curve"}
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide valid Curves"))
+		})
+
+		It("returns error if CRLFiles are provided and client certificates are not verified", func() {
+			options.TLS.ClientAuth = TLSClientAuthRequest
+			options.TLS.CRLFiles = []string{"fake-crl-file"}
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must use the 'verify_if_given' or 'require' ClientAuth and a non-empty CACertFile with CRLFiles"))
+		})
+
+		It("returns error if ReloadInterval is negative", func() {
+			options.TLS.ReloadInterval = -1
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a non-negative ReloadInterval"))
+		})
 	})
 })
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"time"
+)
+
+const (
+	EventTypeCreated = "created"
+	EventTypeUpdated = "updated"
+	EventTypeDeleted = "deleted"
+
+	// Token events carry the hash of the instance tokens, for replicas only.
+	EventTypeTokenIssued  = "token_issued"
+	EventTypeTokenRevoked = "token_revoked"
+)
+
+type Event struct {
+	ID         uint64    `json:"id"`
+	Type       string    `json:"type"`
+	InstanceID string    `json:"instance_id"`
+	Timestamp  time.Time `json:"timestamp"`
+	Settings   string    `json:"-"`
+}
+
+type EventPublisher interface {
+	Publish(Event)
+}
+
+type EventPublishers []EventPublisher
+
+func (p EventPublishers) Publish(event Event) {
+	for _, publisher := range p {
+		publisher.Publish(event)
+	}
+}
+
+func isTokenEvent(event Event) bool {
+	return event.Type == EventTypeTokenIssued || event.Type == EventTypeTokenRevoked
+}
+
+func NewEvent(eventType string, instanceID string) Event {
+	return Event{
+		Type:       eventType,
+		InstanceID: instanceID,
+		Timestamp:  time.Now().UTC(),
+	}
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+const eventBrokerLogTag = "RegistryServerEventBroker"
+const eventBrokerSubscriptionBufferSize = 64
+
+// EventBroker assigns consecutive IDs to the published events. The IDs are
+// only meaningful within the epoch of the broker, which is new every time the
+// registry starts, so clients resuming from an event ID of a previous epoch
+// are told to reset.
+type EventBroker struct {
+	bufferSize int
+	logger     boshlog.Logger
+	epoch      string
+
+	mutex         sync.Mutex
+	lastEventID   uint64
+	buffer        []Event
+	bufferStart   int
+	subscriptions map[*EventSubscription]struct{}
+}
+
+type EventSubscription struct {
+	Events <-chan Event
+
+	events      chan Event
+	broker      *EventBroker
+	lastEventID uint64
+}
+
+func NewEventBroker(
+	bufferSize int,
+	logger boshlog.Logger,
+) *EventBroker {
+	return &EventBroker{
+		bufferSize:    bufferSize,
+		logger:        logger,
+		epoch:         newEventEpoch(),
+		buffer:        make([]Event, 0, bufferSize),
+		subscriptions: map[*EventSubscription]struct{}{},
+	}
+}
+
+// Publish assigns the next event ID, records the event in the ring buffer and
+// fans it out to all subscribers. Subscribers that are not keeping up are
+// dropped, so they can resume using the last event ID they have seen.
+func (b *EventBroker) Publish(event Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.lastEventID++
+	event.ID = b.lastEventID
+
+	if b.bufferSize > 0 {
+		if len(b.buffer) < b.bufferSize {
+			b.buffer = append(b.buffer, event)
+		} else {
+			b.buffer[b.bufferStart] = event
+			b.bufferStart = (b.bufferStart + 1) % b.bufferSize
+		}
+	}
+
+	for subscription := range b.subscriptions {
+		select {
+		case subscription.events <- event:
+		default:
+			b.logger.Warn(eventBrokerLogTag, "Dropping slow events subscriber")
+			b.unsubscribe(subscription)
+		}
+	}
+}
+
+// Subscribe returns a subscription that receives every event published from
+// now on.
+func (b *EventBroker) Subscribe() *EventSubscription {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.subscribe()
+}
+
+// Resume returns the buffered events published after lastEventID together
+// with a subscription that receives every event published from now on. The
+// returned flag is false when some of the events published after lastEventID
+// are no longer buffered, or when lastEventID belongs to another epoch (the
+// registry has been restarted since); all buffered events are returned then.
+func (b *EventBroker) Resume(epoch string, lastEventID uint64) ([]Event, *EventSubscription, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	complete := true
+	if epoch != b.epoch || lastEventID > b.lastEventID {
+		lastEventID = 0
+		complete = false
+	} else if lastEventID < b.lastEventID {
+		oldestEventID := b.lastEventID + 1
+		if len(b.buffer) > 0 {
+			oldestEventID = b.buffer[b.bufferStart].ID
+		}
+		complete = lastEventID+1 >= oldestEventID
+	}
+
+	var backlog []Event
+	for i := 0; i < len(b.buffer); i++ {
+		event := b.buffer[(b.bufferStart+i)%len(b.buffer)]
+		if event.ID > lastEventID {
+			backlog = append(backlog, event)
+		}
+	}
+
+	return backlog, b.subscribe(), complete
+}
+
+func (b *EventBroker) Epoch() string {
+	return b.epoch
+}
+
+func (b *EventBroker) LastEventID() uint64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.lastEventID
+}
+
+func (s *EventSubscription) Close() {
+	s.broker.mutex.Lock()
+	defer s.broker.mutex.Unlock()
+
+	s.broker.unsubscribe(s)
+}
+
+func (b *EventBroker) subscribe() *EventSubscription {
+	events := make(chan Event, eventBrokerSubscriptionBufferSize)
+	subscription := &EventSubscription{
+		Events:      events,
+		events:      events,
+		broker:      b,
+		lastEventID: b.lastEventID,
+	}
+	b.subscriptions[subscription] = struct{}{}
+
+	return subscription
+}
+
+func (b *EventBroker) unsubscribe(subscription *EventSubscription) {
+	if _, found := b.subscriptions[subscription]; found {
+		delete(b.subscriptions, subscription)
+		close(subscription.events)
+	}
+}
+
+func newEventEpoch() string {
+	epoch := make([]byte, 8)
+	rand.Read(epoch)
+
+	return hex.EncodeToString(epoch)
+}
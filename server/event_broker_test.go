@@ -0,0 +1,140 @@
+package server_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+var _ = Describe("EventBroker", func() {
+	var (
+		eventBroker *EventBroker
+
+		logger = boshlog.NewLogger(boshlog.LevelNone)
+	)
+
+	BeforeEach(func() {
+		eventBroker = NewEventBroker(3, logger)
+	})
+
+	Describe("Publish", func() {
+		It("assigns consecutive event IDs", func() {
+			subscription := eventBroker.Subscribe()
+			defer subscription.Close()
+
+			eventBroker.Publish(NewEvent(EventTypeCreated, "fake-instance-id"))
+			eventBroker.Publish(NewEvent(EventTypeDeleted, "fake-instance-id"))
+
+			Expect((<-subscription.Events).ID).To(Equal(uint64(1)))
+			Expect((<-subscription.Events).ID).To(Equal(uint64(2)))
+		})
+
+		It("drops subscribers that are not keeping up", func() {
+			subscription := eventBroker.Subscribe()
+
+			for i := 0; i < 100; i++ {
+				eventBroker.Publish(NewEvent(EventTypeUpdated, "fake-instance-id"))
+			}
+
+			Eventually(func() bool {
+				_, ok := <-subscription.Events
+				return ok
+			}).Should(BeFalse())
+		})
+	})
+
+	Describe("LastEventID", func() {
+		It("returns the ID of the last published event", func() {
+			Expect(eventBroker.LastEventID()).To(Equal(uint64(0)))
+
+			eventBroker.Publish(NewEvent(EventTypeCreated, "fake-instance-id"))
+			Expect(eventBroker.LastEventID()).To(Equal(uint64(1)))
+		})
+	})
+
+	Describe("Epoch", func() {
+		It("is different for every broker", func() {
+			Expect(eventBroker.Epoch()).ToNot(BeEmpty())
+			Expect(eventBroker.Epoch()).ToNot(Equal(NewEventBroker(3, logger).Epoch()))
+		})
+	})
+
+	Describe("Subscribe", func() {
+		It("does not receive events published before subscribing", func() {
+			eventBroker.Publish(NewEvent(EventTypeCreated, "fake-instance-id"))
+
+			subscription := eventBroker.Subscribe()
+			defer subscription.Close()
+
+			Consistently(subscription.Events).ShouldNot(Receive())
+		})
+	})
+
+	Describe("Resume", func() {
+		BeforeEach(func() {
+			for i := 0; i < 5; i++ {
+				eventBroker.Publish(NewEvent(EventTypeUpdated, "fake-instance-id"))
+			}
+		})
+
+		It("returns the buffered events published after the last event ID", func() {
+			backlog, subscription, complete := eventBroker.Resume(eventBroker.Epoch(), 3)
+			defer subscription.Close()
+
+			Expect(complete).To(BeTrue())
+			Expect(backlog).To(HaveLen(2))
+			Expect(backlog[0].ID).To(Equal(uint64(4)))
+			Expect(backlog[1].ID).To(Equal(uint64(5)))
+		})
+
+		It("returns the events still in the buffer if some are missing", func() {
+			backlog, subscription, complete := eventBroker.Resume(eventBroker.Epoch(), 1)
+			defer subscription.Close()
+
+			Expect(complete).To(BeFalse())
+			Expect(backlog).To(HaveLen(3))
+			Expect(backlog[0].ID).To(Equal(uint64(3)))
+		})
+
+		It("returns complete if no events are missing", func() {
+			backlog, subscription, complete := eventBroker.Resume(eventBroker.Epoch(), 2)
+			defer subscription.Close()
+
+			Expect(complete).To(BeTrue())
+			Expect(backlog).To(HaveLen(3))
+		})
+
+		It("returns all buffered events if the last event ID is unknown", func() {
+			backlog, subscription, complete := eventBroker.Resume(eventBroker.Epoch(), 42)
+			defer subscription.Close()
+
+			Expect(complete).To(BeFalse())
+			Expect(backlog).To(HaveLen(3))
+		})
+
+		It("returns all buffered events if the epoch is not the current one", func() {
+			backlog, subscription, complete := eventBroker.Resume("fake-epoch", 4)
+			defer subscription.Close()
+
+			Expect(complete).To(BeFalse())
+			Expect(backlog).To(HaveLen(3))
+			Expect(backlog[0].ID).To(Equal(uint64(3)))
+		})
+
+		It("receives events published after resuming", func() {
+			_, subscription, complete := eventBroker.Resume(eventBroker.Epoch(), 5)
+			defer subscription.Close()
+
+			Expect(complete).To(BeTrue())
+
+			eventBroker.Publish(NewEvent(EventTypeDeleted, "fake-instance-id"))
+
+			event := <-subscription.Events
+			Expect(event.ID).To(Equal(uint64(6)))
+			Expect(event.Type).To(Equal(EventTypeDeleted))
+		})
+	})
+})
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+const eventsHandlerLogTag = "RegistryServerEventsHandler"
+const eventsHandlerKeepAliveInterval = 15 * time.Second
+
+const EventTypeReset = "reset"
+
+type eventWithSettings struct {
+	Event
+	Settings string `json:"settings,omitempty"`
+}
+
+type EventsHandler struct {
+	users       *Users
+	eventBroker *EventBroker
+	logger      boshlog.Logger
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewEventsHandler(
+	users *Users,
+	eventBroker *EventBroker,
+	logger boshlog.Logger,
+) *EventsHandler {
+	return &EventsHandler{
+		users:       users,
+		eventBroker: eventBroker,
+		logger:      logger,
+		stop:        make(chan struct{}),
+	}
+}
+
+// Stop ends the events streams, so clients reconnect to another server while
+// this one shuts down.
+func (eh *EventsHandler) Stop() {
+	eh.stopOnce.Do(func() {
+		close(eh.stop)
+	})
+}
+
+func (eh *EventsHandler) HandleFunc(w http.ResponseWriter, req *http.Request) {
+	eh.logger.Debug(requestLogTag(eventsHandlerLogTag, req), "Received %s %s from %s", req.Method, req.URL.Path, req.RemoteAddr)
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	includeSettings := req.URL.Query().Get("include_settings") == "true"
+	if !eh.users.IsAuthorized(req, RoleReader) || (includeSettings && !eh.users.IsReplicationAuthorized(req)) {
+		eh.logger.Debug(requestLogTag(eventsHandlerLogTag, req), "Received unauthorized request")
+		w.Header().Add("WWW-Authenticate", `Basic realm="Bosh Registry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		eh.logger.Warn(requestLogTag(eventsHandlerLogTag, req), "Response writer does not support streaming")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var backlog []Event
+	var subscription *EventSubscription
+	complete := true
+	if lastEventIDHeader := req.Header.Get("Last-Event-ID"); lastEventIDHeader != "" {
+		epoch, lastEventID, err := parseEventStreamID(lastEventIDHeader)
+		if err != nil {
+			eh.logger.Debug(requestLogTag(eventsHandlerLogTag, req), "Invalid Last-Event-ID '%s'", lastEventIDHeader)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		eh.logger.Debug(requestLogTag(eventsHandlerLogTag, req), "Resuming events stream after event '%d' of epoch '%s'", lastEventID, epoch)
+		backlog, subscription, complete = eh.eventBroker.Resume(epoch, lastEventID)
+	} else {
+		subscription = eh.eventBroker.Subscribe()
+	}
+	defer subscription.Close()
+
+	prefix := req.URL.Query().Get("prefix")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	if !complete {
+		eh.logger.Debug(requestLogTag(eventsHandlerLogTag, req), "Events after '%s' are no longer available, sending reset", req.Header.Get("Last-Event-ID"))
+		// The reset event carries the ID preceding the events that follow, so
+		// clients resume from the current epoch after reconnecting.
+		resetEventID := subscription.lastEventID
+		if len(backlog) > 0 {
+			resetEventID = backlog[0].ID - 1
+		}
+		if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: {}\n\n", formatEventStreamID(eh.eventBroker.Epoch(), resetEventID), EventTypeReset); err != nil {
+			return
+		}
+	}
+
+	for _, event := range backlog {
+		if err := eh.writeEvent(w, event, prefix, includeSettings, req); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsHandlerKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, ok := <-subscription.Events:
+			if !ok {
+				return
+			}
+			if err := eh.writeEvent(w, event, prefix, includeSettings, req); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			eh.logger.Debug(requestLogTag(eventsHandlerLogTag, req), "Closing events stream for %s", req.RemoteAddr)
+			return
+		case <-eh.stop:
+			eh.logger.Debug(requestLogTag(eventsHandlerLogTag, req), "Closing events stream for %s, shutting down", req.RemoteAddr)
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (eh *EventsHandler) writeEvent(w http.ResponseWriter, event Event, prefix string, includeSettings bool, req *http.Request) error {
+	if !strings.HasPrefix(event.InstanceID, prefix) || (isTokenEvent(event) && !includeSettings) {
+		return nil
+	}
+
+	var data interface{} = event
+	if includeSettings {
+		data = eventWithSettings{Event: event, Settings: event.Settings}
+	}
+
+	eventJSON, err := json.Marshal(data)
+	if err != nil {
+		eh.logger.Warn(requestLogTag(eventsHandlerLogTag, req), "Failed to marshal event '%d': '%s'", event.ID, err.Error())
+		return nil
+	}
+
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", formatEventStreamID(eh.eventBroker.Epoch(), event.ID), event.Type, eventJSON)
+	return err
+}
+
+// formatEventStreamID returns the ID of an event in the events stream, made
+// of the epoch of the broker and the event ID.
+func formatEventStreamID(epoch string, eventID uint64) string {
+	if epoch == "" {
+		return strconv.FormatUint(eventID, 10)
+	}
+
+	return epoch + "-" + strconv.FormatUint(eventID, 10)
+}
+
+// parseEventStreamID returns the epoch and event ID of an events stream ID.
+// IDs without an epoch are accepted, but never match the epoch of a broker.
+func parseEventStreamID(streamID string) (string, uint64, error) {
+	var epoch string
+	if i := strings.LastIndex(streamID, "-"); i >= 0 {
+		epoch, streamID = streamID[:i], streamID[i+1:]
+	}
+
+	eventID, err := strconv.ParseUint(streamID, 10, 64)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return epoch, eventID, nil
+}
@@ -0,0 +1,222 @@
+package server_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var _ = Describe("EventsHandler", func() {
+	var (
+		err              error
+		responseRecorder *httptest.ResponseRecorder
+		request          *http.Request
+		eventBroker      *EventBroker
+		eventsHandler    *EventsHandler
+
+		logger = boshlog.NewLogger(boshlog.LevelNone)
+		config = Config{
+			Protocol: "http",
+			Address:  "fake-host",
+			Port:     5555,
+			Username: "fake-username",
+			Password: "fake-password",
+		}
+	)
+
+	BeforeEach(func() {
+		responseRecorder = httptest.NewRecorder()
+		eventBroker = NewEventBroker(10, logger)
+		eventsHandler = NewEventsHandler(newUsers(config), eventBroker, logger)
+
+		eventBroker.Publish(NewEvent(EventTypeCreated, "fake-instance-id-1"))
+		eventBroker.Publish(NewEvent(EventTypeCreated, "other-instance-id"))
+		eventBroker.Publish(NewEvent(EventTypeDeleted, "fake-instance-id-1"))
+	})
+
+	streamEvents := func(request *http.Request, publish func()) string {
+		ctx, cancel := context.WithCancel(request.Context())
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			eventsHandler.HandleFunc(responseRecorder, request.WithContext(ctx))
+			close(done)
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		publish()
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+		Eventually(done).Should(BeClosed())
+
+		return responseRecorder.Body.String()
+	}
+
+	It("returns an Unauthorized error if request does not contain credentials", func() {
+		request, err = http.NewRequest("GET", "/events", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		eventsHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusUnauthorized))
+		Expect(responseRecorder.HeaderMap).To(HaveKey("Www-Authenticate"))
+	})
+
+	It("returns a Bad Request error if Last-Event-ID is not valid", func() {
+		request, err = http.NewRequest("GET", "/events", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.SetBasicAuth("fake-username", "fake-password")
+		request.Header.Set("Last-Event-ID", "fake-event-id")
+
+		eventsHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("streams events published after connecting", func() {
+		request, err = http.NewRequest("GET", "/events", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.SetBasicAuth("fake-username", "fake-password")
+
+		body := streamEvents(request, func() {
+			eventBroker.Publish(NewEvent(EventTypeUpdated, "fake-instance-id-2"))
+		})
+		Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+		Expect(responseRecorder.HeaderMap.Get("Content-Type")).To(Equal("text/event-stream"))
+		Expect(body).To(HavePrefix("id: " + eventBroker.Epoch() + "-4\nevent: updated\ndata: " + `{"id":4,"type":"updated","instance_id":"fake-instance-id-2",`))
+		Expect(body).ToNot(ContainSubstring("-3\n"))
+	})
+
+	It("ends the stream when stopped", func() {
+		request, err = http.NewRequest("GET", "/events", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.SetBasicAuth("fake-username", "fake-password")
+
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			eventsHandler.HandleFunc(responseRecorder, request)
+			close(done)
+		}()
+
+		Consistently(done).ShouldNot(BeClosed())
+		eventsHandler.Stop()
+		Eventually(done).Should(BeClosed())
+	})
+
+	It("resumes the stream after the Last-Event-ID", func() {
+		request, err = http.NewRequest("GET", "/events", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.SetBasicAuth("fake-username", "fake-password")
+		request.Header.Set("Last-Event-ID", eventBroker.Epoch()+"-1")
+
+		body := streamEvents(request, func() {})
+		Expect(body).ToNot(ContainSubstring("event: reset\n"))
+		Expect(body).ToNot(ContainSubstring("-1\n"))
+		Expect(body).To(ContainSubstring("id: " + eventBroker.Epoch() + "-2\nevent: created\n"))
+		Expect(body).To(ContainSubstring("id: " + eventBroker.Epoch() + "-3\nevent: deleted\n"))
+	})
+
+	It("filters events by instance ID prefix", func() {
+		request, err = http.NewRequest("GET", "/events?prefix=fake-", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.SetBasicAuth("fake-username", "fake-password")
+		request.Header.Set("Last-Event-ID", eventBroker.Epoch()+"-0")
+
+		body := streamEvents(request, func() {
+			eventBroker.Publish(NewEvent(EventTypeUpdated, "other-instance-id"))
+		})
+		Expect(body).To(ContainSubstring("id: " + eventBroker.Epoch() + "-1\n"))
+		Expect(body).To(ContainSubstring("id: " + eventBroker.Epoch() + "-3\n"))
+		Expect(body).ToNot(ContainSubstring("other-instance-id"))
+	})
+
+	It("sends a reset event if events after the Last-Event-ID are no longer available", func() {
+		request, err = http.NewRequest("GET", "/events", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.SetBasicAuth("fake-username", "fake-password")
+		request.Header.Set("Last-Event-ID", eventBroker.Epoch()+"-42")
+
+		body := streamEvents(request, func() {})
+		Expect(body).To(HavePrefix("id: " + eventBroker.Epoch() + "-0\nevent: reset\ndata: {}\n\n"))
+		Expect(body).To(ContainSubstring("id: " + eventBroker.Epoch() + "-1\n"))
+	})
+
+	It("sends a reset event if the Last-Event-ID belongs to another epoch", func() {
+		request, err = http.NewRequest("GET", "/events", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.SetBasicAuth("fake-username", "fake-password")
+		request.Header.Set("Last-Event-ID", "fake-epoch-2")
+
+		body := streamEvents(request, func() {})
+		Expect(body).To(HavePrefix("id: " + eventBroker.Epoch() + "-0\nevent: reset\ndata: {}\n\n"))
+		Expect(body).To(ContainSubstring("id: " + eventBroker.Epoch() + "-1\n"))
+		Expect(body).To(ContainSubstring("id: " + eventBroker.Epoch() + "-3\n"))
+	})
+
+	It("sends a reset event if the Last-Event-ID has no epoch", func() {
+		request, err = http.NewRequest("GET", "/events", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.SetBasicAuth("fake-username", "fake-password")
+		request.Header.Set("Last-Event-ID", "2")
+
+		body := streamEvents(request, func() {})
+		Expect(body).To(HavePrefix("id: " + eventBroker.Epoch() + "-0\nevent: reset\ndata: {}\n\n"))
+	})
+
+	It("includes settings if requested", func() {
+		request, err = http.NewRequest("GET", "/events?include_settings=true", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.SetBasicAuth("fake-username", "fake-password")
+
+		body := streamEvents(request, func() {
+			event := NewEvent(EventTypeUpdated, "fake-instance-id-2")
+			event.Settings = `{"agent_id":"fake-agent-id"}`
+			eventBroker.Publish(event)
+		})
+		Expect(body).To(ContainSubstring(`"settings":"{\"agent_id\":\"fake-agent-id\"}"`))
+	})
+
+	It("streams token events only if settings are included", func() {
+		request, err = http.NewRequest("GET", "/events", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.SetBasicAuth("fake-username", "fake-password")
+
+		body := streamEvents(request, func() {
+			eventBroker.Publish(NewEvent(EventTypeTokenRevoked, "fake-instance-id-1"))
+		})
+		Expect(body).ToNot(ContainSubstring("token_revoked"))
+
+		responseRecorder = httptest.NewRecorder()
+		request, err = http.NewRequest("GET", "/events?include_settings=true", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.SetBasicAuth("fake-username", "fake-password")
+
+		body = streamEvents(request, func() {
+			eventBroker.Publish(NewEvent(EventTypeTokenRevoked, "fake-instance-id-1"))
+		})
+		Expect(body).To(ContainSubstring("event: token_revoked\n"))
+	})
+
+	It("refuses to include settings to users without the replicator or admin role", func() {
+		readerPasswordHash, err := bcrypt.GenerateFromPassword([]byte("fake-reader-password"), bcrypt.MinCost)
+		Expect(err).ToNot(HaveOccurred())
+		readerConfig := config
+		readerConfig.Users = []UserConfig{{Name: "fake-reader", PasswordHash: string(readerPasswordHash), Role: RoleReader}}
+		eventsHandler = NewEventsHandler(newUsers(readerConfig), eventBroker, logger)
+
+		request, err = http.NewRequest("GET", "/events?include_settings=true", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.SetBasicAuth("fake-reader", "fake-reader-password")
+
+		eventsHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusUnauthorized))
+	})
+})
@@ -0,0 +1,25 @@
+package fakes
+
+import (
+	"net/http"
+)
+
+type FakeAuthenticator struct {
+	AuthenticateCalled       bool
+	AuthenticateInstanceID   string
+	AuthenticateSettingsJSON string
+	AuthenticateErr          error
+
+	RequiresSettingsResult bool
+}
+
+func (a *FakeAuthenticator) Authenticate(req *http.Request, instanceID string, settingsJSON string) error {
+	a.AuthenticateCalled = true
+	a.AuthenticateInstanceID = instanceID
+	a.AuthenticateSettingsJSON = settingsJSON
+	return a.AuthenticateErr
+}
+
+func (a *FakeAuthenticator) RequiresSettings() bool {
+	return a.RequiresSettingsResult
+}
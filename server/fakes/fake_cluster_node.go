@@ -0,0 +1,53 @@
+package fakes
+
+import (
+	"github.com/frodenas/bosh-registry/server/cluster"
+)
+
+type FakeClusterNode struct {
+	ClusterConfig cluster.Config
+
+	Leading bool
+
+	LeaderMember cluster.Member
+	LeaderFound  bool
+
+	MembersList []cluster.Member
+	MembersErr  error
+
+	JoinCalled bool
+	JoinMember cluster.Member
+	JoinErr    error
+
+	RemoveCalled bool
+	RemoveID     string
+	RemoveErr    error
+}
+
+func (n *FakeClusterNode) Config() cluster.Config {
+	return n.ClusterConfig
+}
+
+func (n *FakeClusterNode) IsLeader() bool {
+	return n.Leading
+}
+
+func (n *FakeClusterNode) Leader() (cluster.Member, bool) {
+	return n.LeaderMember, n.LeaderFound
+}
+
+func (n *FakeClusterNode) Members() ([]cluster.Member, error) {
+	return n.MembersList, n.MembersErr
+}
+
+func (n *FakeClusterNode) Join(member cluster.Member) error {
+	n.JoinCalled = true
+	n.JoinMember = member
+	return n.JoinErr
+}
+
+func (n *FakeClusterNode) Remove(id string) error {
+	n.RemoveCalled = true
+	n.RemoveID = id
+	return n.RemoveErr
+}
@@ -0,0 +1,15 @@
+package fakes
+
+import (
+	"github.com/frodenas/bosh-registry/server"
+)
+
+type FakeEventPublisher struct {
+	PublishCalled   bool
+	PublishedEvents []server.Event
+}
+
+func (p *FakeEventPublisher) Publish(event server.Event) {
+	p.PublishCalled = true
+	p.PublishedEvents = append(p.PublishedEvents, event)
+}
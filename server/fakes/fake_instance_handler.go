@@ -16,6 +16,7 @@ type FakeInstanceHandler struct {
 	Username         string
 	Password         string
 	InstanceSettings []byte
+	RequestIDs       []string
 }
 
 func NewFakeInstanceHandler(username string, password string) *FakeInstanceHandler {
@@ -27,6 +28,8 @@ func NewFakeInstanceHandler(username string, password string) *FakeInstanceHandl
 }
 
 func (s *FakeInstanceHandler) HandleFunc(w http.ResponseWriter, req *http.Request) {
+	s.RequestIDs = append(s.RequestIDs, req.Header.Get("X-Request-Id"))
+
 	if req.Method == "GET" {
 		if s.InstanceSettings != nil {
 			response := agentSettingsResponse{
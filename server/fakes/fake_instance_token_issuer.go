@@ -0,0 +1,36 @@
+package fakes
+
+type FakeInstanceTokenIssuer struct {
+	IssueCalled     bool
+	IssueInstanceID string
+	IssueToken      string
+	IssueErr        error
+
+	RevokeCalled     bool
+	RevokeInstanceID string
+	RevokeErr        error
+
+	RevokeUsedCalled     bool
+	RevokeUsedInstanceID string
+	RevokeUsedToken      string
+	RevokeUsedErr        error
+}
+
+func (i *FakeInstanceTokenIssuer) IssueInstanceToken(instanceID string) (string, error) {
+	i.IssueCalled = true
+	i.IssueInstanceID = instanceID
+	return i.IssueToken, i.IssueErr
+}
+
+func (i *FakeInstanceTokenIssuer) RevokeInstanceToken(instanceID string) error {
+	i.RevokeCalled = true
+	i.RevokeInstanceID = instanceID
+	return i.RevokeErr
+}
+
+func (i *FakeInstanceTokenIssuer) RevokeUsedInstanceToken(instanceID string, token string) error {
+	i.RevokeUsedCalled = true
+	i.RevokeUsedInstanceID = instanceID
+	i.RevokeUsedToken = token
+	return i.RevokeUsedErr
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const healthPath = "/healthz"
+
+const HealthStatusOK = "ok"
+
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+// HealthHandler reports the server is alive, i.e. still answers requests,
+// even when draining. It does not require authentication.
+type HealthHandler struct{}
+
+func NewHealthHandler() *HealthHandler {
+	return &HealthHandler{}
+}
+
+func (hh *HealthHandler) HandleFunc(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	responseJSON, err := json.Marshal(HealthResponse{Status: HealthStatusOK})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseJSON)
+}
@@ -0,0 +1,40 @@
+package server_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+)
+
+var _ = Describe("HealthHandler", func() {
+	var (
+		err              error
+		request          *http.Request
+		responseRecorder *httptest.ResponseRecorder
+		healthHandler    *HealthHandler
+	)
+
+	BeforeEach(func() {
+		request, err = http.NewRequest("GET", "/healthz", nil)
+		Expect(err).ToNot(HaveOccurred())
+		responseRecorder = httptest.NewRecorder()
+		healthHandler = NewHealthHandler()
+	})
+
+	It("reports ok", func() {
+		healthHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+		Expect(responseRecorder.Body.String()).To(MatchJSON(`{"status":"ok"}`))
+	})
+
+	It("returns 405 Method Not Allowed if request method is not GET or HEAD", func() {
+		request.Method = "POST"
+
+		healthHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusMethodNotAllowed))
+	})
+})
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const infoPath = "/info"
+
+// Info describes the running server: its version, how it was built, the
+// features enabled by its configuration and its store adapter.
+type Info struct {
+	Version      string    `json:"version"`
+	Build        BuildInfo `json:"build"`
+	Features     []string  `json:"features"`
+	StoreAdapter string    `json:"store_adapter"`
+}
+
+type BuildInfo struct {
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// InfoHandler reports the Info of the server. It does not require
+// authentication.
+type InfoHandler struct {
+	info Info
+}
+
+func NewInfoHandler(info Info) *InfoHandler {
+	if info.Features == nil {
+		info.Features = []string{}
+	}
+
+	return &InfoHandler{info: info}
+}
+
+func (ih *InfoHandler) HandleFunc(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	responseJSON, err := json.Marshal(ih.info)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseJSON)
+}
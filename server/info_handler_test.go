@@ -0,0 +1,61 @@
+package server_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+)
+
+var _ = Describe("InfoHandler", func() {
+	var (
+		err              error
+		request          *http.Request
+		responseRecorder *httptest.ResponseRecorder
+		infoHandler      *InfoHandler
+	)
+
+	BeforeEach(func() {
+		request, err = http.NewRequest("GET", "/info", nil)
+		Expect(err).ToNot(HaveOccurred())
+		responseRecorder = httptest.NewRecorder()
+		infoHandler = NewInfoHandler(Info{
+			Version: "1.2.3",
+			Build: BuildInfo{
+				Commit:    "fake-commit",
+				Date:      "2016-01-02T15:04:05Z",
+				GoVersion: "go1.6",
+			},
+			Features:     []string{"read_auth_none", "tls"},
+			StoreAdapter: "bolt",
+		})
+	})
+
+	It("reports the info", func() {
+		infoHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+		Expect(responseRecorder.Body.String()).To(MatchJSON(`{
+			"version": "1.2.3",
+			"build": {"commit": "fake-commit", "date": "2016-01-02T15:04:05Z", "go_version": "go1.6"},
+			"features": ["read_auth_none", "tls"],
+			"store_adapter": "bolt"
+		}`))
+	})
+
+	It("reports empty features as a list", func() {
+		infoHandler = NewInfoHandler(Info{Version: "dev", Build: BuildInfo{GoVersion: "go1.6"}, StoreAdapter: "bolt"})
+
+		infoHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Body.String()).To(MatchJSON(`{"version":"dev","build":{"go_version":"go1.6"},"features":[],"store_adapter":"bolt"}`))
+	})
+
+	It("returns 405 Method Not Allowed if request method is not GET or HEAD", func() {
+		request.Method = "POST"
+
+		infoHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusMethodNotAllowed))
+	})
+})
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+)
+
+const (
+	systemdListenPIDEnv  = "LISTEN_PID"
+	systemdListenFDsEnv  = "LISTEN_FDS"
+	systemdListenNameEnv = "LISTEN_FDNAMES"
+	systemdListenFDStart = 3
+)
+
+// fileListener is a listener whose socket can be passed on to another
+// process.
+type fileListener interface {
+	net.Listener
+	File() (*os.File, error)
+}
+
+// inheritedSocket is a socket inherited from another process. The sockets
+// passed on by the process being upgraded are owned by the registry, while
+// the ones passed by systemd are owned by systemd.
+type inheritedSocket struct {
+	listener fileListener
+	owned    bool
+}
+
+var (
+	inheritedListenersOnce  sync.Once
+	inheritedListenersMutex sync.Mutex
+	inheritedListeners      map[string]inheritedSocket
+	inheritedListenersErr   error
+)
+
+// inheritedListener takes the socket for an address inherited from the
+// process being upgraded or passed by systemd socket activation.
+func inheritedListener(address string) (inheritedSocket, bool, error) {
+	inheritedListenersOnce.Do(loadInheritedListeners)
+	if inheritedListenersErr != nil {
+		return inheritedSocket{}, false, inheritedListenersErr
+	}
+
+	inheritedListenersMutex.Lock()
+	defer inheritedListenersMutex.Unlock()
+
+	for inheritedAddress, socket := range inheritedListeners {
+		if sameAddress(inheritedAddress, address) {
+			delete(inheritedListeners, inheritedAddress)
+			return socket, true, nil
+		}
+	}
+
+	return inheritedSocket{}, false, nil
+}
+
+// closeInheritedListeners closes the inherited sockets not taken by any
+// listener.
+func closeInheritedListeners() {
+	inheritedListenersOnce.Do(loadInheritedListeners)
+
+	inheritedListenersMutex.Lock()
+	defer inheritedListenersMutex.Unlock()
+
+	for _, socket := range inheritedListeners {
+		socket.listener.Close()
+	}
+	inheritedListeners = map[string]inheritedSocket{}
+}
+
+func loadInheritedListeners() {
+	inheritedListeners = map[string]inheritedSocket{}
+
+	files, err := upgradeFiles()
+	if err != nil {
+		inheritedListenersErr = err
+		return
+	}
+
+	systemdFiles, err := systemdFiles()
+	if err != nil {
+		inheritedListenersErr = err
+		return
+	}
+
+	for _, file := range files {
+		if err := addInheritedListener(file, file.Name(), true); err != nil {
+			inheritedListenersErr = err
+			return
+		}
+	}
+
+	for _, file := range systemdFiles {
+		if err := addInheritedListener(file, "", false); err != nil {
+			inheritedListenersErr = err
+			return
+		}
+	}
+}
+
+// addInheritedListener adds the socket of a file by its address, or by the
+// address it is bound to when not given.
+func addInheritedListener(file *os.File, address string, owned bool) error {
+	listener, err := net.FileListener(file)
+	file.Close()
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Using inherited socket '%s'", file.Name())
+	}
+
+	inherited, ok := listener.(fileListener)
+	if !ok {
+		listener.Close()
+		return bosherr.Errorf("Inherited socket '%s' is not a TCP or Unix socket", file.Name())
+	}
+
+	if address == "" {
+		address = listener.Addr().String()
+	}
+	inheritedListeners[address] = inheritedSocket{listener: inherited, owned: owned}
+
+	return nil
+}
+
+// upgradeFiles returns the sockets passed on by the process being upgraded,
+// listed as comma-separated "address=fd" pairs.
+func upgradeFiles() ([]*os.File, error) {
+	value := os.Getenv(upgradeListenersEnv)
+	if value == "" {
+		return nil, nil
+	}
+	os.Unsetenv(upgradeListenersEnv)
+
+	var files []*os.File
+	for _, pair := range strings.Split(value, ",") {
+		separator := strings.LastIndex(pair, "=")
+		if separator == -1 {
+			return nil, bosherr.Errorf("Invalid inherited socket '%s'", pair)
+		}
+
+		fd, err := strconv.Atoi(pair[separator+1:])
+		if err != nil {
+			return nil, bosherr.WrapErrorf(err, "Invalid inherited socket '%s'", pair)
+		}
+
+		files = append(files, os.NewFile(uintptr(fd), pair[:separator]))
+	}
+
+	return files, nil
+}
+
+// systemdFiles returns the sockets passed by systemd socket activation, as
+// described at https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html.
+func systemdFiles() ([]*os.File, error) {
+	pid, err := strconv.Atoi(os.Getenv(systemdListenPIDEnv))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv(systemdListenFDsEnv))
+	if err != nil || count < 0 {
+		return nil, bosherr.Errorf("Invalid %s '%s'", systemdListenFDsEnv, os.Getenv(systemdListenFDsEnv))
+	}
+
+	names := strings.Split(os.Getenv(systemdListenNameEnv), ":")
+	os.Unsetenv(systemdListenPIDEnv)
+	os.Unsetenv(systemdListenFDsEnv)
+	os.Unsetenv(systemdListenNameEnv)
+
+	var files []*os.File
+	for i := 0; i < count; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(systemdListenFDStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		files = append(files, os.NewFile(uintptr(systemdListenFDStart+i), name))
+	}
+
+	return files, nil
+}
+
+// sameAddress reports whether two listening addresses are the same, taking
+// any unspecified IP, e.g. "0.0.0.0" or "::", as equal to the others.
+func sameAddress(address, otherAddress string) bool {
+	if address == otherAddress {
+		return true
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+
+	otherHost, otherPort, err := net.SplitHostPort(otherAddress)
+	if err != nil || port != otherPort {
+		return false
+	}
+
+	return isUnspecifiedHost(host) && isUnspecifiedHost(otherHost)
+}
+
+func isUnspecifiedHost(host string) bool {
+	if host == "" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
@@ -1,7 +1,6 @@
 package server
 
 import (
-	"encoding/base64"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
@@ -9,26 +8,36 @@ import (
 
 	boshlog "github.com/cloudfoundry/bosh-utils/logger"
 
+	"github.com/frodenas/bosh-registry/redact"
 	"github.com/frodenas/bosh-registry/server/store"
 )
 
 const instanceHandlerLogTag = "RegistryServerInstanceHandler"
 
 type InstanceHandler struct {
-	config        Config
-	registryStore store.Store
-	logger        boshlog.Logger
+	readAuthenticator  Authenticator
+	writeAuthenticator Authenticator
+	registryStore      store.Store
+	instanceTokens     InstanceTokenIssuer
+	eventPublisher     EventPublisher
+	logger             boshlog.Logger
 }
 
 func NewInstanceHandler(
-	config Config,
+	readAuthenticator Authenticator,
+	writeAuthenticator Authenticator,
 	registryStore store.Store,
+	instanceTokens InstanceTokenIssuer,
+	eventPublisher EventPublisher,
 	logger boshlog.Logger,
 ) *InstanceHandler {
 	return &InstanceHandler{
-		config:        config,
-		registryStore: registryStore,
-		logger:        logger,
+		readAuthenticator:  readAuthenticator,
+		writeAuthenticator: writeAuthenticator,
+		registryStore:      registryStore,
+		instanceTokens:     instanceTokens,
+		eventPublisher:     eventPublisher,
+		logger:             logger,
 	}
 }
 
@@ -37,16 +46,21 @@ type SettingsResponse struct {
 	Status   string `json:"status"`
 }
 
+type TokenResponse struct {
+	Token  string `json:"token"`
+	Status string `json:"status"`
+}
+
 func (ih *InstanceHandler) HandleFunc(w http.ResponseWriter, req *http.Request) {
-	ih.logger.Debug(instanceHandlerLogTag, "Received %s %s from %s", req.Method, req.URL.Path, req.RemoteAddr)
+	ih.logger.Debug(requestLogTag(instanceHandlerLogTag, req), "Received %s %s from %s", req.Method, req.URL.Path, req.RemoteAddr)
 	instanceID, found := ih.getInstanceID(req)
 	if !found {
-		ih.logger.Debug(instanceHandlerLogTag, "Instance ID not found in request:", req.Method)
-		ih.handleNotFound(w)
+		ih.logger.Debug(requestLogTag(instanceHandlerLogTag, req), "Instance ID not found in request:", req.Method)
+		ih.handleNotFound(w, req)
 		return
 	}
 
-	ih.logger.Debug(instanceHandlerLogTag, "Found instance ID in request: '%s'", instanceID)
+	ih.logger.Debug(requestLogTag(instanceHandlerLogTag, req), "Found instance ID in request: '%s'", instanceID)
 
 	switch req.Method {
 	case "GET":
@@ -59,25 +73,58 @@ func (ih *InstanceHandler) HandleFunc(w http.ResponseWriter, req *http.Request)
 		ih.HandleDelete(instanceID, w, req)
 		return
 	default:
-		ih.handleNotFound(w)
+		ih.handleNotFound(w, req)
 		return
 	}
 }
 
+// HandleGet authenticates the request before looking the settings up, so
+// that unauthenticated callers cannot tell which instances exist. When the
+// read authenticator needs the settings, as with the instance IP check, they
+// are looked up first and missing settings are unauthorized.
 func (ih *InstanceHandler) HandleGet(instanceID string, w http.ResponseWriter, req *http.Request) {
+	authorized := false
+	if !requiresSettings(ih.readAuthenticator) {
+		if !ih.isReadAuthorized(req, instanceID, "") {
+			ih.handleUnauthorized(w, req)
+			return
+		}
+		authorized = true
+	}
+
+	ih.logger.Debug(requestLogTag(instanceHandlerLogTag, req), "Reading settings for instance '%s'", instanceID)
 	settingsJSON, found, err := ih.registryStore.Get(instanceID)
 	if err != nil {
-		ih.logger.Debug(instanceHandlerLogTag, "Failed to read settings for instance '%s': '%v'", err)
-		ih.handleBadRequest(w)
+		ih.logger.Debug(requestLogTag(instanceHandlerLogTag, req), "Failed to read settings for instance '%s': '%v'", instanceID, err)
+		ih.handleBadRequest(w, req)
 		return
 	}
 	if !found {
-		ih.logger.Debug(instanceHandlerLogTag, "No settings for instance '%s' found", instanceID)
-		ih.handleNotFound(w)
+		ih.logger.Debug(requestLogTag(instanceHandlerLogTag, req), "No settings for instance '%s' found", instanceID)
+		if !authorized {
+			ih.handleUnauthorized(w, req)
+			return
+		}
+		ih.handleNotFound(w, req)
 		return
 	}
 
-	ih.logger.Debug(instanceHandlerLogTag, "Found settings for instance '%s': '%s'", instanceID, string(settingsJSON))
+	if !authorized && !ih.isReadAuthorized(req, instanceID, settingsJSON) {
+		ih.handleUnauthorized(w, req)
+		return
+	}
+
+	// One-time instance tokens are revoked once the settings have been read,
+	// so agents can retry reads failing before.
+	if token := instanceTokenFromRequest(req); token != "" {
+		if err = ih.instanceTokens.RevokeUsedInstanceToken(instanceID, token); err != nil {
+			ih.logger.Debug(requestLogTag(instanceHandlerLogTag, req), "Failed to revoke token for instance '%s': '%v'", instanceID, err)
+			ih.handleUnauthorized(w, req)
+			return
+		}
+	}
+
+	ih.logger.Debug(requestLogTag(instanceHandlerLogTag, req), "Found settings for instance '%s': '%s'", instanceID, redact.SettingsJSON(string(settingsJSON)))
 
 	response := SettingsResponse{
 		Settings: string(settingsJSON),
@@ -86,7 +133,7 @@ func (ih *InstanceHandler) HandleGet(instanceID string, w http.ResponseWriter, r
 
 	responseJSON, err := json.Marshal(response)
 	if err != nil {
-		ih.handleBadRequest(w)
+		ih.handleBadRequest(w, req)
 		return
 	}
 
@@ -95,38 +142,81 @@ func (ih *InstanceHandler) HandleGet(instanceID string, w http.ResponseWriter, r
 
 func (ih *InstanceHandler) HandlePut(instanceID string, w http.ResponseWriter, req *http.Request) {
 	if !ih.isAuthorized(req, instanceID) {
-		ih.handleUnauthorized(w)
+		ih.handleUnauthorized(w, req)
 		return
 	}
 
 	reqBody, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		ih.handleBadRequest(w)
+		ih.handleBadRequest(w, req)
 		return
 	}
 
-	ih.logger.Debug(instanceHandlerLogTag, "Saving settings for instance '%s': '%s'", instanceID, string(reqBody))
+	_, exists, err := ih.registryStore.Get(instanceID)
+	if err != nil {
+		ih.logger.Debug(requestLogTag(instanceHandlerLogTag, req), "Failed to read settings for instance '%s': '%v'", instanceID, err)
+		ih.handleBadRequest(w, req)
+		return
+	}
+
+	// The token is issued first, so a failure does not answer an error for
+	// settings already saved and published.
+	var token string
+	if req.URL.Query().Get("issue_token") == "true" {
+		ih.logger.Debug(requestLogTag(instanceHandlerLogTag, req), "Issuing token for instance '%s'", instanceID)
+		if token, err = ih.instanceTokens.IssueInstanceToken(instanceID); err != nil {
+			ih.logger.Debug(requestLogTag(instanceHandlerLogTag, req), "Failed to issue token for instance '%s': '%v'", instanceID, err)
+			ih.handleBadRequest(w, req)
+			return
+		}
+	}
+
+	ih.logger.Debug(requestLogTag(instanceHandlerLogTag, req), "Saving settings for instance '%s': '%s'", instanceID, redact.SettingsJSON(string(reqBody)))
 	if err = ih.registryStore.Save(instanceID, string(reqBody)); err != nil {
-		ih.logger.Debug(instanceHandlerLogTag, "Failed to save settings for instance '%s': '%v'", err)
-		ih.handleBadRequest(w)
+		ih.logger.Debug(requestLogTag(instanceHandlerLogTag, req), "Failed to save settings for instance '%s': '%v'", instanceID, err)
+		ih.handleBadRequest(w, req)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	event := NewEvent(EventTypeCreated, instanceID)
+	if exists {
+		event.Type = EventTypeUpdated
+	}
+	event.Settings = string(reqBody)
+	ih.eventPublisher.Publish(event)
+
+	if token == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	responseJSON, err := json.Marshal(TokenResponse{Token: token, Status: "ok"})
+	if err != nil {
+		ih.handleBadRequest(w, req)
+		return
+	}
+
+	w.Write(responseJSON)
 }
 
 func (ih *InstanceHandler) HandleDelete(instanceID string, w http.ResponseWriter, req *http.Request) {
 	if !ih.isAuthorized(req, instanceID) {
-		ih.handleUnauthorized(w)
+		ih.handleUnauthorized(w, req)
 		return
 	}
 
-	ih.logger.Debug(instanceHandlerLogTag, "Deleting settings for instance '%s'", instanceID)
+	ih.logger.Debug(requestLogTag(instanceHandlerLogTag, req), "Deleting settings for instance '%s'", instanceID)
 	if err := ih.registryStore.Delete(instanceID); err != nil {
-		ih.logger.Debug(instanceHandlerLogTag, "Failed to delete settings for instance '%s': '%v'", err)
-		ih.handleBadRequest(w)
+		ih.logger.Debug(requestLogTag(instanceHandlerLogTag, req), "Failed to delete settings for instance '%s': '%v'", instanceID, err)
+		ih.handleBadRequest(w, req)
 		return
 	}
+
+	if err := ih.instanceTokens.RevokeInstanceToken(instanceID); err != nil {
+		ih.logger.Warn(requestLogTag(instanceHandlerLogTag, req), "Failed to revoke token for instance '%s': '%v'", instanceID, err)
+	}
+
+	ih.eventPublisher.Publish(NewEvent(EventTypeDeleted, instanceID))
 }
 
 func (ih *InstanceHandler) getInstanceID(req *http.Request) (string, bool) {
@@ -141,35 +231,46 @@ func (ih *InstanceHandler) getInstanceID(req *http.Request) (string, bool) {
 }
 
 func (ih *InstanceHandler) isAuthorized(req *http.Request, instanceID string) bool {
-	auth := ih.config.Username + ":" + ih.config.Password
-	expectedAuthorizationHeader := "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
+	if err := ih.writeAuthenticator.Authenticate(req, instanceID, ""); err != nil {
+		ih.logger.Warn(requestLogTag(instanceHandlerLogTag, req), "Refusing %s of settings for instance '%s' to '%s': %s", req.Method, instanceID, req.RemoteAddr, err.Error())
+		return false
+	}
+
+	return true
+}
+
+func (ih *InstanceHandler) isReadAuthorized(req *http.Request, instanceID string, settingsJSON string) bool {
+	if err := ih.readAuthenticator.Authenticate(req, instanceID, settingsJSON); err != nil {
+		ih.logger.Warn(requestLogTag(instanceHandlerLogTag, req), "Refusing settings for instance '%s' to '%s': %s", instanceID, req.RemoteAddr, err.Error())
+		return false
+	}
 
-	return expectedAuthorizationHeader == req.Header.Get("Authorization")
+	return true
 }
 
-func (ih *InstanceHandler) handleUnauthorized(w http.ResponseWriter) {
-	ih.logger.Debug(instanceHandlerLogTag, "Received unauthorized request")
+func (ih *InstanceHandler) handleUnauthorized(w http.ResponseWriter, req *http.Request) {
+	ih.logger.Debug(requestLogTag(instanceHandlerLogTag, req), "Received unauthorized request")
 	w.Header().Add("WWW-Authenticate", `Basic realm="Bosh Registry"`)
 	w.WriteHeader(http.StatusUnauthorized)
 }
 
-func (ih *InstanceHandler) handleNotFound(w http.ResponseWriter) {
+func (ih *InstanceHandler) handleNotFound(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusNotFound)
 
 	settingsJSON, err := json.Marshal(SettingsResponse{Status: "not_found"})
 	if err != nil {
-		ih.logger.Warn(instanceHandlerLogTag, "Failed to marshal 'not found' settings response: '%s'", err.Error())
+		ih.logger.Warn(requestLogTag(instanceHandlerLogTag, req), "Failed to marshal 'not found' settings response: '%s'", err.Error())
 		return
 	}
 	w.Write(settingsJSON)
 }
 
-func (ih *InstanceHandler) handleBadRequest(w http.ResponseWriter) {
+func (ih *InstanceHandler) handleBadRequest(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusBadRequest)
 
 	settingsJSON, err := json.Marshal(SettingsResponse{Status: "error"})
 	if err != nil {
-		ih.logger.Warn(instanceHandlerLogTag, "Failed to marshal 'bad request' settings response: '%s'", err.Error())
+		ih.logger.Warn(requestLogTag(instanceHandlerLogTag, req), "Failed to marshal 'bad request' settings response: '%s'", err.Error())
 		return
 	}
 	w.Write(settingsJSON)
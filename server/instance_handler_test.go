@@ -3,27 +3,35 @@ package server_test
 import (
 	"bytes"
 	"errors"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
 	. "github.com/frodenas/bosh-registry/server"
 
-	"github.com/frodenas/bosh-registry/server/store/fakes"
+	"github.com/frodenas/bosh-registry/server/fakes"
+	"github.com/frodenas/bosh-registry/server/store"
+	storefakes "github.com/frodenas/bosh-registry/server/store/fakes"
 
 	boshlog "github.com/cloudfoundry/bosh-utils/logger"
 )
 
 var _ = Describe("InstanceHandler", func() {
 	var (
-		err              error
-		logger           boshlog.Logger
-		responseRecorder *httptest.ResponseRecorder
-		request          *http.Request
-		registryStore    *fakes.FakeStore
-		instanceHandler  *InstanceHandler
+		err               error
+		logger            boshlog.Logger
+		responseRecorder  *httptest.ResponseRecorder
+		request           *http.Request
+		registryStore     *storefakes.FakeStore
+		eventPublisher    *fakes.FakeEventPublisher
+		readAuthenticator *fakes.FakeAuthenticator
+		instanceTokens    *fakes.FakeInstanceTokenIssuer
+		instanceHandler   *InstanceHandler
 
 		config = Config{
 			Protocol: "http",
@@ -31,13 +39,19 @@ var _ = Describe("InstanceHandler", func() {
 			Port:     5555,
 			Username: "fake-username",
 			Password: "fake-password",
+			Users: []UserConfig{
+				{Name: "fake-reader", PasswordHash: "$2a$04$7r81GRQeDgn8ssDbGBv.hu9S5SCsylmffgm4Hkr0fL37Tf.NbZEH.", Role: RoleReader},
+			},
 		}
 	)
 
 	BeforeEach(func() {
-		registryStore = &fakes.FakeStore{}
+		registryStore = &storefakes.FakeStore{}
+		eventPublisher = &fakes.FakeEventPublisher{}
 		logger = boshlog.NewLogger(boshlog.LevelNone)
-		instanceHandler = NewInstanceHandler(config, registryStore, logger)
+		readAuthenticator = &fakes.FakeAuthenticator{}
+		instanceTokens = &fakes.FakeInstanceTokenIssuer{IssueToken: "fake-token"}
+		instanceHandler = NewInstanceHandler(readAuthenticator, NewBasicAuthenticator(newUsers(config), RoleWriter), registryStore, instanceTokens, eventPublisher, logger)
 	})
 
 	Describe("HandleFunc", func() {
@@ -94,6 +108,148 @@ var _ = Describe("InstanceHandler", func() {
 			Expect(responseRecorder.Body.String()).To(ContainSubstring("error"))
 			Expect(registryStore.GetCalled).To(BeTrue())
 		})
+
+		It("returns an Unauthorized error if the read authenticator refuses the request", func() {
+			readAuthenticator.AuthenticateErr = errors.New("fake-authenticate-error")
+			registryStore.GetFound = true
+			registryStore.GetValue = "fake-instance-settings"
+
+			request, err = http.NewRequest("GET", "/instances/fake-instance-id/settings", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			instanceHandler.HandleFunc(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusUnauthorized))
+			Expect(responseRecorder.Body.String()).ToNot(ContainSubstring("fake-instance-settings"))
+			Expect(readAuthenticator.AuthenticateInstanceID).To(Equal("fake-instance-id"))
+			Expect(readAuthenticator.AuthenticateSettingsJSON).To(BeEmpty())
+		})
+
+		It("does not look the settings up if the read authenticator refuses the request", func() {
+			readAuthenticator.AuthenticateErr = errors.New("fake-authenticate-error")
+
+			request, err = http.NewRequest("GET", "/instances/fake-instance-id/settings", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			instanceHandler.HandleFunc(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusUnauthorized))
+			Expect(registryStore.GetCalled).To(BeFalse())
+		})
+
+		It("revokes the instance token used once the settings have been read", func() {
+			registryStore.GetFound = true
+			registryStore.GetValue = "fake-instance-settings"
+
+			request, err = http.NewRequest("GET", "/instances/fake-instance-id/settings", nil)
+			Expect(err).NotTo(HaveOccurred())
+			request.Header.Set("Authorization", "Bearer fake-token")
+
+			instanceHandler.HandleFunc(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(instanceTokens.RevokeUsedCalled).To(BeTrue())
+			Expect(instanceTokens.RevokeUsedInstanceID).To(Equal("fake-instance-id"))
+			Expect(instanceTokens.RevokeUsedToken).To(Equal("fake-token"))
+		})
+
+		It("returns an Unauthorized error if the instance token used cannot be revoked", func() {
+			registryStore.GetFound = true
+			registryStore.GetValue = "fake-instance-settings"
+			instanceTokens.RevokeUsedErr = errors.New("fake-revoke-error")
+
+			request, err = http.NewRequest("GET", "/instances/fake-instance-id/settings", nil)
+			Expect(err).NotTo(HaveOccurred())
+			request.Header.Set("Authorization", "Bearer fake-token")
+
+			instanceHandler.HandleFunc(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusUnauthorized))
+			Expect(responseRecorder.Body.String()).ToNot(ContainSubstring("fake-instance-settings"))
+		})
+
+		It("does not revoke the instance token used if the settings cannot be read", func() {
+			registryStore.GetErr = errors.New("fake-registry-store-error")
+
+			request, err = http.NewRequest("GET", "/instances/fake-instance-id/settings", nil)
+			Expect(err).NotTo(HaveOccurred())
+			request.Header.Set("Authorization", "Bearer fake-token")
+
+			instanceHandler.HandleFunc(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+			Expect(instanceTokens.RevokeUsedCalled).To(BeFalse())
+		})
+
+		Context("with one-time instance tokens", func() {
+			var (
+				tempDir    string
+				tokenStore store.Store
+			)
+
+			BeforeEach(func() {
+				tempDir, err = ioutil.TempDir("", "instance-handler")
+				Expect(err).ToNot(HaveOccurred())
+				tokenStore = store.NewBoltStore(store.BoltConfig{DBFile: filepath.Join(tempDir, "registry.db")}, logger)
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(tempDir)
+			})
+
+			It("accepts the token again if the first read fails", func() {
+				instanceTokens := NewInstanceTokens(InstanceTokensConfig{OneTimeUse: true}, tokenStore, eventPublisher)
+				instanceHandler = NewInstanceHandler(NewInstanceTokenAuthenticator(instanceTokens), NewBasicAuthenticator(newUsers(config), RoleWriter), registryStore, instanceTokens, eventPublisher, logger)
+
+				token, err := instanceTokens.IssueInstanceToken("fake-instance-id")
+				Expect(err).ToNot(HaveOccurred())
+
+				getSettings := func() int {
+					responseRecorder = httptest.NewRecorder()
+					request, err = http.NewRequest("GET", "/instances/fake-instance-id/settings", nil)
+					Expect(err).NotTo(HaveOccurred())
+					request.Header.Set("Authorization", "Bearer "+token)
+
+					instanceHandler.HandleFunc(responseRecorder, request)
+					return responseRecorder.Code
+				}
+
+				registryStore.GetErr = errors.New("fake-registry-store-error")
+				Expect(getSettings()).To(Equal(http.StatusBadRequest))
+
+				registryStore.GetErr = nil
+				Expect(getSettings()).To(Equal(http.StatusNotFound))
+
+				registryStore.GetFound = true
+				registryStore.GetValue = "fake-instance-settings"
+				Expect(getSettings()).To(Equal(http.StatusOK))
+				Expect(responseRecorder.Body.String()).To(ContainSubstring("fake-instance-settings"))
+
+				Expect(getSettings()).To(Equal(http.StatusUnauthorized))
+			})
+		})
+
+		Context("when the read authenticator requires the settings", func() {
+			BeforeEach(func() {
+				readAuthenticator.RequiresSettingsResult = true
+			})
+
+			It("authenticates the request with the instance settings", func() {
+				registryStore.GetFound = true
+				registryStore.GetValue = "fake-instance-settings"
+
+				request, err = http.NewRequest("GET", "/instances/fake-instance-id/settings", nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				instanceHandler.HandleFunc(responseRecorder, request)
+				Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+				Expect(readAuthenticator.AuthenticateSettingsJSON).To(Equal("fake-instance-settings"))
+			})
+
+			It("returns an Unauthorized error if instance settings have not been found", func() {
+				request, err = http.NewRequest("GET", "/instances/fake-instance-id/settings", nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				instanceHandler.HandleFunc(responseRecorder, request)
+				Expect(responseRecorder.Code).To(Equal(http.StatusUnauthorized))
+				Expect(readAuthenticator.AuthenticateCalled).To(BeFalse())
+			})
+		})
 	})
 
 	Describe("HandlePut", func() {
@@ -111,6 +267,86 @@ var _ = Describe("InstanceHandler", func() {
 			Expect(registryStore.SaveCalled).To(BeTrue())
 		})
 
+		It("does not log the secrets of the instance settings", func() {
+			logBuffer := &bytes.Buffer{}
+			logger = boshlog.NewWriterLogger(boshlog.LevelDebug, logBuffer, logBuffer)
+			instanceHandler = NewInstanceHandler(readAuthenticator, NewBasicAuthenticator(newUsers(config), RoleWriter), registryStore, instanceTokens, eventPublisher, logger)
+
+			settingsJSON := `{"agent_id":"fake-agent-id","env":{"bosh":{"password":"fake-password-hash"}}}`
+			request, err = http.NewRequest("PUT", "/instances/fake-instance-id/settings", bytes.NewReader([]byte(settingsJSON)))
+			request.SetBasicAuth("fake-username", "fake-password")
+			Expect(err).NotTo(HaveOccurred())
+
+			instanceHandler.HandleFunc(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(logBuffer.String()).To(ContainSubstring("fake-agent-id"))
+			Expect(logBuffer.String()).ToNot(ContainSubstring("fake-password-hash"))
+		})
+
+		It("does not issue a token if not requested", func() {
+			request, err = http.NewRequest("PUT", "/instances/fake-instance-id/settings", bytes.NewReader([]byte("fake-instance-settings")))
+			request.SetBasicAuth("fake-username", "fake-password")
+			Expect(err).NotTo(HaveOccurred())
+
+			instanceHandler.HandleFunc(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(responseRecorder.Body.String()).To(BeEmpty())
+			Expect(instanceTokens.IssueCalled).To(BeFalse())
+		})
+
+		It("returns an instance token if requested", func() {
+			request, err = http.NewRequest("PUT", "/instances/fake-instance-id/settings?issue_token=true", bytes.NewReader([]byte("fake-instance-settings")))
+			request.SetBasicAuth("fake-username", "fake-password")
+			Expect(err).NotTo(HaveOccurred())
+
+			instanceHandler.HandleFunc(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(responseRecorder.Body.String()).To(Equal(`{"token":"fake-token","status":"ok"}`))
+			Expect(instanceTokens.IssueInstanceID).To(Equal("fake-instance-id"))
+			Expect(registryStore.SaveCalled).To(BeTrue())
+		})
+
+		It("returns a Bad request error without saving the settings if the instance token cannot be issued", func() {
+			instanceTokens.IssueErr = errors.New("fake-issue-error")
+
+			request, err = http.NewRequest("PUT", "/instances/fake-instance-id/settings?issue_token=true", bytes.NewReader([]byte("fake-instance-settings")))
+			request.SetBasicAuth("fake-username", "fake-password")
+			Expect(err).NotTo(HaveOccurred())
+
+			instanceHandler.HandleFunc(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+			Expect(responseRecorder.Body.String()).ToNot(ContainSubstring("fake-token"))
+			Expect(registryStore.SaveCalled).To(BeFalse())
+			Expect(eventPublisher.PublishedEvents).To(BeEmpty())
+		})
+
+		It("publishes a created event if instance settings did not exist", func() {
+			request, err = http.NewRequest("PUT", "/instances/fake-instance-id/settings", bytes.NewReader([]byte("fake-instance-settings")))
+			request.SetBasicAuth("fake-username", "fake-password")
+			Expect(err).NotTo(HaveOccurred())
+
+			instanceHandler.HandleFunc(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(eventPublisher.PublishedEvents).To(HaveLen(1))
+			Expect(eventPublisher.PublishedEvents[0].Type).To(Equal(EventTypeCreated))
+			Expect(eventPublisher.PublishedEvents[0].InstanceID).To(Equal("fake-instance-id"))
+			Expect(eventPublisher.PublishedEvents[0].Settings).To(Equal("fake-instance-settings"))
+		})
+
+		It("publishes an updated event if instance settings already existed", func() {
+			registryStore.GetFound = true
+			registryStore.GetValue = "fake-old-instance-settings"
+
+			request, err = http.NewRequest("PUT", "/instances/fake-instance-id/settings", bytes.NewReader([]byte("fake-instance-settings")))
+			request.SetBasicAuth("fake-username", "fake-password")
+			Expect(err).NotTo(HaveOccurred())
+
+			instanceHandler.HandleFunc(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(eventPublisher.PublishedEvents).To(HaveLen(1))
+			Expect(eventPublisher.PublishedEvents[0].Type).To(Equal(EventTypeUpdated))
+		})
+
 		It("returns a Bad request error if registry store returns an error", func() {
 			registryStore.SaveErr = errors.New("fake-registry-store-error")
 
@@ -122,6 +358,7 @@ var _ = Describe("InstanceHandler", func() {
 			Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
 			Expect(responseRecorder.Body.String()).To(ContainSubstring("error"))
 			Expect(registryStore.SaveCalled).To(BeTrue())
+			Expect(eventPublisher.PublishCalled).To(BeFalse())
 		})
 
 		It("returns an Unauthorized error if request does not contain credentials", func() {
@@ -132,6 +369,16 @@ var _ = Describe("InstanceHandler", func() {
 			Expect(responseRecorder.Code).To(Equal(http.StatusUnauthorized))
 			Expect(responseRecorder.HeaderMap).To(HaveKey("Www-Authenticate"))
 		})
+
+		It("returns an Unauthorized error if user is not a writer", func() {
+			request, err = http.NewRequest("PUT", "/instances/fake-instance-id/settings", bytes.NewReader([]byte("fake-instance-settings")))
+			request.SetBasicAuth("fake-reader", "fake-password")
+			Expect(err).NotTo(HaveOccurred())
+
+			instanceHandler.HandleFunc(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusUnauthorized))
+			Expect(registryStore.SaveCalled).To(BeFalse())
+		})
 	})
 
 	Describe("HandleDelete", func() {
@@ -150,6 +397,9 @@ var _ = Describe("InstanceHandler", func() {
 			instanceHandler.HandleFunc(responseRecorder, request)
 			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
 			Expect(registryStore.DeleteCalled).To(BeTrue())
+			Expect(instanceTokens.RevokeInstanceID).To(Equal("fake-instance-id"))
+			Expect(eventPublisher.PublishedEvents).To(HaveLen(1))
+			Expect(eventPublisher.PublishedEvents[0].Type).To(Equal(EventTypeDeleted))
 		})
 
 		It("returns a Bad request error if registry store returns an error", func() {
@@ -163,6 +413,7 @@ var _ = Describe("InstanceHandler", func() {
 			Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
 			Expect(responseRecorder.Body.String()).To(ContainSubstring("error"))
 			Expect(registryStore.DeleteCalled).To(BeTrue())
+			Expect(eventPublisher.PublishCalled).To(BeFalse())
 		})
 
 		It("returns an Unauthorized error if request does not contain credentials", func() {
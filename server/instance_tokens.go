@@ -0,0 +1,196 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+
+	"github.com/frodenas/bosh-registry/server/store"
+)
+
+// Instance IDs cannot contain slashes, so instance tokens never collide with
+// instance settings in the registry store.
+const instanceTokenKeyPrefix = "tokens/"
+const instanceTokenSize = 32
+
+type InstanceTokenVerifier interface {
+	VerifyInstanceToken(instanceID string, token string) error
+}
+
+type InstanceTokenIssuer interface {
+	IssueInstanceToken(instanceID string) (string, error)
+	RevokeInstanceToken(instanceID string) error
+	RevokeUsedInstanceToken(instanceID string, token string) error
+}
+
+type InstanceTokensConfig struct {
+	OneTimeUse bool `json:"one_time_use,omitempty"`
+}
+
+// revokesOnUse returns whether serving the request revokes the instance token
+// it carries, a write that only the cluster leader or the primary can do.
+func (c InstanceTokensConfig) revokesOnUse(req *http.Request) bool {
+	return c.OneTimeUse && instanceTokenFromRequest(req) != ""
+}
+
+// InstanceTokens keeps the SHA-256 hash of the instance tokens in the
+// registry store. Tokens are random, so a fast hash is enough. Issued and
+// revoked tokens are published as token events, so replicas follow them.
+type InstanceTokens struct {
+	config         InstanceTokensConfig
+	registryStore  store.Store
+	eventPublisher EventPublisher
+	mutex          sync.Mutex
+}
+
+type instanceToken struct {
+	Hash       string `json:"hash"`
+	OneTimeUse bool   `json:"one_time_use,omitempty"`
+}
+
+func NewInstanceTokens(
+	config InstanceTokensConfig,
+	registryStore store.Store,
+	eventPublisher EventPublisher,
+) *InstanceTokens {
+	return &InstanceTokens{
+		config:         config,
+		registryStore:  registryStore,
+		eventPublisher: eventPublisher,
+	}
+}
+
+// IssueInstanceToken returns a new token for the instance, replacing the
+// previous one.
+func (t *InstanceTokens) IssueInstanceToken(instanceID string) (string, error) {
+	tokenBytes := make([]byte, instanceTokenSize)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", bosherr.WrapError(err, "Generating instance token")
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+
+	tokenJSON, err := json.Marshal(instanceToken{Hash: hashInstanceToken(token), OneTimeUse: t.config.OneTimeUse})
+	if err != nil {
+		return "", bosherr.WrapError(err, "Marshalling instance token")
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if err = t.registryStore.Save(instanceTokenKeyPrefix+instanceID, string(tokenJSON)); err != nil {
+		return "", bosherr.WrapErrorf(err, "Saving token for instance '%s'", instanceID)
+	}
+
+	event := NewEvent(EventTypeTokenIssued, instanceID)
+	event.Settings = string(tokenJSON)
+	t.eventPublisher.Publish(event)
+
+	return token, nil
+}
+
+func (t *InstanceTokens) RevokeInstanceToken(instanceID string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.revoke(instanceID)
+}
+
+// VerifyInstanceToken checks the token of the instance. One-time tokens are
+// only revoked by RevokeUsedInstanceToken, once the settings have been read.
+func (t *InstanceTokens) VerifyInstanceToken(instanceID string, token string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	_, err := t.verify(instanceID, token)
+	return err
+}
+
+// RevokeUsedInstanceToken revokes the token used to read the settings of the
+// instance if it can only be used once, returning error if another request
+// used it meanwhile.
+func (t *InstanceTokens) RevokeUsedInstanceToken(instanceID string, token string) error {
+	if !t.config.OneTimeUse {
+		return nil
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	storedToken, err := t.verify(instanceID, token)
+	if err != nil {
+		return err
+	}
+
+	if storedToken.OneTimeUse {
+		if err = t.revoke(instanceID); err != nil {
+			return bosherr.WrapError(err, "failed to revoke one-time instance token")
+		}
+	}
+
+	return nil
+}
+
+func (t *InstanceTokens) verify(instanceID string, token string) (instanceToken, error) {
+	var storedToken instanceToken
+
+	tokenJSON, found, err := t.registryStore.Get(instanceTokenKeyPrefix + instanceID)
+	if err != nil {
+		return storedToken, bosherr.WrapError(err, "failed to read instance token")
+	}
+	if !found {
+		return storedToken, bosherr.Error("no instance token issued")
+	}
+
+	if err = json.Unmarshal([]byte(tokenJSON), &storedToken); err != nil {
+		return storedToken, bosherr.WrapError(err, "failed to unmarshal instance token")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashInstanceToken(token)), []byte(storedToken.Hash)) != 1 {
+		return storedToken, bosherr.Error("invalid instance token")
+	}
+
+	return storedToken, nil
+}
+
+func (t *InstanceTokens) revoke(instanceID string) error {
+	if err := t.registryStore.Delete(instanceTokenKeyPrefix + instanceID); err != nil {
+		return bosherr.WrapErrorf(err, "Deleting token for instance '%s'", instanceID)
+	}
+
+	t.eventPublisher.Publish(NewEvent(EventTypeTokenRevoked, instanceID))
+
+	return nil
+}
+
+func hashInstanceToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func isInstanceTokenKey(key string) bool {
+	return strings.HasPrefix(key, instanceTokenKeyPrefix)
+}
+
+// splitInstanceTokens separates the instance tokens from the settings read
+// from the registry store, keying both by instance ID.
+func splitInstanceTokens(values map[string]string) (map[string]string, map[string]string) {
+	instances := map[string]string{}
+	instanceTokens := map[string]string{}
+	for key, value := range values {
+		if isInstanceTokenKey(key) {
+			instanceTokens[strings.TrimPrefix(key, instanceTokenKeyPrefix)] = value
+		} else {
+			instances[key] = value
+		}
+	}
+
+	return instances, instanceTokens
+}
@@ -0,0 +1,139 @@
+package server_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+
+	"github.com/frodenas/bosh-registry/server/fakes"
+	"github.com/frodenas/bosh-registry/server/store"
+)
+
+var _ = Describe("InstanceTokens", func() {
+	var (
+		err            error
+		tempDir        string
+		registryStore  store.Store
+		eventPublisher *fakes.FakeEventPublisher
+		config         InstanceTokensConfig
+		instanceTokens *InstanceTokens
+	)
+
+	BeforeEach(func() {
+		tempDir, err = ioutil.TempDir("", "instance-tokens")
+		Expect(err).ToNot(HaveOccurred())
+
+		registryStore = store.NewBoltStore(store.BoltConfig{DBFile: filepath.Join(tempDir, "registry.db")}, boshlog.NewLogger(boshlog.LevelNone))
+		eventPublisher = &fakes.FakeEventPublisher{}
+		config = InstanceTokensConfig{}
+	})
+
+	JustBeforeEach(func() {
+		instanceTokens = NewInstanceTokens(config, registryStore, eventPublisher)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	It("verifies issued tokens", func() {
+		token, err := instanceTokens.IssueInstanceToken("fake-instance-id")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(token).To(HaveLen(43))
+
+		Expect(instanceTokens.VerifyInstanceToken("fake-instance-id", token)).To(Succeed())
+		Expect(instanceTokens.VerifyInstanceToken("fake-instance-id", token)).To(Succeed())
+		Expect(instanceTokens.VerifyInstanceToken("fake-other-instance-id", token)).ToNot(Succeed())
+		Expect(instanceTokens.VerifyInstanceToken("fake-instance-id", "fake-token")).ToNot(Succeed())
+	})
+
+	It("stores only the token hash", func() {
+		token, err := instanceTokens.IssueInstanceToken("fake-instance-id")
+		Expect(err).ToNot(HaveOccurred())
+
+		values, err := registryStore.GetAll()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(values).To(HaveKey("tokens/fake-instance-id"))
+		Expect(values["tokens/fake-instance-id"]).ToNot(ContainSubstring(token))
+	})
+
+	It("publishes the token hash when issuing and revoking tokens", func() {
+		token, err := instanceTokens.IssueInstanceToken("fake-instance-id")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(instanceTokens.RevokeInstanceToken("fake-instance-id")).To(Succeed())
+
+		values, err := registryStore.GetAll()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(values).ToNot(HaveKey("tokens/fake-instance-id"))
+
+		Expect(eventPublisher.PublishedEvents).To(HaveLen(2))
+		Expect(eventPublisher.PublishedEvents[0].Type).To(Equal(EventTypeTokenIssued))
+		Expect(eventPublisher.PublishedEvents[0].InstanceID).To(Equal("fake-instance-id"))
+		Expect(eventPublisher.PublishedEvents[0].Settings).To(ContainSubstring(`"hash":`))
+		Expect(eventPublisher.PublishedEvents[0].Settings).ToNot(ContainSubstring(token))
+		Expect(eventPublisher.PublishedEvents[1].Type).To(Equal(EventTypeTokenRevoked))
+	})
+
+	It("replaces the previous token", func() {
+		oldToken, err := instanceTokens.IssueInstanceToken("fake-instance-id")
+		Expect(err).ToNot(HaveOccurred())
+		newToken, err := instanceTokens.IssueInstanceToken("fake-instance-id")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(instanceTokens.VerifyInstanceToken("fake-instance-id", oldToken)).ToNot(Succeed())
+		Expect(instanceTokens.VerifyInstanceToken("fake-instance-id", newToken)).To(Succeed())
+	})
+
+	It("does not verify revoked tokens", func() {
+		token, err := instanceTokens.IssueInstanceToken("fake-instance-id")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(instanceTokens.RevokeInstanceToken("fake-instance-id")).To(Succeed())
+
+		err = instanceTokens.VerifyInstanceToken("fake-instance-id", token)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("no instance token issued"))
+	})
+
+	Context("when tokens can only be used once", func() {
+		BeforeEach(func() {
+			config.OneTimeUse = true
+		})
+
+		It("revokes used tokens only once the settings have been read", func() {
+			token, err := instanceTokens.IssueInstanceToken("fake-instance-id")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(instanceTokens.VerifyInstanceToken("fake-instance-id", "fake-token")).ToNot(Succeed())
+			Expect(instanceTokens.VerifyInstanceToken("fake-instance-id", token)).To(Succeed())
+			Expect(instanceTokens.VerifyInstanceToken("fake-instance-id", token)).To(Succeed())
+
+			Expect(instanceTokens.RevokeUsedInstanceToken("fake-instance-id", "fake-token")).ToNot(Succeed())
+			Expect(instanceTokens.RevokeUsedInstanceToken("fake-instance-id", token)).To(Succeed())
+			Expect(instanceTokens.VerifyInstanceToken("fake-instance-id", token)).ToNot(Succeed())
+
+			err = instanceTokens.RevokeUsedInstanceToken("fake-instance-id", token)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("no instance token issued"))
+
+			Expect(eventPublisher.PublishedEvents).To(HaveLen(2))
+			Expect(eventPublisher.PublishedEvents[1].Type).To(Equal(EventTypeTokenRevoked))
+		})
+	})
+
+	It("does not revoke used tokens that can be used again", func() {
+		token, err := instanceTokens.IssueInstanceToken("fake-instance-id")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(instanceTokens.RevokeUsedInstanceToken("fake-instance-id", token)).To(Succeed())
+		Expect(instanceTokens.VerifyInstanceToken("fake-instance-id", token)).To(Succeed())
+		Expect(eventPublisher.PublishedEvents).To(HaveLen(1))
+	})
+})
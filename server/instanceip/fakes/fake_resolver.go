@@ -0,0 +1,20 @@
+package fakes
+
+import (
+	"net"
+)
+
+type FakeResolver struct {
+	InstanceIPsCalled       bool
+	InstanceIPsInstanceID   string
+	InstanceIPsSettingsJSON string
+	InstanceIPsIPs          []net.IP
+	InstanceIPsErr          error
+}
+
+func (r *FakeResolver) InstanceIPs(instanceID string, settingsJSON string) ([]net.IP, error) {
+	r.InstanceIPsCalled = true
+	r.InstanceIPsInstanceID = instanceID
+	r.InstanceIPsSettingsJSON = settingsJSON
+	return r.InstanceIPsIPs, r.InstanceIPsErr
+}
@@ -0,0 +1,33 @@
+package instanceip
+
+import (
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+)
+
+const defaultResolver = "settings"
+
+type Config struct {
+	Enabled  bool                   `json:"enabled,omitempty"`
+	Resolver string                 `json:"resolver,omitempty"`
+	Options  map[string]interface{} `json:"options,omitempty"`
+}
+
+func (c Config) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+
+	if !isRegistered(c.resolver()) {
+		return bosherr.Errorf("Instance IP Resolver '%s' not supported", c.resolver())
+	}
+
+	return nil
+}
+
+func (c Config) resolver() string {
+	if c.Resolver == "" {
+		return defaultResolver
+	}
+
+	return c.Resolver
+}
@@ -0,0 +1,28 @@
+package instanceip_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server/instanceip"
+)
+
+var _ = Describe("Config", func() {
+	Describe("Validate", func() {
+		It("does not return error if check is disabled", func() {
+			err := Config{Resolver: "fake-resolver"}.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("does not return error if resolver is empty", func() {
+			err := Config{Enabled: true}.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns error if resolver is not supported", func() {
+			err := Config{Enabled: true, Resolver: "fake-resolver"}.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Instance IP Resolver 'fake-resolver' not supported"))
+		})
+	})
+})
@@ -0,0 +1,13 @@
+package instanceip_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestInstanceIP(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Registry Instance IP Suite")
+}
@@ -0,0 +1,64 @@
+package instanceip
+
+import (
+	"net"
+	"sync"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+// Resolver returns the IPs that belong to an instance, given its ID and its
+// stored settings.
+type Resolver interface {
+	InstanceIPs(instanceID string, settingsJSON string) ([]net.IP, error)
+}
+
+// ResolverFactory creates a Resolver from the resolver options.
+type ResolverFactory func(options map[string]interface{}, logger boshlog.Logger) (Resolver, error)
+
+var (
+	factoriesMutex sync.RWMutex
+	factories      = map[string]ResolverFactory{
+		"settings": func(options map[string]interface{}, logger boshlog.Logger) (Resolver, error) {
+			return NewSettingsResolver(logger), nil
+		},
+	}
+)
+
+// RegisterResolver makes a Resolver available by name, so cloud-specific
+// resolvers (for example, querying the IaaS API) can be plugged in.
+func RegisterResolver(name string, factory ResolverFactory) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+
+	factories[name] = factory
+}
+
+func NewResolver(
+	config Config,
+	logger boshlog.Logger,
+) (Resolver, error) {
+	factoriesMutex.RLock()
+	factory, found := factories[config.resolver()]
+	factoriesMutex.RUnlock()
+
+	if !found {
+		return nil, bosherr.Errorf("Instance IP Resolver '%s' not supported", config.resolver())
+	}
+
+	resolver, err := factory(config.Options, logger)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Creating Instance IP Resolver '%s'", config.resolver())
+	}
+
+	return resolver, nil
+}
+
+func isRegistered(name string) bool {
+	factoriesMutex.RLock()
+	defer factoriesMutex.RUnlock()
+
+	_, found := factories[name]
+	return found
+}
@@ -0,0 +1,72 @@
+package instanceip_test
+
+import (
+	"errors"
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server/instanceip"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+
+	"github.com/frodenas/bosh-registry/server/instanceip/fakes"
+)
+
+var _ = Describe("NewResolver", func() {
+	var logger = boshlog.NewLogger(boshlog.LevelNone)
+
+	It("creates a settings resolver by default", func() {
+		resolver, err := NewResolver(Config{Enabled: true}, logger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resolver).To(Equal(NewSettingsResolver(logger)))
+	})
+
+	It("creates a registered resolver", func() {
+		fakeResolver := &fakes.FakeResolver{}
+		RegisterResolver("fake-cloud", func(options map[string]interface{}, logger boshlog.Logger) (Resolver, error) {
+			Expect(options).To(HaveKeyWithValue("region", "fake-region"))
+			return fakeResolver, nil
+		})
+
+		resolver, err := NewResolver(Config{Enabled: true, Resolver: "fake-cloud", Options: map[string]interface{}{"region": "fake-region"}}, logger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resolver).To(Equal(fakeResolver))
+
+		err = Config{Enabled: true, Resolver: "fake-cloud"}.Validate()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("returns error if the resolver cannot be created", func() {
+		RegisterResolver("fake-failing-cloud", func(options map[string]interface{}, logger boshlog.Logger) (Resolver, error) {
+			return nil, errors.New("fake-factory-error")
+		})
+
+		_, err := NewResolver(Config{Enabled: true, Resolver: "fake-failing-cloud"}, logger)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("fake-factory-error"))
+	})
+
+	It("returns error if resolver is not supported", func() {
+		_, err := NewResolver(Config{Enabled: true, Resolver: "fake-unknown-resolver"}, logger)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Instance IP Resolver 'fake-unknown-resolver' not supported"))
+	})
+})
+
+var _ = Describe("SettingsResolver", func() {
+	var resolver = NewSettingsResolver(boshlog.NewLogger(boshlog.LevelNone))
+
+	It("returns the IPs of the instance networks", func() {
+		ips, err := resolver.InstanceIPs("fake-instance-id", `{"networks":{"default":{"ip":"10.0.0.5"},"vip":{"ip":"52.1.2.3"},"dynamic":{"type":"dynamic"},"invalid":{"ip":"fake-ip"}}}`)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ips).To(ConsistOf(net.ParseIP("10.0.0.5"), net.ParseIP("52.1.2.3")))
+	})
+
+	It("returns error if settings are not valid", func() {
+		_, err := resolver.InstanceIPs("fake-instance-id", "fake-settings")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Unmarshalling settings for instance 'fake-instance-id'"))
+	})
+})
@@ -0,0 +1,46 @@
+package instanceip
+
+import (
+	"encoding/json"
+	"net"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+
+	registry "github.com/frodenas/bosh-registry/client"
+)
+
+const settingsResolverLogTag = "RegistrySettingsInstanceIPResolver"
+
+// SettingsResolver resolves the instance IPs from the networks section of the
+// instance settings.
+type SettingsResolver struct {
+	logger boshlog.Logger
+}
+
+func NewSettingsResolver(logger boshlog.Logger) SettingsResolver {
+	return SettingsResolver{logger: logger}
+}
+
+func (r SettingsResolver) InstanceIPs(instanceID string, settingsJSON string) ([]net.IP, error) {
+	var settings registry.AgentSettings
+	if err := json.Unmarshal([]byte(settingsJSON), &settings); err != nil {
+		return nil, bosherr.WrapErrorf(err, "Unmarshalling settings for instance '%s'", instanceID)
+	}
+
+	var ips []net.IP
+	for networkName, network := range settings.Networks {
+		if network.IP == "" {
+			continue
+		}
+
+		ip := net.ParseIP(network.IP)
+		if ip == nil {
+			r.logger.Debug(settingsResolverLogTag, "Ignoring invalid IP '%s' of network '%s' for instance '%s'", network.IP, networkName, instanceID)
+			continue
+		}
+		ips = append(ips, ip)
+	}
+
+	return ips, nil
+}
@@ -1,11 +1,14 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
-	"crypto/x509"
-	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
 
 	bosherr "github.com/cloudfoundry/bosh-utils/errors"
 	boshlog "github.com/cloudfoundry/bosh-utils/logger"
@@ -13,100 +16,345 @@ import (
 
 const listenerLogTag = "RegistryServerListener"
 
+// Handlers are the handlers served by a Listener, and the AccessLog logging
+// their requests. Health, Readiness, Info, Metrics, SignedURLs, Cluster,
+// Replica and AccessLog are optional.
+type Handlers struct {
+	Instances  *InstanceHandler
+	Events     *EventsHandler
+	Backup     *BackupHandler
+	Health     *HealthHandler
+	Readiness  *ReadinessHandler
+	Info       *InfoHandler
+	Metrics    *MetricsHandler
+	SignedURLs *SignedURLsHandler
+	Cluster    *ClusterHandler
+	Replica    *ReplicaHandler
+	AccessLog  *AccessLog
+}
+
+func (h Handlers) ServeMux() *http.ServeMux {
+	instancesHandler := h.Instances.HandleFunc
+	if h.Cluster != nil {
+		instancesHandler = h.Cluster.Wrap(instancesHandler)
+	}
+	if h.Replica != nil {
+		instancesHandler = h.Replica.Wrap(instancesHandler)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/instances/", instancesHandler)
+	mux.HandleFunc("/events", h.Events.HandleFunc)
+	mux.HandleFunc(backupPath, h.Backup.HandleFunc)
+	if h.Health != nil {
+		mux.HandleFunc(healthPath, h.Health.HandleFunc)
+	}
+	if h.Readiness != nil {
+		mux.HandleFunc(readinessPath, h.Readiness.HandleFunc)
+	}
+	if h.Info != nil {
+		mux.HandleFunc(infoPath, h.Info.HandleFunc)
+	}
+	if h.Metrics != nil {
+		mux.HandleFunc(metricsPath, h.Metrics.HandleFunc)
+	}
+	if h.SignedURLs != nil {
+		mux.HandleFunc(signedURLsPath, h.SignedURLs.HandleFunc)
+	}
+	if h.Cluster != nil {
+		mux.HandleFunc(clusterMembersPath, h.Cluster.HandleFunc)
+		mux.HandleFunc(clusterMembersPath+"/", h.Cluster.HandleFunc)
+	}
+	if h.Replica != nil {
+		mux.HandleFunc(replicaStatusPath, h.Replica.HandleStatus)
+	}
+
+	return mux
+}
+
+// Listener serves the handlers on every listener of the configuration,
+// sharing the authentication limiter and the trusted proxies.
 type Listener struct {
-	config   Config
-	handler  *InstanceHandler
-	logger   boshlog.Logger
-	listener net.Listener
+	config      Config
+	handlers    Handlers
+	logger      boshlog.Logger
+	authLimiter *AuthLimiter
+	endpoints   []*endpoint
+}
+
+// endpoint is a socket served by a Listener.
+type endpoint struct {
+	config       ListenerConfig
+	socket       fileListener
+	listener     net.Listener
+	removeSocket bool
+	httpServer   *http.Server
+	tlsReloader  *TLSReloader
 }
 
 func NewListener(
 	config Config,
-	handler *InstanceHandler,
+	handlers Handlers,
 	logger boshlog.Logger,
 ) Listener {
 	return Listener{
-		config:  config,
-		handler: handler,
-		logger:  logger,
+		config:      config,
+		handlers:    handlers,
+		logger:      logger,
+		authLimiter: NewAuthLimiter(config.AuthLimiter, logger),
 	}
 }
 
+// ListenAndServe starts listening and serving, sending to the returned
+// channel the error that stopped serving, or nil when stopped.
 func (l *Listener) ListenAndServe() <-chan error {
-	errChan := make(chan error, 1)
-
-	tcpListener, err := net.ListenTCP(
-		"tcp",
-		&net.TCPAddr{
-			IP:   net.ParseIP(l.config.Address),
-			Port: l.config.Port,
-		},
-	)
-	if err != nil {
-		errChan <- bosherr.WrapError(err, "Starting Registry TCP Listener")
+	if err := l.Listen(); err != nil {
+		errChan := make(chan error, 1)
+		errChan <- err
 		return errChan
 	}
 
-	if l.config.Protocol == "https" {
-		certificates, err := tls.LoadX509KeyPair(l.config.TLS.CertFile, l.config.TLS.KeyFile)
+	return l.Serve()
+}
+
+// Listen opens the sockets of all the listeners, taking the ones inherited
+// from the process it upgrades or passed by systemd if any. Either all of
+// them are opened or none.
+func (l *Listener) Listen() error {
+	trustedProxies, err := NewTrustedProxies(l.config.TrustedProxies)
+	if err != nil {
+		return bosherr.WrapError(err, "Parsing Registry Trusted Proxies")
+	}
+
+	mux := l.handlers.ServeMux()
+	for _, listenerConfig := range l.config.ListenerConfigs() {
+		endpoint, err := l.listenEndpoint(listenerConfig, trustedProxies, mux)
 		if err != nil {
-			errChan <- bosherr.WrapError(err, "Loading X509 Key Pair")
-			return errChan
+			l.closeEndpoints()
+			return bosherr.WrapErrorf(err, "Starting Registry Listener at %s", listenerConfig.Endpoint())
 		}
+		l.endpoints = append(l.endpoints, endpoint)
+	}
 
-		certPool := x509.NewCertPool()
-		if l.config.TLS.CACertFile != "" {
-			caCert, err := ioutil.ReadFile(l.config.TLS.CACertFile)
-			if err != nil {
-				errChan <- bosherr.WrapError(err, "Loading CA certificate")
-				return errChan
+	return nil
+}
+
+// Serve serves the requests accepted by Listen, sending to the returned
+// channel the error that stopped serving any of the listeners, or nil when
+// stopped.
+func (l *Listener) Serve() <-chan error {
+	errChan := make(chan error, len(l.endpoints))
+
+	for _, endpoint := range l.endpoints {
+		l.logger.Debug(listenerLogTag, "Starting Registry Server at %s://%s", endpoint.config.Protocol, endpoint.config.Endpoint())
+		go func(httpServer *http.Server, listener net.Listener) {
+			err := httpServer.Serve(listener)
+			if err == http.ErrServerClosed {
+				err = nil
 			}
+			errChan <- err
+		}(endpoint.httpServer, endpoint.listener)
+	}
+
+	return errChan
+}
 
-			if !certPool.AppendCertsFromPEM(caCert) {
-				errChan <- bosherr.WrapError(err, "Invalid CA Certificate")
-				return errChan
+// Files returns duplicates of the listening sockets by their endpoints, to be
+// inherited by the process upgrading this one.
+func (l *Listener) Files() (map[string]*os.File, error) {
+	if len(l.endpoints) == 0 {
+		return nil, bosherr.Error("Registry Listener is not listening")
+	}
+
+	files := map[string]*os.File{}
+	for _, endpoint := range l.endpoints {
+		file, err := endpoint.socket.File()
+		if err != nil {
+			for _, file := range files {
+				file.Close()
 			}
+			return nil, bosherr.WrapErrorf(err, "Duplicating socket for %s", endpoint.config.Endpoint())
 		}
+		files[endpoint.config.Endpoint()] = file
 
-		tlsConfig := &tls.Config{
-			Certificates: []tls.Certificate{certificates},
-			ClientAuth:   tls.RequireAndVerifyClientCert,
-			ClientCAs:    certPool,
-			MinVersion:   tls.VersionTLS12,
-			CipherSuites: []uint16{
-				tls.TLS_RSA_WITH_AES_128_CBC_SHA,
-				tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-			},
-			PreferServerCipherSuites: true,
-			SessionTicketsDisabled:   true,
-		}
+		// The Unix socket is kept when stopping, as the other process uses it.
+		endpoint.removeSocket = false
+	}
 
-		l.listener = tls.NewListener(tcpListener, tlsConfig)
-	} else {
-		l.listener = tcpListener
+	return files, nil
+}
+
+// Reload applies the AuthLimiter, listeners TLS and shutdown grace period
+// settings of a new configuration, which must have the same listeners.
+// The TLS certificates are loaded again even if their settings did not
+// change, and the previous ones are kept if they cannot be loaded.
+func (l *Listener) Reload(config Config) error {
+	listenerConfigs := config.ListenerConfigs()
+	if len(listenerConfigs) != len(l.endpoints) {
+		return bosherr.Errorf("Must restart to change the number of Listeners")
 	}
 
-	httpServer := http.Server{}
-	mux := http.NewServeMux()
-	mux.HandleFunc("/instances/", l.handler.HandleFunc)
-	httpServer.Handler = mux
+	l.config.ShutdownGracePeriod = config.ShutdownGracePeriod
+	l.authLimiter.Update(config.AuthLimiter)
 
-	l.logger.Debug(listenerLogTag, "Starting Registry Server at %s://%s:%d", l.config.Protocol, l.config.Address, l.config.Port)
-	go func() {
-		err := httpServer.Serve(l.listener)
-		errChan <- err
-	}()
+	for i, endpoint := range l.endpoints {
+		if endpoint.tlsReloader == nil {
+			continue
+		}
 
-	return errChan
+		if err := endpoint.tlsReloader.Update(listenerConfigs[i].TLS); err != nil {
+			return bosherr.WrapErrorf(err, "Reloading Registry Listener at %s", endpoint.config.Endpoint())
+		}
+	}
+
+	return nil
 }
 
+// Stop stops accepting connections and waits up to the shutdown grace period
+// for the requests in progress on all the listeners to finish, closing the
+// connections still active afterwards. The readiness handler reports not
+// ready and the events streams are ended as soon as draining starts.
 func (l *Listener) Stop() {
-	l.logger.Debug(listenerLogTag, "Stopping Registry Server")
-	l.listener.Close()
+	if len(l.endpoints) == 0 {
+		return
+	}
+
+	l.logger.Debug(listenerLogTag, "Stopping Registry Server, draining requests for up to %s", l.config.GracePeriod())
+	if l.handlers.Readiness != nil {
+		l.handlers.Readiness.SetDraining()
+	}
+	if l.handlers.Events != nil {
+		l.handlers.Events.Stop()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.config.GracePeriod())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, e := range l.endpoints {
+		wg.Add(1)
+		go func(e *endpoint) {
+			defer wg.Done()
+			if err := e.httpServer.Shutdown(ctx); err != nil {
+				l.logger.Warn(listenerLogTag, "Closing active connections at %s after the shutdown grace period: %s", e.config.Endpoint(), err.Error())
+				e.httpServer.Close()
+			}
+		}(e)
+	}
+	wg.Wait()
+
+	l.closeEndpoints()
+	l.logger.Debug(listenerLogTag, "Stopped Registry Server")
+}
+
+func (l *Listener) closeEndpoints() {
+	for _, endpoint := range l.endpoints {
+		endpoint.close()
+	}
+	l.endpoints = nil
+}
+
+func (l *Listener) listenEndpoint(config ListenerConfig, trustedProxies TrustedProxies, handler http.Handler) (*endpoint, error) {
+	e := &endpoint{config: config}
+
+	socket, err := l.listenSocket(e)
+	if err != nil {
+		return nil, err
+	}
+	e.socket = socket
+
+	var netListener net.Listener = socket
+	if config.ProxyProtocol {
+		netListener = newProxyProtocolListener(socket, trustedProxies, l.logger)
+	}
+	e.listener = netListener
+
+	if config.Protocol == "https" {
+		e.tlsReloader, err = NewTLSReloader(config.TLS, l.logger)
+		if err != nil {
+			e.close()
+			return nil, bosherr.WrapError(err, "Creating TLS configuration")
+		}
+		e.tlsReloader.Start(config.TLS.ReloadPeriod())
+
+		e.listener = tls.NewListener(netListener, e.tlsReloader.ServerConfig())
+	}
+
+	e.httpServer = &http.Server{
+		ErrorLog: log.New(serverErrorWriter{logger: l.logger, metrics: l.handlers.Metrics}, "", 0),
+	}
+	e.httpServer.Handler = l.authLimiter.Wrap(wrapOperations(handler, config, l.logger))
+	if len(trustedProxies) > 0 {
+		e.httpServer.Handler = trustedProxies.Wrap(e.httpServer.Handler, l.logger)
+	}
+	if l.handlers.Metrics != nil {
+		e.httpServer.Handler = l.handlers.Metrics.Wrap(e.httpServer.Handler)
+	}
+	if l.handlers.AccessLog != nil {
+		e.httpServer.Handler = l.handlers.AccessLog.Wrap(e.httpServer.Handler)
+	}
+	e.httpServer.Handler = wrapRequestID(e.httpServer.Handler)
+
+	return e, nil
+}
+
+// listenSocket takes the socket inherited from the process being upgraded or
+// passed by systemd socket activation, or opens a new one. Host names are
+// resolved to the first of their addresses.
+func (l *Listener) listenSocket(e *endpoint) (fileListener, error) {
+	if socket, found, err := inheritedListener(e.config.Endpoint()); found || err != nil {
+		if err != nil {
+			return nil, err
+		}
+
+		l.logger.Info(listenerLogTag, "Serving inherited socket for %s", e.config.Endpoint())
+		e.removeSocket = socket.owned && e.config.UnixSocket.Enabled()
+		return socket.listener, nil
+	}
+
+	if e.config.UnixSocket.Enabled() {
+		e.removeSocket = true
+		return listenUnix(e.config.UnixSocket)
+	}
+
+	listener, err := net.Listen("tcp", e.config.Endpoint())
+	if err != nil {
+		return nil, err
+	}
+
+	return listener.(*net.TCPListener), nil
+}
+
+func (e *endpoint) close() {
+	if e.listener != nil {
+		e.listener.Close()
+	}
+	if e.tlsReloader != nil {
+		e.tlsReloader.Stop()
+	}
+	if e.removeSocket {
+		os.Remove(e.config.UnixSocket.Path)
+		e.removeSocket = false
+	}
+}
+
+// serverErrorWriter logs the errors of the HTTP servers, counting the failed
+// TLS handshakes.
+type serverErrorWriter struct {
+	logger  boshlog.Logger
+	metrics *MetricsHandler
+}
+
+func (w serverErrorWriter) Write(p []byte) (int, error) {
+	message := strings.TrimSpace(string(p))
+	if strings.Contains(message, "TLS handshake error") {
+		if w.metrics != nil {
+			w.metrics.TLSHandshakeError()
+		}
+		w.logger.Debug(listenerLogTag, "%s", message)
+		return len(p), nil
+	}
+
+	w.logger.Warn(listenerLogTag, "%s", message)
+	return len(p), nil
 }
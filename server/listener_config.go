@@ -0,0 +1,136 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+const operationsLogTag = "RegistryServerOperations"
+
+// Operations a listener can allow. Reads are the GET requests for instance
+// settings and the events stream, writes the other requests for instances,
+// and admin the backup, signed URLs, cluster, replica and metrics requests.
+const (
+	OperationRead  = "read"
+	OperationWrite = "write"
+	OperationAdmin = "admin"
+)
+
+// ListenerConfig describes a socket to serve the registry on. Operations
+// restricts the requests served on it, all of them by default.
+type ListenerConfig struct {
+	Protocol      string           `json:"protocol,omitempty"`
+	Address       string           `json:"address,omitempty"`
+	Port          int              `json:"port,omitempty"`
+	UnixSocket    UnixSocketConfig `json:"unix_socket,omitempty"`
+	TLS           TLSConfig        `json:"tls,omitempty"`
+	ProxyProtocol bool             `json:"proxy_protocol,omitempty"`
+	Operations    []string         `json:"operations,omitempty"`
+}
+
+func (c ListenerConfig) Validate() error {
+	if c.Protocol != "http" && c.Protocol != "https" {
+		return bosherr.Error("Must provide a valid Protocol")
+	}
+
+	if err := c.UnixSocket.Validate(); err != nil {
+		return bosherr.WrapError(err, "Validating Unix Socket configuration")
+	}
+
+	if !c.UnixSocket.Enabled() {
+		if c.Address == "" {
+			return bosherr.Error("Must provide a non-empty Address")
+		}
+
+		if c.Port == 0 {
+			return bosherr.Error("Must provide a non-empty Port")
+		}
+	}
+
+	if c.Protocol == "https" {
+		if err := c.TLS.Validate(); err != nil {
+			return bosherr.WrapError(err, "Validating TLS configuration")
+		}
+	}
+
+	if c.ProxyProtocol && c.UnixSocket.Enabled() {
+		return bosherr.Error("Must not enable ProxyProtocol with a Unix Socket")
+	}
+
+	for _, operation := range c.Operations {
+		switch operation {
+		case OperationRead, OperationWrite, OperationAdmin:
+		default:
+			return bosherr.Errorf("Must provide valid Operations ('%s', '%s' or '%s'), got '%s'", OperationRead, OperationWrite, OperationAdmin, operation)
+		}
+	}
+
+	return nil
+}
+
+// Endpoint returns the address and port, or the path of the Unix socket.
+func (c ListenerConfig) Endpoint() string {
+	if c.UnixSocket.Enabled() {
+		return c.UnixSocket.Path
+	}
+
+	return net.JoinHostPort(c.Address, strconv.Itoa(c.Port))
+}
+
+func (c ListenerConfig) VerifiesClientCerts() bool {
+	return c.Protocol == "https" && c.TLS.VerifiesClientCerts()
+}
+
+func (c ListenerConfig) Allows(operation string) bool {
+	if len(c.Operations) == 0 {
+		return true
+	}
+
+	for _, allowed := range c.Operations {
+		if allowed == operation {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wrapOperations answers the requests for operations not allowed by the
+// listener with a 403 Forbidden. The health, readiness and info endpoints are
+// always allowed.
+func wrapOperations(next http.Handler, config ListenerConfig, logger boshlog.Logger) http.Handler {
+	if len(config.Operations) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if operation := requestOperation(req); operation != "" && !config.Allows(operation) {
+			logger.Debug(requestLogTag(operationsLogTag, req), "Refusing %s %s from '%s', '%s' operations are not allowed on %s", req.Method, req.URL.Path, req.RemoteAddr, operation, config.Endpoint())
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+func requestOperation(req *http.Request) string {
+	switch {
+	case req.URL.Path == healthPath || req.URL.Path == readinessPath || req.URL.Path == infoPath:
+		return ""
+	case req.URL.Path == "/events":
+		return OperationRead
+	case strings.HasPrefix(req.URL.Path, "/instances/"):
+		if req.Method == "GET" || req.Method == "HEAD" {
+			return OperationRead
+		}
+		return OperationWrite
+	}
+
+	return OperationAdmin
+}
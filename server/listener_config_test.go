@@ -0,0 +1,93 @@
+package server_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+)
+
+var _ = Describe("ListenerConfig", func() {
+	var (
+		config ListenerConfig
+
+		validConfig = ListenerConfig{
+			Protocol: "http",
+			Address:  "fake-host",
+			Port:     25777,
+		}
+	)
+
+	BeforeEach(func() {
+		config = validConfig
+	})
+
+	Describe("Validate", func() {
+		It("does not return error if all fields are valid", func() {
+			err := config.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns error if Protocol is not valid", func() {
+			config.Protocol = "fake-protocol"
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a valid Protocol"))
+		})
+
+		It("returns error if Address is empty", func() {
+			config.Address = ""
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a non-empty Address"))
+		})
+
+		It("returns error if TLS is not valid", func() {
+			config.Protocol = "https"
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating TLS configuration"))
+		})
+
+		It("returns error if an Operation is not valid", func() {
+			config.Operations = []string{OperationRead, "fake-operation"}
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide valid Operations ('read', 'write' or 'admin'), got 'fake-operation'"))
+		})
+	})
+
+	Describe("Endpoint", func() {
+		It("joins the Address and Port", func() {
+			config.Address = "::1"
+
+			Expect(config.Endpoint()).To(Equal("[::1]:25777"))
+		})
+
+		It("returns the Unix socket path", func() {
+			config.UnixSocket = UnixSocketConfig{Path: "/fake-path/registry.sock"}
+
+			Expect(config.Endpoint()).To(Equal("/fake-path/registry.sock"))
+		})
+	})
+
+	Describe("Allows", func() {
+		It("allows all the operations by default", func() {
+			Expect(config.Allows(OperationRead)).To(BeTrue())
+			Expect(config.Allows(OperationWrite)).To(BeTrue())
+			Expect(config.Allows(OperationAdmin)).To(BeTrue())
+		})
+
+		It("allows only the provided Operations", func() {
+			config.Operations = []string{OperationRead, OperationWrite}
+
+			Expect(config.Allows(OperationRead)).To(BeTrue())
+			Expect(config.Allows(OperationWrite)).To(BeTrue())
+			Expect(config.Allows(OperationAdmin)).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,456 @@
+package server_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+
+	. "github.com/frodenas/bosh-registry/server"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+
+	"github.com/frodenas/bosh-registry/server/fakes"
+	instanceipfakes "github.com/frodenas/bosh-registry/server/instanceip/fakes"
+	"github.com/frodenas/bosh-registry/server/store"
+	storefakes "github.com/frodenas/bosh-registry/server/store/fakes"
+)
+
+// blockingStore signals the reads and waits until released to answer them.
+type blockingStore struct {
+	storefakes.FakeStore
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) Get(key string) (string, bool, error) {
+	s.reading <- struct{}{}
+	<-s.release
+	return s.FakeStore.Get(key)
+}
+
+var _ = Describe("Listener", func() {
+	var (
+		config           Config
+		listener         Listener
+		registryStore    store.Store
+		readinessHandler *ReadinessHandler
+		accessLog        *AccessLog
+
+		logger = boshlog.NewLogger(boshlog.LevelNone)
+	)
+
+	freePort := func() int {
+		tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer tcpListener.Close()
+
+		return tcpListener.Addr().(*net.TCPAddr).Port
+	}
+
+	getSettings := func(header []byte, requestHeaders string) int {
+		var conn net.Conn
+		Eventually(func() error {
+			var err error
+			conn, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", config.Port))
+			return err
+		}).Should(Succeed())
+		defer conn.Close()
+
+		_, err := conn.Write(header)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = fmt.Fprintf(conn, "GET /instances/fake-instance-id/settings HTTP/1.1\r\nHost: fake-host\r\n%sConnection: close\r\n\r\n", requestHeaders)
+		Expect(err).ToNot(HaveOccurred())
+
+		response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return 0
+		}
+		response.Body.Close()
+
+		return response.StatusCode
+	}
+
+	BeforeEach(func() {
+		config = Config{
+			Protocol:       "http",
+			Address:        "127.0.0.1",
+			Port:           freePort(),
+			Username:       "fake-username",
+			Password:       "fake-password",
+			TrustedProxies: []string{"127.0.0.1"},
+		}
+		registryStore = &storefakes.FakeStore{GetFound: true, GetValue: "fake-settings"}
+		accessLog = nil
+	})
+
+	JustBeforeEach(func() {
+		instanceIPResolver := &instanceipfakes.FakeResolver{InstanceIPsIPs: []net.IP{net.ParseIP("10.0.0.5"), net.ParseIP("2001:db8::5")}}
+		eventBroker := NewEventBroker(10, logger)
+		readinessHandler = NewReadinessHandler(registryStore, logger)
+
+		listener = NewListener(config, Handlers{
+			Instances: NewInstanceHandler(NewIPAuthenticator(instanceIPResolver), NewBasicAuthenticator(newUsers(config), RoleWriter), registryStore, &fakes.FakeInstanceTokenIssuer{}, &fakes.FakeEventPublisher{}, logger),
+			Events:    NewEventsHandler(newUsers(config), eventBroker, logger),
+			Backup:    NewBackupHandler(newUsers(config), registryStore, eventBroker, logger),
+			Readiness: readinessHandler,
+			AccessLog: accessLog,
+		}, logger)
+		listener.ListenAndServe()
+	})
+
+	AfterEach(func() {
+		listener.Stop()
+	})
+
+	It("resolves the client IP from X-Forwarded-For sent by trusted proxies", func() {
+		Expect(getSettings(nil, "X-Forwarded-For: 10.0.0.5\r\n")).To(Equal(http.StatusOK))
+		Expect(getSettings(nil, "X-Forwarded-For: 10.0.0.6\r\n")).To(Equal(http.StatusUnauthorized))
+	})
+
+	Context("when identifying requests", func() {
+		var (
+			logBuffer *gbytes.Buffer
+		)
+
+		BeforeEach(func() {
+			logBuffer = gbytes.NewBuffer()
+			logger = boshlog.NewWriterLogger(boshlog.LevelDebug, logBuffer, logBuffer)
+		})
+
+		AfterEach(func() {
+			listener.Stop()
+			logger = boshlog.NewLogger(boshlog.LevelNone)
+		})
+
+		requestID := func(sentRequestID string) string {
+			req, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d/readyz", config.Port), nil)
+			Expect(err).ToNot(HaveOccurred())
+			if sentRequestID != "" {
+				req.Header.Set(RequestIDHeader, sentRequestID)
+			}
+
+			response, err := http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+			response.Body.Close()
+
+			return response.Header.Get(RequestIDHeader)
+		}
+
+		It("echoes the request ID sent by the client", func() {
+			Expect(requestID("fake-request-id")).To(Equal("fake-request-id"))
+		})
+
+		It("includes the request ID in the lines logged while serving the request", func() {
+			req, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d/instances/fake-instance-id/settings", config.Port), nil)
+			Expect(err).ToNot(HaveOccurred())
+			req.Header.Set(RequestIDHeader, "fake-request-id")
+
+			response, err := http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+			response.Body.Close()
+
+			Expect(logBuffer.Contents()).To(ContainSubstring("[RegistryServerInstanceHandler request_id=fake-request-id] "))
+			Expect(logBuffer.Contents()).To(ContainSubstring("Refusing settings for instance 'fake-instance-id'"))
+		})
+
+		It("generates a request ID when the client does not send a valid one", func() {
+			generatedRequestID := requestID("")
+			Expect(generatedRequestID).To(MatchRegexp("^[0-9a-f]{32}$"))
+			Expect(requestID("")).ToNot(Equal(generatedRequestID))
+
+			Expect(requestID("fake request id")).To(MatchRegexp("^[0-9a-f]{32}$"))
+		})
+	})
+
+	Context("when the access log is enabled", func() {
+		var (
+			tempDir       string
+			accessLogFile string
+		)
+
+		BeforeEach(func() {
+			var err error
+			tempDir, err = ioutil.TempDir("", "access-log")
+			Expect(err).ToNot(HaveOccurred())
+
+			accessLogFile = filepath.Join(tempDir, "access.log")
+			accessLog, err = NewAccessLog(AccessLogConfig{Format: AccessLogFormatJSON, File: accessLogFile}, logger)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			accessLog.Close()
+			os.RemoveAll(tempDir)
+		})
+
+		It("logs the requests with their request ID, client IP and principal", func() {
+			req, err := http.NewRequest("DELETE", fmt.Sprintf("http://127.0.0.1:%d/instances/fake-instance-id/settings?token=fake-token", config.Port), nil)
+			Expect(err).ToNot(HaveOccurred())
+			req.Header.Set("X-Forwarded-For", "10.0.0.5")
+			req.Header.Set(RequestIDHeader, "fake-request-id")
+			req.SetBasicAuth("fake-username", "fake-password")
+
+			response, err := http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+			response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+			var entry AccessLogEntry
+			Eventually(func() error {
+				contents, err := ioutil.ReadFile(accessLogFile)
+				if err != nil {
+					return err
+				}
+				return json.Unmarshal(contents, &entry)
+			}).Should(Succeed())
+
+			Expect(entry.RequestID).To(Equal("fake-request-id"))
+			Expect(entry.ClientIP).To(Equal("10.0.0.5"))
+			Expect(entry.Principal).To(Equal("fake-username"))
+			Expect(entry.Method).To(Equal("DELETE"))
+			Expect(entry.Path).To(Equal("/instances/fake-instance-id/settings"))
+			Expect(entry.InstanceID).To(Equal("fake-instance-id"))
+			Expect(entry.Status).To(Equal(http.StatusOK))
+		})
+	})
+
+	It("passes on its listening socket", func() {
+		address := fmt.Sprintf("127.0.0.1:%d", config.Port)
+
+		files, err := listener.Files()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(files).To(HaveLen(1))
+		Expect(files).To(HaveKey(address))
+		file := files[address]
+		defer file.Close()
+
+		inheritedListener, err := net.FileListener(file)
+		Expect(err).ToNot(HaveOccurred())
+		defer inheritedListener.Close()
+
+		listener.Stop()
+
+		go func() {
+			defer GinkgoRecover()
+			conn, err := net.Dial("tcp", address)
+			Expect(err).ToNot(HaveOccurred())
+			conn.Close()
+		}()
+
+		conn, err := inheritedListener.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		conn.Close()
+	})
+
+	Context("when the PROXY protocol is enabled", func() {
+		BeforeEach(func() {
+			config.ProxyProtocol = true
+		})
+
+		It("resolves the client IP from a PROXY protocol v1 header", func() {
+			Expect(getSettings([]byte("PROXY TCP4 10.0.0.5 127.0.0.1 34567 25777\r\n"), "")).To(Equal(http.StatusOK))
+			Expect(getSettings([]byte("PROXY TCP6 2001:db8::5 ::1 34567 25777\r\n"), "")).To(Equal(http.StatusOK))
+			Expect(getSettings([]byte("PROXY TCP4 10.0.0.6 127.0.0.1 34567 25777\r\n"), "")).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("resolves the client IP from a PROXY protocol v2 header", func() {
+			header := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11")
+			addresses := []byte{10, 0, 0, 5, 127, 0, 0, 1, 0, 0, 0, 0}
+			binary.BigEndian.PutUint16(addresses[8:10], 34567)
+			binary.BigEndian.PutUint16(addresses[10:12], 25777)
+			length := make([]byte, 2)
+			binary.BigEndian.PutUint16(length, uint16(len(addresses)))
+			header = append(append(header, length...), addresses...)
+
+			Expect(getSettings(header, "")).To(Equal(http.StatusOK))
+		})
+
+		It("keeps the proxy address for PROXY protocol headers without addresses", func() {
+			Expect(getSettings([]byte("PROXY UNKNOWN\r\n"), "X-Forwarded-For: 10.0.0.5\r\n")).To(Equal(http.StatusOK))
+		})
+
+		It("closes connections from trusted proxies without a PROXY protocol header", func() {
+			Expect(getSettings(nil, "X-Forwarded-For: 10.0.0.5\r\n")).To(Equal(0))
+		})
+	})
+
+	Context("when stopping", func() {
+		var (
+			reading chan struct{}
+			release chan struct{}
+		)
+
+		BeforeEach(func() {
+			reading = make(chan struct{}, 1)
+			release = make(chan struct{})
+			registryStore = &blockingStore{
+				FakeStore: storefakes.FakeStore{GetFound: true, GetValue: "fake-settings"},
+				reading:   reading,
+				release:   release,
+			}
+		})
+
+		It("waits for the requests in progress and stops accepting new ones", func() {
+			statusCodes := make(chan int, 1)
+			go func() {
+				defer GinkgoRecover()
+				statusCodes <- getSettings(nil, "X-Forwarded-For: 10.0.0.5\r\n")
+			}()
+			Eventually(reading).Should(Receive())
+
+			stopped := make(chan struct{})
+			go func() {
+				listener.Stop()
+				close(stopped)
+			}()
+
+			Eventually(readinessHandler.IsDraining).Should(BeTrue())
+			Consistently(stopped).ShouldNot(BeClosed())
+
+			close(release)
+			Eventually(statusCodes).Should(Receive(Equal(http.StatusOK)))
+			Eventually(stopped).Should(BeClosed())
+
+			_, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", config.Port))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when listening on a Unix socket", func() {
+		var (
+			tempDir string
+		)
+
+		BeforeEach(func() {
+			var err error
+			tempDir, err = ioutil.TempDir("", "listener")
+			Expect(err).ToNot(HaveOccurred())
+
+			config.UnixSocket = UnixSocketConfig{Path: filepath.Join(tempDir, "registry.sock"), Mode: "0660"}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tempDir)
+		})
+
+		It("serves requests with the configured permissions", func() {
+			info, err := os.Stat(config.UnixSocket.Path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode() & os.ModeSocket).ToNot(BeZero())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0660)))
+
+			conn, err := net.Dial("unix", config.UnixSocket.Path)
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+
+			_, err = fmt.Fprint(conn, "GET /readyz HTTP/1.1\r\nHost: fake-host\r\nConnection: close\r\n\r\n")
+			Expect(err).ToNot(HaveOccurred())
+
+			response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			Expect(err).ToNot(HaveOccurred())
+			response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("removes the socket when stopped", func() {
+			listener.Stop()
+
+			_, err := os.Stat(config.UnixSocket.Path)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("replaces a stale socket", func() {
+			listener.Stop()
+
+			staleListener, err := net.Listen("unix", config.UnixSocket.Path)
+			Expect(err).ToNot(HaveOccurred())
+			staleListener.(*net.UnixListener).SetUnlinkOnClose(false)
+			staleListener.Close()
+
+			listener = NewListener(config, Handlers{Readiness: readinessHandler}, logger)
+			Expect(listener.Listen()).To(Succeed())
+		})
+
+		It("returns error if the socket is in use", func() {
+			otherListener := NewListener(config, Handlers{Readiness: readinessHandler}, logger)
+
+			err := otherListener.Listen()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("is in use"))
+		})
+	})
+
+	Context("when serving on multiple listeners", func() {
+		var (
+			readPort  int
+			adminPort int
+		)
+
+		request := func(port int, method string, path string) int {
+			req, err := http.NewRequest(method, fmt.Sprintf("http://localhost:%d%s", port, path), nil)
+			Expect(err).ToNot(HaveOccurred())
+			req.Header.Set("X-Forwarded-For", "10.0.0.5")
+			req.SetBasicAuth("fake-username", "fake-password")
+
+			response, err := http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+			response.Body.Close()
+
+			return response.StatusCode
+		}
+
+		BeforeEach(func() {
+			readPort = freePort()
+			adminPort = freePort()
+			config.Protocol = ""
+			config.Address = ""
+			config.Port = 0
+			config.Listeners = []ListenerConfig{
+				{Protocol: "http", Address: "localhost", Port: readPort, Operations: []string{OperationRead}},
+				{Protocol: "http", Address: "127.0.0.1", Port: adminPort},
+			}
+		})
+
+		It("serves the operations allowed on each listener", func() {
+			Expect(request(readPort, "GET", "/instances/fake-instance-id/settings")).To(Equal(http.StatusOK))
+			Expect(request(readPort, "PUT", "/instances/fake-instance-id/settings")).To(Equal(http.StatusForbidden))
+			Expect(request(readPort, "GET", "/backup")).To(Equal(http.StatusForbidden))
+			Expect(request(readPort, "GET", "/readyz")).To(Equal(http.StatusOK))
+
+			Expect(request(adminPort, "GET", "/instances/fake-instance-id/settings")).To(Equal(http.StatusOK))
+			Expect(request(adminPort, "PUT", "/instances/fake-instance-id/settings")).ToNot(Equal(http.StatusForbidden))
+		})
+
+		It("stops all the listeners", func() {
+			listener.Stop()
+
+			_, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", readPort))
+			Expect(err).To(HaveOccurred())
+			_, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", adminPort))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("does not listen on any of them if one fails", func() {
+			otherConfig := config
+			otherConfig.Listeners = []ListenerConfig{
+				{Protocol: "http", Address: "127.0.0.1", Port: freePort()},
+				config.Listeners[1],
+			}
+			otherListener := NewListener(otherConfig, Handlers{Readiness: readinessHandler}, logger)
+
+			Expect(otherListener.Listen()).ToNot(Succeed())
+			_, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", otherConfig.Listeners[0].Port))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
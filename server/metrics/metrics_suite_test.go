@@ -0,0 +1,13 @@
+package metrics_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestRegistryMetrics(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Registry Metrics Suite")
+}
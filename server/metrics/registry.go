@@ -0,0 +1,313 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the latency histograms.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Registry keeps the metrics exposed in the Prometheus text format.
+type Registry struct {
+	mutex    sync.Mutex
+	families []family
+}
+
+type family interface {
+	write(w io.Writer) error
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// NewCounter registers a counter with the given label names.
+func (r *Registry) NewCounter(name string, help string, labelNames ...string) *Counter {
+	counter := &Counter{desc: newDesc(name, help, "counter", labelNames), values: map[string]*counterValue{}}
+	r.register(counter)
+
+	return counter
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds,
+// in increasing order, and label names.
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	histogram := &Histogram{desc: newDesc(name, help, "histogram", labelNames), buckets: buckets, values: map[string]*histogramValue{}}
+	r.register(histogram)
+
+	return histogram
+}
+
+// NewGaugeFunc registers a gauge whose value is returned by value when the
+// metrics are written. The gauge is left out when value returns an error.
+func (r *Registry) NewGaugeFunc(name string, help string, value func() (float64, error)) {
+	r.register(&gaugeFunc{desc: newDesc(name, help, "gauge", nil), value: value})
+}
+
+// WriteText writes all the metrics in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mutex.Lock()
+	families := append([]family{}, r.families...)
+	r.mutex.Unlock()
+
+	buffered := bufio.NewWriter(w)
+	for _, family := range families {
+		if err := family.write(buffered); err != nil {
+			return err
+		}
+	}
+
+	return buffered.Flush()
+}
+
+func (r *Registry) register(family family) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.families = append(r.families, family)
+}
+
+type desc struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+}
+
+func newDesc(name string, help string, metricType string, labelNames []string) desc {
+	return desc{name: name, help: help, metricType: metricType, labelNames: labelNames}
+}
+
+func (d desc) writeHeader(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, strings.Replace(d.help, "\n", " ", -1), d.name, d.metricType)
+	return err
+}
+
+func (d desc) key(labelValues []string) string {
+	if len(labelValues) != len(d.labelNames) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", d.name, len(d.labelNames), len(labelValues)))
+	}
+
+	return strings.Join(labelValues, "\xff")
+}
+
+// labels formats the label pairs, with the extra pair if not empty.
+func (d desc) labels(labelValues []string, extraName string, extraValue string) string {
+	var pairs []string
+	for i, labelName := range d.labelNames {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labelName, labelValueReplacer.Replace(labelValues[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelValueReplacer escapes label values as the Prometheus text format
+// requires.
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Counter is a monotonically increasing value per set of label values.
+type Counter struct {
+	desc
+
+	mutex  sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labelValues []string
+	value       float64
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	key := c.key(labelValues)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	value, found := c.values[key]
+	if !found {
+		value = &counterValue{labelValues: append([]string{}, labelValues...)}
+		c.values[key] = value
+	}
+	value.value += delta
+}
+
+// Value returns the value for the label values, 0 if never incremented.
+func (c *Counter) Value(labelValues ...string) float64 {
+	key := c.key(labelValues)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if value, found := c.values[key]; found {
+		return value.value
+	}
+
+	return 0
+}
+
+func (c *Counter) write(w io.Writer) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.writeHeader(w); err != nil {
+		return err
+	}
+
+	if len(c.values) == 0 && len(c.labelNames) == 0 {
+		_, err := fmt.Fprintf(w, "%s 0\n", c.name)
+		return err
+	}
+
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := c.values[key]
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", c.name, c.labels(value.labelValues, "", ""), formatFloat(value.value)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Histogram counts observations in buckets per set of label values.
+type Histogram struct {
+	desc
+	buckets []float64
+
+	mutex  sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues  []string
+	bucketCounts []uint64
+	count        uint64
+	sum          float64
+}
+
+func (h *Histogram) Observe(observation float64, labelValues ...string) {
+	key := h.key(labelValues)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	value, found := h.values[key]
+	if !found {
+		value = &histogramValue{labelValues: append([]string{}, labelValues...), bucketCounts: make([]uint64, len(h.buckets))}
+		h.values[key] = value
+	}
+
+	for i, upperBound := range h.buckets {
+		if observation <= upperBound {
+			value.bucketCounts[i]++
+		}
+	}
+	value.count++
+	value.sum += observation
+}
+
+// Count returns the number of observations for the label values.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	key := h.key(labelValues)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if value, found := h.values[key]; found {
+		return value.count
+	}
+
+	return 0
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if err := h.writeHeader(w); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := h.values[key]
+		for i, upperBound := range h.buckets {
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labels(value.labelValues, "le", formatFloat(upperBound)), value.bucketCounts[i]); err != nil {
+				return err
+			}
+		}
+
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labels(value.labelValues, "le", "+Inf"), value.count); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labels(value.labelValues, "", ""), formatFloat(value.sum)); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labels(value.labelValues, "", ""), value.count); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type gaugeFunc struct {
+	desc
+	value func() (float64, error)
+}
+
+func (g *gaugeFunc) write(w io.Writer) error {
+	value, err := g.value()
+	if err != nil {
+		return nil
+	}
+
+	if err := g.writeHeader(w); err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(value))
+	return err
+}
@@ -0,0 +1,96 @@
+package metrics_test
+
+import (
+	"bytes"
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server/metrics"
+)
+
+var _ = Describe("Registry", func() {
+	var (
+		metricsRegistry *Registry
+	)
+
+	BeforeEach(func() {
+		metricsRegistry = NewRegistry()
+	})
+
+	writeText := func() string {
+		buffer := &bytes.Buffer{}
+		Expect(metricsRegistry.WriteText(buffer)).To(Succeed())
+		return buffer.String()
+	}
+
+	It("writes counters sorted by label values", func() {
+		counter := metricsRegistry.NewCounter("fake_total", "Fake counter.", "method", "code")
+		counter.Inc("PUT", "201")
+		counter.Inc("GET", "200")
+		counter.Add(2, "GET", "200")
+
+		Expect(counter.Value("GET", "200")).To(Equal(float64(3)))
+		Expect(writeText()).To(Equal(`# HELP fake_total Fake counter.
+# TYPE fake_total counter
+fake_total{method="GET",code="200"} 3
+fake_total{method="PUT",code="201"} 1
+`))
+	})
+
+	It("writes counters without labels", func() {
+		metricsRegistry.NewCounter("fake_total", "Fake counter.").Inc()
+
+		Expect(writeText()).To(ContainSubstring("\nfake_total 1\n"))
+	})
+
+	It("writes 0 for counters without labels never incremented", func() {
+		metricsRegistry.NewCounter("fake_total", "Fake counter.")
+
+		Expect(writeText()).To(Equal("# HELP fake_total Fake counter.\n# TYPE fake_total counter\nfake_total 0\n"))
+	})
+
+	It("escapes label values", func() {
+		metricsRegistry.NewCounter("fake_total", "Fake counter.", "path").Inc("a\\b\"c\nd")
+
+		Expect(writeText()).To(ContainSubstring(`fake_total{path="a\\b\"c\nd"} 1`))
+	})
+
+	It("writes histograms with cumulative buckets", func() {
+		histogram := metricsRegistry.NewHistogram("fake_seconds", "Fake histogram.", []float64{0.1, 1}, "operation")
+		histogram.Observe(0.05, "get")
+		histogram.Observe(0.5, "get")
+		histogram.Observe(5, "get")
+
+		Expect(histogram.Count("get")).To(Equal(uint64(3)))
+		Expect(writeText()).To(Equal(`# HELP fake_seconds Fake histogram.
+# TYPE fake_seconds histogram
+fake_seconds_bucket{operation="get",le="0.1"} 1
+fake_seconds_bucket{operation="get",le="1"} 2
+fake_seconds_bucket{operation="get",le="+Inf"} 3
+fake_seconds_sum{operation="get"} 5.55
+fake_seconds_count{operation="get"} 3
+`))
+	})
+
+	It("writes gauges with their current value", func() {
+		value := 1.0
+		metricsRegistry.NewGaugeFunc("fake_gauge", "Fake gauge.", func() (float64, error) { return value, nil })
+		value = 2
+
+		Expect(writeText()).To(Equal("# HELP fake_gauge Fake gauge.\n# TYPE fake_gauge gauge\nfake_gauge 2\n"))
+	})
+
+	It("leaves out gauges failing to return their value", func() {
+		metricsRegistry.NewGaugeFunc("fake_gauge", "Fake gauge.", func() (float64, error) { return 0, errors.New("fake-error") })
+
+		Expect(writeText()).To(BeEmpty())
+	})
+
+	It("panics if the label values do not match the label names", func() {
+		counter := metricsRegistry.NewCounter("fake_total", "Fake counter.", "method")
+
+		Expect(func() { counter.Inc() }).To(Panic())
+	})
+})
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+
+	"github.com/frodenas/bosh-registry/server/metrics"
+	"github.com/frodenas/bosh-registry/server/store"
+)
+
+const metricsHandlerLogTag = "RegistryServerMetricsHandler"
+const metricsPath = "/metrics"
+
+// MetricsConfig sets whether the metrics require admin credentials.
+type MetricsConfig struct {
+	RequireAdmin bool `json:"require_admin,omitempty"`
+}
+
+// metricsMethods are the request methods counted by their name, the others
+// are counted as OTHER to bound the number of series.
+var metricsMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true, "OPTIONS": true,
+}
+
+// MetricsHandler exposes the metrics in the Prometheus text format, and
+// records the requests served, the authentication failures and the TLS
+// handshake errors.
+type MetricsHandler struct {
+	config          MetricsConfig
+	users           *Users
+	metricsRegistry *metrics.Registry
+	logger          boshlog.Logger
+
+	requests           *metrics.Counter
+	requestDuration    *metrics.Histogram
+	authFailures       *metrics.Counter
+	tlsHandshakeErrors *metrics.Counter
+}
+
+// NewMetricsHandler returns a MetricsHandler reporting the instances counted
+// from the store keys. In a cluster, given by a non-nil node, only the leader
+// reports them.
+func NewMetricsHandler(
+	config MetricsConfig,
+	users *Users,
+	metricsRegistry *metrics.Registry,
+	registryStore store.Store,
+	clusterNode ClusterNode,
+	logger boshlog.Logger,
+) *MetricsHandler {
+	metricsRegistry.NewGaugeFunc("bosh_registry_instances", "Instances with settings in the Registry Store.", func() (float64, error) {
+		if clusterNode != nil && !clusterNode.IsLeader() {
+			return 0, bosherr.Error("Not the cluster leader")
+		}
+
+		keys, err := registryStore.Keys()
+		if err != nil {
+			logger.Warn(metricsHandlerLogTag, "Counting instances: %s", err.Error())
+			return 0, err
+		}
+
+		instances := 0
+		for _, key := range keys {
+			if !isInstanceTokenKey(key) {
+				instances++
+			}
+		}
+
+		return float64(instances), nil
+	})
+
+	return &MetricsHandler{
+		config:          config,
+		users:           users,
+		metricsRegistry: metricsRegistry,
+		logger:          logger,
+
+		requests:           metricsRegistry.NewCounter("bosh_registry_http_requests_total", "HTTP requests served.", "method", "code"),
+		requestDuration:    metricsRegistry.NewHistogram("bosh_registry_http_request_duration_seconds", "Latency of the HTTP requests served.", metrics.DefaultBuckets, "method", "code"),
+		authFailures:       metricsRegistry.NewCounter("bosh_registry_auth_failures_total", "HTTP requests answered with 401 Unauthorized."),
+		tlsHandshakeErrors: metricsRegistry.NewCounter("bosh_registry_tls_handshake_errors_total", "Failed TLS handshakes."),
+	}
+}
+
+func (mh *MetricsHandler) HandleFunc(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if mh.config.RequireAdmin && !mh.users.IsAuthorized(req, RoleAdmin) {
+		mh.logger.Debug(requestLogTag(metricsHandlerLogTag, req), "Received unauthorized request")
+		w.Header().Add("WWW-Authenticate", `Basic realm="Bosh Registry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	if err := mh.metricsRegistry.WriteText(w); err != nil {
+		mh.logger.Debug(requestLogTag(metricsHandlerLogTag, req), "Writing metrics to %s: %s", req.RemoteAddr, err.Error())
+	}
+}
+
+// Wrap counts the requests, their latency and the authentication failures.
+func (mh *MetricsHandler) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, req)
+
+		method := req.Method
+		if !metricsMethods[method] {
+			method = "OTHER"
+		}
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		code := strconv.Itoa(status)
+
+		mh.requests.Inc(method, code)
+		mh.requestDuration.Observe(time.Since(start).Seconds(), method, code)
+		if status == http.StatusUnauthorized {
+			mh.authFailures.Inc()
+		}
+	})
+}
+
+func (mh *MetricsHandler) TLSHandshakeError() {
+	mh.tlsHandshakeErrors.Inc()
+}
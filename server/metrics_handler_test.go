@@ -0,0 +1,146 @@
+package server_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/bcrypt"
+
+	. "github.com/frodenas/bosh-registry/server"
+
+	"github.com/frodenas/bosh-registry/server/fakes"
+	"github.com/frodenas/bosh-registry/server/metrics"
+	storefakes "github.com/frodenas/bosh-registry/server/store/fakes"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+var _ = Describe("MetricsHandler", func() {
+	var (
+		err              error
+		config           MetricsConfig
+		request          *http.Request
+		responseRecorder *httptest.ResponseRecorder
+		registryStore    *storefakes.FakeStore
+		clusterNode      ClusterNode
+		metricsHandler   *MetricsHandler
+
+		logger = boshlog.NewLogger(boshlog.LevelNone)
+	)
+
+	BeforeEach(func() {
+		config = MetricsConfig{}
+		request, err = http.NewRequest("GET", "/metrics", nil)
+		Expect(err).ToNot(HaveOccurred())
+		responseRecorder = httptest.NewRecorder()
+		registryStore = &storefakes.FakeStore{
+			KeysResult: []string{"fake-instance-id", "other-fake-instance-id", "tokens/other-fake-instance-id"},
+		}
+		clusterNode = nil
+	})
+
+	JustBeforeEach(func() {
+		writerPasswordHash, err := bcrypt.GenerateFromPassword([]byte("fake-password"), bcrypt.MinCost)
+		Expect(err).ToNot(HaveOccurred())
+
+		users := newUsers(Config{
+			Username: "fake-admin",
+			Password: "fake-password",
+			Users:    []UserConfig{{Name: "fake-writer", PasswordHash: string(writerPasswordHash), Role: RoleWriter}},
+		})
+		metricsHandler = NewMetricsHandler(config, users, metrics.NewRegistry(), registryStore, clusterNode, logger)
+	})
+
+	It("reports the number of instances", func() {
+		metricsHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+		Expect(responseRecorder.Header().Get("Content-Type")).To(Equal("text/plain; version=0.0.4"))
+		Expect(responseRecorder.Body.String()).To(ContainSubstring("\nbosh_registry_instances 2\n"))
+		Expect(registryStore.GetAllCalled).To(BeFalse())
+	})
+
+	It("leaves out the number of instances when the store fails", func() {
+		registryStore.KeysErr = errors.New("fake-keys-error")
+
+		metricsHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+		Expect(responseRecorder.Body.String()).ToNot(ContainSubstring("bosh_registry_instances"))
+	})
+
+	Context("in a cluster", func() {
+		var fakeClusterNode *fakes.FakeClusterNode
+
+		BeforeEach(func() {
+			fakeClusterNode = &fakes.FakeClusterNode{}
+			clusterNode = fakeClusterNode
+		})
+
+		It("reports the number of instances on the leader", func() {
+			fakeClusterNode.Leading = true
+
+			metricsHandler.HandleFunc(responseRecorder, request)
+			Expect(responseRecorder.Body.String()).To(ContainSubstring("\nbosh_registry_instances 2\n"))
+		})
+
+		It("leaves out the number of instances on the followers", func() {
+			metricsHandler.HandleFunc(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(responseRecorder.Body.String()).ToNot(ContainSubstring("bosh_registry_instances"))
+			Expect(registryStore.KeysCalled).To(BeFalse())
+		})
+	})
+
+	It("records the requests, their latency and the authentication failures", func() {
+		handler := metricsHandler.Wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Method == "PUT" {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		}))
+
+		for _, method := range []string{"GET", "GET", "PUT", "FAKE"} {
+			req, err := http.NewRequest(method, "/instances/fake-instance-id/settings", nil)
+			Expect(err).ToNot(HaveOccurred())
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		metricsHandler.TLSHandshakeError()
+
+		metricsHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Body.String()).To(ContainSubstring(`bosh_registry_http_requests_total{method="GET",code="200"} 2`))
+		Expect(responseRecorder.Body.String()).To(ContainSubstring(`bosh_registry_http_requests_total{method="PUT",code="401"} 1`))
+		Expect(responseRecorder.Body.String()).To(ContainSubstring(`bosh_registry_http_requests_total{method="OTHER",code="200"} 1`))
+		Expect(responseRecorder.Body.String()).To(ContainSubstring(`bosh_registry_http_request_duration_seconds_count{method="GET",code="200"} 2`))
+		Expect(responseRecorder.Body.String()).To(ContainSubstring("\nbosh_registry_auth_failures_total 1\n"))
+		Expect(responseRecorder.Body.String()).To(ContainSubstring("\nbosh_registry_tls_handshake_errors_total 1\n"))
+	})
+
+	It("returns 405 Method Not Allowed if request method is not GET or HEAD", func() {
+		request.Method = "POST"
+
+		metricsHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusMethodNotAllowed))
+	})
+
+	Context("when admin credentials are required", func() {
+		BeforeEach(func() {
+			config.RequireAdmin = true
+		})
+
+		It("reports the metrics to admins", func() {
+			request.SetBasicAuth("fake-admin", "fake-password")
+
+			metricsHandler.HandleFunc(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+		})
+
+		It("returns 401 Unauthorized to other users", func() {
+			request.SetBasicAuth("fake-writer", "fake-password")
+
+			metricsHandler.HandleFunc(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusUnauthorized))
+			Expect(responseRecorder.Header().Get("WWW-Authenticate")).To(Equal(`Basic realm="Bosh Registry"`))
+		})
+	})
+})
@@ -0,0 +1,173 @@
+package notifications
+
+import (
+	"net/url"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+)
+
+const defaultQueueSize = 100
+const defaultMaxAttempts = 5
+const defaultRetryDelayMs = 1000
+const defaultMaxRetryDelayMs = 60000
+
+const defaultNATSSubject = "bosh.registry.changes"
+
+type Config struct {
+	Webhooks        []WebhookConfig `json:"webhooks,omitempty"`
+	QueueSize       int             `json:"queue_size,omitempty"`
+	MaxAttempts     int             `json:"max_attempts,omitempty"`
+	RetryDelayMs    int             `json:"retry_delay_ms,omitempty"`
+	MaxRetryDelayMs int             `json:"max_retry_delay_ms,omitempty"`
+	NATS            NATSConfig      `json:"nats,omitempty"`
+}
+
+// WebhookConfig is a webhook notified of the registry changes. The settings,
+// which contain credentials, are only sent to https webhooks asking for them.
+type WebhookConfig struct {
+	URL             string `json:"url,omitempty"`
+	Secret          string `json:"secret,omitempty"`
+	IncludeSettings bool   `json:"include_settings,omitempty"`
+}
+
+type NATSConfig struct {
+	URL      string        `json:"url,omitempty"`
+	Subject  string        `json:"subject,omitempty"`
+	Username string        `json:"username,omitempty"`
+	Password string        `json:"password,omitempty"`
+	TLS      NATSTLSConfig `json:"tls,omitempty"`
+}
+
+type NATSTLSConfig struct {
+	CertFile   string `json:"certfile,omitempty"`
+	KeyFile    string `json:"keyfile,omitempty"`
+	CACertFile string `json:"cacertfile,omitempty"`
+}
+
+func (c Config) Validate() error {
+	if c.QueueSize < 0 {
+		return bosherr.Error("Must provide a non-negative QueueSize")
+	}
+
+	if c.MaxAttempts < 0 {
+		return bosherr.Error("Must provide a non-negative MaxAttempts")
+	}
+
+	if c.RetryDelayMs < 0 {
+		return bosherr.Error("Must provide a non-negative RetryDelayMs")
+	}
+
+	if c.MaxRetryDelayMs < 0 {
+		return bosherr.Error("Must provide a non-negative MaxRetryDelayMs")
+	}
+
+	for _, webhook := range c.Webhooks {
+		if err := webhook.Validate(); err != nil {
+			return bosherr.WrapError(err, "Validating Webhook configuration")
+		}
+	}
+
+	if err := c.NATS.Validate(); err != nil {
+		return bosherr.WrapError(err, "Validating NATS configuration")
+	}
+
+	return nil
+}
+
+func (c WebhookConfig) Validate() error {
+	if c.URL == "" {
+		return bosherr.Error("Must provide a non-empty URL")
+	}
+
+	webhookURL, err := url.Parse(c.URL)
+	if err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || webhookURL.Host == "" {
+		return bosherr.Errorf("Must provide a valid http or https URL, got '%s'", c.URL)
+	}
+
+	if c.IncludeSettings && webhookURL.Scheme != "https" {
+		return bosherr.Errorf("Must provide an https URL with IncludeSettings, got '%s'", c.URL)
+	}
+
+	return nil
+}
+
+func (c NATSConfig) Enabled() bool {
+	return c.URL != ""
+}
+
+func (c NATSConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+
+	natsURL, err := url.Parse(c.URL)
+	if err != nil || (natsURL.Scheme != "nats" && natsURL.Scheme != "tls") || natsURL.Host == "" {
+		return bosherr.Errorf("Must provide a valid nats or tls URL, got '%s'", c.URL)
+	}
+
+	if c.Password != "" && c.Username == "" {
+		return bosherr.Error("Must provide a non-empty Username when providing a Password")
+	}
+
+	if err := c.TLS.Validate(); err != nil {
+		return bosherr.WrapError(err, "Validating TLS configuration")
+	}
+
+	return nil
+}
+
+func (c NATSTLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || c.CACertFile != ""
+}
+
+func (c NATSTLSConfig) Validate() error {
+	if c.CertFile != "" && c.KeyFile == "" {
+		return bosherr.Error("Must provide a non-empty KeyFile when providing a CertFile")
+	}
+
+	if c.KeyFile != "" && c.CertFile == "" {
+		return bosherr.Error("Must provide a non-empty CertFile when providing a KeyFile")
+	}
+
+	return nil
+}
+
+func (c NATSConfig) subject() string {
+	if c.Subject == "" {
+		return defaultNATSSubject
+	}
+
+	return c.Subject
+}
+
+func (c Config) queueSize() int {
+	if c.QueueSize == 0 {
+		return defaultQueueSize
+	}
+
+	return c.QueueSize
+}
+
+func (c Config) maxAttempts() int {
+	if c.MaxAttempts == 0 {
+		return defaultMaxAttempts
+	}
+
+	return c.MaxAttempts
+}
+
+func (c Config) retryDelayMs() int {
+	if c.RetryDelayMs == 0 {
+		return defaultRetryDelayMs
+	}
+
+	return c.RetryDelayMs
+}
+
+func (c Config) maxRetryDelayMs() int {
+	if c.MaxRetryDelayMs == 0 {
+		return defaultMaxRetryDelayMs
+	}
+
+	return c.MaxRetryDelayMs
+}
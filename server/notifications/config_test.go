@@ -0,0 +1,176 @@
+package notifications_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server/notifications"
+)
+
+var _ = Describe("Config", func() {
+	var (
+		options Config
+
+		validOptions = Config{
+			Webhooks: []WebhookConfig{
+				{URL: "https://fake-host/fake-path", Secret: "fake-secret"},
+			},
+		}
+	)
+
+	Describe("Validate", func() {
+		BeforeEach(func() {
+			options = validOptions
+		})
+
+		It("does not return error if all fields are valid", func() {
+			err := options.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("does not return error if there are no webhooks", func() {
+			options = Config{}
+
+			err := options.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns error if QueueSize is negative", func() {
+			options.QueueSize = -1
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a non-negative QueueSize"))
+		})
+
+		It("returns error if MaxAttempts is negative", func() {
+			options.MaxAttempts = -1
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a non-negative MaxAttempts"))
+		})
+
+		It("returns error if RetryDelayMs is negative", func() {
+			options.RetryDelayMs = -1
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a non-negative RetryDelayMs"))
+		})
+
+		It("returns error if MaxRetryDelayMs is negative", func() {
+			options.MaxRetryDelayMs = -1
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a non-negative MaxRetryDelayMs"))
+		})
+
+		It("returns error if NATS is not valid", func() {
+			options.NATS = NATSConfig{URL: "http://fake-host:4222"}
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating NATS configuration"))
+		})
+
+		It("returns error if a webhook is not valid", func() {
+			options.Webhooks = []WebhookConfig{{URL: ""}}
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating Webhook configuration"))
+		})
+	})
+})
+
+var _ = Describe("WebhookConfig", func() {
+	Describe("Validate", func() {
+		It("returns error if URL is empty", func() {
+			err := WebhookConfig{}.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a non-empty URL"))
+		})
+
+		It("returns error if URL is not an http or https URL", func() {
+			err := WebhookConfig{URL: "ftp://fake-host/fake-path"}.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a valid http or https URL"))
+		})
+
+		It("returns error if settings are included with an http URL", func() {
+			Expect(WebhookConfig{URL: "https://fake-host/fake-path", IncludeSettings: true}.Validate()).To(Succeed())
+
+			err := WebhookConfig{URL: "http://fake-host/fake-path", IncludeSettings: true}.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide an https URL with IncludeSettings"))
+		})
+	})
+})
+
+var _ = Describe("NATSConfig", func() {
+	var (
+		options NATSConfig
+
+		validOptions = NATSConfig{
+			URL:      "nats://fake-host:4222",
+			Subject:  "fake-subject",
+			Username: "fake-username",
+			Password: "fake-password",
+			TLS: NATSTLSConfig{
+				CertFile:   "fake-certificate",
+				KeyFile:    "fake-key",
+				CACertFile: "fake-ca-certificate",
+			},
+		}
+	)
+
+	Describe("Validate", func() {
+		BeforeEach(func() {
+			options = validOptions
+		})
+
+		It("does not return error if all fields are valid", func() {
+			err := options.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("does not return error if NATS is not enabled", func() {
+			err := NATSConfig{}.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns error if URL is not a nats or tls URL", func() {
+			options.URL = "fake-host:4222"
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a valid nats or tls URL"))
+		})
+
+		It("returns error if Password is provided without Username", func() {
+			options.Username = ""
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a non-empty Username when providing a Password"))
+		})
+
+		It("returns error if CertFile is provided without KeyFile", func() {
+			options.TLS.KeyFile = ""
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a non-empty KeyFile when providing a CertFile"))
+		})
+
+		It("returns error if KeyFile is provided without CertFile", func() {
+			options.TLS.CertFile = ""
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a non-empty CertFile when providing a KeyFile"))
+		})
+	})
+})
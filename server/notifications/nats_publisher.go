@@ -0,0 +1,202 @@
+package notifications
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+	"github.com/nats-io/go-nats"
+
+	"github.com/frodenas/bosh-registry/server"
+)
+
+const natsPublisherLogTag = "RegistryNATSPublisher"
+const natsPublisherClientName = "bosh-registry"
+const natsPublisherConnectRetryDelay = 2 * time.Second
+
+// NATSPublisher publishes registry changes to a NATS subject. Settings are
+// never published, as they contain credentials and the message bus is shared
+// with the agents. When NATS cannot be reached, it keeps connecting in the
+// background, dropping the events published meanwhile.
+type NATSPublisher struct {
+	config  NATSConfig
+	logger  boshlog.Logger
+	options []nats.Option
+
+	mutex      sync.RWMutex
+	connection *nats.Conn
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewNATSPublisher(
+	config NATSConfig,
+	logger boshlog.Logger,
+) (*NATSPublisher, error) {
+	if err := loadNATSTLSFiles(config.TLS); err != nil {
+		return nil, err
+	}
+
+	options := []nats.Option{
+		nats.Name(natsPublisherClientName),
+		nats.MaxReconnects(-1),
+		nats.DisconnectHandler(func(*nats.Conn) {
+			logger.Warn(natsPublisherLogTag, "Disconnected from NATS")
+		}),
+		nats.ReconnectHandler(func(connection *nats.Conn) {
+			logger.Info(natsPublisherLogTag, "Reconnected to NATS server %s", connection.ConnectedServerId())
+		}),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			logger.Error(natsPublisherLogTag, "NATS error: %s", err.Error())
+		}),
+	}
+
+	if config.Username != "" {
+		options = append(options, nats.UserInfo(config.Username, config.Password))
+	}
+
+	if config.TLS.CACertFile != "" {
+		options = append(options, nats.RootCAs(config.TLS.CACertFile))
+	}
+
+	if config.TLS.CertFile != "" {
+		options = append(options, nats.ClientCert(config.TLS.CertFile, config.TLS.KeyFile))
+	}
+
+	p := &NATSPublisher{
+		config:  config,
+		logger:  logger,
+		options: options,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if err := p.connect(); err != nil {
+		logger.Error(natsPublisherLogTag, "Connecting to NATS, retrying in the background: %s", err.Error())
+		go p.retryConnect()
+	} else {
+		close(p.done)
+	}
+
+	return p, nil
+}
+
+func (p *NATSPublisher) Publish(event server.Event) {
+	p.mutex.RLock()
+	connection := p.connection
+	p.mutex.RUnlock()
+
+	if connection == nil {
+		p.logger.Warn(natsPublisherLogTag, "Dropping '%s' event for instance '%s', not connected to NATS", event.Type, event.InstanceID)
+		return
+	}
+
+	payloadJSON, err := json.Marshal(NewPayload(event))
+	if err != nil {
+		p.logger.Error(natsPublisherLogTag, "Marshalling '%s' event for instance '%s': %s", event.Type, event.InstanceID, err.Error())
+		return
+	}
+
+	if err = connection.Publish(p.config.subject(), payloadJSON); err != nil {
+		p.logger.Error(natsPublisherLogTag, "Publishing '%s' event for instance '%s' to NATS subject '%s': %s", event.Type, event.InstanceID, p.config.subject(), err.Error())
+		return
+	}
+
+	p.logger.Debug(natsPublisherLogTag, "Published '%s' event for instance '%s' to NATS subject '%s'", event.Type, event.InstanceID, p.config.subject())
+}
+
+// Connected returns whether the publisher has connected to NATS.
+func (p *NATSPublisher) Connected() bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return p.connection != nil
+}
+
+// Stop stops connecting to NATS, or flushes the pending messages and closes
+// the NATS connection.
+func (p *NATSPublisher) Stop() {
+	select {
+	case <-p.stop:
+		return
+	default:
+		close(p.stop)
+	}
+	<-p.done
+
+	p.mutex.RLock()
+	connection := p.connection
+	p.mutex.RUnlock()
+
+	if connection == nil {
+		return
+	}
+
+	if err := connection.Flush(); err != nil {
+		p.logger.Warn(natsPublisherLogTag, "Flushing NATS connection: %s", err.Error())
+	}
+	connection.Close()
+}
+
+func (p *NATSPublisher) connect() error {
+	connection, err := nats.Connect(p.config.URL, p.options...)
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	p.connection = connection
+	p.mutex.Unlock()
+
+	p.logger.Debug(natsPublisherLogTag, "Connected to NATS server %s", connection.ConnectedServerId())
+
+	return nil
+}
+
+func (p *NATSPublisher) retryConnect() {
+	defer close(p.done)
+
+	for attempt := 2; ; attempt++ {
+		select {
+		case <-time.After(natsPublisherConnectRetryDelay):
+		case <-p.stop:
+			return
+		}
+
+		err := p.connect()
+		if err == nil {
+			return
+		}
+
+		p.logger.Error(natsPublisherLogTag, "Connecting to NATS attempt #%d: %s", attempt, err.Error())
+	}
+}
+
+// loadNATSTLSFiles checks the TLS files, so configuration errors are reported
+// right away rather than retried.
+func loadNATSTLSFiles(config NATSTLSConfig) error {
+	if config.CACertFile != "" {
+		caCert, err := ioutil.ReadFile(config.CACertFile)
+		if err != nil {
+			return bosherr.WrapError(err, "Loading NATS CA certificate")
+		}
+
+		if !x509.NewCertPool().AppendCertsFromPEM(caCert) {
+			return bosherr.Error("Invalid NATS CA Certificate")
+		}
+	}
+
+	if config.CertFile != "" {
+		if _, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile); err != nil {
+			return bosherr.WrapErrorf(err, "Loading NATS X509 Key Pair '%s'", config.CertFile)
+		}
+	}
+
+	return nil
+}
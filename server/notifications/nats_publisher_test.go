@@ -0,0 +1,280 @@
+package notifications_test
+
+import (
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server/notifications"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+	natsserver "github.com/nats-io/gnatsd/server"
+	"github.com/nats-io/go-nats"
+
+	"github.com/frodenas/bosh-registry/server"
+	"github.com/frodenas/bosh-registry/test/certs"
+)
+
+var _ = Describe("NATSPublisher", func() {
+	var (
+		err           error
+		natsServer    *natsserver.Server
+		natsURL       string
+		subscriber    *nats.Conn
+		messages      chan *nats.Msg
+		natsPublisher *NATSPublisher
+
+		logger = boshlog.NewLogger(boshlog.LevelNone)
+	)
+
+	startNATSServer := func(options *natsserver.Options) {
+		options.Host = "127.0.0.1"
+		if options.Port == 0 {
+			options.Port = -1
+		}
+		options.NoLog = true
+		options.NoSigs = true
+
+		natsServer = natsserver.New(options)
+		go natsServer.Start()
+		Expect(natsServer.ReadyForConnections(5 * time.Second)).To(BeTrue())
+
+		natsURL = fmt.Sprintf("nats://%s", natsServer.Addr().String())
+	}
+
+	subscribe := func(subject string, options ...nats.Option) {
+		subscriber, err = nats.Connect(natsURL, options...)
+		Expect(err).ToNot(HaveOccurred())
+
+		messages = make(chan *nats.Msg, 10)
+		_, err = subscriber.ChanSubscribe(subject, messages)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(subscriber.Flush()).To(Succeed())
+	}
+
+	AfterEach(func() {
+		if natsPublisher != nil {
+			natsPublisher.Stop()
+			natsPublisher = nil
+		}
+		if subscriber != nil {
+			subscriber.Close()
+			subscriber = nil
+		}
+		natsServer.Shutdown()
+	})
+
+	Context("when NATS does not require authentication", func() {
+		BeforeEach(func() {
+			startNATSServer(&natsserver.Options{})
+		})
+
+		It("publishes events to the default subject", func() {
+			subscribe("bosh.registry.changes")
+
+			natsPublisher, err = NewNATSPublisher(NATSConfig{URL: natsURL}, logger)
+			Expect(err).ToNot(HaveOccurred())
+
+			event := server.NewEvent(server.EventTypeCreated, "fake-instance-id")
+			event.Settings = "fake-settings"
+			natsPublisher.Publish(event)
+
+			var message *nats.Msg
+			Eventually(messages).Should(Receive(&message))
+
+			var payload Payload
+			err = json.Unmarshal(message.Data, &payload)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(payload.Type).To(Equal(server.EventTypeCreated))
+			Expect(payload.InstanceID).To(Equal("fake-instance-id"))
+			Expect(payload.Settings).To(BeEmpty())
+		})
+
+		It("publishes events to the configured subject", func() {
+			subscribe("fake-subject")
+
+			natsPublisher, err = NewNATSPublisher(NATSConfig{URL: natsURL, Subject: "fake-subject"}, logger)
+			Expect(err).ToNot(HaveOccurred())
+
+			natsPublisher.Publish(server.NewEvent(server.EventTypeDeleted, "fake-instance-id"))
+
+			var message *nats.Msg
+			Eventually(messages).Should(Receive(&message))
+			Expect(string(message.Data)).To(ContainSubstring(`"type":"deleted"`))
+		})
+	})
+
+	Context("when NATS is not available yet", func() {
+		It("connects in the background once NATS becomes available", func() {
+			startNATSServer(&natsserver.Options{})
+			port := natsServer.Addr().(*net.TCPAddr).Port
+			natsServer.Shutdown()
+
+			natsPublisher, err = NewNATSPublisher(NATSConfig{URL: natsURL}, logger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(natsPublisher.Connected()).To(BeFalse())
+
+			startNATSServer(&natsserver.Options{Port: port})
+			subscribe("bosh.registry.changes")
+
+			Eventually(natsPublisher.Connected, 10*time.Second).Should(BeTrue())
+
+			natsPublisher.Publish(server.NewEvent(server.EventTypeCreated, "fake-instance-id"))
+
+			Eventually(messages).Should(Receive())
+		})
+
+		It("stops connecting when stopped", func() {
+			natsPublisher, err = NewNATSPublisher(NATSConfig{URL: "nats://127.0.0.1:1"}, logger)
+			Expect(err).ToNot(HaveOccurred())
+
+			done := make(chan struct{})
+			go func() {
+				natsPublisher.Stop()
+				close(done)
+			}()
+			Eventually(done).Should(BeClosed())
+			Expect(natsPublisher.Connected()).To(BeFalse())
+
+			startNATSServer(&natsserver.Options{})
+		})
+	})
+
+	Context("when NATS requires authentication", func() {
+		BeforeEach(func() {
+			startNATSServer(&natsserver.Options{
+				Username: "fake-username",
+				Password: "fake-password",
+			})
+		})
+
+		It("publishes events using the configured credentials", func() {
+			subscribe("bosh.registry.changes", nats.UserInfo("fake-username", "fake-password"))
+
+			natsPublisher, err = NewNATSPublisher(NATSConfig{
+				URL:      natsURL,
+				Username: "fake-username",
+				Password: "fake-password",
+			}, logger)
+			Expect(err).ToNot(HaveOccurred())
+
+			natsPublisher.Publish(server.NewEvent(server.EventTypeUpdated, "fake-instance-id"))
+
+			Eventually(messages).Should(Receive())
+		})
+
+		It("does not connect if credentials are not valid", func() {
+			natsPublisher, err = NewNATSPublisher(NATSConfig{
+				URL:      natsURL,
+				Username: "fake-username",
+				Password: "wrong-password",
+			}, logger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(natsPublisher.Connected()).To(BeFalse())
+
+			natsPublisher.Publish(server.NewEvent(server.EventTypeUpdated, "fake-instance-id"))
+		})
+	})
+
+	Context("when NATS requires TLS client certificates", func() {
+		var (
+			certsDir   string
+			authority  *certs.Authority
+			clientCert certs.KeyPair
+		)
+
+		BeforeEach(func() {
+			certsDir, err = ioutil.TempDir("", "nats-publisher")
+			Expect(err).ToNot(HaveOccurred())
+
+			authority, err = certs.NewAuthority(certsDir, "nats")
+			Expect(err).ToNot(HaveOccurred())
+
+			serverCert, err := authority.IssueServer("nats-server")
+			Expect(err).ToNot(HaveOccurred())
+
+			clientCert, err = authority.IssueClient("nats-client", pkix.Name{CommonName: "nats-client"})
+			Expect(err).ToNot(HaveOccurred())
+
+			tlsConfig, err := natsserver.GenTLSConfig(&natsserver.TLSConfigOpts{
+				CertFile: serverCert.CertFile,
+				KeyFile:  serverCert.KeyFile,
+				CaFile:   authority.CertFile,
+				Verify:   true,
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			startNATSServer(&natsserver.Options{
+				TLS:        true,
+				TLSVerify:  true,
+				TLSConfig:  tlsConfig,
+				TLSTimeout: 2,
+			})
+			natsURL = fmt.Sprintf("tls://%s", natsServer.Addr().String())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(certsDir)
+		})
+
+		It("publishes events using the configured certificates", func() {
+			subscribe(
+				"bosh.registry.changes",
+				nats.RootCAs(authority.CertFile),
+				nats.ClientCert(clientCert.CertFile, clientCert.KeyFile),
+			)
+
+			natsPublisher, err = NewNATSPublisher(NATSConfig{
+				URL: natsURL,
+				TLS: NATSTLSConfig{
+					CertFile:   clientCert.CertFile,
+					KeyFile:    clientCert.KeyFile,
+					CACertFile: authority.CertFile,
+				},
+			}, logger)
+			Expect(err).ToNot(HaveOccurred())
+
+			natsPublisher.Publish(server.NewEvent(server.EventTypeCreated, "fake-instance-id"))
+
+			Eventually(messages).Should(Receive())
+		})
+
+		It("does not connect if no client certificate is provided", func() {
+			natsPublisher, err = NewNATSPublisher(NATSConfig{
+				URL: natsURL,
+				TLS: NATSTLSConfig{CACertFile: authority.CertFile},
+			}, logger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(natsPublisher.Connected()).To(BeFalse())
+		})
+
+		It("returns error if the CA certificate cannot be loaded", func() {
+			_, err = NewNATSPublisher(NATSConfig{
+				URL: natsURL,
+				TLS: NATSTLSConfig{CACertFile: "fake-ca-cert-file"},
+			}, logger)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Loading NATS CA certificate"))
+		})
+
+		It("returns error if the client certificate cannot be loaded", func() {
+			_, err = NewNATSPublisher(NATSConfig{
+				URL: natsURL,
+				TLS: NATSTLSConfig{
+					CertFile:   "fake-cert-file",
+					KeyFile:    "fake-key-file",
+					CACertFile: authority.CertFile,
+				},
+			}, logger)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Loading NATS X509 Key Pair"))
+		})
+	})
+})
@@ -0,0 +1,13 @@
+package notifications_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestRegistryNotifications(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Registry Notifications Suite")
+}
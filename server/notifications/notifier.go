@@ -0,0 +1,140 @@
+package notifications
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+
+	"github.com/frodenas/bosh-registry/server"
+)
+
+const notifierLogTag = "RegistryNotifier"
+
+// Notifier publishes the registry changes to the webhooks and the NATS
+// subject of its configuration, which can be reloaded while running.
+type Notifier struct {
+	logger boshlog.Logger
+
+	mutex           sync.RWMutex
+	config          Config
+	webhookNotifier *WebhookNotifier
+	natsPublisher   *NATSPublisher
+	draining        []*WebhookNotifier
+}
+
+func NewNotifier(
+	config Config,
+	logger boshlog.Logger,
+) (*Notifier, error) {
+	n := &Notifier{logger: logger}
+	if err := n.Reload(config); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+func (n *Notifier) Publish(event server.Event) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	n.webhookNotifier.Publish(event)
+	if n.natsPublisher != nil {
+		n.natsPublisher.Publish(event)
+	}
+}
+
+// Reload switches to the webhooks and the NATS subject of the configuration,
+// keeping the ones whose configuration has not changed. The events queued for
+// the previous webhooks are still delivered.
+func (n *Notifier) Reload(config Config) error {
+	n.mutex.RLock()
+	webhookNotifier, natsPublisher := n.webhookNotifier, n.natsPublisher
+	keepWebhooks := webhookNotifier != nil && reflect.DeepEqual(webhooksConfig(config), webhooksConfig(n.config))
+	keepNATS := reflect.DeepEqual(config.NATS, n.config.NATS) && (natsPublisher != nil || !config.NATS.Enabled())
+	n.mutex.RUnlock()
+
+	if !keepNATS {
+		natsPublisher = nil
+		if config.NATS.Enabled() {
+			var err error
+			natsPublisher, err = NewNATSPublisher(config.NATS, n.logger)
+			if err != nil {
+				return bosherr.WrapError(err, "Creating NATS Publisher")
+			}
+		}
+	}
+
+	if !keepWebhooks {
+		webhookNotifier = NewWebhookNotifier(config, n.logger)
+	}
+
+	n.mutex.Lock()
+	previousWebhookNotifier, previousNATSPublisher := n.webhookNotifier, n.natsPublisher
+	n.config = config
+	n.webhookNotifier = webhookNotifier
+	n.natsPublisher = natsPublisher
+	if !keepWebhooks && previousWebhookNotifier != nil {
+		n.draining = append(drainingWebhookNotifiers(n.draining), previousWebhookNotifier)
+	}
+	n.mutex.Unlock()
+
+	if !keepWebhooks && previousWebhookNotifier != nil {
+		n.logger.Info(notifierLogTag, "Switched to %d webhooks", len(config.Webhooks))
+		previousWebhookNotifier.Close()
+	}
+
+	if !keepNATS && previousNATSPublisher != nil {
+		n.logger.Info(notifierLogTag, "Stopping previous NATS publisher")
+		previousNATSPublisher.Stop()
+	}
+
+	return nil
+}
+
+// Stop stops accepting events and waits until the queued ones, including
+// those of the webhooks of previous configurations, have been delivered or
+// until the timeout expires.
+func (n *Notifier) Stop(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+
+	n.mutex.RLock()
+	webhookNotifiers := append([]*WebhookNotifier{n.webhookNotifier}, n.draining...)
+	natsPublisher := n.natsPublisher
+	n.mutex.RUnlock()
+
+	if natsPublisher != nil {
+		natsPublisher.Stop()
+	}
+
+	for _, webhookNotifier := range webhookNotifiers {
+		webhookNotifier.Close()
+	}
+
+	for _, webhookNotifier := range webhookNotifiers {
+		webhookNotifier.Wait(time.Until(deadline))
+	}
+}
+
+// drainingWebhookNotifiers returns the webhook notifiers still delivering
+// their queued events.
+func drainingWebhookNotifiers(webhookNotifiers []*WebhookNotifier) []*WebhookNotifier {
+	var draining []*WebhookNotifier
+	for _, webhookNotifier := range webhookNotifiers {
+		select {
+		case <-webhookNotifier.Done():
+		default:
+			draining = append(draining, webhookNotifier)
+		}
+	}
+
+	return draining
+}
+
+func webhooksConfig(config Config) Config {
+	config.NATS = NATSConfig{}
+	return config
+}
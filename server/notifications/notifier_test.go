@@ -0,0 +1,119 @@
+package notifications_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server/notifications"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+
+	"github.com/frodenas/bosh-registry/server"
+)
+
+var _ = Describe("Notifier", func() {
+	var (
+		mutex          sync.Mutex
+		receivedBodies map[string][]string
+		webhookServer  *httptest.Server
+		notifier       *Notifier
+
+		logger = boshlog.NewLogger(boshlog.LevelNone)
+	)
+
+	bodies := func(path string) func() []string {
+		return func() []string {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return receivedBodies[path]
+		}
+	}
+
+	BeforeEach(func() {
+		receivedBodies = map[string][]string{}
+		webhookServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			receivedBodies[req.URL.Path] = append(receivedBodies[req.URL.Path], string(body))
+		}))
+
+		var err error
+		notifier, err = NewNotifier(Config{Webhooks: []WebhookConfig{{URL: webhookServer.URL + "/fake-webhook"}}}, logger)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		notifier.Stop(time.Second)
+		webhookServer.Close()
+	})
+
+	It("posts the events to the webhooks", func() {
+		notifier.Publish(server.NewEvent(server.EventTypeCreated, "fake-instance-id"))
+
+		Eventually(bodies("/fake-webhook")).Should(HaveLen(1))
+		Expect(bodies("/fake-webhook")()[0]).To(ContainSubstring("fake-instance-id"))
+	})
+
+	It("posts the events to the webhooks of a reloaded configuration", func() {
+		notifier.Publish(server.NewEvent(server.EventTypeCreated, "fake-instance-id-1"))
+
+		err := notifier.Reload(Config{Webhooks: []WebhookConfig{{URL: webhookServer.URL + "/fake-new-webhook"}}})
+		Expect(err).ToNot(HaveOccurred())
+
+		notifier.Publish(server.NewEvent(server.EventTypeCreated, "fake-instance-id-2"))
+
+		Eventually(bodies("/fake-webhook")).Should(HaveLen(1))
+		Expect(bodies("/fake-webhook")()[0]).To(ContainSubstring("fake-instance-id-1"))
+		Eventually(bodies("/fake-new-webhook")).Should(HaveLen(1))
+		Expect(bodies("/fake-new-webhook")()[0]).To(ContainSubstring("fake-instance-id-2"))
+	})
+
+	It("keeps the previous configuration if the reloaded one cannot be applied", func() {
+		err := notifier.Reload(Config{NATS: NATSConfig{
+			URL: "tls://127.0.0.1:1",
+			TLS: NATSTLSConfig{CACertFile: "fake-ca-cert-file"},
+		}})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Creating NATS Publisher"))
+
+		notifier.Publish(server.NewEvent(server.EventTypeCreated, "fake-instance-id"))
+
+		Eventually(bodies("/fake-webhook")).Should(HaveLen(1))
+	})
+	It("stops within the timeout, without blocking the publishers", func() {
+		blockWebhook := make(chan struct{})
+		blockingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ioutil.ReadAll(req.Body)
+			<-blockWebhook
+		}))
+		defer blockingServer.Close()
+		defer close(blockWebhook)
+
+		err := notifier.Reload(Config{Webhooks: []WebhookConfig{{URL: blockingServer.URL}}})
+		Expect(err).ToNot(HaveOccurred())
+		notifier.Publish(server.NewEvent(server.EventTypeCreated, "fake-instance-id"))
+
+		stopped := make(chan struct{})
+		go func() {
+			notifier.Stop(200 * time.Millisecond)
+			close(stopped)
+		}()
+
+		published := make(chan struct{})
+		go func() {
+			notifier.Publish(server.NewEvent(server.EventTypeDeleted, "fake-instance-id"))
+			close(published)
+		}()
+		Eventually(published).Should(BeClosed())
+		Consistently(stopped, "100ms").ShouldNot(BeClosed())
+		Eventually(stopped, "1s").Should(BeClosed())
+	})
+})
@@ -0,0 +1,24 @@
+package notifications
+
+import (
+	"time"
+
+	"github.com/frodenas/bosh-registry/server"
+)
+
+type Payload struct {
+	Type       string    `json:"type"`
+	InstanceID string    `json:"instance_id"`
+	Timestamp  time.Time `json:"timestamp"`
+	Settings   string    `json:"settings,omitempty"`
+}
+
+// NewPayload returns the notification payload for an event. Settings are left
+// out, it is up to each notifier to decide whether they can be sent.
+func NewPayload(event server.Event) Payload {
+	return Payload{
+		Type:       event.Type,
+		InstanceID: event.InstanceID,
+		Timestamp:  event.Timestamp,
+	}
+}
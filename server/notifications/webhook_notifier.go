@@ -0,0 +1,232 @@
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+
+	"github.com/frodenas/bosh-registry/redact"
+	"github.com/frodenas/bosh-registry/server"
+)
+
+const webhookNotifierLogTag = "RegistryWebhookNotifier"
+const webhookNotifierTimeout = 10 * time.Second
+const webhookSignatureHeader = "X-Registry-Signature"
+const webhookTimestampHeader = "X-Registry-Timestamp"
+
+type WebhookNotifier struct {
+	config     Config
+	logger     boshlog.Logger
+	httpClient *http.Client
+	webhooks   []*webhook
+	wg         sync.WaitGroup
+	ctx        context.Context
+	cancel     context.CancelFunc
+	done       chan struct{}
+
+	mutex   sync.RWMutex
+	stopped bool
+}
+
+type webhook struct {
+	config WebhookConfig
+	queue  chan Payload
+}
+
+func NewWebhookNotifier(
+	config Config,
+	logger boshlog.Logger,
+) *WebhookNotifier {
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &WebhookNotifier{
+		config:     config,
+		logger:     logger,
+		httpClient: &http.Client{Timeout: webhookNotifierTimeout},
+		ctx:        ctx,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+
+	for _, webhookConfig := range config.Webhooks {
+		w := &webhook{
+			config: webhookConfig,
+			queue:  make(chan Payload, config.queueSize()),
+		}
+		n.webhooks = append(n.webhooks, w)
+
+		n.wg.Add(1)
+		go n.deliver(w)
+	}
+
+	go func() {
+		n.wg.Wait()
+		close(n.done)
+	}()
+
+	return n
+}
+
+// Publish enqueues the event for every webhook. It never blocks: when a
+// webhook queue is full the event is dropped for that webhook.
+func (n *WebhookNotifier) Publish(event server.Event) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	if n.stopped {
+		return
+	}
+
+	for _, w := range n.webhooks {
+		payload := NewPayload(event)
+		if w.config.IncludeSettings {
+			payload.Settings = event.Settings
+		}
+
+		select {
+		case w.queue <- payload:
+		default:
+			n.logger.Warn(webhookNotifierLogTag, "Dropping '%s' event for instance '%s', queue for webhook '%s' is full", event.Type, event.InstanceID, redact.URL(w.config.URL))
+		}
+	}
+}
+
+// Stop stops accepting events and waits until the queued ones have been
+// delivered, or until the timeout expires, dropping the undelivered ones.
+func (n *WebhookNotifier) Stop(timeout time.Duration) {
+	n.Close()
+	n.Wait(timeout)
+}
+
+// Close stops accepting events, delivering the queued ones in the background.
+func (n *WebhookNotifier) Close() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if !n.stopped {
+		n.stopped = true
+		for _, w := range n.webhooks {
+			close(w.queue)
+		}
+	}
+}
+
+// Wait waits until the queued events have been delivered once closed. When
+// the timeout expires first, the deliveries in progress are cancelled and the
+// remaining events dropped.
+func (n *WebhookNotifier) Wait(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-n.done:
+		return
+	case <-timer.C:
+	}
+
+	n.logger.Warn(webhookNotifierLogTag, "Cancelling the webhook deliveries in progress, timed out after %s", timeout)
+	n.cancel()
+	<-n.done
+}
+
+// Done returns a channel closed once the queued events have been delivered.
+func (n *WebhookNotifier) Done() <-chan struct{} {
+	return n.done
+}
+
+func (n *WebhookNotifier) deliver(w *webhook) {
+	defer n.wg.Done()
+
+	for payload := range w.queue {
+		if n.ctx.Err() != nil {
+			n.logger.Error(webhookNotifierLogTag, "Dropping '%s' event for instance '%s' to webhook '%s', deliveries have been cancelled", payload.Type, payload.InstanceID, redact.URL(w.config.URL))
+			continue
+		}
+
+		payloadJSON, err := json.Marshal(payload)
+		if err != nil {
+			n.logger.Error(webhookNotifierLogTag, "Marshalling '%s' event for instance '%s': %s", payload.Type, payload.InstanceID, err.Error())
+			continue
+		}
+
+		retryDelay := time.Duration(n.config.retryDelayMs()) * time.Millisecond
+		maxRetryDelay := time.Duration(n.config.maxRetryDelayMs()) * time.Millisecond
+		for attempt := 1; ; attempt++ {
+			err = n.post(w.config, payloadJSON)
+			if err == nil {
+				n.logger.Debug(webhookNotifierLogTag, "Delivered '%s' event for instance '%s' to webhook '%s'", payload.Type, payload.InstanceID, redact.URL(w.config.URL))
+				break
+			}
+
+			if attempt >= n.config.maxAttempts() || n.ctx.Err() != nil {
+				n.logger.Error(webhookNotifierLogTag, "Giving up delivering '%s' event for instance '%s' to webhook '%s' after %d attempts: %s", payload.Type, payload.InstanceID, redact.URL(w.config.URL), attempt, err.Error())
+				break
+			}
+
+			n.logger.Debug(webhookNotifierLogTag, "Delivering event to webhook '%s' attempt #%d got error '%v'", redact.URL(w.config.URL), attempt, err)
+			retryTimer := time.NewTimer(retryDelay)
+			select {
+			case <-retryTimer.C:
+			case <-n.ctx.Done():
+				retryTimer.Stop()
+			}
+			if retryDelay *= 2; retryDelay > maxRetryDelay {
+				retryDelay = maxRetryDelay
+			}
+		}
+	}
+}
+
+func (n *WebhookNotifier) post(config WebhookConfig, payloadJSON []byte) error {
+	request, err := http.NewRequest("POST", config.URL, bytes.NewReader(payloadJSON))
+	if err != nil {
+		return bosherr.WrapError(err, "Creating POST request")
+	}
+	request = request.WithContext(n.ctx)
+
+	request.Header.Set("Content-Type", "application/json")
+	if config.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		request.Header.Set(webhookTimestampHeader, timestamp)
+		request.Header.Set(webhookSignatureHeader, "sha256="+Sign(config.Secret, timestamp, payloadJSON))
+	}
+
+	response, err := n.httpClient.Do(request)
+	if err != nil {
+		return bosherr.WrapError(err, "Performing POST request")
+	}
+	// Reading the body to the end lets the connection be reused.
+	defer func() {
+		io.Copy(ioutil.Discard, response.Body)
+		response.Body.Close()
+	}()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return bosherr.Errorf("Received status code '%d'", response.StatusCode)
+	}
+
+	return nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the timestamp, a dot and the
+// payload using the webhook secret, as sent in the X-Registry-Signature
+// header. Signing the X-Registry-Timestamp header lets webhooks refuse
+// replayed deliveries.
+func Sign(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,192 @@
+package notifications_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server/notifications"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+
+	"github.com/frodenas/bosh-registry/server"
+)
+
+type receivedRequest struct {
+	Body      []byte
+	Signature string
+	Timestamp string
+}
+
+var _ = Describe("WebhookNotifier", func() {
+	var (
+		mutex            sync.Mutex
+		receivedRequests []receivedRequest
+		failures         int
+		webhookServer    *httptest.Server
+		notifier         *WebhookNotifier
+
+		logger = boshlog.NewLogger(boshlog.LevelNone)
+	)
+
+	requests := func() []receivedRequest {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return receivedRequests
+	}
+
+	BeforeEach(func() {
+		receivedRequests = nil
+		failures = 0
+		webhookServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if failures > 0 {
+				failures--
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			receivedRequests = append(receivedRequests, receivedRequest{
+				Body:      body,
+				Signature: req.Header.Get("X-Registry-Signature"),
+				Timestamp: req.Header.Get("X-Registry-Timestamp"),
+			})
+		}))
+	})
+
+	AfterEach(func() {
+		notifier.Stop(time.Second)
+		webhookServer.Close()
+	})
+
+	It("posts the event to the webhook, without the settings", func() {
+		notifier = NewWebhookNotifier(Config{Webhooks: []WebhookConfig{{URL: webhookServer.URL}}}, logger)
+
+		event := server.NewEvent(server.EventTypeCreated, "fake-instance-id")
+		event.Settings = "fake-settings"
+		notifier.Publish(event)
+
+		Eventually(requests).Should(HaveLen(1))
+
+		var payload Payload
+		err := json.Unmarshal(requests()[0].Body, &payload)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(payload.Type).To(Equal(server.EventTypeCreated))
+		Expect(payload.InstanceID).To(Equal("fake-instance-id"))
+		Expect(payload.Settings).To(BeEmpty())
+		Expect(requests()[0].Signature).To(BeEmpty())
+	})
+
+	It("posts the settings to the webhooks including them", func() {
+		notifier = NewWebhookNotifier(Config{Webhooks: []WebhookConfig{{URL: webhookServer.URL, IncludeSettings: true}}}, logger)
+
+		event := server.NewEvent(server.EventTypeCreated, "fake-instance-id")
+		event.Settings = "fake-settings"
+		notifier.Publish(event)
+
+		Eventually(requests).Should(HaveLen(1))
+
+		var payload Payload
+		err := json.Unmarshal(requests()[0].Body, &payload)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(payload.Settings).To(Equal("fake-settings"))
+	})
+
+	It("signs the payload if the webhook has a secret", func() {
+		notifier = NewWebhookNotifier(Config{Webhooks: []WebhookConfig{{URL: webhookServer.URL, Secret: "fake-secret"}}}, logger)
+
+		notifier.Publish(server.NewEvent(server.EventTypeDeleted, "fake-instance-id"))
+
+		Eventually(requests).Should(HaveLen(1))
+		Expect(requests()[0].Signature).To(Equal("sha256=" + Sign("fake-secret", requests()[0].Timestamp, requests()[0].Body)))
+		Expect(requests()[0].Signature).ToNot(Equal("sha256=" + Sign("fake-secret", "0", requests()[0].Body)))
+
+		timestamp, err := strconv.ParseInt(requests()[0].Timestamp, 10, 64)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(time.Unix(timestamp, 0)).To(BeTemporally("~", time.Now(), 5*time.Second))
+	})
+
+	It("retries failed deliveries", func() {
+		failures = 2
+		notifier = NewWebhookNotifier(Config{
+			Webhooks:     []WebhookConfig{{URL: webhookServer.URL}},
+			RetryDelayMs: 1,
+		}, logger)
+
+		notifier.Publish(server.NewEvent(server.EventTypeUpdated, "fake-instance-id"))
+
+		Eventually(requests).Should(HaveLen(1))
+	})
+
+	It("caps the exponential backoff to the maximum retry delay", func() {
+		failures = 5
+		notifier = NewWebhookNotifier(Config{
+			Webhooks:        []WebhookConfig{{URL: webhookServer.URL}},
+			MaxAttempts:     6,
+			RetryDelayMs:    50,
+			MaxRetryDelayMs: 50,
+		}, logger)
+
+		notifier.Publish(server.NewEvent(server.EventTypeUpdated, "fake-instance-id"))
+
+		// Without the cap, the retries would wait 50+100+200+400+800ms.
+		Eventually(requests, time.Second).Should(HaveLen(1))
+	})
+
+	It("gives up after the maximum number of attempts", func() {
+		failures = 3
+		notifier = NewWebhookNotifier(Config{
+			Webhooks:     []WebhookConfig{{URL: webhookServer.URL}},
+			MaxAttempts:  3,
+			RetryDelayMs: 1,
+		}, logger)
+
+		notifier.Publish(server.NewEvent(server.EventTypeUpdated, "fake-instance-id-1"))
+		notifier.Publish(server.NewEvent(server.EventTypeUpdated, "fake-instance-id-2"))
+
+		Eventually(requests).Should(HaveLen(1))
+		Expect(string(requests()[0].Body)).To(ContainSubstring("fake-instance-id-2"))
+	})
+
+	It("cancels the retries once the stop timeout expires", func() {
+		failures = 100
+		notifier = NewWebhookNotifier(Config{
+			Webhooks:     []WebhookConfig{{URL: webhookServer.URL}},
+			RetryDelayMs: 10000,
+		}, logger)
+
+		notifier.Publish(server.NewEvent(server.EventTypeUpdated, "fake-instance-id-1"))
+		notifier.Publish(server.NewEvent(server.EventTypeUpdated, "fake-instance-id-2"))
+		Eventually(func() int {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return failures
+		}).Should(Equal(99))
+
+		start := time.Now()
+		notifier.Stop(50 * time.Millisecond)
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		Expect(requests()).To(BeEmpty())
+	})
+
+	It("does not block when the queue is full", func() {
+		notifier = NewWebhookNotifier(Config{
+			Webhooks:    []WebhookConfig{{URL: "http://127.0.0.1:1"}},
+			QueueSize:   1,
+			MaxAttempts: 1,
+		}, logger)
+
+		for i := 0; i < 10; i++ {
+			notifier.Publish(server.NewEvent(server.EventTypeUpdated, "fake-instance-id"))
+		}
+	})
+})
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+const proxyProtocolLogTag = "RegistryServerProxyProtocol"
+const proxyProtocolHeaderTimeout = 5 * time.Second
+const proxyProtocolV1MaxLength = 107
+
+var proxyProtocolV1Prefix = []byte("PROXY ")
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolListener reads the PROXY protocol (v1 or v2) header sent by
+// trusted proxies before handing their connections over, so the connections
+// report the address of the original client. Connections from other sources
+// are handed over untouched.
+type proxyProtocolListener struct {
+	net.Listener
+	trustedProxies TrustedProxies
+	logger         boshlog.Logger
+
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newProxyProtocolListener(listener net.Listener, trustedProxies TrustedProxies, logger boshlog.Logger) *proxyProtocolListener {
+	l := &proxyProtocolListener{
+		Listener:       listener,
+		trustedProxies: trustedProxies,
+		logger:         logger,
+		conns:          make(chan net.Conn),
+		errs:           make(chan error, 1),
+		done:           make(chan struct{}),
+	}
+	go l.acceptLoop()
+
+	return l
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, bosherr.Error("Listener closed")
+	}
+}
+
+func (l *proxyProtocolListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+func (l *proxyProtocolListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			l.errs <- err
+			return
+		}
+
+		go l.handshake(conn)
+	}
+}
+
+func (l *proxyProtocolListener) handshake(conn net.Conn) {
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); !ok || !l.trustedProxies.Contains(tcpAddr.IP) {
+		l.handOver(conn)
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout))
+	reader := bufio.NewReader(conn)
+	remoteAddr, err := readProxyProtocolHeader(reader)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		l.logger.Warn(proxyProtocolLogTag, "Closing connection from proxy '%s': %s", conn.RemoteAddr(), err.Error())
+		conn.Close()
+		return
+	}
+
+	if remoteAddr == nil {
+		remoteAddr = conn.RemoteAddr()
+	}
+
+	l.handOver(&proxyProtocolConn{Conn: conn, reader: reader, remoteAddr: remoteAddr})
+}
+
+func (l *proxyProtocolListener) handOver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// readProxyProtocolHeader returns the source address of a PROXY protocol
+// header, or nil when the header does not carry one (LOCAL or UNKNOWN).
+func readProxyProtocolHeader(reader *bufio.Reader) (net.Addr, error) {
+	prefix, err := reader.Peek(len(proxyProtocolV1Prefix))
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Reading PROXY protocol header")
+	}
+
+	if bytes.Equal(prefix, proxyProtocolV1Prefix) {
+		return readProxyProtocolV1Header(reader)
+	}
+
+	signature, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Reading PROXY protocol header")
+	}
+
+	if bytes.Equal(signature, proxyProtocolV2Signature) {
+		return readProxyProtocolV2Header(reader)
+	}
+
+	return nil, bosherr.Error("Missing PROXY protocol header")
+}
+
+func readProxyProtocolV1Header(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtocolV1MaxLength {
+			return nil, bosherr.Error("PROXY protocol v1 header too long")
+		}
+
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, bosherr.WrapError(err, "Reading PROXY protocol v1 header")
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, bosherr.Errorf("Invalid PROXY protocol v1 header '%s'", strings.TrimSpace(string(line)))
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, bosherr.Errorf("Invalid PROXY protocol v1 source address '%s:%s'", fields[2], fields[4])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyProtocolV2Header(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, bosherr.WrapError(err, "Reading PROXY protocol v2 header")
+	}
+
+	versionCommand := header[12]
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	if versionCommand>>4 != 2 {
+		return nil, bosherr.Errorf("Unsupported PROXY protocol version '%d'", versionCommand>>4)
+	}
+
+	addresses := make([]byte, length)
+	if _, err := io.ReadFull(reader, addresses); err != nil {
+		return nil, bosherr.WrapError(err, "Reading PROXY protocol v2 addresses")
+	}
+
+	switch versionCommand & 0x0F {
+	case 0x0:
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, bosherr.Errorf("Unsupported PROXY protocol v2 command '%d'", versionCommand&0x0F)
+	}
+
+	switch family {
+	case 0x11:
+		if len(addresses) < 12 {
+			return nil, bosherr.Error("Invalid PROXY protocol v2 IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:4]), Port: int(binary.BigEndian.Uint16(addresses[8:10]))}, nil
+	case 0x21:
+		if len(addresses) < 36 {
+			return nil, bosherr.Error("Invalid PROXY protocol v2 IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:16]), Port: int(binary.BigEndian.Uint16(addresses[32:34]))}, nil
+	}
+
+	return nil, nil
+}
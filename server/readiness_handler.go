@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+
+	"github.com/frodenas/bosh-registry/server/store"
+)
+
+const readinessHandlerLogTag = "RegistryServerReadinessHandler"
+const readinessPath = "/readyz"
+
+// readinessCheckKey is read from the store to check it answers. It is never
+// saved, so the read does not return any settings.
+const readinessCheckKey = "readiness-check"
+
+const (
+	ReadinessStatusReady            = "ready"
+	ReadinessStatusDraining         = "draining"
+	ReadinessStatusStoreUnavailable = "store_unavailable"
+)
+
+type ReadinessResponse struct {
+	Status string `json:"status"`
+}
+
+// ReadinessHandler reports whether the server accepts new requests, so load
+// balancers stop sending them as soon as it starts draining or when the store
+// does not answer. In a cluster, the store is the local store of the node, as
+// linearizable reads fail on the followers. It does not require
+// authentication.
+type ReadinessHandler struct {
+	registryStore store.Store
+	logger        boshlog.Logger
+	draining      int32
+}
+
+func NewReadinessHandler(
+	registryStore store.Store,
+	logger boshlog.Logger,
+) *ReadinessHandler {
+	return &ReadinessHandler{
+		registryStore: registryStore,
+		logger:        logger,
+	}
+}
+
+func (rh *ReadinessHandler) SetDraining() {
+	atomic.StoreInt32(&rh.draining, 1)
+}
+
+func (rh *ReadinessHandler) IsDraining() bool {
+	return atomic.LoadInt32(&rh.draining) == 1
+}
+
+func (rh *ReadinessHandler) HandleFunc(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := ReadinessResponse{Status: ReadinessStatusReady}
+	status := http.StatusOK
+	if rh.IsDraining() {
+		rh.logger.Debug(requestLogTag(readinessHandlerLogTag, req), "Reporting not ready to %s, draining", req.RemoteAddr)
+		response.Status = ReadinessStatusDraining
+		status = http.StatusServiceUnavailable
+	} else if _, _, err := rh.registryStore.Get(readinessCheckKey); err != nil {
+		rh.logger.Warn(requestLogTag(readinessHandlerLogTag, req), "Reporting not ready to %s, checking the Registry Store: %s", req.RemoteAddr, err.Error())
+		response.Status = ReadinessStatusStoreUnavailable
+		status = http.StatusServiceUnavailable
+	}
+
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	w.Write(responseJSON)
+}
@@ -0,0 +1,66 @@
+package server_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+
+	storefakes "github.com/frodenas/bosh-registry/server/store/fakes"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+var _ = Describe("ReadinessHandler", func() {
+	var (
+		err              error
+		request          *http.Request
+		responseRecorder *httptest.ResponseRecorder
+		registryStore    *storefakes.FakeStore
+		readinessHandler *ReadinessHandler
+
+		logger = boshlog.NewLogger(boshlog.LevelNone)
+	)
+
+	BeforeEach(func() {
+		request, err = http.NewRequest("GET", "/readyz", nil)
+		Expect(err).ToNot(HaveOccurred())
+		responseRecorder = httptest.NewRecorder()
+		registryStore = &storefakes.FakeStore{}
+		readinessHandler = NewReadinessHandler(registryStore, logger)
+	})
+
+	It("reports ready", func() {
+		readinessHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+		Expect(responseRecorder.Body.String()).To(MatchJSON(`{"status":"ready"}`))
+		Expect(registryStore.GetCalled).To(BeTrue())
+	})
+
+	It("reports not ready when the store does not answer", func() {
+		registryStore.GetErr = errors.New("fake-get-error")
+
+		readinessHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(responseRecorder.Body.String()).To(MatchJSON(`{"status":"store_unavailable"}`))
+	})
+
+	It("reports not ready when draining", func() {
+		readinessHandler.SetDraining()
+
+		readinessHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(responseRecorder.Body.String()).To(MatchJSON(`{"status":"draining"}`))
+	})
+
+	It("returns 405 Method Not Allowed if request method is not GET or HEAD", func() {
+		request.Method = "POST"
+
+		readinessHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusMethodNotAllowed))
+	})
+})
@@ -0,0 +1,43 @@
+package server
+
+import (
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+
+	registry "github.com/frodenas/bosh-registry/client"
+)
+
+const (
+	ReplicaWritesRefuse = "refuse"
+	ReplicaWritesProxy  = "proxy"
+)
+
+type ReplicaConfig struct {
+	Primary registry.ClientOptions `json:"primary,omitempty"`
+	Writes  string                 `json:"writes,omitempty"`
+}
+
+func (c ReplicaConfig) Enabled() bool {
+	return c.Primary.Host != ""
+}
+
+func (c ReplicaConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+
+	if err := c.Primary.Validate(); err != nil {
+		return bosherr.WrapError(err, "Validating Primary configuration")
+	}
+
+	switch c.Writes {
+	case "", ReplicaWritesRefuse, ReplicaWritesProxy:
+	default:
+		return bosherr.Errorf("Must provide a valid Writes ('%s' or '%s'), got '%s'", ReplicaWritesRefuse, ReplicaWritesProxy, c.Writes)
+	}
+
+	return nil
+}
+
+func (c ReplicaConfig) ProxyWrites() bool {
+	return c.Writes == ReplicaWritesProxy
+}
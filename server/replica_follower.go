@@ -0,0 +1,440 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+
+	"github.com/frodenas/bosh-registry/server/store"
+)
+
+const replicaFollowerLogTag = "RegistryServerReplicaFollower"
+const replicaFollowerRetryDelay = 1 * time.Second
+const replicaFollowerBackupTimeout = 30 * time.Second
+
+const (
+	ReplicaStatusBootstrapping = "bootstrapping"
+	ReplicaStatusFollowing     = "following"
+	ReplicaStatusDisconnected  = "disconnected"
+)
+
+var errReplicaReset = bosherr.Error("Primary events stream has been reset")
+
+// ReplicaStatus describes how far behind the primary a replica is. LagSeconds
+// is the replication delay of the last applied event while following the
+// primary, and the time since the last contact with the primary otherwise.
+type ReplicaStatus struct {
+	Primary       string     `json:"primary"`
+	Status        string     `json:"status"`
+	Bootstrapped  bool       `json:"bootstrapped"`
+	LastEventID   uint64     `json:"last_event_id"`
+	LastEventAt   *time.Time `json:"last_event_at,omitempty"`
+	LastContactAt *time.Time `json:"last_contact_at,omitempty"`
+	LagSeconds    float64    `json:"lag_seconds"`
+}
+
+// ReplicaFollower keeps a local store in sync with a primary registry: it
+// bootstraps from the primary backup and then applies the primary events
+// stream, publishing the resulting changes to the local events stream.
+type ReplicaFollower struct {
+	config         ReplicaConfig
+	registryStore  store.Store
+	eventPublisher EventPublisher
+	logger         boshlog.Logger
+	httpClient     *http.Client
+	retryDelay     time.Duration
+
+	mutex         sync.Mutex
+	status        string
+	bootstrapped  bool
+	epoch         string
+	lastEventID   uint64
+	lastEventAt   time.Time
+	lastContactAt time.Time
+	eventLag      time.Duration
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewReplicaFollower(
+	config ReplicaConfig,
+	registryStore store.Store,
+	eventPublisher EventPublisher,
+	logger boshlog.Logger,
+) (*ReplicaFollower, error) {
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if config.Primary.Protocol == "https" {
+		tlsConfig, err := config.Primary.TLS.TLSConfig()
+		if err != nil {
+			return nil, bosherr.WrapError(err, "Creating Primary TLS configuration")
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &ReplicaFollower{
+		config:         config,
+		registryStore:  registryStore,
+		eventPublisher: eventPublisher,
+		logger:         logger,
+		httpClient:     &http.Client{Transport: transport},
+		retryDelay:     replicaFollowerRetryDelay,
+		status:         ReplicaStatusBootstrapping,
+	}, nil
+}
+
+func (f *ReplicaFollower) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel = cancel
+	f.done = make(chan struct{})
+
+	f.logger.Info(replicaFollowerLogTag, "Following primary registry at '%s'", f.config.Primary.Endpoint())
+	go f.run(ctx)
+}
+
+func (f *ReplicaFollower) Stop() {
+	if f.cancel == nil {
+		return
+	}
+
+	f.cancel()
+	<-f.done
+	f.logger.Debug(replicaFollowerLogTag, "Stopped following primary registry")
+}
+
+func (f *ReplicaFollower) Status() ReplicaStatus {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	status := ReplicaStatus{
+		Primary:      f.config.Primary.Endpoint(),
+		Status:       f.status,
+		Bootstrapped: f.bootstrapped,
+		LastEventID:  f.lastEventID,
+	}
+
+	if !f.lastEventAt.IsZero() {
+		lastEventAt := f.lastEventAt
+		status.LastEventAt = &lastEventAt
+	}
+
+	if !f.lastContactAt.IsZero() {
+		lastContactAt := f.lastContactAt
+		status.LastContactAt = &lastContactAt
+	}
+
+	if f.status == ReplicaStatusFollowing {
+		status.LagSeconds = f.eventLag.Seconds()
+	} else if !f.lastContactAt.IsZero() {
+		status.LagSeconds = time.Since(f.lastContactAt).Seconds()
+	}
+
+	return status
+}
+
+func (f *ReplicaFollower) run(ctx context.Context) {
+	defer close(f.done)
+
+	for {
+		err := f.sync(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err == errReplicaReset {
+			f.logger.Info(replicaFollowerLogTag, "Primary events are no longer available, bootstrapping again")
+			f.setBootstrapped(false)
+		} else if err != nil {
+			f.logger.Warn(replicaFollowerLogTag, "Following primary registry: %s", err.Error())
+		}
+		f.setStatus(ReplicaStatusDisconnected)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(f.retryDelay):
+		}
+	}
+}
+
+func (f *ReplicaFollower) sync(ctx context.Context) error {
+	if !f.isBootstrapped() {
+		f.setStatus(ReplicaStatusBootstrapping)
+		if err := f.bootstrap(ctx); err != nil {
+			return bosherr.WrapError(err, "Bootstrapping from primary backup")
+		}
+	}
+
+	return f.follow(ctx)
+}
+
+func (f *ReplicaFollower) bootstrap(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, replicaFollowerBackupTimeout)
+	defer cancel()
+
+	httpResponse, err := f.get(ctx, backupPath, nil)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+
+	var backup BackupResponse
+	if err = json.NewDecoder(httpResponse.Body).Decode(&backup); err != nil {
+		return bosherr.WrapError(err, "Unmarshalling primary backup")
+	}
+
+	localValues, err := f.registryStore.GetAll()
+	if err != nil {
+		return bosherr.WrapError(err, "Reading local settings")
+	}
+	localInstances, localInstanceTokens := splitInstanceTokens(localValues)
+
+	for instanceID := range localInstances {
+		if _, found := backup.Instances[instanceID]; !found {
+			if err = f.apply(NewEvent(EventTypeDeleted, instanceID)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for instanceID, settings := range backup.Instances {
+		localSettings, found := localInstances[instanceID]
+		if found && localSettings == settings {
+			continue
+		}
+
+		event := NewEvent(EventTypeCreated, instanceID)
+		if found {
+			event.Type = EventTypeUpdated
+		}
+		event.Settings = settings
+		if err = f.apply(event); err != nil {
+			return err
+		}
+	}
+
+	for instanceID := range localInstanceTokens {
+		if _, found := backup.InstanceTokens[instanceID]; !found {
+			if err = f.apply(NewEvent(EventTypeTokenRevoked, instanceID)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for instanceID, tokenJSON := range backup.InstanceTokens {
+		if localInstanceTokens[instanceID] == tokenJSON {
+			continue
+		}
+
+		event := NewEvent(EventTypeTokenIssued, instanceID)
+		event.Settings = tokenJSON
+		if err = f.apply(event); err != nil {
+			return err
+		}
+	}
+
+	f.logger.Info(replicaFollowerLogTag, "Bootstrapped %d instances from primary backup at event '%d'", len(backup.Instances), backup.LastEventID)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.bootstrapped = true
+	f.epoch = backup.Epoch
+	f.lastEventID = backup.LastEventID
+	f.lastContactAt = time.Now().UTC()
+
+	return nil
+}
+
+func (f *ReplicaFollower) follow(ctx context.Context) error {
+	headers := map[string]string{
+		"Accept":        "text/event-stream",
+		"Last-Event-ID": f.lastEventStreamID(),
+	}
+	httpResponse, err := f.get(ctx, "/events?include_settings=true", headers)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+
+	f.setStatus(ReplicaStatusFollowing)
+	f.touch()
+	f.logger.Debug(replicaFollowerLogTag, "Following primary events after event '%d'", f.LastEventID())
+
+	reader := bufio.NewReader(httpResponse.Body)
+	var eventType, eventData string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return bosherr.Error("Primary closed the events stream")
+			}
+			return bosherr.WrapError(err, "Reading primary events stream")
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "":
+			if eventType == EventTypeReset {
+				return errReplicaReset
+			}
+			if eventData != "" {
+				if err = f.applyEventData(eventData); err != nil {
+					return err
+				}
+			}
+			eventType, eventData = "", ""
+		case strings.HasPrefix(line, ":"):
+			f.touch()
+		case strings.HasPrefix(line, "event:"):
+			eventType = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			eventData += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+}
+
+func (f *ReplicaFollower) applyEventData(eventData string) error {
+	var primaryEvent eventWithSettings
+	if err := json.Unmarshal([]byte(eventData), &primaryEvent); err != nil {
+		return bosherr.WrapError(err, "Unmarshalling primary event")
+	}
+
+	event := NewEvent(primaryEvent.Type, primaryEvent.InstanceID)
+	event.Settings = primaryEvent.Settings
+	if err := f.apply(event); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.lastEventID = primaryEvent.ID
+	f.lastEventAt = primaryEvent.Timestamp
+	f.lastContactAt = now
+	f.eventLag = now.Sub(primaryEvent.Timestamp)
+	if f.eventLag < 0 {
+		f.eventLag = 0
+	}
+
+	return nil
+}
+
+// apply writes an event of the primary to the local store. Token events are
+// not published, so the notifications only report settings changes.
+func (f *ReplicaFollower) apply(event Event) error {
+	switch event.Type {
+	case EventTypeTokenIssued:
+		if err := f.registryStore.Save(instanceTokenKeyPrefix+event.InstanceID, event.Settings); err != nil {
+			return bosherr.WrapErrorf(err, "Saving token for instance '%s'", event.InstanceID)
+		}
+		f.logger.Debug(replicaFollowerLogTag, "Applied '%s' event for instance '%s'", event.Type, event.InstanceID)
+		return nil
+	case EventTypeTokenRevoked:
+		if err := f.registryStore.Delete(instanceTokenKeyPrefix + event.InstanceID); err != nil {
+			return bosherr.WrapErrorf(err, "Deleting token for instance '%s'", event.InstanceID)
+		}
+		f.logger.Debug(replicaFollowerLogTag, "Applied '%s' event for instance '%s'", event.Type, event.InstanceID)
+		return nil
+	case EventTypeCreated, EventTypeUpdated:
+		if err := f.registryStore.Save(event.InstanceID, event.Settings); err != nil {
+			return bosherr.WrapErrorf(err, "Saving settings for instance '%s'", event.InstanceID)
+		}
+	case EventTypeDeleted:
+		if err := f.registryStore.Delete(event.InstanceID); err != nil {
+			return bosherr.WrapErrorf(err, "Deleting settings for instance '%s'", event.InstanceID)
+		}
+	default:
+		f.logger.Debug(replicaFollowerLogTag, "Ignoring primary event of type '%s'", event.Type)
+		return nil
+	}
+
+	f.logger.Debug(replicaFollowerLogTag, "Applied '%s' event for instance '%s'", event.Type, event.InstanceID)
+	f.eventPublisher.Publish(event)
+
+	return nil
+}
+
+func (f *ReplicaFollower) get(ctx context.Context, path string, headers map[string]string) (*http.Response, error) {
+	endpoint := f.config.Primary.Endpoint() + path
+
+	request, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Creating GET request for primary endpoint '%s'", endpoint)
+	}
+	request = request.WithContext(ctx)
+	request.SetBasicAuth(f.config.Primary.Username, f.config.Primary.Password)
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	httpResponse, err := f.httpClient.Do(request)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Requesting primary endpoint '%s'", endpoint)
+	}
+
+	if httpResponse.StatusCode == http.StatusUnauthorized {
+		httpResponse.Body.Close()
+		return nil, bosherr.Errorf("Received status code '%d' from primary endpoint '%s': Primary credentials must be of a '%s' or '%s' user", httpResponse.StatusCode, endpoint, RoleReplicator, RoleAdmin)
+	}
+
+	if httpResponse.StatusCode != http.StatusOK {
+		httpResponse.Body.Close()
+		return nil, bosherr.Errorf("Received status code '%d' from primary endpoint '%s'", httpResponse.StatusCode, endpoint)
+	}
+
+	return httpResponse, nil
+}
+
+// lastEventStreamID returns the ID of the last applied event in the primary
+// events stream. The primary resets the stream once it has restarted with a
+// new epoch, and the replica bootstraps again then.
+func (f *ReplicaFollower) lastEventStreamID() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return formatEventStreamID(f.epoch, f.lastEventID)
+}
+
+func (f *ReplicaFollower) LastEventID() uint64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.lastEventID
+}
+
+func (f *ReplicaFollower) isBootstrapped() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.bootstrapped
+}
+
+func (f *ReplicaFollower) setBootstrapped(bootstrapped bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.bootstrapped = bootstrapped
+}
+
+func (f *ReplicaFollower) setStatus(status string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.status = status
+}
+
+func (f *ReplicaFollower) touch() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.lastContactAt = time.Now().UTC()
+}
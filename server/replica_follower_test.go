@@ -0,0 +1,217 @@
+package server_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+
+	registry "github.com/frodenas/bosh-registry/client"
+	"github.com/frodenas/bosh-registry/server/fakes"
+	"github.com/frodenas/bosh-registry/server/store"
+)
+
+var _ = Describe("ReplicaFollower", func() {
+	var (
+		err             error
+		tempDir         string
+		primaryStore    store.Store
+		primaryMutex    sync.Mutex
+		primaryMux      *http.ServeMux
+		primaryEvents   *EventBroker
+		primaryTokens   *InstanceTokens
+		primary         *httptest.Server
+		replicaStore    store.Store
+		replicaEvents   *fakes.FakeEventPublisher
+		replicaConfig   ReplicaConfig
+		replicaFollower *ReplicaFollower
+
+		logger = boshlog.NewLogger(boshlog.LevelNone)
+		config = Config{
+			Protocol: "http",
+			Address:  "127.0.0.1",
+			Port:     5555,
+			Username: "fake-username",
+			Password: "fake-password",
+		}
+	)
+
+	startPrimary := func() {
+		eventBroker := NewEventBroker(10, logger)
+		primaryTokens = NewInstanceTokens(InstanceTokensConfig{}, primaryStore, eventBroker)
+		handlers := Handlers{
+			Instances: NewInstanceHandler(NoneAuthenticator{}, NewBasicAuthenticator(newUsers(config), RoleWriter), primaryStore, primaryTokens, eventBroker, logger),
+			Events:    NewEventsHandler(newUsers(config), eventBroker, logger),
+			Backup:    NewBackupHandler(newUsers(config), primaryStore, eventBroker, logger),
+		}
+
+		primaryMutex.Lock()
+		defer primaryMutex.Unlock()
+		primaryMux = handlers.ServeMux()
+		primaryEvents = eventBroker
+	}
+
+	putSettings := func(instanceID string, settings string) {
+		request, err := http.NewRequest("PUT", primary.URL+"/instances/"+instanceID+"/settings", bytes.NewBufferString(settings))
+		Expect(err).ToNot(HaveOccurred())
+		request.SetBasicAuth("fake-username", "fake-password")
+
+		httpResponse, err := http.DefaultClient.Do(request)
+		Expect(err).ToNot(HaveOccurred())
+		httpResponse.Body.Close()
+		Expect(httpResponse.StatusCode).To(Equal(http.StatusOK))
+	}
+
+	replicaSettings := func(instanceID string) func() string {
+		return func() string {
+			settings, _, err := replicaStore.Get(instanceID)
+			Expect(err).ToNot(HaveOccurred())
+			return settings
+		}
+	}
+
+	BeforeEach(func() {
+		tempDir, err = ioutil.TempDir("", "replica-follower")
+		Expect(err).ToNot(HaveOccurred())
+
+		primaryStore = store.NewBoltStore(store.BoltConfig{DBFile: filepath.Join(tempDir, "primary.db")}, logger)
+		replicaStore = store.NewBoltStore(store.BoltConfig{DBFile: filepath.Join(tempDir, "replica.db")}, logger)
+		replicaEvents = &fakes.FakeEventPublisher{}
+
+		startPrimary()
+		primary = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			primaryMutex.Lock()
+			mux := primaryMux
+			primaryMutex.Unlock()
+			mux.ServeHTTP(w, req)
+		}))
+
+		primaryURL, err := url.Parse(primary.URL)
+		Expect(err).ToNot(HaveOccurred())
+		port, err := strconv.Atoi(primaryURL.Port())
+		Expect(err).ToNot(HaveOccurred())
+
+		replicaConfig = ReplicaConfig{
+			Primary: registry.ClientOptions{
+				Protocol: "http",
+				Host:     primaryURL.Hostname(),
+				Port:     port,
+				Username: "fake-username",
+				Password: "fake-password",
+			},
+		}
+
+		err = primaryStore.Save("fake-instance-id-1", "fake-settings-1")
+		Expect(err).ToNot(HaveOccurred())
+		err = replicaStore.Save("stale-instance-id", "stale-settings")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	JustBeforeEach(func() {
+		replicaFollower, err = NewReplicaFollower(replicaConfig, replicaStore, replicaEvents, logger)
+		Expect(err).ToNot(HaveOccurred())
+		replicaFollower.Start()
+
+		Eventually(func() string { return replicaFollower.Status().Status }).Should(Equal(ReplicaStatusFollowing))
+	})
+
+	AfterEach(func() {
+		replicaFollower.Stop()
+		primary.CloseClientConnections()
+		primary.Close()
+		os.RemoveAll(tempDir)
+	})
+
+	It("bootstraps from the primary backup", func() {
+		Expect(replicaSettings("fake-instance-id-1")()).To(Equal("fake-settings-1"))
+
+		_, found, err := replicaStore.Get("stale-instance-id")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(BeFalse())
+
+		Expect(replicaEvents.PublishedEvents).To(HaveLen(2))
+		Expect(replicaFollower.Status().Bootstrapped).To(BeTrue())
+	})
+
+	It("follows the primary instance tokens", func() {
+		bootstrapToken, err := primaryTokens.IssueInstanceToken("fake-instance-id-1")
+		Expect(err).ToNot(HaveOccurred())
+		startPrimary()
+		primary.CloseClientConnections()
+
+		replicaTokens := NewInstanceTokens(InstanceTokensConfig{}, replicaStore, &fakes.FakeEventPublisher{})
+		Eventually(func() error {
+			return replicaTokens.VerifyInstanceToken("fake-instance-id-1", bootstrapToken)
+		}, "5s").Should(Succeed())
+
+		Eventually(func() string { return replicaFollower.Status().Status }).Should(Equal(ReplicaStatusFollowing))
+		token, err := primaryTokens.IssueInstanceToken("fake-instance-id-1")
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(func() error {
+			return replicaTokens.VerifyInstanceToken("fake-instance-id-1", token)
+		}).Should(Succeed())
+
+		Expect(primaryTokens.RevokeInstanceToken("fake-instance-id-1")).To(Succeed())
+		Eventually(func() error {
+			return replicaTokens.VerifyInstanceToken("fake-instance-id-1", token)
+		}).ShouldNot(Succeed())
+
+		for _, event := range replicaEvents.PublishedEvents {
+			Expect(event.Type).ToNot(HavePrefix("token_"))
+		}
+	})
+
+	It("applies the primary changes", func() {
+		putSettings("fake-instance-id-2", "fake-settings-2")
+		Eventually(replicaSettings("fake-instance-id-2")).Should(Equal("fake-settings-2"))
+
+		putSettings("fake-instance-id-2", "fake-settings-3")
+		Eventually(replicaSettings("fake-instance-id-2")).Should(Equal("fake-settings-3"))
+
+		status := replicaFollower.Status()
+		Expect(status.LastEventID).To(Equal(uint64(2)))
+		Expect(status.LastEventAt).ToNot(BeNil())
+		Expect(status.LagSeconds).To(BeNumerically("<", 5))
+	})
+
+	It("bootstraps again if the primary events stream is reset", func() {
+		putSettings("fake-instance-id-2", "fake-settings-2")
+		Eventually(replicaSettings("fake-instance-id-2")).Should(Equal("fake-settings-2"))
+
+		err = primaryStore.Save("fake-instance-id-3", "fake-settings-3")
+		Expect(err).ToNot(HaveOccurred())
+		startPrimary()
+		primary.CloseClientConnections()
+
+		Eventually(replicaSettings("fake-instance-id-3"), "5s").Should(Equal("fake-settings-3"))
+		Eventually(func() string { return replicaFollower.Status().Status }).Should(Equal(ReplicaStatusFollowing))
+	})
+	It("bootstraps again if the primary has restarted and published as many events", func() {
+		putSettings("fake-instance-id-2", "fake-settings-2")
+		Eventually(replicaSettings("fake-instance-id-2")).Should(Equal("fake-settings-2"))
+		Expect(replicaFollower.Status().LastEventID).To(Equal(uint64(1)))
+
+		err = primaryStore.Save("fake-instance-id-3", "fake-settings-3")
+		Expect(err).ToNot(HaveOccurred())
+		startPrimary()
+		event := NewEvent(EventTypeUpdated, "fake-instance-id-1")
+		event.Settings = "fake-settings-1"
+		primaryEvents.Publish(event)
+		primaryEvents.Publish(event)
+		primary.CloseClientConnections()
+
+		Eventually(replicaSettings("fake-instance-id-3"), "5s").Should(Equal("fake-settings-3"))
+	})
+})
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+const replicaHandlerLogTag = "RegistryServerReplicaHandler"
+const replicaStatusPath = "/replica/status"
+
+type ReplicaStatusProvider interface {
+	Status() ReplicaStatus
+}
+
+type ReplicaHandler struct {
+	config               ReplicaConfig
+	instanceTokensConfig InstanceTokensConfig
+	follower             ReplicaStatusProvider
+	proxy                *httputil.ReverseProxy
+	logger               boshlog.Logger
+}
+
+func NewReplicaHandler(
+	config ReplicaConfig,
+	instanceTokensConfig InstanceTokensConfig,
+	follower ReplicaStatusProvider,
+	logger boshlog.Logger,
+) (*ReplicaHandler, error) {
+	replicaHandler := &ReplicaHandler{
+		config:               config,
+		instanceTokensConfig: instanceTokensConfig,
+		follower:             follower,
+		logger:               logger,
+	}
+
+	if config.ProxyWrites() {
+		primaryURL, err := url.Parse(config.Primary.Endpoint())
+		if err != nil {
+			return nil, bosherr.WrapError(err, "Parsing Primary endpoint")
+		}
+
+		transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+		if config.Primary.Protocol == "https" {
+			if transport.TLSClientConfig, err = config.Primary.TLS.TLSConfig(); err != nil {
+				return nil, bosherr.WrapError(err, "Creating Primary TLS configuration")
+			}
+		}
+
+		replicaHandler.proxy = httputil.NewSingleHostReverseProxy(primaryURL)
+		replicaHandler.proxy.Transport = transport
+	}
+
+	return replicaHandler, nil
+}
+
+type ReplicaResponse struct {
+	Status string `json:"status"`
+}
+
+// Wrap refuses writes, or proxies them to the primary when configured, as the
+// local store only follows the primary. Reads revoking a one-time instance
+// token are writes too.
+func (rh *ReplicaHandler) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "GET" && !rh.instanceTokensConfig.revokesOnUse(req) {
+			next(w, req)
+			return
+		}
+
+		if rh.proxy != nil {
+			rh.logger.Debug(requestLogTag(replicaHandlerLogTag, req), "Proxying %s %s to primary registry", req.Method, req.URL.Path)
+			rh.proxy.ServeHTTP(w, req)
+			return
+		}
+
+		rh.logger.Debug(requestLogTag(replicaHandlerLogTag, req), "Refusing %s %s on a read-only replica", req.Method, req.URL.Path)
+		w.Header().Set("Allow", "GET")
+		rh.writeJSON(w, http.StatusMethodNotAllowed, ReplicaResponse{Status: "read_only"}, req)
+	}
+}
+
+func (rh *ReplicaHandler) HandleStatus(w http.ResponseWriter, req *http.Request) {
+	rh.logger.Debug(requestLogTag(replicaHandlerLogTag, req), "Received %s %s from %s", req.Method, req.URL.Path, req.RemoteAddr)
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	rh.writeJSON(w, http.StatusOK, rh.follower.Status(), req)
+}
+
+func (rh *ReplicaHandler) writeJSON(w http.ResponseWriter, statusCode int, response interface{}, req *http.Request) {
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		rh.logger.Warn(requestLogTag(replicaHandlerLogTag, req), "Failed to marshal replica response: '%s'", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(statusCode)
+	w.Write(responseJSON)
+}
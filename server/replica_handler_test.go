@@ -0,0 +1,164 @@
+package server_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+
+	registry "github.com/frodenas/bosh-registry/client"
+)
+
+type fakeReplicaStatusProvider struct {
+	status ReplicaStatus
+}
+
+func (p fakeReplicaStatusProvider) Status() ReplicaStatus {
+	return p.status
+}
+
+var _ = Describe("ReplicaHandler", func() {
+	var (
+		err              error
+		responseRecorder *httptest.ResponseRecorder
+		request          *http.Request
+		replicaConfig    ReplicaConfig
+		tokensConfig     InstanceTokensConfig
+		replicaHandler   *ReplicaHandler
+		nextCalled       bool
+		next             http.HandlerFunc
+		primary          *httptest.Server
+		primaryRequests  []*http.Request
+
+		logger = boshlog.NewLogger(boshlog.LevelNone)
+		status = ReplicaStatus{Primary: "http://fake-primary-host:5555", Status: ReplicaStatusFollowing, LastEventID: 42}
+	)
+
+	BeforeEach(func() {
+		primaryRequests = nil
+		primary = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			primaryRequests = append(primaryRequests, req)
+			w.WriteHeader(http.StatusCreated)
+		}))
+
+		primaryURL, err := url.Parse(primary.URL)
+		Expect(err).ToNot(HaveOccurred())
+		port, err := strconv.Atoi(primaryURL.Port())
+		Expect(err).ToNot(HaveOccurred())
+
+		replicaConfig = ReplicaConfig{
+			Primary: registry.ClientOptions{
+				Protocol: "http",
+				Host:     primaryURL.Hostname(),
+				Port:     port,
+				Username: "fake-username",
+				Password: "fake-password",
+			},
+		}
+
+		tokensConfig = InstanceTokensConfig{}
+		responseRecorder = httptest.NewRecorder()
+		nextCalled = false
+		next = func(w http.ResponseWriter, req *http.Request) {
+			nextCalled = true
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+
+	AfterEach(func() {
+		primary.Close()
+	})
+
+	JustBeforeEach(func() {
+		replicaHandler, err = NewReplicaHandler(replicaConfig, tokensConfig, fakeReplicaStatusProvider{status: status}, logger)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	Describe("Wrap", func() {
+		It("serves reads locally", func() {
+			request, err = http.NewRequest("GET", "/instances/fake-instance-id/settings", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			replicaHandler.Wrap(next)(responseRecorder, request)
+			Expect(nextCalled).To(BeTrue())
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+		})
+
+		It("refuses writes", func() {
+			request, err = http.NewRequest("PUT", "/instances/fake-instance-id/settings", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			replicaHandler.Wrap(next)(responseRecorder, request)
+			Expect(nextCalled).To(BeFalse())
+			Expect(responseRecorder.Code).To(Equal(http.StatusMethodNotAllowed))
+			Expect(responseRecorder.Body.String()).To(Equal(`{"status":"read_only"}`))
+			Expect(primaryRequests).To(BeEmpty())
+		})
+
+		Context("when writes are proxied", func() {
+			BeforeEach(func() {
+				replicaConfig.Writes = ReplicaWritesProxy
+			})
+
+			It("proxies writes to the primary", func() {
+				request, err = http.NewRequest("DELETE", "/instances/fake-instance-id/settings", nil)
+				Expect(err).NotTo(HaveOccurred())
+				request.SetBasicAuth("fake-client-username", "fake-client-password")
+
+				replicaHandler.Wrap(next)(responseRecorder, request)
+				Expect(nextCalled).To(BeFalse())
+				Expect(responseRecorder.Code).To(Equal(http.StatusCreated))
+				Expect(primaryRequests).To(HaveLen(1))
+				Expect(primaryRequests[0].Method).To(Equal("DELETE"))
+				Expect(primaryRequests[0].URL.Path).To(Equal("/instances/fake-instance-id/settings"))
+
+				username, password, _ := primaryRequests[0].BasicAuth()
+				Expect(username).To(Equal("fake-client-username"))
+				Expect(password).To(Equal("fake-client-password"))
+			})
+
+			It("serves reads with reusable instance tokens locally", func() {
+				request, err = http.NewRequest("GET", "/instances/fake-instance-id/settings?token=fake-token", nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				replicaHandler.Wrap(next)(responseRecorder, request)
+				Expect(nextCalled).To(BeTrue())
+				Expect(primaryRequests).To(BeEmpty())
+			})
+
+			Context("when instance tokens can only be used once", func() {
+				BeforeEach(func() {
+					tokensConfig.OneTimeUse = true
+				})
+
+				It("proxies reads with instance tokens to the primary, which revokes them", func() {
+					request, err = http.NewRequest("GET", "/instances/fake-instance-id/settings?token=fake-token", nil)
+					Expect(err).NotTo(HaveOccurred())
+
+					replicaHandler.Wrap(next)(responseRecorder, request)
+					Expect(nextCalled).To(BeFalse())
+					Expect(primaryRequests).To(HaveLen(1))
+					Expect(primaryRequests[0].URL.Query().Get("token")).To(Equal("fake-token"))
+				})
+			})
+		})
+	})
+
+	Describe("HandleStatus", func() {
+		It("returns the replica status", func() {
+			request, err = http.NewRequest("GET", "/replica/status", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			replicaHandler.HandleStatus(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(responseRecorder.Body.String()).To(Equal(`{"primary":"http://fake-primary-host:5555","status":"following","bootstrapped":false,"last_event_id":42,"lag_seconds":0}`))
+		})
+	})
+})
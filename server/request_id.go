@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+)
+
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds the length of the request IDs sent by clients.
+const maxRequestIDLength = 128
+
+type requestInfoKey struct{}
+
+// requestInfo is the identity of a request, shared by all the handlers that
+// serve it.
+type requestInfo struct {
+	id string
+
+	mutex     sync.Mutex
+	principal string
+}
+
+// wrapRequestID identifies every request by the request ID sent by the
+// client, or a new one if it did not send a valid one, echoing it in the
+// response.
+func wrapRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			req.Header.Set(RequestIDHeader, id)
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		ctx := context.WithValue(req.Context(), requestInfoKey{}, &requestInfo{id: id})
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// requestID returns the ID of the request, or an empty string if it has none.
+func requestID(req *http.Request) string {
+	if info, found := req.Context().Value(requestInfoKey{}).(*requestInfo); found {
+		return info.id
+	}
+
+	return ""
+}
+
+// requestPrincipal returns the identity authenticated for the request, or an
+// empty string if there is none.
+func requestPrincipal(req *http.Request) string {
+	info, found := req.Context().Value(requestInfoKey{}).(*requestInfo)
+	if !found {
+		return ""
+	}
+
+	info.mutex.Lock()
+	defer info.mutex.Unlock()
+
+	return info.principal
+}
+
+// setRequestPrincipal records the identity authenticated for the request.
+func setRequestPrincipal(req *http.Request, principal string) {
+	info, found := req.Context().Value(requestInfoKey{}).(*requestInfo)
+	if !found {
+		return
+	}
+
+	info.mutex.Lock()
+	defer info.mutex.Unlock()
+
+	info.principal = principal
+}
+
+// requestLogTag appends the ID of the request to a log tag, so every line
+// logged while serving the request can be correlated.
+func requestLogTag(tag string, req *http.Request) string {
+	if id := requestID(req); id != "" {
+		return tag + " request_id=" + id
+	}
+
+	return tag
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,15 @@
+package server
+
+import (
+	"net"
+	"net/http"
+)
+
+func requestIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
@@ -5,9 +5,18 @@ import (
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
 )
 
 func TestRegistryServer(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Registry Server Suite")
 }
+
+func newUsers(config Config) *Users {
+	users, err := NewUsers(config)
+	Expect(err).ToNot(HaveOccurred())
+
+	return users
+}
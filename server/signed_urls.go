@@ -0,0 +1,194 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+)
+
+const signedURLMinSecretLength = 32
+const defaultSignedURLMaxExpiresIn = 24 * 60 * 60
+
+const (
+	signedURLExpiresParam   = "expires"
+	signedURLKeyIDParam     = "key_id"
+	signedURLSignatureParam = "signature"
+)
+
+// SignedURLsConfig contains the keys used to sign settings URLs. The first
+// key signs new URLs, while every key verifies them, so keys can be rotated
+// by adding a new first key and removing the old one once the URLs it signed
+// have expired.
+type SignedURLsConfig struct {
+	Keys         []SigningKeyConfig `json:"keys,omitempty"`
+	MaxExpiresIn int                `json:"max_expires_in,omitempty"`
+}
+
+type SigningKeyConfig struct {
+	ID     string `json:"id,omitempty"`
+	Secret string `json:"secret,omitempty"`
+}
+
+func (c SignedURLsConfig) Enabled() bool {
+	return len(c.Keys) > 0
+}
+
+func (c SignedURLsConfig) Validate() error {
+	keyIDs := map[string]struct{}{}
+	for _, key := range c.Keys {
+		if key.ID == "" {
+			return bosherr.Error("Must provide a non-empty ID for every key")
+		}
+
+		if len(key.Secret) < signedURLMinSecretLength {
+			return bosherr.Errorf("Must provide a Secret of at least %d characters for key '%s'", signedURLMinSecretLength, key.ID)
+		}
+
+		if _, found := keyIDs[key.ID]; found {
+			return bosherr.Errorf("Duplicated key '%s'", key.ID)
+		}
+		keyIDs[key.ID] = struct{}{}
+	}
+
+	if c.MaxExpiresIn < 0 {
+		return bosherr.Error("Must provide a non-negative MaxExpiresIn")
+	}
+
+	return nil
+}
+
+// MaxExpiry returns how long signed URLs can be valid for.
+func (c SignedURLsConfig) MaxExpiry() time.Duration {
+	if c.MaxExpiresIn == 0 {
+		return defaultSignedURLMaxExpiresIn * time.Second
+	}
+
+	return time.Duration(c.MaxExpiresIn) * time.Second
+}
+
+// SignedURLs signs and verifies time-limited GET URLs. The signature is an
+// HMAC-SHA256 over the path and the expiry of the URL. Without keys, signed
+// URLs are disabled.
+type SignedURLs struct {
+	mutex  sync.RWMutex
+	config SignedURLsConfig
+	keys   map[string][]byte
+}
+
+func NewSignedURLs(config SignedURLsConfig) (*SignedURLs, error) {
+	signedURLs := &SignedURLs{}
+	if err := signedURLs.Update(config); err != nil {
+		return nil, err
+	}
+
+	return signedURLs, nil
+}
+
+// Update replaces the signing keys and maximum expiry with the ones of the
+// configuration.
+func (s *SignedURLs) Update(config SignedURLsConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	keys := map[string][]byte{}
+	for _, key := range config.Keys {
+		keys[key.ID] = []byte(key.Secret)
+	}
+
+	s.mutex.Lock()
+	s.config = config
+	s.keys = keys
+	s.mutex.Unlock()
+
+	return nil
+}
+
+func (s *SignedURLs) Enabled() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.config.Enabled()
+}
+
+func (s *SignedURLs) MaxExpiry() time.Duration {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.config.MaxExpiry()
+}
+
+// Sign returns the path with the query parameters that make it valid until
+// expiresAt.
+func (s *SignedURLs) Sign(path string, expiresAt time.Time) (string, error) {
+	s.mutex.RLock()
+	config := s.config
+	s.mutex.RUnlock()
+
+	if !config.Enabled() {
+		return "", bosherr.Error("Signed URLs are not enabled")
+	}
+
+	if expiresAt.After(time.Now().Add(config.MaxExpiry())) {
+		return "", bosherr.Errorf("Expiry cannot be later than %s from now", config.MaxExpiry())
+	}
+
+	key := config.Keys[0]
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+
+	query := url.Values{}
+	query.Set(signedURLExpiresParam, expires)
+	query.Set(signedURLKeyIDParam, key.ID)
+	query.Set(signedURLSignatureParam, signURL([]byte(key.Secret), path, expires))
+
+	return (&url.URL{Path: path, RawQuery: query.Encode()}).String(), nil
+}
+
+// Verify checks the signature and the expiry of the request URL.
+func (s *SignedURLs) Verify(req *http.Request) error {
+	query := req.URL.Query()
+	signature := query.Get(signedURLSignatureParam)
+	if signature == "" {
+		return bosherr.Error("missing URL signature")
+	}
+
+	s.mutex.RLock()
+	secret, found := s.keys[query.Get(signedURLKeyIDParam)]
+	s.mutex.RUnlock()
+	if !found {
+		return bosherr.Errorf("unknown URL signing key '%s'", query.Get(signedURLKeyIDParam))
+	}
+
+	expires := query.Get(signedURLExpiresParam)
+	if !hmac.Equal([]byte(signature), []byte(signURL(secret, req.URL.Path, expires))) {
+		return bosherr.Error("invalid URL signature")
+	}
+
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return bosherr.Errorf("invalid URL expiry '%s'", expires)
+	}
+
+	if time.Now().Unix() > expiresAt {
+		return bosherr.Errorf("signed URL expired at %s", time.Unix(expiresAt, 0).UTC().Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+func signURL(secret []byte, path string, expires string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("GET\n"))
+	mac.Write([]byte(path))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(expires))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
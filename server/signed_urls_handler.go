@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+const signedURLsHandlerLogTag = "RegistryServerSignedURLsHandler"
+const signedURLsPath = "/signed_urls"
+const defaultSignedURLExpiresIn = 60 * 60
+
+type SignedURLsHandler struct {
+	users      *Users
+	signedURLs *SignedURLs
+	logger     boshlog.Logger
+}
+
+func NewSignedURLsHandler(
+	users *Users,
+	signedURLs *SignedURLs,
+	logger boshlog.Logger,
+) *SignedURLsHandler {
+	return &SignedURLsHandler{
+		users:      users,
+		signedURLs: signedURLs,
+		logger:     logger,
+	}
+}
+
+type SignedURLRequest struct {
+	InstanceID string `json:"instance_id"`
+	ExpiresIn  int    `json:"expires_in,omitempty"`
+}
+
+type SignedURLResponse struct {
+	URL       string     `json:"url,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Status    string     `json:"status"`
+}
+
+func (sh *SignedURLsHandler) HandleFunc(w http.ResponseWriter, req *http.Request) {
+	sh.logger.Debug(requestLogTag(signedURLsHandlerLogTag, req), "Received %s %s from %s", req.Method, req.URL.Path, req.RemoteAddr)
+	if !sh.signedURLs.Enabled() {
+		http.NotFound(w, req)
+		return
+	}
+
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !sh.users.IsAuthorized(req, RoleAdmin) {
+		sh.logger.Debug(requestLogTag(signedURLsHandlerLogTag, req), "Received unauthorized request")
+		w.Header().Add("WWW-Authenticate", `Basic realm="Bosh Registry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		sh.writeJSON(w, http.StatusBadRequest, SignedURLResponse{Status: "error"}, req)
+		return
+	}
+
+	var signedURLRequest SignedURLRequest
+	if err = json.Unmarshal(reqBody, &signedURLRequest); err != nil {
+		sh.logger.Debug(requestLogTag(signedURLsHandlerLogTag, req), "Failed to unmarshal signed URL request: '%v'", err)
+		sh.writeJSON(w, http.StatusBadRequest, SignedURLResponse{Status: "error"}, req)
+		return
+	}
+
+	if signedURLRequest.InstanceID == "" || strings.Contains(signedURLRequest.InstanceID, "/") || signedURLRequest.ExpiresIn < 0 {
+		sh.logger.Debug(requestLogTag(signedURLsHandlerLogTag, req), "Invalid signed URL request for instance '%s' expiring in %d seconds", signedURLRequest.InstanceID, signedURLRequest.ExpiresIn)
+		sh.writeJSON(w, http.StatusBadRequest, SignedURLResponse{Status: "error"}, req)
+		return
+	}
+
+	expiresIn := time.Duration(signedURLRequest.ExpiresIn) * time.Second
+	if expiresIn == 0 {
+		expiresIn = defaultSignedURLExpiresIn * time.Second
+		if expiresIn > sh.signedURLs.MaxExpiry() {
+			expiresIn = sh.signedURLs.MaxExpiry()
+		}
+	}
+	expiresAt := time.Now().Add(expiresIn).Truncate(time.Second).UTC()
+
+	signedPath, err := sh.signedURLs.Sign("/instances/"+signedURLRequest.InstanceID+"/settings", expiresAt)
+	if err != nil {
+		sh.logger.Debug(requestLogTag(signedURLsHandlerLogTag, req), "Failed to sign URL for instance '%s': '%v'", signedURLRequest.InstanceID, err)
+		sh.writeJSON(w, http.StatusBadRequest, SignedURLResponse{Status: "error"}, req)
+		return
+	}
+
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+
+	sh.logger.Debug(requestLogTag(signedURLsHandlerLogTag, req), "Signed URL for instance '%s' expiring at %s", signedURLRequest.InstanceID, expiresAt)
+	sh.writeJSON(w, http.StatusOK, SignedURLResponse{
+		URL:       scheme + "://" + req.Host + signedPath,
+		ExpiresAt: &expiresAt,
+		Status:    "ok",
+	}, req)
+}
+
+func (sh *SignedURLsHandler) writeJSON(w http.ResponseWriter, statusCode int, response SignedURLResponse, req *http.Request) {
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		sh.logger.Warn(requestLogTag(signedURLsHandlerLogTag, req), "Failed to marshal signed URL response: '%s'", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(statusCode)
+	w.Write(responseJSON)
+}
@@ -0,0 +1,130 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+var _ = Describe("SignedURLsHandler", func() {
+	var (
+		err               error
+		responseRecorder  *httptest.ResponseRecorder
+		request           *http.Request
+		signedURLs        *SignedURLs
+		signedURLsHandler *SignedURLsHandler
+
+		logger = boshlog.NewLogger(boshlog.LevelNone)
+		config = Config{
+			Protocol: "http",
+			Address:  "fake-host",
+			Port:     5555,
+			Username: "fake-username",
+			Password: "fake-password",
+			Users: []UserConfig{
+				{Name: "fake-writer", PasswordHash: "$2a$04$7r81GRQeDgn8ssDbGBv.hu9S5SCsylmffgm4Hkr0fL37Tf.NbZEH.", Role: RoleWriter},
+			},
+		}
+	)
+
+	BeforeEach(func() {
+		responseRecorder = httptest.NewRecorder()
+		signedURLs, err = NewSignedURLs(SignedURLsConfig{
+			Keys:         []SigningKeyConfig{{ID: "fake-key-id", Secret: "fake-secret-fake-secret-fake-secret"}},
+			MaxExpiresIn: 1800,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		signedURLsHandler = NewSignedURLsHandler(newUsers(config), signedURLs, logger)
+	})
+
+	newRequest := func(body string) *http.Request {
+		request, err := http.NewRequest("POST", "http://fake-host:5555/signed_urls", bytes.NewReader([]byte(body)))
+		Expect(err).NotTo(HaveOccurred())
+		request.SetBasicAuth("fake-username", "fake-password")
+		return request
+	}
+
+	It("returns a signed settings URL", func() {
+		request = newRequest(`{"instance_id":"fake-instance-id","expires_in":60}`)
+
+		signedURLsHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+
+		var response SignedURLResponse
+		Expect(json.Unmarshal(responseRecorder.Body.Bytes(), &response)).To(Succeed())
+		Expect(response.Status).To(Equal("ok"))
+		Expect(response.URL).To(HavePrefix("http://fake-host:5555/instances/fake-instance-id/settings?"))
+		Expect(*response.ExpiresAt).To(BeTemporally("~", time.Now().Add(time.Minute), 2*time.Second))
+
+		signedURL, err := url.Parse(response.URL)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(signedURLs.Verify(&http.Request{URL: signedURL})).To(Succeed())
+	})
+
+	It("limits the default expiry to the maximum expiry", func() {
+		request = newRequest(`{"instance_id":"fake-instance-id"}`)
+
+		signedURLsHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+
+		var response SignedURLResponse
+		Expect(json.Unmarshal(responseRecorder.Body.Bytes(), &response)).To(Succeed())
+		Expect(*response.ExpiresAt).To(BeTemporally("~", time.Now().Add(30*time.Minute), 2*time.Second))
+	})
+
+	It("returns a Bad request error if the expiry is later than the maximum expiry", func() {
+		request = newRequest(`{"instance_id":"fake-instance-id","expires_in":3600}`)
+
+		signedURLsHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+		Expect(responseRecorder.Body.String()).To(Equal(`{"status":"error"}`))
+	})
+
+	It("returns a Bad request error if the instance ID is not valid", func() {
+		request = newRequest(`{"instance_id":"fake-instance-id/settings"}`)
+
+		signedURLsHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("returns a Bad request error if the request is not valid", func() {
+		request = newRequest(`fake-request`)
+
+		signedURLsHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("returns an Unauthorized error if the user is not an admin", func() {
+		request = newRequest(`{"instance_id":"fake-instance-id"}`)
+		request.SetBasicAuth("fake-writer", "fake-password")
+
+		signedURLsHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("returns a Method not allowed error on GET requests", func() {
+		request, err = http.NewRequest("GET", "/signed_urls", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		signedURLsHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusMethodNotAllowed))
+	})
+
+	It("returns a Not found error if signed URLs are not enabled", func() {
+		Expect(signedURLs.Update(SignedURLsConfig{})).To(Succeed())
+		request = newRequest(`{"instance_id":"fake-instance-id"}`)
+
+		signedURLsHandler.HandleFunc(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(http.StatusNotFound))
+	})
+})
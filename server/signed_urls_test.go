@@ -0,0 +1,219 @@
+package server_test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+)
+
+var _ = Describe("SignedURLsConfig", func() {
+	var config SignedURLsConfig
+
+	BeforeEach(func() {
+		config = SignedURLsConfig{
+			Keys: []SigningKeyConfig{
+				{ID: "fake-key-id", Secret: "fake-secret-fake-secret-fake-secret"},
+			},
+		}
+	})
+
+	Describe("Validate", func() {
+		It("does not return error if all fields are valid", func() {
+			Expect(config.Validate()).To(Succeed())
+		})
+
+		It("returns error if a key ID is empty", func() {
+			config.Keys[0].ID = ""
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a non-empty ID for every key"))
+		})
+
+		It("returns error if a key secret is too short", func() {
+			config.Keys[0].Secret = "fake-secret"
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a Secret of at least 32 characters for key 'fake-key-id'"))
+		})
+
+		It("returns error if a key is duplicated", func() {
+			config.Keys = append(config.Keys, config.Keys[0])
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Duplicated key 'fake-key-id'"))
+		})
+
+		It("returns error if MaxExpiresIn is negative", func() {
+			config.MaxExpiresIn = -1
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a non-negative MaxExpiresIn"))
+		})
+	})
+
+	Describe("MaxExpiry", func() {
+		It("defaults to a day", func() {
+			Expect(config.MaxExpiry()).To(Equal(24 * time.Hour))
+		})
+
+		It("returns MaxExpiresIn", func() {
+			config.MaxExpiresIn = 60
+			Expect(config.MaxExpiry()).To(Equal(time.Minute))
+		})
+	})
+})
+
+var _ = Describe("SignedURLs", func() {
+	var (
+		err        error
+		config     SignedURLsConfig
+		signedURLs *SignedURLs
+	)
+
+	BeforeEach(func() {
+		config = SignedURLsConfig{
+			Keys: []SigningKeyConfig{
+				{ID: "fake-key-id", Secret: "fake-secret-fake-secret-fake-secret"},
+			},
+		}
+	})
+
+	JustBeforeEach(func() {
+		signedURLs, err = NewSignedURLs(config)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	newRequest := func(path string) *http.Request {
+		request, err := http.NewRequest("GET", path, nil)
+		Expect(err).ToNot(HaveOccurred())
+		return request
+	}
+
+	signPath := func(path string, expiresAt time.Time) string {
+		signedPath, err := signedURLs.Sign(path, expiresAt)
+		Expect(err).ToNot(HaveOccurred())
+		return signedPath
+	}
+
+	It("does not sign URLs if no key is provided", func() {
+		signedURLs, err = NewSignedURLs(SignedURLsConfig{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(signedURLs.Enabled()).To(BeFalse())
+
+		_, err = signedURLs.Sign("/instances/fake-instance-id/settings", time.Now().Add(time.Minute))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Signed URLs are not enabled"))
+	})
+
+	It("returns error if the configuration is not valid", func() {
+		_, err = NewSignedURLs(SignedURLsConfig{MaxExpiresIn: -1})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Must provide a non-negative MaxExpiresIn"))
+	})
+
+	It("verifies signed URLs until they expire", func() {
+		signedPath := signPath("/instances/fake-instance-id/settings", time.Now().Add(time.Minute))
+		Expect(signedPath).To(HavePrefix("/instances/fake-instance-id/settings?expires="))
+		Expect(signedURLs.Verify(newRequest(signedPath))).To(Succeed())
+
+		signedPath = signPath("/instances/fake-instance-id/settings", time.Now().Add(-time.Minute))
+		err = signedURLs.Verify(newRequest(signedPath))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("signed URL expired"))
+	})
+
+	It("refuses URLs without signature", func() {
+		err = signedURLs.Verify(newRequest("/instances/fake-instance-id/settings"))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("missing URL signature"))
+	})
+
+	It("refuses signatures of other paths", func() {
+		signedPath := signPath("/instances/fake-instance-id/settings", time.Now().Add(time.Minute))
+		otherPath := strings.Replace(signedPath, "fake-instance-id", "fake-other-instance-id", 1)
+
+		err = signedURLs.Verify(newRequest(otherPath))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("invalid URL signature"))
+	})
+
+	It("refuses URLs whose expiry has been changed", func() {
+		expiresAt := time.Now().Add(time.Minute)
+		signedPath := signPath("/instances/fake-instance-id/settings", expiresAt)
+		expires := fmt.Sprintf("expires=%d", expiresAt.Unix())
+		Expect(signedPath).To(ContainSubstring(expires))
+		otherPath := strings.Replace(signedPath, expires, fmt.Sprintf("expires=%d", expiresAt.Unix()+60), 1)
+
+		err = signedURLs.Verify(newRequest(otherPath))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("invalid URL signature"))
+	})
+
+	It("refuses expiries later than the maximum", func() {
+		_, err = signedURLs.Sign("/instances/fake-instance-id/settings", time.Now().Add(25*time.Hour))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Expiry cannot be later than 24h0m0s from now"))
+	})
+
+	Describe("Update", func() {
+		It("keeps the previous keys if the configuration is not valid", func() {
+			signedPath := signPath("/instances/fake-instance-id/settings", time.Now().Add(time.Minute))
+
+			err = signedURLs.Update(SignedURLsConfig{Keys: []SigningKeyConfig{{ID: "fake-new-key-id", Secret: "fake-secret"}}})
+			Expect(err).To(HaveOccurred())
+
+			Expect(signedURLs.Verify(newRequest(signedPath))).To(Succeed())
+		})
+
+		It("disables signed URLs if the keys are removed", func() {
+			signedPath := signPath("/instances/fake-instance-id/settings", time.Now().Add(time.Minute))
+
+			Expect(signedURLs.Update(SignedURLsConfig{})).To(Succeed())
+			Expect(signedURLs.Enabled()).To(BeFalse())
+			Expect(signedURLs.Verify(newRequest(signedPath))).ToNot(Succeed())
+		})
+	})
+
+	Context("when keys are rotated", func() {
+		var oldSignedPath string
+
+		BeforeEach(func() {
+			oldSignedURLs, err := NewSignedURLs(config)
+			Expect(err).ToNot(HaveOccurred())
+			oldSignedPath, err = oldSignedURLs.Sign("/instances/fake-instance-id/settings", time.Now().Add(time.Minute))
+			Expect(err).ToNot(HaveOccurred())
+
+			config.Keys = []SigningKeyConfig{
+				{ID: "fake-new-key-id", Secret: "fake-new-secret-fake-new-secret-fake-new-secret"},
+				config.Keys[0],
+			}
+		})
+
+		It("signs with the first key", func() {
+			Expect(signPath("/instances/fake-instance-id/settings", time.Now().Add(time.Minute))).To(ContainSubstring("key_id=fake-new-key-id"))
+		})
+
+		It("verifies URLs signed with any key", func() {
+			Expect(signedURLs.Verify(newRequest(oldSignedPath))).To(Succeed())
+		})
+
+		It("refuses URLs signed with removed keys", func() {
+			config.Keys = config.Keys[:1]
+			Expect(signedURLs.Update(config)).To(Succeed())
+
+			err = signedURLs.Verify(newRequest(oldSignedPath))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("unknown URL signing key 'fake-key-id'"))
+		})
+	})
+})
@@ -1,6 +1,8 @@
 package store
 
 import (
+	"errors"
+	"sync"
 	"time"
 
 	bosherr "github.com/cloudfoundry/bosh-utils/errors"
@@ -14,9 +16,20 @@ const boltStoreFileMode = 0600
 const boltStoreFileLockTimeout = 1
 const boltStoreBucketName = "Registry"
 
+// ErrClosed is returned by the operations on a closed store.
+var ErrClosed = errors.New("Registry Store is closed")
+
 type BoltStore struct {
 	config BoltConfig
 	logger boshlog.Logger
+	state  *boltStoreState
+}
+
+// boltStoreState is shared by the copies of a BoltStore, so closing any of
+// them waits for the operations in progress on all of them.
+type boltStoreState struct {
+	mutex  sync.RWMutex
+	closed bool
 }
 
 func NewBoltStore(
@@ -26,17 +39,22 @@ func NewBoltStore(
 	return BoltStore{
 		config: config,
 		logger: logger,
+		state:  &boltStoreState{},
 	}
 }
 
 func (s BoltStore) Delete(key string) error {
+	if err := s.begin(); err != nil {
+		return bosherr.WrapErrorf(err, "Deleting key '%s'", key)
+	}
+	defer s.end()
+
 	db, err := s.openDB()
 	if err != nil {
 		return bosherr.WrapErrorf(err, "Deleting key '%s'", key)
 	}
 	defer db.Close()
 
-	s.logger.Debug(boltStoreLogTag, "Deleting key '%s'", key)
 	err = db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(boltStoreBucketName))
 		if bucket != nil {
@@ -52,6 +70,11 @@ func (s BoltStore) Delete(key string) error {
 }
 
 func (s BoltStore) Get(key string) (string, bool, error) {
+	if err := s.begin(); err != nil {
+		return "", false, bosherr.WrapErrorf(err, "Reading key '%s'", key)
+	}
+	defer s.end()
+
 	db, err := s.openDB()
 	if err != nil {
 		return "", false, bosherr.WrapErrorf(err, "Reading key '%s'", key)
@@ -59,7 +82,6 @@ func (s BoltStore) Get(key string) (string, bool, error) {
 	defer db.Close()
 
 	var value []byte
-	s.logger.Debug(boltStoreLogTag, "Reading key '%s'", key)
 	db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(boltStoreBucketName))
 		if bucket != nil {
@@ -74,14 +96,77 @@ func (s BoltStore) Get(key string) (string, bool, error) {
 	return "", false, nil
 }
 
+func (s BoltStore) GetAll() (map[string]string, error) {
+	if err := s.begin(); err != nil {
+		return nil, bosherr.WrapError(err, "Reading all keys")
+	}
+	defer s.end()
+
+	db, err := s.openDB()
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Reading all keys")
+	}
+	defer db.Close()
+
+	values := map[string]string{}
+
+	db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(boltStoreBucketName))
+		if bucket != nil {
+			return bucket.ForEach(func(key []byte, value []byte) error {
+				values[string(key)] = string(value)
+				return nil
+			})
+		}
+
+		return nil
+	})
+
+	return values, nil
+}
+
+// Keys returns the keys without copying their values, to count them.
+func (s BoltStore) Keys() ([]string, error) {
+	if err := s.begin(); err != nil {
+		return nil, bosherr.WrapError(err, "Reading keys")
+	}
+	defer s.end()
+
+	db, err := s.openDB()
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Reading keys")
+	}
+	defer db.Close()
+
+	keys := []string{}
+
+	db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(boltStoreBucketName))
+		if bucket != nil {
+			cursor := bucket.Cursor()
+			for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+				keys = append(keys, string(key))
+			}
+		}
+
+		return nil
+	})
+
+	return keys, nil
+}
+
 func (s BoltStore) Save(key string, value string) error {
+	if err := s.begin(); err != nil {
+		return bosherr.WrapErrorf(err, "Saving key '%s'", key)
+	}
+	defer s.end()
+
 	db, err := s.openDB()
 	if err != nil {
 		return bosherr.WrapErrorf(err, "Saving key '%s'", key)
 	}
 	defer db.Close()
 
-	s.logger.Debug(boltStoreLogTag, "Saving key '%s'", key)
 	err = db.Update(func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists([]byte(boltStoreBucketName))
 		if err != nil {
@@ -96,6 +181,33 @@ func (s BoltStore) Save(key string, value string) error {
 	return nil
 }
 
+// Close waits for the operations in progress and makes the next ones fail.
+func (s BoltStore) Close() error {
+	s.state.mutex.Lock()
+	defer s.state.mutex.Unlock()
+
+	if !s.state.closed {
+		s.logger.Debug(boltStoreLogTag, "Closing store")
+		s.state.closed = true
+	}
+
+	return nil
+}
+
+func (s BoltStore) begin() error {
+	s.state.mutex.RLock()
+	if s.state.closed {
+		s.state.mutex.RUnlock()
+		return ErrClosed
+	}
+
+	return nil
+}
+
+func (s BoltStore) end() {
+	s.state.mutex.RUnlock()
+}
+
 func (s BoltStore) openDB() (db *bolt.DB, err error) {
 	dbOptions := &bolt.Options{
 		Timeout: boltStoreFileLockTimeout * time.Second,
@@ -50,6 +50,49 @@ var _ = Describe("BoltStore", func() {
 		})
 	})
 
+	Describe("GetAll", func() {
+		It("returns all keys and values", func() {
+			err = boltStore.Save("fake-key-1", "fake-value-1")
+			Expect(err).ToNot(HaveOccurred())
+
+			err = boltStore.Save("fake-key-2", "fake-value-2")
+			Expect(err).ToNot(HaveOccurred())
+
+			values, err := boltStore.GetAll()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(values).To(Equal(map[string]string{
+				"fake-key-1": "fake-value-1",
+				"fake-key-2": "fake-value-2",
+			}))
+		})
+
+		It("returns an empty map if there are no keys", func() {
+			values, err := boltStore.GetAll()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(values).To(BeEmpty())
+		})
+	})
+
+	Describe("Keys", func() {
+		It("returns all keys", func() {
+			err = boltStore.Save("fake-key-1", "fake-value-1")
+			Expect(err).ToNot(HaveOccurred())
+
+			err = boltStore.Save("fake-key-2", "fake-value-2")
+			Expect(err).ToNot(HaveOccurred())
+
+			keys, err := boltStore.Keys()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(keys).To(ConsistOf("fake-key-1", "fake-key-2"))
+		})
+
+		It("returns no keys if there are none", func() {
+			keys, err := boltStore.Keys()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(keys).To(BeEmpty())
+		})
+	})
+
 	Describe("Delete", func() {
 		It("deletes the key if it exist", func() {
 			err = boltStore.Save("fake-key", "fake-value")
@@ -93,4 +136,23 @@ var _ = Describe("BoltStore", func() {
 			Expect(value).To(Equal("fake-new-value"))
 		})
 	})
+
+	Describe("Close", func() {
+		It("makes the next operations fail", func() {
+			err = boltStore.Close()
+			Expect(err).ToNot(HaveOccurred())
+
+			err = boltStore.Save("fake-key", "fake-value")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(ErrClosed.Error()))
+
+			_, _, err = boltStore.Get("fake-key")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("does not return error if already closed", func() {
+			Expect(boltStore.Close()).To(Succeed())
+			Expect(boltStore.Close()).To(Succeed())
+		})
+	})
 })
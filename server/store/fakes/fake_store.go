@@ -9,8 +9,19 @@ type FakeStore struct {
 	GetValue  string
 	GetErr    error
 
+	GetAllCalled bool
+	GetAllValues map[string]string
+	GetAllErr    error
+
+	KeysCalled bool
+	KeysResult []string
+	KeysErr    error
+
 	SaveCalled bool
 	SaveErr    error
+
+	CloseCalled bool
+	CloseErr    error
 }
 
 func (s *FakeStore) Delete(key string) error {
@@ -23,7 +34,22 @@ func (s *FakeStore) Get(key string) (string, bool, error) {
 	return s.GetValue, s.GetFound, s.GetErr
 }
 
+func (s *FakeStore) GetAll() (map[string]string, error) {
+	s.GetAllCalled = true
+	return s.GetAllValues, s.GetAllErr
+}
+
+func (s *FakeStore) Keys() ([]string, error) {
+	s.KeysCalled = true
+	return s.KeysResult, s.KeysErr
+}
+
 func (s *FakeStore) Save(key, value string) error {
 	s.SaveCalled = true
 	return s.SaveErr
 }
+
+func (s *FakeStore) Close() error {
+	s.CloseCalled = true
+	return s.CloseErr
+}
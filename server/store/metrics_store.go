@@ -0,0 +1,80 @@
+package store
+
+import (
+	"time"
+
+	"github.com/frodenas/bosh-registry/server/metrics"
+)
+
+// MetricsStore records the latency and the errors of the operations of a
+// store, labelled with its adapter.
+type MetricsStore struct {
+	store    Store
+	adapter  string
+	duration *metrics.Histogram
+	errors   *metrics.Counter
+}
+
+func NewMetricsStore(
+	store Store,
+	adapter string,
+	metricsRegistry *metrics.Registry,
+) MetricsStore {
+	return MetricsStore{
+		store:    store,
+		adapter:  adapter,
+		duration: metricsRegistry.NewHistogram("bosh_registry_store_operation_duration_seconds", "Latency of the Registry Store operations.", metrics.DefaultBuckets, "adapter", "operation"),
+		errors:   metricsRegistry.NewCounter("bosh_registry_store_operation_errors_total", "Failed Registry Store operations.", "adapter", "operation"),
+	}
+}
+
+func (s MetricsStore) Delete(key string) error {
+	start := time.Now()
+	err := s.store.Delete(key)
+	s.observe("delete", start, err)
+
+	return err
+}
+
+func (s MetricsStore) Get(key string) (string, bool, error) {
+	start := time.Now()
+	value, found, err := s.store.Get(key)
+	s.observe("get", start, err)
+
+	return value, found, err
+}
+
+func (s MetricsStore) GetAll() (map[string]string, error) {
+	start := time.Now()
+	values, err := s.store.GetAll()
+	s.observe("get_all", start, err)
+
+	return values, err
+}
+
+func (s MetricsStore) Keys() ([]string, error) {
+	start := time.Now()
+	keys, err := s.store.Keys()
+	s.observe("keys", start, err)
+
+	return keys, err
+}
+
+func (s MetricsStore) Save(key string, value string) error {
+	start := time.Now()
+	err := s.store.Save(key, value)
+	s.observe("save", start, err)
+
+	return err
+}
+
+func (s MetricsStore) Close() error {
+	return s.store.Close()
+}
+
+func (s MetricsStore) observe(operation string, start time.Time, err error) {
+	s.duration.Observe(time.Since(start).Seconds(), s.adapter, operation)
+	if err != nil {
+		s.errors.Inc(s.adapter, operation)
+	}
+}
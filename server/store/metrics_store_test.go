@@ -0,0 +1,58 @@
+package store_test
+
+import (
+	"bytes"
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server/store"
+
+	"github.com/frodenas/bosh-registry/server/metrics"
+	"github.com/frodenas/bosh-registry/server/store/fakes"
+)
+
+var _ = Describe("MetricsStore", func() {
+	var (
+		fakeStore       *fakes.FakeStore
+		metricsRegistry *metrics.Registry
+		metricsStore    MetricsStore
+	)
+
+	BeforeEach(func() {
+		fakeStore = &fakes.FakeStore{GetFound: true, GetValue: "fake-value"}
+		metricsRegistry = metrics.NewRegistry()
+		metricsStore = NewMetricsStore(fakeStore, "fake-adapter", metricsRegistry)
+	})
+
+	writeText := func() string {
+		buffer := &bytes.Buffer{}
+		Expect(metricsRegistry.WriteText(buffer)).To(Succeed())
+		return buffer.String()
+	}
+
+	It("records the latency of the operations", func() {
+		value, found, err := metricsStore.Get("fake-key")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(BeTrue())
+		Expect(value).To(Equal("fake-value"))
+
+		Expect(metricsStore.Save("fake-key", "fake-value")).To(Succeed())
+		Expect(fakeStore.SaveCalled).To(BeTrue())
+
+		Expect(writeText()).To(ContainSubstring(`bosh_registry_store_operation_duration_seconds_count{adapter="fake-adapter",operation="get"} 1`))
+		Expect(writeText()).To(ContainSubstring(`bosh_registry_store_operation_duration_seconds_count{adapter="fake-adapter",operation="save"} 1`))
+		Expect(writeText()).ToNot(ContainSubstring("bosh_registry_store_operation_errors_total{"))
+	})
+
+	It("counts the failed operations", func() {
+		fakeStore.DeleteErr = errors.New("fake-delete-err")
+
+		err := metricsStore.Delete("fake-key")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(Equal("fake-delete-err"))
+
+		Expect(writeText()).To(ContainSubstring(`bosh_registry_store_operation_errors_total{adapter="fake-adapter",operation="delete"} 1`))
+	})
+})
@@ -10,7 +10,10 @@ import (
 type Store interface {
 	Delete(string) error
 	Get(string) (string, bool, error)
+	GetAll() (map[string]string, error)
+	Keys() ([]string, error)
 	Save(string, string) error
+	Close() error
 }
 
 func NewStore(
@@ -0,0 +1,361 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+const defaultTLSReloadInterval = 60
+
+const (
+	TLSClientAuthNone          = "none"
+	TLSClientAuthRequest       = "request"
+	TLSClientAuthVerifyIfGiven = "verify_if_given"
+	TLSClientAuthRequire       = "require"
+)
+
+var tlsClientAuthTypes = map[string]tls.ClientAuthType{
+	TLSClientAuthNone:          tls.NoClientCert,
+	TLSClientAuthRequest:       tls.RequestClientCert,
+	TLSClientAuthVerifyIfGiven: tls.VerifyClientCertIfGiven,
+	TLSClientAuthRequire:       tls.RequireAndVerifyClientCert,
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+type TLSConfig struct {
+	CertFile     string                 `json:"certfile,omitempty"`
+	KeyFile      string                 `json:"keyfile,omitempty"`
+	CACertFile   string                 `json:"cacertfile,omitempty"`
+	Certificates []TLSCertificateConfig `json:"certificates,omitempty"`
+
+	ClientAuth   string   `json:"client_auth,omitempty"`
+	MinVersion   string   `json:"min_version,omitempty"`
+	MaxVersion   string   `json:"max_version,omitempty"`
+	CipherSuites []string `json:"cipher_suites,omitempty"`
+	Curves       []string `json:"curves,omitempty"`
+
+	CRLFiles         []string `json:"crl_files,omitempty"`
+	OCSPResponseFile string   `json:"ocsp_response_file,omitempty"`
+
+	ReloadInterval int `json:"reload_interval,omitempty"`
+}
+
+// TLSCertificateConfig is an additional certificate and key pair, served to
+// the clients asking for one of its names through SNI.
+type TLSCertificateConfig struct {
+	CertFile string `json:"certfile,omitempty"`
+	KeyFile  string `json:"keyfile,omitempty"`
+}
+
+func (c TLSConfig) Validate() error {
+	if c.CertFile == "" {
+		return bosherr.Error("Must provide a non-empty CertFile")
+	}
+
+	if c.KeyFile == "" {
+		return bosherr.Error("Must provide a non-empty KeyFile")
+	}
+
+	for _, certificate := range c.Certificates {
+		if certificate.CertFile == "" || certificate.KeyFile == "" {
+			return bosherr.Error("Must provide a non-empty CertFile and KeyFile for every certificate")
+		}
+	}
+
+	if _, found := tlsClientAuthTypes[c.ClientAuthMode()]; !found {
+		return bosherr.Errorf("Must provide a valid ClientAuth ('%s', '%s', '%s' or '%s'), got '%s'", TLSClientAuthNone, TLSClientAuthRequest, TLSClientAuthVerifyIfGiven, TLSClientAuthRequire, c.ClientAuth)
+	}
+
+	// Without ClientAuth, the CACertFile is optional as it used to be, so no
+	// client certificate can be verified when it is not provided.
+	if c.ClientAuth != "" && c.verifiesClientCertsMode() && c.CACertFile == "" {
+		return bosherr.Errorf("Must provide a non-empty CACertFile with ClientAuth '%s'", c.ClientAuthMode())
+	}
+
+	if len(c.CRLFiles) > 0 && !c.VerifiesClientCerts() {
+		return bosherr.Errorf("Must use the '%s' or '%s' ClientAuth and a non-empty CACertFile with CRLFiles", TLSClientAuthVerifyIfGiven, TLSClientAuthRequire)
+	}
+
+	for _, crlFile := range c.CRLFiles {
+		if crlFile == "" {
+			return bosherr.Error("Must provide non-empty CRLFiles")
+		}
+	}
+
+	minVersion, maxVersion, err := c.versions()
+	if err != nil {
+		return err
+	}
+
+	if maxVersion != 0 && minVersion > maxVersion {
+		return bosherr.Errorf("Must provide a MinVersion not greater than MaxVersion, got '%s' and '%s'", c.MinVersion, c.MaxVersion)
+	}
+
+	if len(c.CipherSuites) > 0 && minVersion == tls.VersionTLS13 {
+		return bosherr.Error("Must not provide CipherSuites with MinVersion '1.3', as TLS 1.3 cipher suites are not configurable")
+	}
+
+	if _, err := c.cipherSuites(); err != nil {
+		return err
+	}
+
+	if _, err := c.curves(); err != nil {
+		return err
+	}
+
+	if c.ReloadInterval < 0 {
+		return bosherr.Error("Must provide a non-negative ReloadInterval")
+	}
+
+	return nil
+}
+
+// ReloadPeriod returns how often the certificate files are checked for
+// changes.
+func (c TLSConfig) ReloadPeriod() time.Duration {
+	if c.ReloadInterval == 0 {
+		return defaultTLSReloadInterval * time.Second
+	}
+
+	return time.Duration(c.ReloadInterval) * time.Second
+}
+
+// ClientAuthMode returns the client authentication mode, which requires a
+// verified client certificate by default.
+func (c TLSConfig) ClientAuthMode() string {
+	if c.ClientAuth == "" {
+		return TLSClientAuthRequire
+	}
+
+	return c.ClientAuth
+}
+
+// VerifiesClientCerts returns if client certificates are verified against a
+// CA certificate, so they can authenticate requests.
+func (c TLSConfig) VerifiesClientCerts() bool {
+	return c.verifiesClientCertsMode() && c.CACertFile != ""
+}
+
+func (c TLSConfig) verifiesClientCertsMode() bool {
+	return c.ClientAuthMode() == TLSClientAuthVerifyIfGiven || c.ClientAuthMode() == TLSClientAuthRequire
+}
+
+// ServerConfig loads the certificates, the CRLs and the OCSP response and
+// returns the server TLS configuration.
+func (c TLSConfig) ServerConfig(logger boshlog.Logger) (*tls.Config, error) {
+	tlsConfig, _, err := c.serverConfig(logger)
+	return tlsConfig, err
+}
+
+// serverConfig also returns when the first of the CRLs and the OCSP response
+// still valid expires.
+func (c TLSConfig) serverConfig(logger boshlog.Logger) (*tls.Config, time.Time, error) {
+	var certificates []tls.Certificate
+	for _, certificate := range append([]TLSCertificateConfig{{CertFile: c.CertFile, KeyFile: c.KeyFile}}, c.Certificates...) {
+		keyPair, err := tls.LoadX509KeyPair(certificate.CertFile, certificate.KeyFile)
+		if err != nil {
+			return nil, time.Time{}, bosherr.WrapErrorf(err, "Loading X509 Key Pair '%s'", certificate.CertFile)
+		}
+		certificates = append(certificates, keyPair)
+	}
+
+	var ocspNextUpdate time.Time
+	if c.OCSPResponseFile != "" {
+		ocspStaple, nextUpdate, err := loadOCSPStaple(c.OCSPResponseFile, certificates[0], logger)
+		if err != nil {
+			return nil, time.Time{}, bosherr.WrapError(err, "Loading OCSP response")
+		}
+		certificates[0].OCSPStaple = ocspStaple
+		ocspNextUpdate = nextUpdate
+	}
+
+	crls, err := loadCRLs(c.CRLFiles, logger)
+	if err != nil {
+		return nil, time.Time{}, bosherr.WrapError(err, "Loading CRLs")
+	}
+
+	certPool := x509.NewCertPool()
+	if c.CACertFile != "" {
+		caCert, err := ioutil.ReadFile(c.CACertFile)
+		if err != nil {
+			return nil, time.Time{}, bosherr.WrapError(err, "Loading CA certificate")
+		}
+
+		if !certPool.AppendCertsFromPEM(caCert) {
+			return nil, time.Time{}, bosherr.Error("Invalid CA Certificate")
+		}
+	}
+
+	minVersion, maxVersion, err := c.versions()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	cipherSuites, err := c.cipherSuites()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	curves, err := c.curves()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates:           certificates,
+		ClientAuth:             tlsClientAuthTypes[c.ClientAuthMode()],
+		ClientCAs:              certPool,
+		MinVersion:             minVersion,
+		MaxVersion:             maxVersion,
+		CipherSuites:           cipherSuites,
+		CurvePreferences:       curves,
+		SessionTicketsDisabled: true,
+	}
+
+	if len(crls) > 0 {
+		tlsConfig.VerifyPeerCertificate = newCRLVerifier(crls)
+	}
+
+	return tlsConfig, nextRevocationExpiry(crls, ocspNextUpdate), nil
+}
+
+// ClientConfig returns the TLS configuration to connect to the registries
+// sharing the certificates of this one, as the nodes of a cluster do. The CA
+// certificate, when provided, verifies their certificates, and the server
+// certificate, loaded on every handshake to follow rotations, is presented
+// as client certificate.
+func (c TLSConfig) ClientConfig() (*tls.Config, error) {
+	var rootCAs *x509.CertPool
+	if c.CACertFile != "" {
+		caCert, err := ioutil.ReadFile(c.CACertFile)
+		if err != nil {
+			return nil, bosherr.WrapError(err, "Loading CA certificate")
+		}
+
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(caCert) {
+			return nil, bosherr.Error("Invalid CA Certificate")
+		}
+	}
+
+	minVersion, maxVersion, err := c.versions()
+	if err != nil {
+		return nil, err
+	}
+
+	certFile, keyFile := c.CertFile, c.KeyFile
+	return &tls.Config{
+		RootCAs:    rootCAs,
+		MinVersion: minVersion,
+		MaxVersion: maxVersion,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			keyPair, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, bosherr.WrapErrorf(err, "Loading X509 Key Pair '%s'", certFile)
+			}
+
+			return &keyPair, nil
+		},
+	}, nil
+}
+
+// versions returns the minimum (TLS 1.2 by default) and maximum (0, the
+// highest supported, by default) TLS versions.
+func (c TLSConfig) versions() (uint16, uint16, error) {
+	minVersion := uint16(tls.VersionTLS12)
+	if c.MinVersion != "" {
+		version, found := tlsVersions[c.MinVersion]
+		if !found {
+			return 0, 0, bosherr.Errorf("Must provide a valid MinVersion (%s), got '%s'", strings.Join(tlsVersionNames(), ", "), c.MinVersion)
+		}
+		minVersion = version
+	}
+
+	var maxVersion uint16
+	if c.MaxVersion != "" {
+		version, found := tlsVersions[c.MaxVersion]
+		if !found {
+			return 0, 0, bosherr.Errorf("Must provide a valid MaxVersion (%s), got '%s'", strings.Join(tlsVersionNames(), ", "), c.MaxVersion)
+		}
+		maxVersion = version
+	}
+
+	return minVersion, maxVersion, nil
+}
+
+// cipherSuites returns the cipher suites with the given names (as in
+// tls.CipherSuiteName), or nil to use the Go defaults. The suites with known
+// security issues, as listed by tls.InsecureCipherSuites, are refused.
+func (c TLSConfig) cipherSuites() ([]uint16, error) {
+	if len(c.CipherSuites) == 0 {
+		return nil, nil
+	}
+
+	suiteIDs := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		suiteIDs[suite.Name] = suite.ID
+	}
+
+	insecureSuites := map[string]struct{}{}
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecureSuites[suite.Name] = struct{}{}
+	}
+
+	var cipherSuites []uint16
+	for _, name := range c.CipherSuites {
+		if _, found := insecureSuites[name]; found {
+			return nil, bosherr.Errorf("Must not provide insecure CipherSuites, got '%s'", name)
+		}
+
+		id, found := suiteIDs[name]
+		if !found {
+			return nil, bosherr.Errorf("Must provide valid CipherSuites, got '%s'", name)
+		}
+		cipherSuites = append(cipherSuites, id)
+	}
+
+	return cipherSuites, nil
+}
+
+func (c TLSConfig) curves() ([]tls.CurveID, error) {
+	var curves []tls.CurveID
+	for _, name := range c.Curves {
+		curve, found := tlsCurves[name]
+		if !found {
+			return nil, bosherr.Errorf("Must provide valid Curves ('X25519', 'P256', 'P384' or 'P521'), got '%s'", name)
+		}
+		curves = append(curves, curve)
+	}
+
+	return curves, nil
+}
+
+func tlsVersionNames() []string {
+	var names []string
+	for name := range tlsVersions {
+		names = append(names, "'"+name+"'")
+	}
+	sort.Strings(names)
+
+	return names
+}
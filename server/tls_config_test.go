@@ -0,0 +1,256 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCertificate(commonName string, dnsNames []string, issuer *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	serialNumber, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	Expect(err).ToNot(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	parent, parentKey := template, key
+	if issuer == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		parent, parentKey = issuer.cert, issuer.key
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	Expect(err).ToNot(HaveOccurred())
+
+	cert, err := x509.ParseCertificate(certDER)
+	Expect(err).ToNot(HaveOccurred())
+
+	return &testCertificate{cert: cert, key: key}
+}
+
+func (c *testCertificate) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+}
+
+func (c *testCertificate) keyPEM() []byte {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	Expect(err).ToNot(HaveOccurred())
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	tlsCert, err := tls.X509KeyPair(c.certPEM(), c.keyPEM())
+	Expect(err).ToNot(HaveOccurred())
+	return tlsCert
+}
+
+// writeFiles writes the certificate and key to dir, returning their paths.
+func (c *testCertificate) writeFiles(dir string, name string) (string, string) {
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	Expect(ioutil.WriteFile(certFile, c.certPEM(), 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(keyFile, c.keyPEM(), 0600)).To(Succeed())
+	return certFile, keyFile
+}
+
+// tlsHandshake runs a handshake between a client and a server with the given
+// configurations, returning the connection state seen by the client. It uses
+// a TCP connection, as both sides can write at once when the handshake fails.
+func tlsHandshake(serverConfig *tls.Config, clientConfig *tls.Config) (tls.ConnectionState, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+	defer listener.Close()
+
+	go func() {
+		serverConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer serverConn.Close()
+		tls.Server(serverConn, serverConfig).Handshake()
+	}()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	Expect(err).ToNot(HaveOccurred())
+	defer clientConn.Close()
+
+	client := tls.Client(clientConn, clientConfig)
+	if err := client.Handshake(); err != nil {
+		return tls.ConnectionState{}, err
+	}
+
+	// Under TLS 1.3 the server verifies the client certificate after the
+	// client completes the handshake, so read to get its verdict.
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		return tls.ConnectionState{}, err
+	}
+
+	return client.ConnectionState(), nil
+}
+
+var _ = Describe("TLSConfig", func() {
+	var (
+		err         error
+		tempDir     string
+		ca          *testCertificate
+		clientCert  *testCertificate
+		config      TLSConfig
+		rootCAs     *x509.CertPool
+		clientCerts []tls.Certificate
+
+		logger = boshlog.NewLogger(boshlog.LevelNone)
+	)
+
+	BeforeEach(func() {
+		tempDir, err = ioutil.TempDir("", "tls-config")
+		Expect(err).ToNot(HaveOccurred())
+
+		ca = newTestCertificate("fake-ca", nil, nil)
+		caFile, _ := ca.writeFiles(tempDir, "ca")
+		certFile, keyFile := newTestCertificate("fake-registry", []string{"registry.fake-domain"}, ca).writeFiles(tempDir, "registry")
+		otherCertFile, otherKeyFile := newTestCertificate("fake-other-registry", []string{"other.fake-domain"}, ca).writeFiles(tempDir, "other")
+		clientCert = newTestCertificate("fake-client", nil, ca)
+
+		rootCAs = x509.NewCertPool()
+		rootCAs.AddCert(ca.cert)
+		clientCerts = []tls.Certificate{clientCert.tlsCertificate()}
+
+		config = TLSConfig{
+			CertFile:     certFile,
+			KeyFile:      keyFile,
+			CACertFile:   caFile,
+			Certificates: []TLSCertificateConfig{{CertFile: otherCertFile, KeyFile: otherKeyFile}},
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	Describe("ClientConfig", func() {
+		It("verifies the server with the CA certificate and presents the certificate", func() {
+			serverConfig, err := config.ServerConfig(logger)
+			Expect(err).ToNot(HaveOccurred())
+
+			clientConfig, err := config.ClientConfig()
+			Expect(err).ToNot(HaveOccurred())
+			clientConfig.ServerName = "registry.fake-domain"
+
+			state, err := tlsHandshake(serverConfig, clientConfig)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(state.PeerCertificates[0].Subject.CommonName).To(Equal("fake-registry"))
+		})
+
+		It("returns error if the CA certificate is not valid", func() {
+			Expect(ioutil.WriteFile(config.CACertFile, []byte("fake-ca-cert"), 0600)).To(Succeed())
+
+			_, err := config.ClientConfig()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Invalid CA Certificate"))
+		})
+	})
+
+	Describe("ServerConfig", func() {
+		It("requires a verified client certificate by default", func() {
+			serverConfig, err := config.ServerConfig(logger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(serverConfig.ClientAuth).To(Equal(tls.RequireAndVerifyClientCert))
+			Expect(serverConfig.MinVersion).To(Equal(uint16(tls.VersionTLS12)))
+
+			_, err = tlsHandshake(serverConfig, &tls.Config{ServerName: "registry.fake-domain", RootCAs: rootCAs})
+			Expect(err).To(HaveOccurred())
+
+			_, err = tlsHandshake(serverConfig, &tls.Config{ServerName: "registry.fake-domain", RootCAs: rootCAs, Certificates: clientCerts})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("does not require client certificates with ClientAuth 'verify_if_given'", func() {
+			config.ClientAuth = TLSClientAuthVerifyIfGiven
+			serverConfig, err := config.ServerConfig(logger)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = tlsHandshake(serverConfig, &tls.Config{ServerName: "registry.fake-domain", RootCAs: rootCAs})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("selects the certificate by SNI", func() {
+			serverConfig, err := config.ServerConfig(logger)
+			Expect(err).ToNot(HaveOccurred())
+
+			state, err := tlsHandshake(serverConfig, &tls.Config{ServerName: "other.fake-domain", RootCAs: rootCAs, Certificates: clientCerts})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(state.PeerCertificates[0].Subject.CommonName).To(Equal("fake-other-registry"))
+
+			state, err = tlsHandshake(serverConfig, &tls.Config{ServerName: "registry.fake-domain", RootCAs: rootCAs, Certificates: clientCerts})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(state.PeerCertificates[0].Subject.CommonName).To(Equal("fake-registry"))
+		})
+
+		It("sets the versions, cipher suites and curves", func() {
+			config.MaxVersion = "1.2"
+			config.CipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}
+			config.Curves = []string{"P384"}
+			serverConfig, err := config.ServerConfig(logger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(serverConfig.MaxVersion).To(Equal(uint16(tls.VersionTLS12)))
+			Expect(serverConfig.CipherSuites).To(Equal([]uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}))
+			Expect(serverConfig.CurvePreferences).To(Equal([]tls.CurveID{tls.CurveP384}))
+
+			state, err := tlsHandshake(serverConfig, &tls.Config{ServerName: "registry.fake-domain", RootCAs: rootCAs, Certificates: clientCerts})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(state.Version).To(Equal(uint16(tls.VersionTLS12)))
+			Expect(state.CipherSuite).To(Equal(tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384))
+		})
+
+		It("returns error if a certificate cannot be loaded", func() {
+			config.Certificates[0].KeyFile = filepath.Join(tempDir, "fake-key")
+
+			_, err = config.ServerConfig(logger)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Loading X509 Key Pair"))
+		})
+
+		It("returns error if the CA certificate is not valid", func() {
+			Expect(ioutil.WriteFile(config.CACertFile, []byte("fake-ca-certificate"), 0600)).To(Succeed())
+
+			_, err = config.ServerConfig(logger)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Invalid CA Certificate"))
+		})
+	})
+})
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+const tlsReloaderLogTag = "RegistryServerTLSReloader"
+
+// TLSReloader serves the certificates, client CA certificates, CRLs and OCSP
+// response of a TLSConfig, reloading them when their files change, when a CRL
+// or the OCSP response expires, or when asked to. A failed reload keeps the
+// previous ones.
+type TLSReloader struct {
+	logger boshlog.Logger
+
+	mutex        sync.RWMutex
+	config       TLSConfig
+	current      *tls.Config
+	certificates []tls.Certificate
+	fingerprint  string
+	expiry       time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewTLSReloader(config TLSConfig, logger boshlog.Logger) (*TLSReloader, error) {
+	r := &TLSReloader{
+		logger: logger,
+	}
+
+	if err := r.load(config); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// ServerConfig returns the TLS configuration to serve, which picks the
+// current certificates and client CA certificates on every handshake.
+func (r *TLSReloader) ServerConfig() *tls.Config {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.current
+}
+
+// Reload loads the certificates and client CA certificates again.
+func (r *TLSReloader) Reload() error {
+	r.mutex.RLock()
+	config := r.config
+	r.mutex.RUnlock()
+
+	return r.load(config)
+}
+
+// Update loads the certificates and client CA certificates of a new
+// configuration, keeping the previous configuration if they cannot be loaded.
+func (r *TLSReloader) Update(config TLSConfig) error {
+	return r.load(config)
+}
+
+func (r *TLSReloader) load(config TLSConfig) error {
+	fingerprint := filesFingerprint(config)
+
+	loaded, expiry, err := config.serverConfig(r.logger)
+	if err != nil {
+		return bosherr.WrapError(err, "Reloading TLS configuration")
+	}
+
+	current := loaded.Clone()
+	current.Certificates = nil
+	current.GetCertificate = r.getCertificate
+	current.GetConfigForClient = r.getConfigForClient
+
+	r.mutex.Lock()
+	r.config = config
+	r.current = current
+	r.certificates = loaded.Certificates
+	r.fingerprint = fingerprint
+	r.expiry = expiry
+	r.mutex.Unlock()
+
+	r.logger.Debug(tlsReloaderLogTag, "Loaded TLS certificates")
+	return nil
+}
+
+// Start reloads the certificates and client CA certificates whenever their
+// files change or a CRL or the OCSP response expires, checking them every
+// interval. Expired OCSP responses are no longer stapled and expired CRLs are
+// reported.
+func (r *TLSReloader) Start(interval time.Duration) {
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+
+	go func() {
+		defer close(r.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				r.reloadIfChanged()
+
+				r.mutex.RLock()
+				period := r.config.ReloadPeriod()
+				r.mutex.RUnlock()
+				if period != interval {
+					interval = period
+					ticker.Reset(interval)
+				}
+			}
+		}
+	}()
+}
+
+func (r *TLSReloader) Stop() {
+	if r.stop == nil {
+		return
+	}
+
+	close(r.stop)
+	<-r.done
+	r.stop = nil
+}
+
+func (r *TLSReloader) reloadIfChanged() {
+	r.mutex.RLock()
+	changed := filesFingerprint(r.config) != r.fingerprint
+	expired := !r.expiry.IsZero() && time.Now().After(r.expiry)
+	r.mutex.RUnlock()
+
+	switch {
+	case changed:
+		r.logger.Info(tlsReloaderLogTag, "TLS certificate files changed, reloading them")
+	case expired:
+		r.logger.Info(tlsReloaderLogTag, "TLS CRL or OCSP response expired, reloading them")
+	default:
+		return
+	}
+
+	if err := r.Reload(); err != nil {
+		r.logger.Error(tlsReloaderLogTag, "Keeping the previous TLS certificates: %s", err.Error())
+	}
+}
+
+func (r *TLSReloader) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	return r.ServerConfig(), nil
+}
+
+// getCertificate returns the first certificate supported by the client, as
+// selected by its SNI and signature schemes, or the first certificate.
+func (r *TLSReloader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for i := range r.certificates {
+		if hello.SupportsCertificate(&r.certificates[i]) == nil {
+			return &r.certificates[i], nil
+		}
+	}
+
+	return &r.certificates[0], nil
+}
+
+// filesFingerprint identifies the contents of the certificate files by their
+// sizes and modification times.
+func filesFingerprint(config TLSConfig) string {
+	files := []string{config.CertFile, config.KeyFile, config.CACertFile, config.OCSPResponseFile}
+	for _, certificate := range config.Certificates {
+		files = append(files, certificate.CertFile, certificate.KeyFile)
+	}
+	files = append(files, config.CRLFiles...)
+
+	var fingerprint string
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+
+		info, err := os.Stat(file)
+		if err != nil {
+			fingerprint += fmt.Sprintf("%s:missing;", file)
+			continue
+		}
+		fingerprint += fmt.Sprintf("%s:%d:%d;", file, info.Size(), info.ModTime().UnixNano())
+	}
+
+	return fingerprint
+}
@@ -0,0 +1,186 @@
+package server_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+	"golang.org/x/crypto/ocsp"
+)
+
+var _ = Describe("TLSReloader", func() {
+	var (
+		err         error
+		tempDir     string
+		ca          *testCertificate
+		config      TLSConfig
+		tlsReloader *TLSReloader
+		logBuffer   *bytes.Buffer
+		logger      boshlog.Logger
+	)
+
+	clientConfig := func(ca *testCertificate, clientCert *testCertificate) *tls.Config {
+		rootCAs := x509.NewCertPool()
+		rootCAs.AddCert(ca.cert)
+
+		return &tls.Config{
+			ServerName:   "registry.fake-domain",
+			RootCAs:      rootCAs,
+			Certificates: []tls.Certificate{clientCert.tlsCertificate()},
+		}
+	}
+
+	serverCommonName := func() string {
+		state, err := tlsHandshake(tlsReloader.ServerConfig(), clientConfig(ca, newTestCertificate("fake-client", nil, ca)))
+		Expect(err).ToNot(HaveOccurred())
+		return state.PeerCertificates[0].Subject.CommonName
+	}
+
+	BeforeEach(func() {
+		tempDir, err = ioutil.TempDir("", "tls-reloader")
+		Expect(err).ToNot(HaveOccurred())
+
+		ca = newTestCertificate("fake-ca", nil, nil)
+		caFile, _ := ca.writeFiles(tempDir, "ca")
+		certFile, keyFile := newTestCertificate("fake-registry", []string{"registry.fake-domain"}, ca).writeFiles(tempDir, "registry")
+
+		config = TLSConfig{CertFile: certFile, KeyFile: keyFile, CACertFile: caFile}
+
+		logBuffer = &bytes.Buffer{}
+		logger = boshlog.NewWriterLogger(boshlog.LevelDebug, logBuffer, logBuffer)
+	})
+
+	JustBeforeEach(func() {
+		tlsReloader, err = NewTLSReloader(config, logger)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		tlsReloader.Stop()
+		os.RemoveAll(tempDir)
+	})
+
+	It("returns error if the certificates cannot be loaded", func() {
+		config.KeyFile = config.CertFile
+
+		_, err = NewTLSReloader(config, logger)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Reloading TLS configuration"))
+	})
+
+	It("serves the reloaded certificate", func() {
+		Expect(serverCommonName()).To(Equal("fake-registry"))
+
+		newTestCertificate("fake-new-registry", []string{"registry.fake-domain"}, ca).writeFiles(tempDir, "registry")
+		Expect(serverCommonName()).To(Equal("fake-registry"))
+
+		Expect(tlsReloader.Reload()).To(Succeed())
+		Expect(serverCommonName()).To(Equal("fake-new-registry"))
+	})
+
+	It("verifies client certificates with the reloaded CA certificate", func() {
+		newCA := newTestCertificate("fake-new-ca", nil, nil)
+		newClientConfig := clientConfig(ca, newTestCertificate("fake-client", nil, newCA))
+
+		_, err = tlsHandshake(tlsReloader.ServerConfig(), newClientConfig)
+		Expect(err).To(HaveOccurred())
+
+		Expect(ioutil.WriteFile(config.CACertFile, append(ca.certPEM(), newCA.certPEM()...), 0600)).To(Succeed())
+		Expect(tlsReloader.Reload()).To(Succeed())
+
+		_, err = tlsHandshake(tlsReloader.ServerConfig(), newClientConfig)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("keeps the previous certificates if they cannot be reloaded", func() {
+		Expect(ioutil.WriteFile(config.KeyFile, []byte("fake-key"), 0600)).To(Succeed())
+
+		err = tlsReloader.Reload()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Reloading TLS configuration"))
+		Expect(serverCommonName()).To(Equal("fake-registry"))
+	})
+
+	It("switches to the certificates of an updated configuration", func() {
+		certFile, keyFile := newTestCertificate("fake-other-registry", []string{"registry.fake-domain"}, ca).writeFiles(tempDir, "other-registry")
+		newConfig := config
+		newConfig.CertFile, newConfig.KeyFile = certFile, keyFile
+
+		Expect(tlsReloader.Update(newConfig)).To(Succeed())
+		Expect(serverCommonName()).To(Equal("fake-other-registry"))
+	})
+
+	It("keeps the previous configuration if the updated one cannot be loaded", func() {
+		newConfig := config
+		newConfig.KeyFile = config.CertFile
+
+		Expect(tlsReloader.Update(newConfig)).ToNot(Succeed())
+		Expect(tlsReloader.Reload()).To(Succeed())
+		Expect(serverCommonName()).To(Equal("fake-registry"))
+	})
+
+	It("reloads the certificates when their files change", func() {
+		tlsReloader.Start(10 * time.Millisecond)
+
+		newTestCertificate("fake-new-registry", []string{"registry.fake-domain"}, ca).writeFiles(tempDir, "registry")
+		future := time.Now().Add(time.Minute)
+		Expect(os.Chtimes(config.CertFile, future, future)).To(Succeed())
+
+		Eventually(serverCommonName).Should(Equal("fake-new-registry"))
+	})
+
+	Context("with an OCSP response and a CRL about to expire", func() {
+		BeforeEach(func() {
+			registryCert := newTestCertificate("fake-registry", []string{"registry.fake-domain"}, ca)
+			config.CertFile, config.KeyFile = registryCert.writeFiles(tempDir, "registry")
+			nextUpdate := time.Now().Add(2 * time.Second)
+
+			response, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+				Status:       ocsp.Good,
+				SerialNumber: registryCert.cert.SerialNumber,
+				ThisUpdate:   time.Now().Add(-time.Minute),
+				NextUpdate:   nextUpdate,
+			}, ca.key)
+			Expect(err).ToNot(HaveOccurred())
+			config.OCSPResponseFile = filepath.Join(tempDir, "registry.ocsp")
+			Expect(ioutil.WriteFile(config.OCSPResponseFile, response, 0600)).To(Succeed())
+
+			crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{Number: big.NewInt(1), ThisUpdate: time.Now().Add(-time.Hour), NextUpdate: nextUpdate}, ca.cert, ca.key)
+			Expect(err).ToNot(HaveOccurred())
+			config.CRLFiles = []string{filepath.Join(tempDir, "ca.crl")}
+			Expect(ioutil.WriteFile(config.CRLFiles[0], pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER}), 0600)).To(Succeed())
+
+			config.ReloadInterval = 1
+		})
+
+		It("stops stapling the OCSP response and reports the CRL once they expire, even if their files do not change", func() {
+			ocspResponse := func() []byte {
+				state, err := tlsHandshake(tlsReloader.ServerConfig(), clientConfig(ca, newTestCertificate("fake-client", nil, ca)))
+				Expect(err).ToNot(HaveOccurred())
+				return state.OCSPResponse
+			}
+
+			Expect(ocspResponse()).ToNot(BeEmpty())
+
+			tlsReloader.Start(config.ReloadPeriod())
+			Eventually(ocspResponse, 5*time.Second).Should(BeEmpty())
+
+			tlsReloader.Stop()
+			Expect(logBuffer.String()).To(ContainSubstring("Not stapling OCSP response file '" + config.OCSPResponseFile + "': expired at"))
+			Expect(logBuffer.String()).To(ContainSubstring("CRL file '" + config.CRLFiles[0] + "' of issuer 'fake-ca' expired at"))
+		})
+	})
+})
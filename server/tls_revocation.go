@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+	"golang.org/x/crypto/ocsp"
+)
+
+const tlsRevocationLogTag = "RegistryServerTLSRevocation"
+
+// loadCRLs parses the PEM (possibly with several CRLs) or DER encoded CRL
+// files. Expired CRLs are still used, as their revoked certificates remain
+// revoked, but are reported.
+func loadCRLs(crlFiles []string, logger boshlog.Logger) ([]*x509.RevocationList, error) {
+	var crls []*x509.RevocationList
+	for _, crlFile := range crlFiles {
+		crlBytes, err := ioutil.ReadFile(crlFile)
+		if err != nil {
+			return nil, bosherr.WrapErrorf(err, "Reading CRL file '%s'", crlFile)
+		}
+
+		ders := [][]byte{crlBytes}
+		if bytes.Contains(crlBytes, []byte("-----BEGIN")) {
+			ders = nil
+			for block, rest := pem.Decode(crlBytes); block != nil; block, rest = pem.Decode(rest) {
+				if block.Type == "X509 CRL" {
+					ders = append(ders, block.Bytes)
+				}
+			}
+
+			if len(ders) == 0 {
+				return nil, bosherr.Errorf("No CRL found in CRL file '%s'", crlFile)
+			}
+		}
+
+		for _, der := range ders {
+			crl, err := x509.ParseRevocationList(der)
+			if err != nil {
+				return nil, bosherr.WrapErrorf(err, "Parsing CRL file '%s'", crlFile)
+			}
+
+			if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+				logger.Warn(tlsRevocationLogTag, "CRL file '%s' of issuer '%s' expired at %s", crlFile, crl.Issuer.CommonName, crl.NextUpdate.UTC().Format(time.RFC3339))
+			}
+			crls = append(crls, crl)
+		}
+	}
+
+	return crls, nil
+}
+
+// newCRLVerifier returns a tls.Config VerifyPeerCertificate hook refusing
+// the verified chains with a certificate revoked by a CRL of its issuer.
+func newCRLVerifier(crls []*x509.RevocationList) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			for i := 0; i < len(chain)-1; i++ {
+				if err := checkRevocation(crls, chain[i], chain[i+1]); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+}
+
+func checkRevocation(crls []*x509.RevocationList, cert *x509.Certificate, issuer *x509.Certificate) error {
+	for _, crl := range crls {
+		if !bytes.Equal(crl.RawIssuer, cert.RawIssuer) || crl.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+
+		for _, revoked := range crl.RevokedCertificateEntries {
+			if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return bosherr.Errorf("Certificate '%s' with serial number '%s' has been revoked", cert.Subject.CommonName, cert.SerialNumber)
+			}
+		}
+	}
+
+	return nil
+}
+
+// loadOCSPStaple reads a DER encoded OCSP response for the certificate,
+// returning it with its next update. Its signature is checked when the
+// certificate file contains the issuer certificate. A response that is not
+// good or has expired is not stapled.
+func loadOCSPStaple(ocspResponseFile string, certificate tls.Certificate, logger boshlog.Logger) ([]byte, time.Time, error) {
+	ocspStaple, err := ioutil.ReadFile(ocspResponseFile)
+	if err != nil {
+		return nil, time.Time{}, bosherr.WrapErrorf(err, "Reading OCSP response file '%s'", ocspResponseFile)
+	}
+
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil, time.Time{}, bosherr.WrapError(err, "Parsing certificate")
+	}
+
+	var issuer *x509.Certificate
+	if len(certificate.Certificate) > 1 {
+		if issuer, err = x509.ParseCertificate(certificate.Certificate[1]); err != nil {
+			return nil, time.Time{}, bosherr.WrapError(err, "Parsing issuer certificate")
+		}
+	}
+
+	response, err := ocsp.ParseResponseForCert(ocspStaple, leaf, issuer)
+	if err != nil {
+		return nil, time.Time{}, bosherr.WrapErrorf(err, "Parsing OCSP response file '%s'", ocspResponseFile)
+	}
+
+	if response.Status != ocsp.Good {
+		logger.Warn(tlsRevocationLogTag, "Not stapling OCSP response file '%s': status is not good for certificate '%s'", ocspResponseFile, leaf.Subject.CommonName)
+		return nil, time.Time{}, nil
+	}
+
+	if !response.NextUpdate.IsZero() && time.Now().After(response.NextUpdate) {
+		logger.Warn(tlsRevocationLogTag, "Not stapling OCSP response file '%s': expired at %s", ocspResponseFile, response.NextUpdate.UTC().Format(time.RFC3339))
+		return nil, time.Time{}, nil
+	}
+
+	return ocspStaple, response.NextUpdate, nil
+}
+
+// nextRevocationExpiry returns the earliest of the next updates of the CRLs
+// and of the stapled OCSP response that have not passed yet, or the zero
+// time if none is left, so that they can be checked again once it passes.
+func nextRevocationExpiry(crls []*x509.RevocationList, ocspNextUpdate time.Time) time.Time {
+	nextUpdates := []time.Time{ocspNextUpdate}
+	for _, crl := range crls {
+		nextUpdates = append(nextUpdates, crl.NextUpdate)
+	}
+
+	var expiry time.Time
+	now := time.Now()
+	for _, nextUpdate := range nextUpdates {
+		if nextUpdate.After(now) && (expiry.IsZero() || nextUpdate.Before(expiry)) {
+			expiry = nextUpdate
+		}
+	}
+
+	return expiry
+}
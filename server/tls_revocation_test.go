@@ -0,0 +1,192 @@
+package server_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+	"golang.org/x/crypto/ocsp"
+)
+
+var _ = Describe("TLS revocation", func() {
+	var (
+		err         error
+		tempDir     string
+		ca          *testCertificate
+		config      TLSConfig
+		rootCAs     *x509.CertPool
+		clientCerts []tls.Certificate
+		logBuffer   *bytes.Buffer
+		logger      boshlog.Logger
+	)
+
+	BeforeEach(func() {
+		tempDir, err = ioutil.TempDir("", "tls-revocation")
+		Expect(err).ToNot(HaveOccurred())
+
+		ca = newTestCertificate("fake-ca", nil, nil)
+		caFile, _ := ca.writeFiles(tempDir, "ca")
+		certFile, keyFile := newTestCertificate("fake-registry", []string{"registry.fake-domain"}, ca).writeFiles(tempDir, "registry")
+
+		rootCAs = x509.NewCertPool()
+		rootCAs.AddCert(ca.cert)
+		clientCerts = []tls.Certificate{newTestCertificate("fake-client", nil, ca).tlsCertificate()}
+
+		config = TLSConfig{
+			CertFile:   certFile,
+			KeyFile:    keyFile,
+			CACertFile: caFile,
+		}
+
+		logBuffer = &bytes.Buffer{}
+		logger = boshlog.NewWriterLogger(boshlog.LevelDebug, logBuffer, logBuffer)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	Context("with CRL files", func() {
+		var revokedClientCert *testCertificate
+
+		writeCRL := func(issuer *testCertificate, nextUpdate time.Time, revoked ...*testCertificate) string {
+			template := &x509.RevocationList{Number: big.NewInt(1), ThisUpdate: time.Now().Add(-2 * time.Hour), NextUpdate: nextUpdate}
+			for _, cert := range revoked {
+				template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{SerialNumber: cert.cert.SerialNumber, RevocationTime: time.Now()})
+			}
+
+			crlDER, err := x509.CreateRevocationList(rand.Reader, template, issuer.cert, issuer.key)
+			Expect(err).ToNot(HaveOccurred())
+
+			crlFile := filepath.Join(tempDir, issuer.cert.Subject.CommonName+".crl")
+			Expect(ioutil.WriteFile(crlFile, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER}), 0600)).To(Succeed())
+			return crlFile
+		}
+
+		BeforeEach(func() {
+			revokedClientCert = newTestCertificate("fake-revoked-client", nil, ca)
+			config.CRLFiles = []string{writeCRL(ca, time.Now().Add(time.Hour), revokedClientCert)}
+		})
+
+		It("refuses revoked client certificates", func() {
+			serverConfig, err := config.ServerConfig(logger)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = tlsHandshake(serverConfig, &tls.Config{ServerName: "registry.fake-domain", RootCAs: rootCAs, Certificates: clientCerts})
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = tlsHandshake(serverConfig, &tls.Config{ServerName: "registry.fake-domain", RootCAs: rootCAs, Certificates: []tls.Certificate{revokedClientCert.tlsCertificate()}})
+			Expect(err).To(HaveOccurred())
+			Expect(logBuffer.String()).ToNot(ContainSubstring("expired"))
+		})
+
+		It("ignores CRLs of other issuers", func() {
+			otherCA := newTestCertificate("fake-other-ca", nil, nil)
+			config.CRLFiles = []string{writeCRL(otherCA, time.Now().Add(time.Hour), revokedClientCert)}
+
+			serverConfig, err := config.ServerConfig(logger)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = tlsHandshake(serverConfig, &tls.Config{ServerName: "registry.fake-domain", RootCAs: rootCAs, Certificates: []tls.Certificate{revokedClientCert.tlsCertificate()}})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("keeps refusing revoked client certificates with an expired CRL, logging a warning", func() {
+			config.CRLFiles = []string{writeCRL(ca, time.Now().Add(-time.Hour), revokedClientCert)}
+
+			serverConfig, err := config.ServerConfig(logger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(logBuffer.String()).To(ContainSubstring("CRL file '" + config.CRLFiles[0] + "' of issuer 'fake-ca' expired"))
+
+			_, err = tlsHandshake(serverConfig, &tls.Config{ServerName: "registry.fake-domain", RootCAs: rootCAs, Certificates: []tls.Certificate{revokedClientCert.tlsCertificate()}})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns error if a CRL file is not valid", func() {
+			Expect(ioutil.WriteFile(config.CRLFiles[0], []byte("fake-crl"), 0600)).To(Succeed())
+
+			_, err = config.ServerConfig(logger)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Loading CRLs"))
+		})
+	})
+
+	Context("with an OCSP response file", func() {
+		var registryCert *testCertificate
+
+		writeOCSPResponse := func(status int, nextUpdate time.Time) {
+			response, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+				Status:       status,
+				SerialNumber: registryCert.cert.SerialNumber,
+				ThisUpdate:   time.Now().Add(-time.Minute),
+				NextUpdate:   nextUpdate,
+			}, ca.key)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ioutil.WriteFile(config.OCSPResponseFile, response, 0600)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			registryCert = newTestCertificate("fake-registry", []string{"registry.fake-domain"}, ca)
+			config.CertFile, config.KeyFile = registryCert.writeFiles(tempDir, "registry")
+			Expect(ioutil.WriteFile(config.CertFile, append(registryCert.certPEM(), ca.certPEM()...), 0600)).To(Succeed())
+
+			config.OCSPResponseFile = filepath.Join(tempDir, "registry.ocsp")
+			writeOCSPResponse(ocsp.Good, time.Now().Add(time.Hour))
+		})
+
+		It("staples the OCSP response", func() {
+			serverConfig, err := config.ServerConfig(logger)
+			Expect(err).ToNot(HaveOccurred())
+
+			state, err := tlsHandshake(serverConfig, &tls.Config{ServerName: "registry.fake-domain", RootCAs: rootCAs, Certificates: clientCerts})
+			Expect(err).ToNot(HaveOccurred())
+
+			response, err := ocsp.ParseResponseForCert(state.OCSPResponse, state.PeerCertificates[0], ca.cert)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(response.Status).To(Equal(ocsp.Good))
+		})
+
+		It("does not staple the OCSP response if it is not good, logging a warning", func() {
+			writeOCSPResponse(ocsp.Revoked, time.Now().Add(time.Hour))
+
+			serverConfig, err := config.ServerConfig(logger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(serverConfig.Certificates[0].OCSPStaple).To(BeEmpty())
+			Expect(logBuffer.String()).To(ContainSubstring("status is not good"))
+
+			state, err := tlsHandshake(serverConfig, &tls.Config{ServerName: "registry.fake-domain", RootCAs: rootCAs, Certificates: clientCerts})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(state.OCSPResponse).To(BeEmpty())
+		})
+
+		It("does not staple the OCSP response if it has expired, logging a warning", func() {
+			writeOCSPResponse(ocsp.Good, time.Now().Add(-time.Second))
+
+			serverConfig, err := config.ServerConfig(logger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(serverConfig.Certificates[0].OCSPStaple).To(BeEmpty())
+			Expect(logBuffer.String()).To(ContainSubstring("expired at"))
+		})
+
+		It("returns error if the OCSP response is for another certificate", func() {
+			config.CertFile, config.KeyFile = newTestCertificate("fake-other-registry", nil, ca).writeFiles(tempDir, "other-registry")
+
+			_, err = config.ServerConfig(logger)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Loading OCSP response"))
+		})
+	})
+})
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+const trustedProxiesLogTag = "RegistryServerTrustedProxies"
+
+type TrustedProxies []*net.IPNet
+
+// NewTrustedProxies parses a list of CIDRs or single IPs.
+func NewTrustedProxies(cidrs []string) (TrustedProxies, error) {
+	var trustedProxies TrustedProxies
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, bosherr.Errorf("Invalid trusted proxy '%s'", cidr)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			trustedProxies = append(trustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, bosherr.WrapErrorf(err, "Invalid trusted proxy '%s'", cidr)
+		}
+		trustedProxies = append(trustedProxies, ipNet)
+	}
+
+	return trustedProxies, nil
+}
+
+func (p TrustedProxies) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range p {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClientIP returns the IP of the client that originated the request. The
+// forwarding headers are only honored when the request comes from a trusted
+// proxy, walking the forwarded addresses from the closest hop until reaching
+// one that is not a trusted proxy.
+func (p TrustedProxies) ClientIP(req *http.Request) net.IP {
+	ip := requestIP(req)
+	if !p.Contains(ip) {
+		return ip
+	}
+
+	forwardedIPs, found := forwardedFor(req.Header)
+	if !found {
+		return ip
+	}
+
+	for i := len(forwardedIPs) - 1; i >= 0; i-- {
+		forwardedIP := net.ParseIP(forwardedIPs[i])
+		if forwardedIP == nil {
+			break
+		}
+
+		ip = forwardedIP
+		if !p.Contains(ip) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// Wrap replaces the request remote address with the client IP, so it is used
+// by the handlers, both in logs and to authorize requests.
+func (p TrustedProxies) Wrap(next http.Handler, logger boshlog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clientIP := p.ClientIP(req)
+		if clientIP != nil && !clientIP.Equal(requestIP(req)) {
+			logger.Debug(requestLogTag(trustedProxiesLogTag, req), "Resolved client IP '%s' for request from proxy '%s'", clientIP, req.RemoteAddr)
+			req.RemoteAddr = net.JoinHostPort(clientIP.String(), "0")
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// forwardedFor returns the addresses listed by the Forwarded header, or by
+// the X-Forwarded-For header when the former is not present, ordered from the
+// client to the closest proxy.
+func forwardedFor(header http.Header) ([]string, bool) {
+	if forwarded := header["Forwarded"]; len(forwarded) > 0 {
+		var addresses []string
+		for _, element := range strings.Split(strings.Join(forwarded, ","), ",") {
+			address := ""
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+					address = forwardedNodeIP(strings.Trim(pair[4:], `"`))
+				}
+			}
+			addresses = append(addresses, address)
+		}
+		return addresses, true
+	}
+
+	if xForwardedFor := header["X-Forwarded-For"]; len(xForwardedFor) > 0 {
+		var addresses []string
+		for _, address := range strings.Split(strings.Join(xForwardedFor, ","), ",") {
+			addresses = append(addresses, forwardedNodeIP(strings.TrimSpace(address)))
+		}
+		return addresses, true
+	}
+
+	return nil, false
+}
+
+// forwardedNodeIP strips the port and IPv6 brackets from a forwarded node.
+func forwardedNodeIP(node string) string {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+}
@@ -0,0 +1,97 @@
+package server_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+var _ = Describe("TrustedProxies", func() {
+	var (
+		err            error
+		request        *http.Request
+		trustedProxies TrustedProxies
+	)
+
+	BeforeEach(func() {
+		trustedProxies, err = NewTrustedProxies([]string{"10.0.0.0/24", "192.168.1.1", "2001:db8::/32"})
+		Expect(err).ToNot(HaveOccurred())
+
+		request, err = http.NewRequest("GET", "/instances/fake-instance-id/settings", nil)
+		Expect(err).ToNot(HaveOccurred())
+		request.RemoteAddr = "10.0.0.1:34567"
+	})
+
+	Describe("NewTrustedProxies", func() {
+		It("returns error if a trusted proxy is not valid", func() {
+			_, err = NewTrustedProxies([]string{"fake-proxy"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Invalid trusted proxy 'fake-proxy'"))
+		})
+
+		It("returns error if a trusted proxy CIDR is not valid", func() {
+			_, err = NewTrustedProxies([]string{"10.0.0.0/99"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Invalid trusted proxy '10.0.0.0/99'"))
+		})
+	})
+
+	Describe("Contains", func() {
+		It("checks CIDRs and single IPs", func() {
+			Expect(trustedProxies.Contains(net.ParseIP("10.0.0.200"))).To(BeTrue())
+			Expect(trustedProxies.Contains(net.ParseIP("192.168.1.1"))).To(BeTrue())
+			Expect(trustedProxies.Contains(net.ParseIP("2001:db8::1"))).To(BeTrue())
+			Expect(trustedProxies.Contains(net.ParseIP("192.168.1.2"))).To(BeFalse())
+			Expect(trustedProxies.Contains(nil)).To(BeFalse())
+		})
+	})
+
+	Describe("ClientIP", func() {
+		It("returns the remote IP if there are no forwarding headers", func() {
+			Expect(trustedProxies.ClientIP(request).String()).To(Equal("10.0.0.1"))
+		})
+
+		It("uses X-Forwarded-For if request comes from a trusted proxy", func() {
+			request.Header.Set("X-Forwarded-For", "1.2.3.4, 5.6.7.8, 192.168.1.1")
+			Expect(trustedProxies.ClientIP(request).String()).To(Equal("5.6.7.8"))
+		})
+
+		It("uses Forwarded if request comes from a trusted proxy", func() {
+			request.Header.Set("Forwarded", `for=1.2.3.4;proto=https, for="[2001:db8:cafe::17]:4711"`)
+			request.Header.Set("X-Forwarded-For", "5.6.7.8")
+			Expect(trustedProxies.ClientIP(request).String()).To(Equal("1.2.3.4"))
+		})
+
+		It("stops at an invalid forwarded address", func() {
+			request.Header.Set("X-Forwarded-For", "1.2.3.4, unknown, 192.168.1.1")
+			Expect(trustedProxies.ClientIP(request).String()).To(Equal("192.168.1.1"))
+		})
+
+		It("ignores forwarding headers if request does not come from a trusted proxy", func() {
+			request.RemoteAddr = "5.6.7.8:34567"
+			request.Header.Set("X-Forwarded-For", "1.2.3.4")
+			Expect(trustedProxies.ClientIP(request).String()).To(Equal("5.6.7.8"))
+		})
+	})
+
+	Describe("Wrap", func() {
+		It("replaces the remote address with the client IP", func() {
+			request.Header.Set("X-Forwarded-For", "1.2.3.4")
+
+			var remoteAddr string
+			handler := trustedProxies.Wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				remoteAddr = req.RemoteAddr
+			}), boshlog.NewLogger(boshlog.LevelNone))
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+
+			Expect(remoteAddr).To(Equal("1.2.3.4:0"))
+		})
+	})
+})
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"net"
+	"os"
+	osuser "os/user"
+	"strconv"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+)
+
+const defaultUnixSocketMode = 0600
+
+// UnixSocketConfig sets the Unix domain socket to listen on instead of the
+// TCP address and port. Mode is an octal string, e.g. "0660", and Group a
+// group name or ID.
+type UnixSocketConfig struct {
+	Path  string `json:"path,omitempty"`
+	Mode  string `json:"mode,omitempty"`
+	Group string `json:"group,omitempty"`
+}
+
+func (c UnixSocketConfig) Enabled() bool {
+	return c.Path != ""
+}
+
+func (c UnixSocketConfig) Validate() error {
+	if !c.Enabled() {
+		if c.Mode != "" || c.Group != "" {
+			return bosherr.Error("Must provide a non-empty Path")
+		}
+		return nil
+	}
+
+	if _, err := c.FileMode(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// FileMode returns the permissions of the socket, 0600 by default.
+func (c UnixSocketConfig) FileMode() (os.FileMode, error) {
+	if c.Mode == "" {
+		return defaultUnixSocketMode, nil
+	}
+
+	mode, err := strconv.ParseUint(c.Mode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, bosherr.Errorf("Must provide a valid octal Mode, got '%s'", c.Mode)
+	}
+
+	return os.FileMode(mode), nil
+}
+
+// listenUnix listens on the socket, replacing a stale one left by a previous
+// process, and sets its permissions. The socket is not removed when closed,
+// so it can be passed on to the process upgrading this one.
+func listenUnix(config UnixSocketConfig) (*net.UnixListener, error) {
+	if info, err := os.Lstat(config.Path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", config.Path); err == nil {
+			conn.Close()
+			return nil, bosherr.Errorf("Unix socket '%s' is in use", config.Path)
+		}
+
+		if err := os.Remove(config.Path); err != nil {
+			return nil, bosherr.WrapErrorf(err, "Removing stale Unix socket '%s'", config.Path)
+		}
+	}
+
+	unixListener, err := net.ListenUnix("unix", &net.UnixAddr{Name: config.Path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	unixListener.SetUnlinkOnClose(false)
+
+	if err := setUnixSocketPermissions(config); err != nil {
+		unixListener.Close()
+		os.Remove(config.Path)
+		return nil, err
+	}
+
+	return unixListener, nil
+}
+
+func setUnixSocketPermissions(config UnixSocketConfig) error {
+	mode, err := config.FileMode()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(config.Path, mode); err != nil {
+		return bosherr.WrapErrorf(err, "Setting Unix socket '%s' mode", config.Path)
+	}
+
+	if config.Group == "" {
+		return nil
+	}
+
+	gid, err := strconv.Atoi(config.Group)
+	if err != nil {
+		group, err := osuser.LookupGroup(config.Group)
+		if err != nil {
+			return bosherr.WrapErrorf(err, "Looking up Unix socket group '%s'", config.Group)
+		}
+
+		if gid, err = strconv.Atoi(group.Gid); err != nil {
+			return bosherr.WrapErrorf(err, "Parsing Unix socket group '%s' ID", config.Group)
+		}
+	}
+
+	if err := os.Chown(config.Path, -1, gid); err != nil {
+		return bosherr.WrapErrorf(err, "Setting Unix socket '%s' group", config.Path)
+	}
+
+	return nil
+}
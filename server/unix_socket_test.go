@@ -0,0 +1,55 @@
+package server_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+)
+
+var _ = Describe("UnixSocketConfig", func() {
+	var (
+		config UnixSocketConfig
+	)
+
+	BeforeEach(func() {
+		config = UnixSocketConfig{Path: "/fake-path/registry.sock", Mode: "0660", Group: "fake-group"}
+	})
+
+	Describe("Validate", func() {
+		It("does not return error if all fields are valid", func() {
+			err := config.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("does not return error if not enabled", func() {
+			err := UnixSocketConfig{}.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns error if Mode is set without Path", func() {
+			err := UnixSocketConfig{Mode: "0660"}.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a non-empty Path"))
+		})
+
+		It("returns error if Mode is not valid", func() {
+			config.Mode = "0999"
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a valid octal Mode, got '0999'"))
+		})
+	})
+
+	Describe("FileMode", func() {
+		It("returns the mode", func() {
+			Expect(config.FileMode()).To(BeEquivalentTo(0660))
+		})
+
+		It("defaults to 0600", func() {
+			config.Mode = ""
+			Expect(config.FileMode()).To(BeEquivalentTo(0600))
+		})
+	})
+})
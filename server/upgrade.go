@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+const upgraderLogTag = "RegistryServerUpgrader"
+
+const (
+	// upgradeListenersEnv lists the inherited listening sockets as
+	// comma-separated "address=fd" pairs.
+	upgradeListenersEnv = "BOSH_REGISTRY_UPGRADE_LISTENERS"
+
+	// upgradeReadyFDEnv is the pipe the new process writes to once serving.
+	upgradeReadyFDEnv = "BOSH_REGISTRY_UPGRADE_READY_FD"
+
+	upgradeReadyMessage = "ready"
+)
+
+// Upgrader re-executes the registry binary, passing on the listening sockets
+// of the current process, and waits for the new process to be serving.
+type Upgrader struct {
+	timeout time.Duration
+	logger  boshlog.Logger
+}
+
+func NewUpgrader(
+	timeout time.Duration,
+	logger boshlog.Logger,
+) Upgrader {
+	return Upgrader{
+		timeout: timeout,
+		logger:  logger,
+	}
+}
+
+// Upgrade starts the binary at the path the current process was started
+// from, with the same arguments, and returns once it is serving. When the new
+// process fails or is not serving before the timeout, it is killed and an
+// error is returned, so the current process keeps serving.
+func (u Upgrader) Upgrade(listener *Listener) error {
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return bosherr.WrapError(err, "Finding the registry binary")
+	}
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return bosherr.WrapError(err, "Creating upgrade ready pipe")
+	}
+	defer readyReader.Close()
+
+	files := []*os.File{readyWriter}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	listenerFiles, err := listener.Files()
+	if err != nil {
+		return bosherr.WrapError(err, "Passing on the listening sockets")
+	}
+
+	var inherited []string
+	for address, file := range listenerFiles {
+		files = append(files, file)
+		inherited = append(inherited, fmt.Sprintf("%s=%d", address, 3+len(files)-1))
+	}
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(
+		upgradeEnviron(),
+		fmt.Sprintf("%s=%d", upgradeReadyFDEnv, 3),
+		fmt.Sprintf("%s=%s", upgradeListenersEnv, strings.Join(inherited, ",")),
+	)
+
+	u.logger.Info(upgraderLogTag, "Starting new registry process '%s'", path)
+	if err := cmd.Start(); err != nil {
+		return bosherr.WrapErrorf(err, "Starting new registry process '%s'", path)
+	}
+	go cmd.Wait()
+
+	// Close our copies of the files, so reading the pipe ends when the new
+	// process exits.
+	for _, file := range files {
+		file.Close()
+	}
+	files = nil
+
+	ready := make(chan bool, 1)
+	go func() {
+		message, _ := bufio.NewReader(readyReader).ReadString('\n')
+		ready <- strings.TrimSpace(message) == upgradeReadyMessage
+	}()
+
+	select {
+	case ok := <-ready:
+		if !ok {
+			return bosherr.Errorf("New registry process %d exited before serving", cmd.Process.Pid)
+		}
+	case <-time.After(u.timeout):
+		cmd.Process.Kill()
+		return bosherr.Errorf("New registry process %d not serving after %s", cmd.Process.Pid, u.timeout)
+	}
+
+	u.logger.Info(upgraderLogTag, "New registry process %d is serving", cmd.Process.Pid)
+	return nil
+}
+
+// NotifyUpgradeReady tells the process being upgraded, if any, that this one
+// is serving, and closes the inherited sockets not taken by any listener.
+func NotifyUpgradeReady() error {
+	closeInheritedListeners()
+
+	fdString := os.Getenv(upgradeReadyFDEnv)
+	if fdString == "" {
+		return nil
+	}
+	os.Unsetenv(upgradeReadyFDEnv)
+
+	fd, err := strconv.Atoi(fdString)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Parsing %s", upgradeReadyFDEnv)
+	}
+
+	readyFile := os.NewFile(uintptr(fd), "upgrade-ready")
+	defer readyFile.Close()
+
+	if _, err := fmt.Fprintln(readyFile, upgradeReadyMessage); err != nil {
+		return bosherr.WrapError(err, "Notifying the upgraded registry process")
+	}
+
+	return nil
+}
+
+// upgradeEnviron returns the environment without the variables of a previous
+// upgrade.
+func upgradeEnviron() []string {
+	var environ []string
+	for _, variable := range os.Environ() {
+		if strings.HasPrefix(variable, upgradeListenersEnv+"=") || strings.HasPrefix(variable, upgradeReadyFDEnv+"=") {
+			continue
+		}
+		environ = append(environ, variable)
+	}
+
+	return environ
+}
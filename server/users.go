@@ -0,0 +1,238 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"sync"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The replicator role reads like the reader one, and can also read the
+// settings of every instance at once, as replicas do.
+const (
+	RoleReader     = "reader"
+	RoleReplicator = "replicator"
+	RoleWriter     = "writer"
+	RoleAdmin      = "admin"
+)
+
+var roleLevels = map[string]int{
+	RoleReader:     1,
+	RoleReplicator: 1,
+	RoleWriter:     2,
+	RoleAdmin:      3,
+}
+
+type UserConfig struct {
+	Name         string `json:"name,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+	Role         string `json:"role,omitempty"`
+}
+
+func (c UserConfig) Validate() error {
+	if c.Name == "" {
+		return bosherr.Error("Must provide a non-empty Name")
+	}
+
+	if _, err := bcrypt.Cost([]byte(c.PasswordHash)); err != nil {
+		return bosherr.WrapErrorf(err, "Must provide a valid bcrypt PasswordHash for user '%s'", c.Name)
+	}
+
+	if _, found := roleLevels[c.Role]; !found {
+		return bosherr.Errorf("Must provide a valid Role ('%s', '%s', '%s' or '%s') for user '%s', got '%s'", RoleReader, RoleReplicator, RoleWriter, RoleAdmin, c.Name, c.Role)
+	}
+
+	return nil
+}
+
+// unknownUserPasswordHash is compared with the password of unknown users, so
+// they take as long to refuse as known ones.
+const unknownUserPasswordHash = "$2a$10$LP9dlmQlY192Ncov9DQMFeFxC9YSaqpvWCSc31.ppWtAU8KpzKBPm"
+
+type user struct {
+	passwordHash []byte
+	password     []byte
+	role         string
+}
+
+// Users authenticates requests using HTTP basic authentication or, failing
+// that, the verified client certificate. The legacy Username and Password are
+// an admin user. As bcrypt is deliberately slow, the credentials that have
+// been verified are remembered (keyed by an HMAC with a random key, so the
+// passwords are not kept in memory).
+type Users struct {
+	mutex             sync.RWMutex
+	users             map[string]user
+	hasPasswordHashes bool
+	clientCerts       ClientCerts
+
+	verifiedKey   []byte
+	verifiedMutex sync.RWMutex
+	verified      map[string]struct{}
+}
+
+func NewUsers(config Config) (*Users, error) {
+	users := &Users{
+		verifiedKey: make([]byte, sha256.Size),
+		verified:    map[string]struct{}{},
+	}
+
+	if _, err := rand.Read(users.verifiedKey); err != nil {
+		return nil, bosherr.WrapError(err, "Generating verified credentials key")
+	}
+
+	if err := users.Update(config); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// Update replaces the users and client certificate rules with the ones of
+// the configuration.
+func (u *Users) Update(config Config) error {
+	users := map[string]user{}
+	hasPasswordHashes := false
+
+	if config.Username != "" {
+		users[config.Username] = user{password: []byte(config.Password), role: RoleAdmin}
+	}
+
+	clientCerts, err := NewClientCerts(config.ClientCerts)
+	if err != nil {
+		return bosherr.WrapError(err, "Validating ClientCerts")
+	}
+
+	for _, userConfig := range config.Users {
+		if err := userConfig.Validate(); err != nil {
+			return err
+		}
+
+		if _, found := users[userConfig.Name]; found {
+			return bosherr.Errorf("Duplicated user '%s'", userConfig.Name)
+		}
+
+		users[userConfig.Name] = user{passwordHash: []byte(userConfig.PasswordHash), role: userConfig.Role}
+		hasPasswordHashes = true
+	}
+
+	u.mutex.Lock()
+	u.users = users
+	u.hasPasswordHashes = hasPasswordHashes
+	u.clientCerts = clientCerts
+	u.mutex.Unlock()
+
+	u.verifiedMutex.Lock()
+	u.verified = map[string]struct{}{}
+	u.verifiedMutex.Unlock()
+
+	return nil
+}
+
+// Authenticate returns the name and role of the user whose credentials are
+// in the request, recording the name as the principal of the request.
+func (u *Users) Authenticate(req *http.Request) (string, string, bool) {
+	name, role, found := u.authenticateBasic(req)
+	if !found {
+		name, role, found = u.ClientCerts().Role(req)
+	}
+
+	if found {
+		setRequestPrincipal(req, name)
+	}
+
+	return name, role, found
+}
+
+func (u *Users) authenticateBasic(req *http.Request) (string, string, bool) {
+	name, password, found := req.BasicAuth()
+	if !found {
+		return "", "", false
+	}
+
+	u.mutex.RLock()
+	user, found := u.users[name]
+	hasPasswordHashes := u.hasPasswordHashes
+	u.mutex.RUnlock()
+
+	if !found {
+		if hasPasswordHashes {
+			bcrypt.CompareHashAndPassword([]byte(unknownUserPasswordHash), []byte(password))
+		}
+		failAuthAttempt(req, name)
+		return "", "", false
+	}
+
+	if user.passwordHash == nil {
+		if subtle.ConstantTimeCompare(user.password, []byte(password)) != 1 {
+			failAuthAttempt(req, name)
+			return "", "", false
+		}
+		return name, user.role, true
+	}
+
+	verifiedKey := u.verifiedCredentialsKey(name, password, user.passwordHash)
+	u.verifiedMutex.RLock()
+	_, verified := u.verified[verifiedKey]
+	u.verifiedMutex.RUnlock()
+
+	if !verified {
+		if bcrypt.CompareHashAndPassword(user.passwordHash, []byte(password)) != nil {
+			failAuthAttempt(req, name)
+			return "", "", false
+		}
+
+		u.verifiedMutex.Lock()
+		u.verified[verifiedKey] = struct{}{}
+		u.verifiedMutex.Unlock()
+	}
+
+	return name, user.role, true
+}
+
+// ClientCerts returns the current client certificate rules.
+func (u *Users) ClientCerts() ClientCerts {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	return u.clientCerts
+}
+
+// IsAuthorized returns if the request contains the credentials of a user
+// whose role is, at least, the given role.
+func (u *Users) IsAuthorized(req *http.Request, role string) bool {
+	_, userRole, found := u.Authenticate(req)
+	if !found {
+		return false
+	}
+
+	return roleLevels[userRole] >= roleLevels[role]
+}
+
+// IsReplicationAuthorized returns if the request contains the credentials of
+// a replicator or admin user, who can read the settings of every instance at
+// once.
+func (u *Users) IsReplicationAuthorized(req *http.Request) bool {
+	_, userRole, found := u.Authenticate(req)
+	if !found {
+		return false
+	}
+
+	return userRole == RoleReplicator || userRole == RoleAdmin
+}
+
+func (u *Users) verifiedCredentialsKey(name string, password string, passwordHash []byte) string {
+	mac := hmac.New(sha256.New, u.verifiedKey)
+	mac.Write([]byte(name))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	mac.Write([]byte{0})
+	mac.Write(passwordHash)
+
+	return string(mac.Sum(nil))
+}
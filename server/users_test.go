@@ -0,0 +1,234 @@
+package server_test
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/frodenas/bosh-registry/server"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var _ = Describe("Users", func() {
+	var (
+		err     error
+		config  Config
+		users   *Users
+		request *http.Request
+	)
+
+	passwordHash := func(password string) string {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		Expect(err).ToNot(HaveOccurred())
+		return string(hash)
+	}
+
+	BeforeEach(func() {
+		config = Config{
+			Username: "fake-username",
+			Password: "fake-password",
+			Users: []UserConfig{
+				{Name: "fake-reader", PasswordHash: passwordHash("fake-reader-password"), Role: RoleReader},
+				{Name: "fake-replicator", PasswordHash: passwordHash("fake-replicator-password"), Role: RoleReplicator},
+				{Name: "fake-writer", PasswordHash: passwordHash("fake-writer-password"), Role: RoleWriter},
+				{Name: "fake-admin", PasswordHash: passwordHash("fake-admin-password"), Role: RoleAdmin},
+			},
+		}
+
+		request, err = http.NewRequest("GET", "/instances/fake-instance-id/settings", nil)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	JustBeforeEach(func() {
+		users, err = NewUsers(config)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	Describe("NewUsers", func() {
+		It("returns error if a user is not valid", func() {
+			config.Users[0].Role = "fake-role"
+
+			_, err = NewUsers(config)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a valid Role"))
+		})
+
+		It("returns error if a password hash is not a bcrypt hash", func() {
+			config.Users[0].PasswordHash = "fake-reader-password"
+
+			_, err = NewUsers(config)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide a valid bcrypt PasswordHash for user 'fake-reader'"))
+		})
+
+		It("returns error if a user is duplicated", func() {
+			config.Users[0].Name = "fake-username"
+
+			_, err = NewUsers(config)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Duplicated user 'fake-username'"))
+		})
+	})
+
+	Describe("Authenticate", func() {
+		It("authenticates users with bcrypt hashed passwords", func() {
+			request.SetBasicAuth("fake-writer", "fake-writer-password")
+
+			name, role, found := users.Authenticate(request)
+			Expect(found).To(BeTrue())
+			Expect(name).To(Equal("fake-writer"))
+			Expect(role).To(Equal(RoleWriter))
+
+			name, role, found = users.Authenticate(request)
+			Expect(found).To(BeTrue())
+			Expect(name).To(Equal("fake-writer"))
+		})
+
+		It("authenticates verified client certificates with a role", func() {
+			config.ClientCerts = []ClientCertConfig{{CN: "fake-cpi", Role: RoleWriter}}
+			users, err = NewUsers(config)
+			Expect(err).ToNot(HaveOccurred())
+
+			withClientCert(request, &x509.Certificate{Subject: pkix.Name{CommonName: "fake-cpi"}})
+
+			name, role, found := users.Authenticate(request)
+			Expect(found).To(BeTrue())
+			Expect(name).To(Equal("CN=fake-cpi"))
+			Expect(role).To(Equal(RoleWriter))
+
+			request.SetBasicAuth("fake-reader", "fake-reader-password")
+			name, role, found = users.Authenticate(request)
+			Expect(found).To(BeTrue())
+			Expect(name).To(Equal("fake-reader"))
+			Expect(role).To(Equal(RoleReader))
+		})
+
+		It("does not authenticate client certificates of requests forwarded by a cluster follower", func() {
+			config.ClientCerts = []ClientCertConfig{{CN: "fake-registry", Role: RoleWriter}}
+			users, err = NewUsers(config)
+			Expect(err).ToNot(HaveOccurred())
+
+			withClientCert(request, &x509.Certificate{Subject: pkix.Name{CommonName: "fake-registry"}})
+			request.Header.Set("X-Registry-Forwarded-By", "fake-node-id")
+
+			_, _, found := users.Authenticate(request)
+			Expect(found).To(BeFalse())
+
+			request.SetBasicAuth("fake-reader", "fake-reader-password")
+			name, _, found := users.Authenticate(request)
+			Expect(found).To(BeTrue())
+			Expect(name).To(Equal("fake-reader"))
+		})
+
+		It("authenticates the legacy user as an admin", func() {
+			request.SetBasicAuth("fake-username", "fake-password")
+
+			_, role, found := users.Authenticate(request)
+			Expect(found).To(BeTrue())
+			Expect(role).To(Equal(RoleAdmin))
+		})
+
+		It("does not authenticate wrong passwords", func() {
+			request.SetBasicAuth("fake-writer", "fake-writer-password")
+			_, _, found := users.Authenticate(request)
+			Expect(found).To(BeTrue())
+
+			request.SetBasicAuth("fake-writer", "fake-reader-password")
+			_, _, found = users.Authenticate(request)
+			Expect(found).To(BeFalse())
+
+			request.SetBasicAuth("fake-username", "fake-writer-password")
+			_, _, found = users.Authenticate(request)
+			Expect(found).To(BeFalse())
+		})
+
+		It("does not authenticate unknown users", func() {
+			request.SetBasicAuth("fake-unknown", "fake-password")
+
+			_, _, found := users.Authenticate(request)
+			Expect(found).To(BeFalse())
+		})
+
+		It("does not authenticate requests without credentials", func() {
+			_, _, found := users.Authenticate(request)
+			Expect(found).To(BeFalse())
+		})
+	})
+
+	Describe("Update", func() {
+		It("replaces the users", func() {
+			err = users.Update(Config{
+				Users: []UserConfig{
+					{Name: "fake-new-reader", PasswordHash: passwordHash("fake-new-reader-password"), Role: RoleReader},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			request.SetBasicAuth("fake-new-reader", "fake-new-reader-password")
+			name, role, found := users.Authenticate(request)
+			Expect(found).To(BeTrue())
+			Expect(name).To(Equal("fake-new-reader"))
+			Expect(role).To(Equal(RoleReader))
+
+			request.SetBasicAuth("fake-reader", "fake-reader-password")
+			_, _, found = users.Authenticate(request)
+			Expect(found).To(BeFalse())
+
+			request.SetBasicAuth("fake-username", "fake-password")
+			_, _, found = users.Authenticate(request)
+			Expect(found).To(BeFalse())
+		})
+
+		It("keeps the previous users if the configuration is not valid", func() {
+			config.Users = append(config.Users, UserConfig{Name: "fake-reader", PasswordHash: passwordHash("fake-password"), Role: RoleReader})
+
+			err = users.Update(config)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Duplicated user 'fake-reader'"))
+
+			request.SetBasicAuth("fake-reader", "fake-reader-password")
+			_, _, found := users.Authenticate(request)
+			Expect(found).To(BeTrue())
+		})
+	})
+
+	Describe("IsAuthorized", func() {
+		It("authorizes users with the role or a higher one", func() {
+			request.SetBasicAuth("fake-reader", "fake-reader-password")
+			Expect(users.IsAuthorized(request, RoleReader)).To(BeTrue())
+			Expect(users.IsAuthorized(request, RoleWriter)).To(BeFalse())
+
+			request.SetBasicAuth("fake-writer", "fake-writer-password")
+			Expect(users.IsAuthorized(request, RoleReader)).To(BeTrue())
+			Expect(users.IsAuthorized(request, RoleWriter)).To(BeTrue())
+			Expect(users.IsAuthorized(request, RoleAdmin)).To(BeFalse())
+
+			request.SetBasicAuth("fake-admin", "fake-admin-password")
+			Expect(users.IsAuthorized(request, RoleAdmin)).To(BeTrue())
+
+			request.SetBasicAuth("fake-replicator", "fake-replicator-password")
+			Expect(users.IsAuthorized(request, RoleReader)).To(BeTrue())
+			Expect(users.IsAuthorized(request, RoleWriter)).To(BeFalse())
+		})
+	})
+
+	Describe("IsReplicationAuthorized", func() {
+		It("authorizes replicator and admin users only", func() {
+			request.SetBasicAuth("fake-replicator", "fake-replicator-password")
+			Expect(users.IsReplicationAuthorized(request)).To(BeTrue())
+
+			request.SetBasicAuth("fake-admin", "fake-admin-password")
+			Expect(users.IsReplicationAuthorized(request)).To(BeTrue())
+
+			request.SetBasicAuth("fake-reader", "fake-reader-password")
+			Expect(users.IsReplicationAuthorized(request)).To(BeFalse())
+
+			request.SetBasicAuth("fake-writer", "fake-writer-password")
+			Expect(users.IsReplicationAuthorized(request)).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,142 @@
+/*
+Package certs generates short-lived certificates for tests.
+*/
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// Authority is a certificate authority used to issue test certificates.
+type Authority struct {
+	// Directory where certificate files are written
+	Dir string
+
+	// CA certificate file (PEM format)
+	CertFile string
+
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// KeyPair are the files of an issued certificate.
+type KeyPair struct {
+	// Certificate file (PEM format)
+	CertFile string
+
+	// Private key file (PEM format)
+	KeyFile string
+}
+
+// NewAuthority creates a self-signed certificate authority in dir.
+func NewAuthority(dir string, name string) (*Authority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := newTemplate(name)
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	certFile := filepath.Join(dir, name+"-ca.pem")
+	if err = writePEM(certFile, "CERTIFICATE", der); err != nil {
+		return nil, err
+	}
+
+	return &Authority{
+		Dir:      dir,
+		CertFile: certFile,
+		cert:     cert,
+		key:      key,
+	}, nil
+}
+
+// IssueServer issues a server certificate valid for localhost and 127.0.0.1.
+func (a *Authority) IssueServer(name string) (KeyPair, error) {
+	template := newTemplate(name)
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	template.DNSNames = []string{"localhost"}
+	template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+
+	return a.issue(name, template)
+}
+
+// IssueClient issues a client certificate for the given subject.
+func (a *Authority) IssueClient(name string, subject pkix.Name, dnsNames ...string) (KeyPair, error) {
+	template := newTemplate(name)
+	template.Subject = subject
+	template.DNSNames = dnsNames
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	return a.issue(name, template)
+}
+
+func (a *Authority) issue(name string, template *x509.Certificate) (KeyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return KeyPair{}, err
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &key.PublicKey, a.key)
+	if err != nil {
+		return KeyPair{}, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return KeyPair{}, err
+	}
+
+	keyPair := KeyPair{
+		CertFile: filepath.Join(a.Dir, name+"-cert.pem"),
+		KeyFile:  filepath.Join(a.Dir, name+"-key.pem"),
+	}
+
+	if err = writePEM(keyPair.CertFile, "CERTIFICATE", der); err != nil {
+		return KeyPair{}, err
+	}
+
+	if err = writePEM(keyPair.KeyFile, "EC PRIVATE KEY", keyDER); err != nil {
+		return KeyPair{}, err
+	}
+
+	return keyPair, nil
+}
+
+func newTemplate(commonName string) *x509.Certificate {
+	serialNumber, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+
+	return &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+}
+
+func writePEM(file string, blockType string, bytes []byte) error {
+	return ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: bytes}), 0600)
+}